@@ -0,0 +1,138 @@
+package clients
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Types of client (RFC 6749 section 2.1). Confidential clients can keep a
+// secret and authenticate with it, public ones such as single-page and
+// mobile applications cannot.
+const (
+	TypeConfidential = "confidential"
+	TypePublic       = "public"
+)
+
+// Grant types a client can be allowed to use.
+const (
+	GrantAuthorizationCode = "authorization_code"
+	GrantRefreshToken      = "refresh_token"
+	GrantClientCredentials = "client_credentials"
+)
+
+// List is a list of values stored as a comma separated column.
+type List []string
+
+func (l List) Value() (driver.Value, error) {
+	return strings.Join(l, ","), nil
+}
+
+func (l *List) Scan(src interface{}) error {
+	var value string
+	switch src := src.(type) {
+	case string:
+		value = src
+	case []byte:
+		value = string(src)
+	case nil:
+	default:
+		return fmt.Errorf("cannot scan %T into a list", src)
+	}
+	*l = List{}
+	if value != "" {
+		*l = strings.Split(value, ",")
+	}
+	return nil
+}
+
+// Contains tells whether the list holds the given value.
+func (l List) Contains(value string) bool {
+	for _, item := range l {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Client is an application allowed to request tokens. Lifetimes are in
+// seconds, 0 standing for the defaults of the server.
+type Client struct {
+	ID              string    `json:"clientId"`
+	SecretHash      string    `json:"-" db:"secret_hash"`
+	Name            string    `json:"name"`
+	Type            string    `json:"type"`
+	RedirectURIs    List      `json:"redirectUris" db:"redirect_uris"`
+	GrantTypes      List      `json:"grantTypes" db:"grant_types"`
+	Scopes          List      `json:"scopes"`
+	AccessTokenTTL  int       `json:"accessTokenTTL" db:"access_token_ttl"`
+	RefreshTokenTTL int       `json:"refreshTokenTTL" db:"refresh_token_ttl"`
+	CreatedAt       time.Time `json:"createdAt" db:"created_at"`
+}
+
+// AccessTokenLifetime returns the lifetime of the access tokens issued to
+// the client, falling back to the given default.
+func (c *Client) AccessTokenLifetime(fallback time.Duration) time.Duration {
+	if c.AccessTokenTTL > 0 {
+		return time.Duration(c.AccessTokenTTL) * time.Second
+	}
+	return fallback
+}
+
+// RefreshTokenLifetime is the counterpart of AccessTokenLifetime for refresh
+// tokens.
+func (c *Client) RefreshTokenLifetime(fallback time.Duration) time.Duration {
+	if c.RefreshTokenTTL > 0 {
+		return time.Duration(c.RefreshTokenTTL) * time.Second
+	}
+	return fallback
+}
+
+// ClientSettings are the attributes of a client administrators can change.
+type ClientSettings struct {
+	Name            string   `json:"name" validate:"required,max=255"`
+	RedirectURIs    []string `json:"redirectUris" validate:"max=20,dive,required,max=2000"`
+	GrantTypes      []string `json:"grantTypes" validate:"required,min=1,dive,oneof=authorization_code refresh_token client_credentials"`
+	Scopes          []string `json:"scopes" validate:"max=100,dive,required,max=255"`
+	AccessTokenTTL  int      `json:"accessTokenTTL" validate:"min=0"`
+	RefreshTokenTTL int      `json:"refreshTokenTTL" validate:"min=0"`
+}
+
+type ClientCreationRequest struct {
+	Type string `json:"type" validate:"required,oneof=confidential public"`
+	ClientSettings
+}
+
+type ClientUpdateRequest struct {
+	ClientSettings
+}
+
+type MultipleClientResponse struct {
+	Clients []Client `json:"clients"`
+}
+
+type SingleClientResponse struct {
+	Client Client `json:"client"`
+}
+
+// ClientSecretResponse carries the secret of a confidential client, which is
+// only shown when the client is created or its secret is rotated.
+type ClientSecretResponse struct {
+	Client       Client `json:"client"`
+	ClientSecret string `json:"clientSecret,omitempty"`
+}
+
+func (resp *MultipleClientResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func (resp *SingleClientResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func (resp *ClientSecretResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
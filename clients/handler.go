@@ -0,0 +1,126 @@
+package clients
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/Kavuti/goauth/auth"
+	"github.com/Kavuti/goauth/ratelimit"
+	"github.com/Kavuti/goauth/utils"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/jmoiron/sqlx"
+)
+
+type ClientHandler interface {
+	Routes() chi.Router
+
+	List(w http.ResponseWriter, r *http.Request)
+	Get(w http.ResponseWriter, r *http.Request)
+	Create(w http.ResponseWriter, r *http.Request)
+	Update(w http.ResponseWriter, r *http.Request)
+	Delete(w http.ResponseWriter, r *http.Request)
+	RotateSecret(w http.ResponseWriter, r *http.Request)
+}
+
+type clientHandler struct {
+	chi.Router
+	service ClientService
+	limits  ratelimit.Store
+}
+
+func (h *clientHandler) List(w http.ResponseWriter, r *http.Request) {
+	defer utils.RecoverIfError(w, r)
+	clients, err := h.service.List()
+	utils.CheckError(err)
+
+	render.Render(w, r, &MultipleClientResponse{Clients: clients})
+}
+
+func (h *clientHandler) Get(w http.ResponseWriter, r *http.Request) {
+	defer utils.RecoverIfError(w, r)
+	id := chi.URLParam(r, "id")
+	client, err := h.service.Get(id)
+	utils.CheckError(err)
+
+	render.Render(w, r, &SingleClientResponse{Client: *client})
+}
+
+func (h *clientHandler) Create(w http.ResponseWriter, r *http.Request) {
+	defer utils.RecoverIfError(w, r)
+	request := ClientCreationRequest{}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	utils.CheckError(err)
+
+	err = utils.ValidateStruct(request)
+	utils.CheckError(err)
+
+	response, err := h.service.Create(&request)
+	utils.CheckError(err)
+
+	render.Status(r, http.StatusCreated)
+	render.Render(w, r, response)
+}
+
+func (h *clientHandler) Update(w http.ResponseWriter, r *http.Request) {
+	defer utils.RecoverIfError(w, r)
+	id := chi.URLParam(r, "id")
+	request := ClientUpdateRequest{}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	utils.CheckError(err)
+
+	err = utils.ValidateStruct(request)
+	utils.CheckError(err)
+
+	err = h.service.Update(id, &request)
+	utils.CheckError(err)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *clientHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	defer utils.RecoverIfError(w, r)
+	id := chi.URLParam(r, "id")
+	err := h.service.Delete(id)
+	utils.CheckError(err)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *clientHandler) RotateSecret(w http.ResponseWriter, r *http.Request) {
+	defer utils.RecoverIfError(w, r)
+	id := chi.URLParam(r, "id")
+	response, err := h.service.RotateSecret(id)
+	utils.CheckError(err)
+
+	render.Render(w, r, response)
+}
+
+// Routes are restricted to administrators who logged in with a second
+// factor, as clients decide who can obtain tokens.
+func (h *clientHandler) Routes() chi.Router {
+	r := chi.NewRouter()
+	r.Use(auth.RequireRole(auth.AdminRole))
+	r.Use(auth.RequireMFA)
+	r.Use(ratelimit.Middleware(h.limits, ratelimit.PolicyFromEnv("CLIENTS", 60, time.Minute, ratelimit.ByUser)))
+
+	r.Get("/", h.List)
+	r.Post("/", h.Create)
+	r.Get("/{id}", h.Get)
+	r.Put("/{id}", h.Update)
+	r.Delete("/{id}", h.Delete)
+	r.Post("/{id}/secret", h.RotateSecret)
+
+	return r
+}
+
+func NewClientHandler(r chi.Router, db *sqlx.DB, limits ratelimit.Store) ClientHandler {
+	handler := &clientHandler{
+		Router:  r,
+		service: NewClientService(db),
+		limits:  limits,
+	}
+
+	return handler
+}
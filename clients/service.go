@@ -0,0 +1,258 @@
+package clients
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Kavuti/goauth/utils"
+	"github.com/jmoiron/sqlx"
+)
+
+type ClientService interface {
+	List() ([]Client, error)
+	Get(id string) (*Client, error)
+	Create(req *ClientCreationRequest) (*ClientSecretResponse, error)
+	Update(id string, req *ClientUpdateRequest) error
+	Delete(id string) error
+	RotateSecret(id string) (*ClientSecretResponse, error)
+	Authenticate(id string, secret string) (*Client, error)
+}
+
+type clientService struct {
+	db *sqlx.DB
+}
+
+func (s *clientService) List() ([]Client, error) {
+	tx := s.db.MustBegin()
+	defer tx.Rollback()
+
+	clients := []Client{}
+	err := tx.Select(&clients, "SELECT * FROM clients ORDER BY created_at")
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	return clients, nil
+}
+
+func (s *clientService) Get(id string) (*Client, error) {
+	if id == "" {
+		return nil, utils.ServiceError("Client ID parameter is mandatory", http.StatusBadRequest)
+	}
+
+	tx := s.db.MustBegin()
+	defer tx.Rollback()
+
+	var client Client
+	err := tx.Get(&client, "SELECT * FROM clients WHERE id=$1", id)
+	if err == sql.ErrNoRows {
+		return nil, utils.ServiceError("No client found with the given ID", http.StatusNotFound)
+	}
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	return &client, nil
+}
+
+// Create registers a client, returning its secret when it is confidential.
+// Only a digest of the secret is stored, so it cannot be shown again.
+func (s *clientService) Create(req *ClientCreationRequest) (*ClientSecretResponse, error) {
+	err := checkSettings(req.Type, &req.ClientSettings)
+	if err != nil {
+		return nil, err
+	}
+	id, err := newClientID()
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	secret := ""
+	client := newClient(id, req.Type, &req.ClientSettings)
+	if req.Type == TypeConfidential {
+		secret, err = utils.RandomToken()
+		if err != nil {
+			return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+		}
+		client.SecretHash = utils.HashToken(secret)
+	}
+
+	tx := s.db.MustBegin()
+	defer tx.Rollback()
+
+	err = tx.Get(&client.CreatedAt, `INSERT INTO clients (id, secret_hash, name, type, redirect_uris, grant_types, scopes, access_token_ttl, refresh_token_ttl)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING created_at`,
+		client.ID, client.SecretHash, client.Name, client.Type, client.RedirectURIs, client.GrantTypes, client.Scopes, client.AccessTokenTTL, client.RefreshTokenTTL)
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	return &ClientSecretResponse{Client: *client, ClientSecret: secret}, nil
+}
+
+// Update replaces the settings of a client. Its type cannot change, since
+// that would hand a secret to a public client or take it from a confidential
+// one.
+func (s *clientService) Update(id string, req *ClientUpdateRequest) error {
+	if id == "" {
+		return utils.ServiceError("Client ID parameter is mandatory", http.StatusBadRequest)
+	}
+
+	tx := s.db.MustBegin()
+	defer tx.Rollback()
+
+	var clientType string
+	err := tx.Get(&clientType, "SELECT type FROM clients WHERE id=$1 FOR UPDATE", id)
+	if err == sql.ErrNoRows {
+		return utils.ServiceError("No client found with the given ID", http.StatusNotFound)
+	}
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	err = checkSettings(clientType, &req.ClientSettings)
+	if err != nil {
+		return err
+	}
+
+	client := newClient(id, clientType, &req.ClientSettings)
+	_, err = tx.Exec(`UPDATE clients SET name = $1, redirect_uris = $2, grant_types = $3, scopes = $4, access_token_ttl = $5, refresh_token_ttl = $6
+		WHERE id = $7`, client.Name, client.RedirectURIs, client.GrantTypes, client.Scopes, client.AccessTokenTTL, client.RefreshTokenTTL, id)
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	return nil
+}
+
+func (s *clientService) Delete(id string) error {
+	if id == "" {
+		return utils.ServiceError("Client ID parameter is mandatory", http.StatusBadRequest)
+	}
+
+	tx := s.db.MustBegin()
+	defer tx.Rollback()
+
+	rows, err := tx.MustExec("DELETE FROM clients WHERE id=$1", id).RowsAffected()
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	if rows == 0 {
+		return utils.ServiceError("No client found with the given ID", http.StatusNotFound)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	return nil
+}
+
+// RotateSecret replaces the secret of a confidential client, which stops
+// authenticating with the previous one right away.
+func (s *clientService) RotateSecret(id string) (*ClientSecretResponse, error) {
+	client, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if client.Type != TypeConfidential {
+		return nil, utils.ServiceError("Public clients have no secret", http.StatusBadRequest)
+	}
+	secret, err := utils.RandomToken()
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+
+	tx := s.db.MustBegin()
+	defer tx.Rollback()
+
+	_, err = tx.Exec("UPDATE clients SET secret_hash = $1 WHERE id = $2", utils.HashToken(secret), id)
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	return &ClientSecretResponse{Client: *client, ClientSecret: secret}, nil
+}
+
+// Authenticate checks the credentials of a confidential client. Unknown
+// clients, public clients and wrong secrets produce the same error.
+func (s *clientService) Authenticate(id string, secret string) (*Client, error) {
+	client, err := s.Get(id)
+	if err != nil && utils.ErrorStatus(err) != http.StatusNotFound {
+		return nil, err
+	}
+	if client == nil || client.Type != TypeConfidential ||
+		subtle.ConstantTimeCompare([]byte(client.SecretHash), []byte(utils.HashToken(secret))) != 1 {
+		return nil, utils.ServiceError("Invalid client credentials", http.StatusUnauthorized)
+	}
+	return client, nil
+}
+
+// checkSettings enforces the rules binding the settings of a client together,
+// beyond those of the validate tags.
+func checkSettings(clientType string, settings *ClientSettings) error {
+	fields := []utils.FieldError{}
+	grants := List(settings.GrantTypes)
+	if grants.Contains(GrantClientCredentials) && clientType != TypeConfidential {
+		fields = append(fields, utils.FieldError{Field: "grantTypes", Code: "confidential_only", Message: "Only confidential clients can use the client_credentials grant"})
+	}
+	if grants.Contains(GrantAuthorizationCode) && len(settings.RedirectURIs) == 0 {
+		fields = append(fields, utils.FieldError{Field: "redirectUris", Code: "required", Message: "The authorization_code grant needs at least one redirect URI"})
+	}
+	for _, redirectURI := range settings.RedirectURIs {
+		parsed, err := url.Parse(redirectURI)
+		if err != nil || !parsed.IsAbs() || parsed.Fragment != "" || strings.Contains(redirectURI, ",") {
+			fields = append(fields, utils.FieldError{Field: "redirectUris", Code: "invalid", Message: "Redirect URIs must be absolute, without fragment"})
+			break
+		}
+	}
+	for _, scope := range settings.Scopes {
+		if strings.ContainsAny(scope, " ,\"\\") {
+			fields = append(fields, utils.FieldError{Field: "scopes", Code: "invalid", Message: "Scopes cannot contain spaces, commas, quotes or backslashes"})
+			break
+		}
+	}
+	if len(fields) > 0 {
+		return utils.ValidationError(fields...)
+	}
+	return nil
+}
+
+func newClient(id string, clientType string, settings *ClientSettings) *Client {
+	return &Client{
+		ID:              id,
+		Name:            settings.Name,
+		Type:            clientType,
+		RedirectURIs:    append(List{}, settings.RedirectURIs...),
+		GrantTypes:      append(List{}, settings.GrantTypes...),
+		Scopes:          append(List{}, settings.Scopes...),
+		AccessTokenTTL:  settings.AccessTokenTTL,
+		RefreshTokenTTL: settings.RefreshTokenTTL,
+	}
+}
+
+func newClientID() (string, error) {
+	bytes := make([]byte, 16)
+	_, err := rand.Read(bytes)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bytes), nil
+}
+
+func NewClientService(db *sqlx.DB) ClientService {
+	return &clientService{db: db}
+}
@@ -0,0 +1,209 @@
+package clients
+
+import (
+	"database/sql"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/Kavuti/goauth/utils"
+	"github.com/jmoiron/sqlx"
+)
+
+var clientColumns = []string{"id", "secret_hash", "name", "type", "redirect_uris", "grant_types", "scopes", "access_token_ttl", "refresh_token_ttl", "created_at"}
+
+func clientRow(clientType string, secretHash string) *sqlmock.Rows {
+	return sqlmock.NewRows(clientColumns).AddRow("client", secretHash, "Test", clientType, "https://app.test/callback", "authorization_code,refresh_token", "read,write", 0, 3600, time.Now())
+}
+
+func Test_List(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM clients").WillReturnRows(clientRow(TypeConfidential, "hash"))
+	mock.ExpectRollback()
+
+	service := &clientService{db: sqlx.NewDb(db, "sqlmock")}
+	clients, err := service.List()
+	if err != nil {
+		t.Fatalf("Error executing List test: %s\n", err.Error())
+	}
+	if len(clients) != 1 || len(clients[0].RedirectURIs) != 1 || !clients[0].Scopes.Contains("write") {
+		t.Fatalf("Error executing List test: unexpected clients %v\n", clients)
+	}
+	if clients[0].RefreshTokenLifetime(time.Minute) != time.Hour || clients[0].AccessTokenLifetime(time.Minute) != time.Minute {
+		t.Fatal("Error executing List test: wrong token lifetimes")
+	}
+}
+
+func Test_Get_NotFound(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM clients WHERE (.+)").WithArgs("client").WillReturnError(sql.ErrNoRows)
+	mock.ExpectRollback()
+
+	service := &clientService{db: sqlx.NewDb(db, "sqlmock")}
+	_, err = service.Get("client")
+	if utils.ErrorStatus(err) != http.StatusNotFound {
+		t.Fatalf("Error executing Get_NotFound test: unexpected error %v\n", err)
+	}
+}
+
+func Test_Create(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO clients (.+) RETURNING created_at").
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), "Test", TypeConfidential, "https://app.test/callback", "authorization_code,client_credentials", "", 0, 0).
+		WillReturnRows(sqlmock.NewRows([]string{"created_at"}).AddRow(time.Now()))
+	mock.ExpectCommit()
+
+	service := &clientService{db: sqlx.NewDb(db, "sqlmock")}
+	response, err := service.Create(&ClientCreationRequest{Type: TypeConfidential, ClientSettings: ClientSettings{
+		Name:         "Test",
+		RedirectURIs: []string{"https://app.test/callback"},
+		GrantTypes:   []string{GrantAuthorizationCode, GrantClientCredentials},
+	}})
+	if err != nil {
+		t.Fatalf("Error executing Create test: %s\n", err.Error())
+	}
+	if response.ClientSecret == "" || response.Client.SecretHash != utils.HashToken(response.ClientSecret) {
+		t.Fatal("Error executing Create test: secret not generated")
+	}
+}
+
+func Test_Create_InvalidSettings(t *testing.T) {
+	service := &clientService{}
+	_, err := service.Create(&ClientCreationRequest{Type: TypePublic, ClientSettings: ClientSettings{
+		Name:         "Test",
+		RedirectURIs: []string{"/callback#fragment"},
+		GrantTypes:   []string{GrantAuthorizationCode, GrantClientCredentials},
+		Scopes:       []string{"read write"},
+	}})
+	if len(utils.FieldErrors(err)) != 3 {
+		t.Fatalf("Error executing Create_InvalidSettings test: unexpected error %v\n", utils.FieldErrors(err))
+	}
+}
+
+func Test_Update(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT type FROM clients (.+) FOR UPDATE").WithArgs("client").WillReturnRows(sqlmock.NewRows([]string{"type"}).AddRow(TypePublic))
+	mock.ExpectExec("UPDATE clients SET name").WithArgs("Test", "https://app.test/callback", "authorization_code", "openid", 60, 0, "client").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	service := &clientService{db: sqlx.NewDb(db, "sqlmock")}
+	err = service.Update("client", &ClientUpdateRequest{ClientSettings{
+		Name:           "Test",
+		RedirectURIs:   []string{"https://app.test/callback"},
+		GrantTypes:     []string{GrantAuthorizationCode},
+		Scopes:         []string{"openid"},
+		AccessTokenTTL: 60,
+	}})
+	if err != nil {
+		t.Fatalf("Error executing Update test: %s\n", err.Error())
+	}
+}
+
+func Test_Update_PublicClientCredentials(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT type FROM clients (.+) FOR UPDATE").WithArgs("client").WillReturnRows(sqlmock.NewRows([]string{"type"}).AddRow(TypePublic))
+	mock.ExpectRollback()
+
+	service := &clientService{db: sqlx.NewDb(db, "sqlmock")}
+	err = service.Update("client", &ClientUpdateRequest{ClientSettings{Name: "Test", GrantTypes: []string{GrantClientCredentials}}})
+	if utils.ErrorStatus(err) != http.StatusBadRequest {
+		t.Fatalf("Error executing Update_PublicClientCredentials test: unexpected error %v\n", err)
+	}
+}
+
+func Test_Delete(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM clients").WithArgs("client").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	service := &clientService{db: sqlx.NewDb(db, "sqlmock")}
+	err = service.Delete("client")
+	if utils.ErrorStatus(err) != http.StatusNotFound {
+		t.Fatalf("Error executing Delete test: unexpected error %v\n", err)
+	}
+}
+
+func Test_RotateSecret(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM clients WHERE (.+)").WithArgs("client").WillReturnRows(clientRow(TypeConfidential, "hash"))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE clients SET secret_hash").WithArgs(sqlmock.AnyArg(), "client").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	service := &clientService{db: sqlx.NewDb(db, "sqlmock")}
+	response, err := service.RotateSecret("client")
+	if err != nil {
+		t.Fatalf("Error executing RotateSecret test: %s\n", err.Error())
+	}
+	if response.ClientSecret == "" {
+		t.Fatal("Error executing RotateSecret test: no secret returned")
+	}
+}
+
+func Test_Authenticate(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	for i := 0; i < 2; i++ {
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT (.+) FROM clients WHERE (.+)").WithArgs("client").WillReturnRows(clientRow(TypeConfidential, utils.HashToken("secret")))
+		mock.ExpectCommit()
+	}
+
+	service := &clientService{db: sqlx.NewDb(db, "sqlmock")}
+	client, err := service.Authenticate("client", "secret")
+	if err != nil || client.ID != "client" {
+		t.Fatalf("Error executing Authenticate test: %v\n", err)
+	}
+	_, err = service.Authenticate("client", "wrong")
+	if utils.ErrorStatus(err) != http.StatusUnauthorized {
+		t.Fatalf("Error executing Authenticate test: wrong secret accepted\n")
+	}
+}
@@ -0,0 +1,69 @@
+package keys
+
+import (
+	"crypto"
+	"database/sql"
+	"net/http"
+	"time"
+)
+
+const (
+	RS256 = "RS256"
+	ES256 = "ES256"
+	EdDSA = "EdDSA"
+)
+
+// SigningKey is the persisted form of a key pair. The private key is stored
+// encrypted and is only decrypted when the key is loaded for signing.
+type SigningKey struct {
+	Kid        string       `db:"kid"`
+	Algorithm  string       `db:"algorithm"`
+	PrivateKey []byte       `db:"private_key"`
+	PublicKey  []byte       `db:"public_key"`
+	CreatedAt  time.Time    `db:"created_at"`
+	RetiredAt  sql.NullTime `db:"retired_at"`
+}
+
+// Key is a decoded key pair ready to sign or verify tokens. Private is nil
+// for keys loaded only for verification.
+type Key struct {
+	Kid       string
+	Algorithm string
+	Private   crypto.Signer
+	Public    crypto.PublicKey
+}
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+type SigningKeyInfo struct {
+	Kid       string     `json:"kid"`
+	Algorithm string     `json:"algorithm"`
+	CreatedAt time.Time  `json:"createdAt"`
+	RetiredAt *time.Time `json:"retiredAt,omitempty"`
+}
+
+type MultipleKeyResponse struct {
+	Keys []SigningKeyInfo `json:"keys"`
+}
+
+func (resp *JWKSet) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func (resp *MultipleKeyResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
@@ -0,0 +1,75 @@
+package keys
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/Kavuti/goauth/auth"
+	"github.com/Kavuti/goauth/ratelimit"
+	"github.com/Kavuti/goauth/utils"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+)
+
+type KeyHandler interface {
+	Routes() chi.Router
+
+	JWKS(w http.ResponseWriter, r *http.Request)
+	List(w http.ResponseWriter, r *http.Request)
+	Rotate(w http.ResponseWriter, r *http.Request)
+}
+
+type keyHandler struct {
+	chi.Router
+	service KeyService
+	limits  ratelimit.Store
+}
+
+func (h *keyHandler) JWKS(w http.ResponseWriter, r *http.Request) {
+	defer utils.RecoverIfError(w, r)
+	set, err := h.service.JWKS()
+	utils.CheckError(err)
+
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	render.Render(w, r, set)
+}
+
+func (h *keyHandler) List(w http.ResponseWriter, r *http.Request) {
+	defer utils.RecoverIfError(w, r)
+	keys, err := h.service.List()
+	utils.CheckError(err)
+
+	render.Render(w, r, &MultipleKeyResponse{Keys: keys})
+}
+
+func (h *keyHandler) Rotate(w http.ResponseWriter, r *http.Request) {
+	defer utils.RecoverIfError(w, r)
+	_, err := h.service.Rotate()
+	utils.CheckError(err)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Routes are restricted to administrators who logged in with a second
+// factor, as the keys sign every token goauth issues.
+func (h *keyHandler) Routes() chi.Router {
+	r := chi.NewRouter()
+	r.Use(auth.RequireRole(auth.AdminRole))
+	r.Use(auth.RequireMFA)
+	r.Use(ratelimit.Middleware(h.limits, ratelimit.PolicyFromEnv("KEYS", 30, time.Minute, ratelimit.ByUser)))
+
+	r.Get("/", h.List)
+	r.Post("/rotate", h.Rotate)
+
+	return r
+}
+
+func NewKeyHandler(r chi.Router, service KeyService, limits ratelimit.Store) KeyHandler {
+	handler := &keyHandler{
+		Router:  r,
+		service: service,
+		limits:  limits,
+	}
+
+	return handler
+}
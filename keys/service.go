@@ -0,0 +1,347 @@
+package keys
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Kavuti/goauth/utils"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	defaultAlgorithm        = RS256
+	defaultRetention        = 48 * time.Hour
+	defaultRotationInterval = 30 * 24 * time.Hour
+	cacheTTL                = time.Minute
+)
+
+type KeyService interface {
+	SigningKey() (*Key, error)
+	VerificationKey(kid string) (*Key, error)
+	Rotate() (*Key, error)
+	RotateIfOlderThan(maxAge time.Duration) error
+	List() ([]SigningKeyInfo, error)
+	JWKS() (*JWKSet, error)
+	StartRotation(interval time.Duration)
+}
+
+type cachedKey struct {
+	key      *Key
+	loadedAt time.Time
+}
+
+type keyService struct {
+	db            *sqlx.DB
+	encryptionKey []byte
+	algorithm     string
+	retention     time.Duration
+
+	mutex  sync.RWMutex
+	active *cachedKey
+	public map[string]*cachedKey
+}
+
+// SigningKey returns the active key, creating the first one if the database
+// holds none yet.
+func (s *keyService) SigningKey() (*Key, error) {
+	s.mutex.RLock()
+	active := s.active
+	s.mutex.RUnlock()
+	if active != nil && time.Since(active.loadedAt) < cacheTTL {
+		return active.key, nil
+	}
+
+	tx := s.db.MustBegin()
+	defer tx.Rollback()
+
+	var stored []SigningKey
+	err := tx.Select(&stored, "SELECT * FROM signing_keys WHERE retired_at IS NULL ORDER BY created_at DESC LIMIT 1")
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	if len(stored) == 0 {
+		return s.Rotate()
+	}
+
+	key, err := s.decode(&stored[0], true)
+	if err != nil {
+		return nil, err
+	}
+	s.cacheActive(key)
+	return key, nil
+}
+
+// VerificationKey returns the public key with the given kid, as long as it is
+// active or was retired less than the retention period ago.
+func (s *keyService) VerificationKey(kid string) (*Key, error) {
+	s.mutex.RLock()
+	cached, ok := s.public[kid]
+	s.mutex.RUnlock()
+	if ok && time.Since(cached.loadedAt) < cacheTTL {
+		return cached.key, nil
+	}
+
+	tx := s.db.MustBegin()
+	defer tx.Rollback()
+
+	var stored SigningKey
+	err := tx.Get(&stored, "SELECT * FROM signing_keys WHERE kid=$1 AND (retired_at IS NULL OR retired_at > $2)",
+		kid, time.Now().Add(-s.retention))
+	if err != nil {
+		return nil, utils.ServiceError("Unknown signing key", http.StatusUnauthorized)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+
+	key, err := s.decode(&stored, false)
+	if err != nil {
+		return nil, err
+	}
+	s.mutex.Lock()
+	s.public[kid] = &cachedKey{key: key, loadedAt: time.Now()}
+	s.mutex.Unlock()
+	return key, nil
+}
+
+// Rotate generates a new active key and retires the previous one. Retired
+// keys keep being published so that tokens they signed can still be verified.
+func (s *keyService) Rotate() (*Key, error) {
+	tx := s.db.MustBegin()
+	defer tx.Rollback()
+
+	_, err := tx.Exec("LOCK TABLE signing_keys IN EXCLUSIVE MODE")
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	key, err := s.rotate(tx)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+
+	s.cacheActive(key)
+	log.Printf("Signing key rotated: %s (%s) is now active\n", key.Kid, key.Algorithm)
+	return key, nil
+}
+
+// RotateIfOlderThan rotates the active key only when it was created more than
+// maxAge ago. The table lock makes concurrent instances agree on a single
+// rotation.
+func (s *keyService) RotateIfOlderThan(maxAge time.Duration) error {
+	tx := s.db.MustBegin()
+	defer tx.Rollback()
+
+	_, err := tx.Exec("LOCK TABLE signing_keys IN EXCLUSIVE MODE")
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	var fresh int
+	err = tx.Get(&fresh, "SELECT COUNT(*) FROM signing_keys WHERE retired_at IS NULL AND created_at > $1", time.Now().Add(-maxAge))
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	if fresh > 0 {
+		return nil
+	}
+
+	key, err := s.rotate(tx)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+
+	s.cacheActive(key)
+	log.Printf("Signing key rotated: %s (%s) is now active\n", key.Kid, key.Algorithm)
+	return nil
+}
+
+func (s *keyService) List() ([]SigningKeyInfo, error) {
+	tx := s.db.MustBegin()
+	defer tx.Rollback()
+
+	var stored []SigningKey
+	err := tx.Select(&stored, "SELECT * FROM signing_keys ORDER BY created_at DESC")
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+
+	infos := make([]SigningKeyInfo, 0, len(stored))
+	for _, key := range stored {
+		info := SigningKeyInfo{Kid: key.Kid, Algorithm: key.Algorithm, CreatedAt: key.CreatedAt}
+		if key.RetiredAt.Valid {
+			retiredAt := key.RetiredAt.Time
+			info.RetiredAt = &retiredAt
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (s *keyService) JWKS() (*JWKSet, error) {
+	tx := s.db.MustBegin()
+	defer tx.Rollback()
+
+	var stored []SigningKey
+	err := tx.Select(&stored, "SELECT * FROM signing_keys WHERE retired_at IS NULL OR retired_at > $1 ORDER BY created_at DESC",
+		time.Now().Add(-s.retention))
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+
+	set := &JWKSet{Keys: []JWK{}}
+	for i := range stored {
+		key, err := s.decode(&stored[i], false)
+		if err != nil {
+			return nil, err
+		}
+		jwk, err := toJWK(key)
+		if err != nil {
+			return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set, nil
+}
+
+// StartRotation makes sure a signing key exists and then rotates it in the
+// background every time it grows older than interval.
+func (s *keyService) StartRotation(interval time.Duration) {
+	utils.CheckError(s.RotateIfOlderThan(interval))
+
+	checkEvery := interval / 24
+	if checkEvery < time.Minute {
+		checkEvery = time.Minute
+	}
+	go func() {
+		ticker := time.NewTicker(checkEvery)
+		defer ticker.Stop()
+		for range ticker.C {
+			err := s.RotateIfOlderThan(interval)
+			if err != nil {
+				log.Printf("Error rotating signing keys: %s\n", err.Error())
+			}
+		}
+	}()
+}
+
+func (s *keyService) rotate(tx *sqlx.Tx) (*Key, error) {
+	signer, err := generateKey(s.algorithm)
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	private, err := x509.MarshalPKCS8PrivateKey(signer)
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	public, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	encrypted, err := utils.Encrypt(s.encryptionKey, private)
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	kid, err := newKid()
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+
+	_, err = tx.Exec("UPDATE signing_keys SET retired_at = NOW() WHERE retired_at IS NULL")
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	_, err = tx.Exec("INSERT INTO signing_keys (kid, algorithm, private_key, public_key) VALUES ($1, $2, $3, $4)",
+		kid, s.algorithm, encrypted, public)
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	return &Key{Kid: kid, Algorithm: s.algorithm, Private: signer, Public: signer.Public()}, nil
+}
+
+func (s *keyService) decode(stored *SigningKey, withPrivate bool) (*Key, error) {
+	key := &Key{Kid: stored.Kid, Algorithm: stored.Algorithm}
+	public, err := parsePublicKey(stored.PublicKey)
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	key.Public = public
+	if !withPrivate {
+		return key, nil
+	}
+
+	der, err := utils.Decrypt(s.encryptionKey, stored.PrivateKey)
+	if err != nil {
+		return nil, utils.ServiceError("Error decrypting signing key "+stored.Kid, http.StatusInternalServerError)
+	}
+	key.Private, err = parsePrivateKey(der)
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	return key, nil
+}
+
+func (s *keyService) cacheActive(key *Key) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.active = &cachedKey{key: key, loadedAt: time.Now()}
+	s.public[key.Kid] = &cachedKey{key: key, loadedAt: time.Now()}
+}
+
+func newKid() (string, error) {
+	bytes := make([]byte, 12)
+	_, err := rand.Read(bytes)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bytes), nil
+}
+
+// RotationIntervalFromEnv reads KEY_ROTATION_INTERVAL, defaulting to 30 days.
+func RotationIntervalFromEnv() time.Duration {
+	return utils.DurationFromEnv("KEY_ROTATION_INTERVAL", defaultRotationInterval)
+}
+
+func NewKeyService(db *sqlx.DB) KeyService {
+	algorithm := os.Getenv("SIGNING_ALGORITHM")
+	if algorithm == "" {
+		algorithm = defaultAlgorithm
+	}
+	if algorithm != RS256 && algorithm != ES256 && algorithm != EdDSA {
+		utils.CheckError(errors.New("SIGNING_ALGORITHM must be one of RS256, ES256 and EdDSA"))
+	}
+
+	return &keyService{
+		db:            db,
+		encryptionKey: utils.EncryptionKeyFromEnv(),
+		algorithm:     algorithm,
+		retention:     utils.DurationFromEnv("KEY_RETENTION", defaultRetention),
+		public:        map[string]*cachedKey{},
+	}
+}
@@ -0,0 +1,179 @@
+package keys
+
+import (
+	"crypto/x509"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/Kavuti/goauth/utils"
+	"github.com/jmoiron/sqlx"
+)
+
+var (
+	testEncryptionKey = []byte("0123456789abcdef0123456789abcdef")
+	signingKeyColumns = []string{"kid", "algorithm", "private_key", "public_key", "created_at", "retired_at"}
+)
+
+func newTestService(db *sqlx.DB, algorithm string) *keyService {
+	return &keyService{
+		db:            db,
+		encryptionKey: testEncryptionKey,
+		algorithm:     algorithm,
+		retention:     time.Hour,
+		public:        map[string]*cachedKey{},
+	}
+}
+
+func storedKey(t *testing.T, algorithm string) (private []byte, public []byte) {
+	signer, err := generateKey(algorithm)
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	der, _ := x509.MarshalPKCS8PrivateKey(signer)
+	private, err = utils.Encrypt(testEncryptionKey, der)
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	public, _ = x509.MarshalPKIXPublicKey(signer.Public())
+	return private, public
+}
+
+func Test_Rotate(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("LOCK TABLE signing_keys").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("UPDATE signing_keys SET retired_at").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO signing_keys").WithArgs(sqlmock.AnyArg(), ES256, sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	service := newTestService(sqlx.NewDb(db, "sqlmock"), ES256)
+	key, err := service.Rotate()
+	if err != nil {
+		t.Fatalf("Error executing Rotate test: %s\n", err.Error())
+	}
+	active, err := service.SigningKey()
+	if err != nil || active.Kid != key.Kid {
+		t.Fatal("Error executing Rotate test: rotated key is not the active one")
+	}
+}
+
+func Test_RotateIfOlderThan_Fresh(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("LOCK TABLE signing_keys").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT COUNT(.+) FROM signing_keys WHERE (.+)").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectRollback()
+
+	service := newTestService(sqlx.NewDb(db, "sqlmock"), ES256)
+	err = service.RotateIfOlderThan(time.Hour)
+	if err != nil {
+		t.Fatalf("Error executing RotateIfOlderThan_Fresh test: %s\n", err.Error())
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("Error executing RotateIfOlderThan_Fresh test: %s\n", err.Error())
+	}
+}
+
+func Test_SigningKey(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	private, public := storedKey(t, RS256)
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM signing_keys WHERE (.+)").WillReturnRows(sqlmock.NewRows(signingKeyColumns).AddRow("kid", RS256, private, public, time.Now(), nil))
+	mock.ExpectCommit()
+
+	service := newTestService(sqlx.NewDb(db, "sqlmock"), RS256)
+	key, err := service.SigningKey()
+	if err != nil {
+		t.Fatalf("Error executing SigningKey test: %s\n", err.Error())
+	}
+	if key.Kid != "kid" || key.Private == nil {
+		t.Fatal("Error executing SigningKey test: private key not decrypted")
+	}
+}
+
+func Test_SigningKey_WrongEncryptionKey(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	private, public := storedKey(t, EdDSA)
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM signing_keys WHERE (.+)").WillReturnRows(sqlmock.NewRows(signingKeyColumns).AddRow("kid", EdDSA, private, public, time.Now(), nil))
+	mock.ExpectCommit()
+
+	service := newTestService(sqlx.NewDb(db, "sqlmock"), EdDSA)
+	service.encryptionKey = []byte("fedcba9876543210fedcba9876543210")
+	_, err = service.SigningKey()
+	if err == nil {
+		t.Fatal("Error executing SigningKey_WrongEncryptionKey test: no error returned")
+	}
+}
+
+func Test_VerificationKey_Unknown(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM signing_keys WHERE (.+)").WillReturnError(errors.New("Not found"))
+	mock.ExpectRollback()
+
+	service := newTestService(sqlx.NewDb(db, "sqlmock"), RS256)
+	_, err = service.VerificationKey("unknown")
+	if err == nil {
+		t.Fatal("Error executing VerificationKey_Unknown test: no error returned")
+	}
+}
+
+func Test_JWKS(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	rows := sqlmock.NewRows(signingKeyColumns)
+	for _, algorithm := range []string{RS256, ES256, EdDSA} {
+		private, public := storedKey(t, algorithm)
+		rows.AddRow(algorithm, algorithm, private, public, time.Now(), nil)
+	}
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM signing_keys WHERE (.+)").WillReturnRows(rows)
+	mock.ExpectCommit()
+
+	service := newTestService(sqlx.NewDb(db, "sqlmock"), RS256)
+	set, err := service.JWKS()
+	if err != nil {
+		t.Fatalf("Error executing JWKS test: %s\n", err.Error())
+	}
+	expected := map[string]string{RS256: "RSA", ES256: "EC", EdDSA: "OKP"}
+	if len(set.Keys) != 3 {
+		t.Fatalf("Error executing JWKS test: expected 3 keys, got %d\n", len(set.Keys))
+	}
+	for _, jwk := range set.Keys {
+		if jwk.Kty != expected[jwk.Alg] || jwk.Kid != jwk.Alg || jwk.Use != "sig" {
+			t.Fatalf("Error executing JWKS test: unexpected key %#v\n", jwk)
+		}
+	}
+}
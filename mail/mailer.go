@@ -0,0 +1,137 @@
+package mail
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Kavuti/goauth/utils"
+)
+
+const defaultQueueSize = 100
+
+type Mailer interface {
+	Send(message *Message) error
+}
+
+type smtpMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func (m *smtpMailer) Send(message *Message) error {
+	content, err := message.Bytes(m.from)
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{message.To}, content)
+}
+
+func NewSMTPMailer(host string, port string, username string, password string, from string) Mailer {
+	var auth smtp.Auth
+	if username != "" {
+		auth = smtp.PlainAuth("", username, password, host)
+	}
+	return &smtpMailer{addr: host + ":" + port, from: from, auth: auth}
+}
+
+// fileMailer stores every message as an .eml file instead of delivering it,
+// which makes the outgoing mail easy to inspect during development.
+type fileMailer struct {
+	dir  string
+	from string
+}
+
+func (m *fileMailer) Send(message *Message) error {
+	content, err := message.Bytes(m.from)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), strings.ReplaceAll(message.To, "@", "_at_"))
+	return os.WriteFile(filepath.Join(m.dir, name), content, 0600)
+}
+
+func NewFileMailer(dir string, from string) Mailer {
+	return &fileMailer{dir: dir, from: from}
+}
+
+// logMailer writes the text part of every message to the given writer.
+type logMailer struct {
+	out io.Writer
+}
+
+func (m *logMailer) Send(message *Message) error {
+	_, err := fmt.Fprintf(m.out, "To: %s\nSubject: %s\n\n%s\n", message.To, message.Subject, message.Text)
+	return err
+}
+
+func NewLogMailer(out io.Writer) Mailer {
+	return &logMailer{out: out}
+}
+
+// asyncMailer hands messages over to a background worker, so that callers
+// never wait on the delivery of a message.
+type asyncMailer struct {
+	mailer Mailer
+	queue  chan *Message
+}
+
+func (m *asyncMailer) Send(message *Message) error {
+	select {
+	case m.queue <- message:
+		return nil
+	default:
+		return errors.New("mail queue is full")
+	}
+}
+
+func (m *asyncMailer) work() {
+	for message := range m.queue {
+		err := m.mailer.Send(message)
+		if err != nil {
+			log.Printf("Error sending mail to %s: %s\n", message.To, err.Error())
+		}
+	}
+}
+
+func NewAsyncMailer(mailer Mailer, queueSize int) Mailer {
+	async := &asyncMailer{mailer: mailer, queue: make(chan *Message, queueSize)}
+	go async.work()
+	return async
+}
+
+// NewMailerFromEnv builds the mailer selected by MAIL_TRANSPORT, which is
+// mandatory: "smtp", "file" (writing to MAIL_DIR) or "log". The log transport
+// writes the links and codes of every message to the process log, so it has
+// to be chosen explicitly, for development only. Delivery always happens in
+// the background.
+func NewMailerFromEnv() Mailer {
+	from := os.Getenv("MAIL_FROM")
+	var mailer Mailer
+	switch transport := os.Getenv("MAIL_TRANSPORT"); transport {
+	case "smtp":
+		port := os.Getenv("SMTP_PORT")
+		if port == "" {
+			port = "587"
+		}
+		mailer = NewSMTPMailer(os.Getenv("SMTP_HOST"), port, os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"), from)
+	case "file":
+		dir := os.Getenv("MAIL_DIR")
+		utils.CheckError(os.MkdirAll(dir, 0700))
+		mailer = NewFileMailer(dir, from)
+	case "log":
+		mailer = NewLogMailer(log.Writer())
+	case "":
+		utils.CheckError(errors.New("MAIL_TRANSPORT must be set to smtp, file or log"))
+	default:
+		utils.CheckError(fmt.Errorf("unknown MAIL_TRANSPORT %q", transport))
+	}
+	return NewAsyncMailer(mailer, defaultQueueSize)
+}
@@ -0,0 +1,126 @@
+package mail
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type messageData struct {
+	Name      string
+	Link      string
+	Code      string
+	ExpiresIn string
+	Time      string
+	NewEmail  string
+}
+
+func Test_Compose(t *testing.T) {
+	message, err := Compose(KindVerification, "test@test.com", &messageData{Name: "<b>Test</b>", Link: "https://goauth/verify?token=abc", ExpiresIn: "1 hour"})
+	if err != nil {
+		t.Fatalf("Error executing Compose test: %s\n", err.Error())
+	}
+	if message.Subject == "" || message.To != "test@test.com" {
+		t.Fatalf("Error executing Compose test: unexpected message %#v\n", message)
+	}
+	if !strings.Contains(message.Text, "<b>Test</b>") || !strings.Contains(message.Text, "https://goauth/verify?token=abc") {
+		t.Fatal("Error executing Compose test: text part not rendered")
+	}
+	if strings.Contains(message.HTML, "<b>Test</b>") || !strings.Contains(message.HTML, "&lt;b&gt;Test&lt;/b&gt;") {
+		t.Fatal("Error executing Compose test: HTML part not escaped")
+	}
+}
+
+func Test_Compose_AllKinds(t *testing.T) {
+	for kind := range subjects {
+		message, err := Compose(kind, "test@test.com", &messageData{Name: "Test", Link: "https://goauth/link?token=abc", Code: "123456", ExpiresIn: "1 hour", Time: "1 January 2024"})
+		if err != nil {
+			t.Fatalf("Error executing Compose_AllKinds test for %s: %s\n", kind, err.Error())
+		}
+		if !strings.Contains(message.Text, "Hello Test") || !strings.Contains(message.HTML, "Hello Test") {
+			t.Fatalf("Error executing Compose_AllKinds test: %s message not rendered\n", kind)
+		}
+	}
+}
+
+func Test_Compose_UnknownKind(t *testing.T) {
+	_, err := Compose("unknown", "test@test.com", nil)
+	if err == nil {
+		t.Fatal("Error executing Compose_UnknownKind test: no error returned")
+	}
+}
+
+func Test_HumanDuration(t *testing.T) {
+	durations := map[time.Duration]string{
+		time.Hour:        "1 hour",
+		24 * time.Hour:   "24 hours",
+		15 * time.Minute: "15 minutes",
+		90 * time.Second: "1m30s",
+	}
+	for duration, expected := range durations {
+		if HumanDuration(duration) != expected {
+			t.Fatalf("Error executing HumanDuration test: got %s, expected %s\n", HumanDuration(duration), expected)
+		}
+	}
+}
+
+func Test_MessageBytes(t *testing.T) {
+	message := &Message{To: "test@test.com", Subject: "Verify your email address", Text: "text body", HTML: "<p>html body</p>"}
+	content, err := message.Bytes("goauth@test.com")
+	if err != nil {
+		t.Fatalf("Error executing MessageBytes test: %s\n", err.Error())
+	}
+	for _, expected := range []string{"From: goauth@test.com", "To: test@test.com", "multipart/alternative", "text/plain", "text/html", "text body", "<p>html body</p>"} {
+		if !bytes.Contains(content, []byte(expected)) {
+			t.Fatalf("Error executing MessageBytes test: %q missing from message\n", expected)
+		}
+	}
+}
+
+func Test_FileMailer(t *testing.T) {
+	dir := t.TempDir()
+	mailer := NewFileMailer(dir, "goauth@test.com")
+	err := mailer.Send(&Message{To: "test@test.com", Subject: "Subject", Text: "text body"})
+	if err != nil {
+		t.Fatalf("Error executing FileMailer test: %s\n", err.Error())
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if len(files) != 1 {
+		t.Fatalf("Error executing FileMailer test: expected 1 message, found %d\n", len(files))
+	}
+	content, _ := os.ReadFile(files[0])
+	if !bytes.Contains(content, []byte("text body")) {
+		t.Fatal("Error executing FileMailer test: message body not written")
+	}
+}
+
+type blockingMailer struct {
+	sent chan *Message
+}
+
+func (m *blockingMailer) Send(message *Message) error {
+	m.sent <- message
+	return nil
+}
+
+func Test_AsyncMailer(t *testing.T) {
+	delegate := &blockingMailer{sent: make(chan *Message)}
+	mailer := NewAsyncMailer(delegate, 1)
+
+	err := mailer.Send(&Message{To: "test@test.com"})
+	if err != nil {
+		t.Fatalf("Error executing AsyncMailer test: %s\n", err.Error())
+	}
+	select {
+	case message := <-delegate.sent:
+		if message.To != "test@test.com" {
+			t.Fatal("Error executing AsyncMailer test: unexpected message delivered")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Error executing AsyncMailer test: message not delivered")
+	}
+}
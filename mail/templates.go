@@ -0,0 +1,81 @@
+package mail
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	texttemplate "text/template"
+	"time"
+)
+
+// Kinds of message goauth sends. Each one has a text and an HTML template
+// named after it in the templates directory.
+const (
+	KindVerification      = "verification"
+	KindPasswordReset     = "password_reset"
+	KindMagicLink         = "magic_link"
+	KindEmailOTP          = "email_otp"
+	KindPasswordChanged   = "password_changed"
+	KindEmailChange       = "email_change"
+	KindEmailChangeNotice = "email_change_notice"
+	KindAccountLocked     = "account_locked"
+)
+
+var subjects = map[string]string{
+	KindVerification:      "Verify your email address",
+	KindPasswordReset:     "Reset your password",
+	KindMagicLink:         "Your sign-in link",
+	KindEmailOTP:          "Your verification code",
+	KindPasswordChanged:   "Your password was changed",
+	KindEmailChange:       "Confirm your new email address",
+	KindEmailChangeNotice: "Your email address is being changed",
+	KindAccountLocked:     "Your account was locked",
+}
+
+//go:embed templates
+var templateFiles embed.FS
+
+var (
+	textTemplates = texttemplate.Must(texttemplate.ParseFS(templateFiles, "templates/*.txt"))
+	htmlTemplates = htmltemplate.Must(htmltemplate.ParseFS(templateFiles, "templates/*.html"))
+)
+
+// Compose renders the message of the given kind for a recipient.
+func Compose(kind string, to string, data interface{}) (*Message, error) {
+	subject, ok := subjects[kind]
+	if !ok {
+		return nil, fmt.Errorf("unknown message kind %q", kind)
+	}
+
+	var text bytes.Buffer
+	err := textTemplates.ExecuteTemplate(&text, kind+".txt", data)
+	if err != nil {
+		return nil, err
+	}
+	var html bytes.Buffer
+	err = htmlTemplates.ExecuteTemplate(&html, kind+".html", data)
+	if err != nil {
+		return nil, err
+	}
+	return &Message{To: to, Subject: subject, Text: text.String(), HTML: html.String()}, nil
+}
+
+// HumanDuration formats the validity of the links and codes sent to users.
+func HumanDuration(d time.Duration) string {
+	switch {
+	case d >= time.Hour && d%time.Hour == 0:
+		return plural(int(d/time.Hour), "hour")
+	case d >= time.Minute && d%time.Minute == 0:
+		return plural(int(d/time.Minute), "minute")
+	default:
+		return d.String()
+	}
+}
+
+func plural(count int, unit string) string {
+	if count == 1 {
+		return fmt.Sprintf("1 %s", unit)
+	}
+	return fmt.Sprintf("%d %ss", count, unit)
+}
@@ -8,8 +8,19 @@ import (
 	"reflect"
 	"time"
 
+	"github.com/Kavuti/goauth/auth"
+	"github.com/Kavuti/goauth/clients"
+	"github.com/Kavuti/goauth/keys"
+	"github.com/Kavuti/goauth/mail"
+	"github.com/Kavuti/goauth/mfa"
+	"github.com/Kavuti/goauth/oauth"
+	"github.com/Kavuti/goauth/ratelimit"
 	"github.com/Kavuti/goauth/roles"
+	"github.com/Kavuti/goauth/sessions"
+	"github.com/Kavuti/goauth/tokens"
 	"github.com/Kavuti/goauth/users"
+	"github.com/Kavuti/goauth/utils"
+	"github.com/Kavuti/goauth/webauthn"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/render"
@@ -46,21 +57,67 @@ func main() {
 	}
 	log.Println("Database migrations applied. Starting the service")
 
+	// Administrator bootstrap: ADMIN_EMAIL names a verified user to grant the
+	// ADMIN role at startup, so that a fresh installation has someone able to
+	// assign roles. Register and verify that user, then restart the service.
+	if adminEmail := os.Getenv("ADMIN_EMAIL"); adminEmail != "" {
+		err = roles.NewRoleService(db).BootstrapAdmin(adminEmail)
+		if err != nil {
+			log.Printf("ADMIN role not granted to %s: %s\n", adminEmail, err.Error())
+		} else {
+			log.Printf("ADMIN role granted to %s\n", adminEmail)
+		}
+	}
+
 	// Router Configuration
+	utils.TrustProxiesFromEnv()
 	r := chi.NewRouter()
 	r.Use(middleware.RequestID)
-	r.Use(middleware.RealIP)
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
 	r.Use(middleware.Timeout(60 * time.Second))
 	r.Use(render.SetContentType(render.ContentTypeJSON))
 
+	// Services shared between handlers
+	mode := auth.ModeFromEnv()
+	keyService := keys.NewKeyService(db)
+	keyService.StartRotation(keys.RotationIntervalFromEnv())
+	tokenService := tokens.NewTokenService(db, keyService)
+	sessionService := sessions.NewSessionService(db)
+	webAuthnService := webauthn.NewWebAuthnService(db)
+	mailer := mail.NewMailerFromEnv()
+	mfaService := mfa.NewMFAService(db, webAuthnService, mailer)
+	rateLimits := ratelimit.StoreFromEnv(db)
+	if mode.Tokens {
+		r.Use(tokens.Middleware(tokenService))
+	}
+	if mode.Sessions {
+		r.Use(sessions.Middleware(sessionService))
+	}
+
 	// Handlers registration
-	usersHandler := users.NewUserHandler(r, db)
-	rolesHandler := roles.NewRoleHandler(r, db)
+	usersHandler := users.NewUserHandler(r, db, tokenService, sessionService, mfaService, webAuthnService, mailer, rateLimits, mode)
+	rolesHandler := roles.NewRoleHandler(r, db, rateLimits)
+	clientsHandler := clients.NewClientHandler(r, db, rateLimits)
+	tokensHandler := tokens.NewTokenHandler(r, tokenService)
+	oauthHandler := oauth.NewOAuthHandler(r, db, tokenService, keyService, rateLimits)
+	keysHandler := keys.NewKeyHandler(r, keyService, rateLimits)
+	mfaHandler := mfa.NewMFAHandler(r, mfaService)
+	webAuthnHandler := webauthn.NewWebAuthnHandler(r, webAuthnService)
 
 	r.Mount("/users", usersHandler.Routes())
 	r.Mount("/roles", rolesHandler.Routes())
+	r.Mount("/clients", clientsHandler.Routes())
+	r.Mount("/oauth", oauthHandler.Routes())
+	r.Mount("/keys", keysHandler.Routes())
+	r.Mount("/mfa", mfaHandler.Routes())
+	r.Mount("/webauthn", webAuthnHandler.Routes())
+	r.Mount("/userinfo", oauthHandler.UserInfoRoutes())
+	r.Get("/.well-known/jwks.json", keysHandler.JWKS)
+	r.Get("/.well-known/openid-configuration", oauthHandler.Discovery)
+	if mode.Tokens {
+		r.Mount("/token", tokensHandler.Routes())
+	}
 
 	// Server start listening
 	port := os.Getenv("SERVER_PORT")
@@ -0,0 +1,30 @@
+package mfa
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+
+	"github.com/Kavuti/goauth/utils"
+)
+
+type emailCodeData struct {
+	Name      string
+	Code      string
+	ExpiresIn string
+}
+
+// generateEmailCode returns a random code of six digits.
+func generateEmailCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+// hashEmailCode salts the code with its challenge, since a six digits code
+// alone is trivially reversed from its digest.
+func hashEmailCode(challengeHash string, code string) string {
+	return utils.HashToken(challengeHash + ":" + code)
+}
@@ -0,0 +1,85 @@
+package mfa
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/Kavuti/goauth/auth"
+)
+
+// Second factors a login challenge can be answered with.
+const (
+	MethodTOTP         = "totp"
+	MethodWebAuthn     = "webauthn"
+	MethodEmail        = "email"
+	MethodRecoveryCode = "recovery_code"
+)
+
+// AMR returns the authentication method references (RFC 8176) the given
+// second factor adds to those of the first one.
+func AMR(method string) []string {
+	switch method {
+	case MethodTOTP:
+		return []string{auth.AMROTP, auth.AMRMFA}
+	case MethodWebAuthn:
+		return []string{auth.AMRHardwareKey, auth.AMRMFA}
+	case MethodEmail:
+		return []string{auth.AMROTP, auth.AMREmail, auth.AMRMFA}
+	}
+	return []string{auth.AMRMFA}
+}
+
+type TOTP struct {
+	UserEmail    string       `db:"user_email"`
+	Secret       []byte       `db:"secret"`
+	LastUsedStep int64        `db:"last_used_step"`
+	CreatedAt    time.Time    `db:"created_at"`
+	ConfirmedAt  sql.NullTime `db:"confirmed_at"`
+}
+
+type EmailSettings struct {
+	UserEmail      string       `db:"user_email"`
+	FailedAttempts int          `db:"failed_attempts"`
+	LockedUntil    sql.NullTime `db:"locked_until"`
+	CreatedAt      time.Time    `db:"created_at"`
+}
+
+type Challenge struct {
+	TokenHash  string       `db:"token_hash"`
+	UserEmail  string       `db:"user_email"`
+	AMR        string       `db:"amr"`
+	Attempts   int          `db:"attempts"`
+	CreatedAt  time.Time    `db:"created_at"`
+	ExpiresAt  time.Time    `db:"expires_at"`
+	ConsumedAt sql.NullTime `db:"consumed_at"`
+}
+
+type TOTPConfirmationRequest struct {
+	Code string `json:"code" validate:"required,len=6,numeric"`
+}
+
+type TOTPEnrollmentResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+type MethodsResponse struct {
+	Methods []string `json:"methods"`
+}
+
+func (resp *TOTPEnrollmentResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func (resp *RecoveryCodesResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func (resp *MethodsResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
@@ -0,0 +1,89 @@
+package mfa
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/Kavuti/goauth/auth"
+	"github.com/Kavuti/goauth/utils"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+)
+
+type MFAHandler interface {
+	Routes() chi.Router
+
+	Methods(w http.ResponseWriter, r *http.Request)
+	EnrollTOTP(w http.ResponseWriter, r *http.Request)
+	ConfirmTOTP(w http.ResponseWriter, r *http.Request)
+	EnableEmail(w http.ResponseWriter, r *http.Request)
+}
+
+type mfaHandler struct {
+	chi.Router
+	service MFAService
+}
+
+func (h *mfaHandler) Methods(w http.ResponseWriter, r *http.Request) {
+	defer utils.RecoverIfError(w, r)
+	principal, _ := auth.FromContext(r.Context())
+	methods, err := h.service.Methods(principal.Email)
+	utils.CheckError(err)
+
+	render.Render(w, r, &MethodsResponse{Methods: methods})
+}
+
+func (h *mfaHandler) EnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	defer utils.RecoverIfError(w, r)
+	principal, _ := auth.FromContext(r.Context())
+	response, err := h.service.EnrollTOTP(principal.Email)
+	utils.CheckError(err)
+
+	render.Render(w, r, response)
+}
+
+func (h *mfaHandler) ConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	defer utils.RecoverIfError(w, r)
+	principal, _ := auth.FromContext(r.Context())
+	request := TOTPConfirmationRequest{}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	utils.CheckError(err)
+
+	err = utils.ValidateStruct(request)
+	utils.CheckError(err)
+
+	response, err := h.service.ConfirmTOTP(principal.Email, request.Code)
+	utils.CheckError(err)
+
+	render.Render(w, r, response)
+}
+
+func (h *mfaHandler) EnableEmail(w http.ResponseWriter, r *http.Request) {
+	defer utils.RecoverIfError(w, r)
+	principal, _ := auth.FromContext(r.Context())
+	err := h.service.EnableEmail(principal.Email)
+	utils.CheckError(err)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *mfaHandler) Routes() chi.Router {
+	r := chi.NewRouter()
+	r.Use(auth.RequireAuthentication)
+
+	r.Get("/", h.Methods)
+	r.Post("/totp", h.EnrollTOTP)
+	r.Post("/totp/confirm", h.ConfirmTOTP)
+	r.Post("/email", h.EnableEmail)
+
+	return r
+}
+
+func NewMFAHandler(r chi.Router, service MFAService) MFAHandler {
+	handler := &mfaHandler{
+		Router:  r,
+		service: service,
+	}
+
+	return handler
+}
@@ -0,0 +1,543 @@
+package mfa
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Kavuti/goauth/auth"
+	"github.com/Kavuti/goauth/mail"
+	"github.com/Kavuti/goauth/utils"
+	"github.com/Kavuti/goauth/webauthn"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	defaultIssuer        = "goauth"
+	defaultChallengeTTL  = 5 * time.Minute
+	defaultEmailCodeTTL  = 5 * time.Minute
+	defaultEmailLockout  = 15 * time.Minute
+	emailCodeInterval    = 30 * time.Second
+	maxChallengeAttempts = 5
+	maxEmailCodeFailures = 10
+	recoveryCodeCount    = 10
+)
+
+type MFAService interface {
+	EnrollTOTP(email string) (*TOTPEnrollmentResponse, error)
+	ConfirmTOTP(email string, code string) (*RecoveryCodesResponse, error)
+	EnableEmail(email string) error
+	Methods(email string) ([]string, error)
+
+	CreateChallenge(email string, amr []string) (string, error)
+	SendEmailCode(token string) error
+	ChallengeEmail(token string) (string, error)
+	VerifyChallenge(token string, method string, code string) (string, []string, error)
+}
+
+type mfaService struct {
+	db            *sqlx.DB
+	webauthn      webauthn.WebAuthnService
+	mailer        mail.Mailer
+	encryptionKey []byte
+	issuer        string
+	challengeTTL  time.Duration
+	emailCodeTTL  time.Duration
+	emailLockout  time.Duration
+}
+
+// EnrollTOTP generates a new TOTP secret for the user. The secret is only
+// used at login once ConfirmTOTP proves the user's authenticator has it.
+func (s *mfaService) EnrollTOTP(email string) (*TOTPEnrollmentResponse, error) {
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	encrypted, err := utils.Encrypt(s.encryptionKey, secret)
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+
+	tx := s.db.MustBegin()
+	defer tx.Rollback()
+
+	rows, err := tx.MustExec(`INSERT INTO mfa_totp (user_email, secret) VALUES ($1, $2)
+		ON CONFLICT (user_email) DO UPDATE SET secret = EXCLUDED.secret, created_at = NOW(), last_used_step = 0
+		WHERE mfa_totp.confirmed_at IS NULL`, email, encrypted).RowsAffected()
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	if rows == 0 {
+		return nil, utils.ServiceError("TOTP is already enrolled", http.StatusConflict)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+
+	return &TOTPEnrollmentResponse{
+		Secret: secretEncoding.EncodeToString(secret),
+		URI:    totpURI(s.issuer, email, secret),
+	}, nil
+}
+
+// ConfirmTOTP activates a pending enrollment with a first code from the
+// authenticator and hands out a fresh set of recovery codes.
+func (s *mfaService) ConfirmTOTP(email string, code string) (*RecoveryCodesResponse, error) {
+	tx := s.db.MustBegin()
+	defer tx.Rollback()
+
+	var totp TOTP
+	err := tx.Get(&totp, "SELECT * FROM mfa_totp WHERE user_email=$1 AND confirmed_at IS NULL FOR UPDATE", email)
+	if err == sql.ErrNoRows {
+		return nil, utils.ServiceError("No pending TOTP enrollment", http.StatusNotFound)
+	}
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	secret, err := utils.Decrypt(s.encryptionKey, totp.Secret)
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	step, ok := validateTOTP(secret, code, time.Now(), totp.LastUsedStep)
+	if !ok {
+		return nil, utils.ServiceError("Invalid TOTP code", http.StatusBadRequest)
+	}
+
+	_, err = tx.Exec("UPDATE mfa_totp SET confirmed_at = NOW(), last_used_step = $1 WHERE user_email = $2", step, email)
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	codes, err := replaceRecoveryCodes(tx, email)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	return &RecoveryCodesResponse{RecoveryCodes: codes}, nil
+}
+
+// EnableEmail turns on codes sent by email as a second factor. The address has
+// to be verified, or the codes could go to someone else.
+func (s *mfaService) EnableEmail(email string) error {
+	tx := s.db.MustBegin()
+	defer tx.Rollback()
+
+	var verified bool
+	err := tx.Get(&verified, "SELECT verified FROM users WHERE email=$1", email)
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	if !verified {
+		return utils.ServiceError("The email address has to be verified first", http.StatusBadRequest)
+	}
+	rows, err := tx.MustExec("INSERT INTO mfa_email (user_email) VALUES ($1) ON CONFLICT (user_email) DO NOTHING", email).RowsAffected()
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	if rows == 0 {
+		return utils.ServiceError("Email codes are already enabled", http.StatusConflict)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	return nil
+}
+
+// Methods lists the second factors the user can currently answer a login
+// challenge with. An empty list means MFA is not enabled.
+func (s *mfaService) Methods(email string) ([]string, error) {
+	tx := s.db.MustBegin()
+	defer tx.Rollback()
+
+	var totp int
+	err := tx.Get(&totp, "SELECT COUNT(*) FROM mfa_totp WHERE user_email=$1 AND confirmed_at IS NOT NULL", email)
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	var emailCodes int
+	err = tx.Get(&emailCodes, "SELECT COUNT(*) FROM mfa_email WHERE user_email=$1", email)
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	var passkeys int
+	err = tx.Get(&passkeys, "SELECT COUNT(*) FROM webauthn_credentials WHERE user_email=$1", email)
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	var recoveryCodes int
+	err = tx.Get(&recoveryCodes, "SELECT COUNT(*) FROM mfa_recovery_codes WHERE user_email=$1 AND used_at IS NULL", email)
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+
+	methods := []string{}
+	if totp > 0 {
+		methods = append(methods, MethodTOTP)
+	}
+	if passkeys > 0 {
+		methods = append(methods, MethodWebAuthn)
+	}
+	if emailCodes > 0 {
+		methods = append(methods, MethodEmail)
+	}
+	if len(methods) > 0 && recoveryCodes > 0 {
+		methods = append(methods, MethodRecoveryCode)
+	}
+	return methods, nil
+}
+
+// CreateChallenge starts the second step of a login for a user who already
+// proved a first factor, described by amr, returning the token that
+// identifies it.
+func (s *mfaService) CreateChallenge(email string, amr []string) (string, error) {
+	token, err := utils.RandomToken()
+	if err != nil {
+		return "", utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+
+	tx := s.db.MustBegin()
+	defer tx.Rollback()
+
+	_, err = tx.Exec("INSERT INTO mfa_challenges (token_hash, user_email, amr, expires_at) VALUES ($1, $2, $3, $4)",
+		utils.HashToken(token), email, strings.Join(amr, ","), time.Now().Add(s.challengeTTL))
+	if err != nil {
+		return "", utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return "", utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	return token, nil
+}
+
+// SendEmailCode emails a one-time code answering the given login challenge,
+// replacing the one sent before, if any.
+func (s *mfaService) SendEmailCode(token string) error {
+	code, err := generateEmailCode()
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+
+	tx := s.db.MustBegin()
+	defer tx.Rollback()
+
+	challenge, err := getChallenge(tx, token)
+	if err != nil {
+		return err
+	}
+	if !allowsEmail(&challenge) {
+		return utils.ServiceError("Unsupported MFA method", http.StatusBadRequest)
+	}
+	settings, err := s.emailSettings(tx, challenge.UserEmail)
+	if err != nil {
+		return err
+	}
+	var sentAt []time.Time
+	err = tx.Select(&sentAt, "SELECT created_at FROM mfa_email_codes WHERE challenge_hash=$1", challenge.TokenHash)
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	if len(sentAt) > 0 && time.Since(sentAt[0]) < emailCodeInterval {
+		return utils.ServiceError("Code already sent recently, retry later", http.StatusTooManyRequests)
+	}
+	_, err = tx.Exec(`INSERT INTO mfa_email_codes (challenge_hash, code_hash, created_at, expires_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (challenge_hash) DO UPDATE SET code_hash = EXCLUDED.code_hash, created_at = EXCLUDED.created_at, expires_at = EXCLUDED.expires_at`,
+		challenge.TokenHash, hashEmailCode(challenge.TokenHash, code), time.Now(), time.Now().Add(s.emailCodeTTL))
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	var name string
+	err = tx.Get(&name, "SELECT first_name FROM users WHERE email=$1", settings.UserEmail)
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+
+	message, err := mail.Compose(mail.KindEmailOTP, settings.UserEmail, &emailCodeData{
+		Name:      name,
+		Code:      code,
+		ExpiresIn: mail.HumanDuration(s.emailCodeTTL),
+	})
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	err = s.mailer.Send(message)
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	return nil
+}
+
+// ChallengeEmail returns the email of the user a login challenge was created
+// for, as long as it can still be answered.
+func (s *mfaService) ChallengeEmail(token string) (string, error) {
+	tx := s.db.MustBegin()
+	defer tx.Rollback()
+
+	challenge, err := getChallenge(tx, token)
+	if err != nil {
+		return "", err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return "", utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	return challenge.UserEmail, nil
+}
+
+// VerifyChallenge checks the second factor answering a login challenge and
+// returns the email of the user completing the login, along with the
+// authentication methods of both factors. Challenges are single use and are
+// abandoned after too many wrong codes.
+func (s *mfaService) VerifyChallenge(token string, method string, code string) (string, []string, error) {
+	tx := s.db.MustBegin()
+	defer tx.Rollback()
+
+	challenge, err := getChallenge(tx, token)
+	if err != nil {
+		return "", nil, err
+	}
+
+	ok, err := s.verifyCode(tx, &challenge, method, code)
+	if err != nil {
+		return "", nil, err
+	}
+	if !ok {
+		_, err = tx.Exec("UPDATE mfa_challenges SET attempts = attempts + 1 WHERE token_hash = $1", challenge.TokenHash)
+		if err != nil {
+			return "", nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+		}
+		err = tx.Commit()
+		if err != nil {
+			return "", nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+		}
+		return "", nil, utils.ServiceError("Invalid MFA code", http.StatusUnauthorized)
+	}
+
+	_, err = tx.Exec("UPDATE mfa_challenges SET consumed_at = NOW() WHERE token_hash = $1", challenge.TokenHash)
+	if err != nil {
+		return "", nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return "", nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	amr := append(strings.Split(challenge.AMR, ","), AMR(method)...)
+	return challenge.UserEmail, amr, nil
+}
+
+// getChallenge locks a login challenge that can still be answered.
+func getChallenge(tx *sqlx.Tx, token string) (Challenge, error) {
+	var challenge Challenge
+	err := tx.Get(&challenge, `SELECT * FROM mfa_challenges
+		WHERE token_hash=$1 AND consumed_at IS NULL AND expires_at > NOW() FOR UPDATE`, utils.HashToken(token))
+	if err != nil || challenge.Attempts >= maxChallengeAttempts {
+		return challenge, utils.ServiceError("Invalid or expired MFA challenge", http.StatusUnauthorized)
+	}
+	return challenge, nil
+}
+
+// allowsEmail tells whether an email code can answer the challenge: it cannot
+// when the first factor was proven through the mailbox already.
+func allowsEmail(challenge *Challenge) bool {
+	for _, method := range strings.Split(challenge.AMR, ",") {
+		if method == auth.AMREmail {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *mfaService) verifyCode(tx *sqlx.Tx, challenge *Challenge, method string, code string) (bool, error) {
+	email := challenge.UserEmail
+	switch method {
+	case MethodTOTP:
+		return s.verifyTOTP(tx, email, code)
+	case MethodWebAuthn:
+		return s.verifyWebAuthn(email, code)
+	case MethodEmail:
+		if !allowsEmail(challenge) {
+			break
+		}
+		return s.verifyEmailCode(tx, challenge, code)
+	case MethodRecoveryCode:
+		return verifyRecoveryCode(tx, email, code)
+	default:
+	}
+	return false, utils.ServiceError("Unsupported MFA method", http.StatusBadRequest)
+}
+
+func (s *mfaService) verifyTOTP(tx *sqlx.Tx, email string, code string) (bool, error) {
+	var totp TOTP
+	err := tx.Get(&totp, "SELECT * FROM mfa_totp WHERE user_email=$1 AND confirmed_at IS NOT NULL FOR UPDATE", email)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	secret, err := utils.Decrypt(s.encryptionKey, totp.Secret)
+	if err != nil {
+		return false, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	step, ok := validateTOTP(secret, code, time.Now(), totp.LastUsedStep)
+	if !ok {
+		return false, nil
+	}
+	_, err = tx.Exec("UPDATE mfa_totp SET last_used_step = $1 WHERE user_email = $2", step, email)
+	if err != nil {
+		return false, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	return true, nil
+}
+
+// emailSettings locks the email codes settings of the user, failing while
+// they are locked out.
+func (s *mfaService) emailSettings(tx *sqlx.Tx, email string) (*EmailSettings, error) {
+	var settings EmailSettings
+	err := tx.Get(&settings, "SELECT * FROM mfa_email WHERE user_email=$1 FOR UPDATE", email)
+	if err == sql.ErrNoRows {
+		return nil, utils.ServiceError("Email codes are not enabled", http.StatusBadRequest)
+	}
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	if settings.LockedUntil.Valid && settings.LockedUntil.Time.After(time.Now()) {
+		return nil, utils.ServiceError("Too many wrong codes, retry later", http.StatusTooManyRequests)
+	}
+	return &settings, nil
+}
+
+// verifyEmailCode checks the code sent for the challenge. Wrong codes are
+// counted across challenges, and too many of them lock email codes out for
+// a while, so that a new login cannot be used to get more guesses.
+func (s *mfaService) verifyEmailCode(tx *sqlx.Tx, challenge *Challenge, code string) (bool, error) {
+	settings, err := s.emailSettings(tx, challenge.UserEmail)
+	if err != nil {
+		return false, err
+	}
+	var codeHashes []string
+	err = tx.Select(&codeHashes, "SELECT code_hash FROM mfa_email_codes WHERE challenge_hash=$1 AND expires_at > NOW()", challenge.TokenHash)
+	if err != nil {
+		return false, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+
+	if len(codeHashes) == 0 || subtle.ConstantTimeCompare([]byte(codeHashes[0]), []byte(hashEmailCode(challenge.TokenHash, code))) != 1 {
+		failures := settings.FailedAttempts + 1
+		lockedUntil := sql.NullTime{}
+		if failures >= maxEmailCodeFailures {
+			failures = 0
+			lockedUntil = sql.NullTime{Time: time.Now().Add(s.emailLockout), Valid: true}
+		}
+		_, err = tx.Exec("UPDATE mfa_email SET failed_attempts = $1, locked_until = $2 WHERE user_email = $3", failures, lockedUntil, challenge.UserEmail)
+		if err != nil {
+			return false, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+		}
+		return false, nil
+	}
+
+	_, err = tx.Exec("UPDATE mfa_email SET failed_attempts = 0, locked_until = NULL WHERE user_email = $1", challenge.UserEmail)
+	if err != nil {
+		return false, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	_, err = tx.Exec("DELETE FROM mfa_email_codes WHERE challenge_hash = $1", challenge.TokenHash)
+	if err != nil {
+		return false, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	return true, nil
+}
+
+// verifyWebAuthn checks a passkey assertion, sent as code in its JSON
+// serialization, against the challenge handed out at login.
+func (s *mfaService) verifyWebAuthn(email string, code string) (bool, error) {
+	var assertion webauthn.AssertionRequest
+	err := json.Unmarshal([]byte(code), &assertion)
+	if err != nil {
+		return false, nil
+	}
+	result, err := s.webauthn.FinishLogin(&assertion)
+	if err != nil {
+		return false, nil
+	}
+	return result.Email == email, nil
+}
+
+func verifyRecoveryCode(tx *sqlx.Tx, email string, code string) (bool, error) {
+	rows, err := tx.MustExec(`UPDATE mfa_recovery_codes SET used_at = NOW()
+		WHERE code_hash = $1 AND user_email = $2 AND used_at IS NULL`, hashRecoveryCode(code), email).RowsAffected()
+	if err != nil {
+		return false, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	return rows == 1, nil
+}
+
+func replaceRecoveryCodes(tx *sqlx.Tx, email string) ([]string, error) {
+	_, err := tx.Exec("DELETE FROM mfa_recovery_codes WHERE user_email = $1", email)
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		code, err := generateRecoveryCode()
+		if err != nil {
+			return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+		}
+		_, err = tx.Exec("INSERT INTO mfa_recovery_codes (code_hash, user_email) VALUES ($1, $2)", hashRecoveryCode(code), email)
+		if err != nil {
+			return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// generateRecoveryCode returns a code such as "abcde-fghij", carrying 50 bits
+// of entropy.
+func generateRecoveryCode() (string, error) {
+	bytes := make([]byte, 7)
+	_, err := rand.Read(bytes)
+	if err != nil {
+		return "", err
+	}
+	code := strings.ToLower(secretEncoding.EncodeToString(bytes))[:10]
+	return code[:5] + "-" + code[5:], nil
+}
+
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	return utils.HashToken(normalized)
+}
+
+func NewMFAService(db *sqlx.DB, webAuthnService webauthn.WebAuthnService, mailer mail.Mailer) MFAService {
+	issuer := os.Getenv("TOTP_ISSUER")
+	if issuer == "" {
+		issuer = defaultIssuer
+	}
+	return &mfaService{
+		db:            db,
+		webauthn:      webAuthnService,
+		mailer:        mailer,
+		encryptionKey: utils.EncryptionKeyFromEnv(),
+		issuer:        issuer,
+		challengeTTL:  utils.DurationFromEnv("MFA_CHALLENGE_TTL", defaultChallengeTTL),
+		emailCodeTTL:  utils.DurationFromEnv("EMAIL_OTP_TTL", defaultEmailCodeTTL),
+		emailLockout:  utils.DurationFromEnv("EMAIL_OTP_LOCKOUT", defaultEmailLockout),
+	}
+}
@@ -0,0 +1,344 @@
+package mfa
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/Kavuti/goauth/mail"
+	"github.com/Kavuti/goauth/utils"
+	"github.com/jmoiron/sqlx"
+)
+
+var testEncryptionKey = []byte("0123456789abcdef0123456789abcdef")
+
+var totpColumns = []string{"user_email", "secret", "last_used_step", "created_at", "confirmed_at"}
+
+var challengeColumns = []string{"token_hash", "user_email", "amr", "attempts", "created_at", "expires_at", "consumed_at"}
+
+func newTestService(t *testing.T) (*mfaService, sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	t.Cleanup(func() { db.Close() })
+	return &mfaService{db: sqlx.NewDb(db, "sqlmock"), encryptionKey: testEncryptionKey, issuer: "goauth", challengeTTL: time.Minute}, mock
+}
+
+func encryptedSecret(t *testing.T, secret []byte) []byte {
+	encrypted, err := utils.Encrypt(testEncryptionKey, secret)
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	return encrypted
+}
+
+func Test_TOTPCode(t *testing.T) {
+	// Test vectors from RFC 6238, appendix B, truncated to six digits.
+	secret := []byte("12345678901234567890")
+	vectors := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+	}
+	for timestamp, expected := range vectors {
+		code := totpCode(secret, timestamp/totpPeriod)
+		if code != expected {
+			t.Fatalf("Error executing TOTPCode test: got %s at %d, expected %s\n", code, timestamp, expected)
+		}
+	}
+}
+
+func Test_ValidateTOTP_Replay(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	now := time.Unix(1111111109, 0)
+	code := totpCode(secret, now.Unix()/totpPeriod)
+
+	step, ok := validateTOTP(secret, code, now, 0)
+	if !ok {
+		t.Fatal("Error executing ValidateTOTP_Replay test: valid code refused")
+	}
+	_, ok = validateTOTP(secret, code, now, step)
+	if ok {
+		t.Fatal("Error executing ValidateTOTP_Replay test: replayed code accepted")
+	}
+}
+
+func Test_EnrollTOTP(t *testing.T) {
+	service, mock := newTestService(t)
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO mfa_totp .+").WithArgs("test@test.com", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	response, err := service.EnrollTOTP("test@test.com")
+	if err != nil {
+		t.Fatalf("Error executing EnrollTOTP test: %s\n", err.Error())
+	}
+	if response.Secret == "" || response.URI == "" {
+		t.Fatalf("Error executing EnrollTOTP test: unexpected response %v\n", response)
+	}
+}
+
+func Test_EnrollTOTP_AlreadyEnrolled(t *testing.T) {
+	service, mock := newTestService(t)
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO mfa_totp .+").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	_, err := service.EnrollTOTP("test@test.com")
+	if err == nil {
+		t.Fatal("Error executing EnrollTOTP_AlreadyEnrolled test: no error returned")
+	}
+}
+
+func Test_ConfirmTOTP(t *testing.T) {
+	service, mock := newTestService(t)
+	secret := []byte("12345678901234567890")
+	code := totpCode(secret, time.Now().Unix()/totpPeriod)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM mfa_totp WHERE .+").WithArgs("test@test.com").WillReturnRows(sqlmock.NewRows(totpColumns).AddRow("test@test.com", encryptedSecret(t, secret), 0, time.Now(), nil))
+	mock.ExpectExec("UPDATE mfa_totp SET confirmed_at .+").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM mfa_recovery_codes .+").WillReturnResult(sqlmock.NewResult(0, 0))
+	for i := 0; i < recoveryCodeCount; i++ {
+		mock.ExpectExec("INSERT INTO mfa_recovery_codes .+").WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectCommit()
+
+	response, err := service.ConfirmTOTP("test@test.com", code)
+	if err != nil {
+		t.Fatalf("Error executing ConfirmTOTP test: %s\n", err.Error())
+	}
+	if len(response.RecoveryCodes) != recoveryCodeCount {
+		t.Fatalf("Error executing ConfirmTOTP test: got %d recovery codes\n", len(response.RecoveryCodes))
+	}
+}
+
+func Test_ConfirmTOTP_WrongCode(t *testing.T) {
+	service, mock := newTestService(t)
+	secret := []byte("12345678901234567890")
+	code := totpCode(secret, time.Now().Unix()/totpPeriod-10)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM mfa_totp WHERE .+").WillReturnRows(sqlmock.NewRows(totpColumns).AddRow("test@test.com", encryptedSecret(t, secret), 0, time.Now(), nil))
+	mock.ExpectRollback()
+
+	_, err := service.ConfirmTOTP("test@test.com", code)
+	if err == nil {
+		t.Fatal("Error executing ConfirmTOTP_WrongCode test: no error returned")
+	}
+}
+
+func Test_ChallengeEmail(t *testing.T) {
+	service, mock := newTestService(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM mfa_challenges .+").WithArgs(utils.HashToken("challenge")).WillReturnRows(sqlmock.NewRows(challengeColumns).AddRow(utils.HashToken("challenge"), "test@test.com", "pwd", 0, time.Now(), time.Now().Add(time.Minute), nil))
+	mock.ExpectCommit()
+
+	email, err := service.ChallengeEmail("challenge")
+	if err != nil || email != "test@test.com" {
+		t.Fatalf("Error executing ChallengeEmail test: unexpected result %s, %v\n", email, err)
+	}
+}
+
+func Test_VerifyChallenge_TOTP(t *testing.T) {
+	service, mock := newTestService(t)
+	secret := []byte("12345678901234567890")
+	code := totpCode(secret, time.Now().Unix()/totpPeriod)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM mfa_challenges .+").WithArgs(utils.HashToken("challenge")).WillReturnRows(sqlmock.NewRows(challengeColumns).AddRow(utils.HashToken("challenge"), "test@test.com", "pwd", 0, time.Now(), time.Now().Add(time.Minute), nil))
+	mock.ExpectQuery("SELECT (.+) FROM mfa_totp WHERE .+").WillReturnRows(sqlmock.NewRows(totpColumns).AddRow("test@test.com", encryptedSecret(t, secret), 0, time.Now(), time.Now()))
+	mock.ExpectExec("UPDATE mfa_totp SET last_used_step .+").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE mfa_challenges SET consumed_at .+").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	email, amr, err := service.VerifyChallenge("challenge", MethodTOTP, code)
+	if err != nil {
+		t.Fatalf("Error executing VerifyChallenge_TOTP test: %s\n", err.Error())
+	}
+	if email != "test@test.com" || strings.Join(amr, ",") != "pwd,otp,mfa" {
+		t.Fatalf("Error executing VerifyChallenge_TOTP test: unexpected result %s %v\n", email, amr)
+	}
+}
+
+func Test_VerifyChallenge_WrongCode(t *testing.T) {
+	service, mock := newTestService(t)
+	secret := []byte("12345678901234567890")
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM mfa_challenges .+").WillReturnRows(sqlmock.NewRows(challengeColumns).AddRow(utils.HashToken("challenge"), "test@test.com", "pwd", 0, time.Now(), time.Now().Add(time.Minute), nil))
+	mock.ExpectQuery("SELECT (.+) FROM mfa_totp WHERE .+").WillReturnRows(sqlmock.NewRows(totpColumns).AddRow("test@test.com", encryptedSecret(t, secret), 0, time.Now(), time.Now()))
+	mock.ExpectExec("UPDATE mfa_challenges SET attempts .+").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	_, _, err := service.VerifyChallenge("challenge", MethodTOTP, "abcdef")
+	if err == nil {
+		t.Fatal("Error executing VerifyChallenge_WrongCode test: no error returned")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("Error executing VerifyChallenge_WrongCode test: %s\n", err.Error())
+	}
+}
+
+func Test_VerifyChallenge_TooManyAttempts(t *testing.T) {
+	service, mock := newTestService(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM mfa_challenges .+").WillReturnRows(sqlmock.NewRows(challengeColumns).AddRow(utils.HashToken("challenge"), "test@test.com", "pwd", maxChallengeAttempts, time.Now(), time.Now().Add(time.Minute), nil))
+	mock.ExpectRollback()
+
+	_, _, err := service.VerifyChallenge("challenge", MethodRecoveryCode, "abcde-fghij")
+	if err == nil {
+		t.Fatal("Error executing VerifyChallenge_TooManyAttempts test: no error returned")
+	}
+}
+
+func Test_VerifyChallenge_RecoveryCode(t *testing.T) {
+	service, mock := newTestService(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM mfa_challenges .+").WillReturnRows(sqlmock.NewRows(challengeColumns).AddRow(utils.HashToken("challenge"), "test@test.com", "pwd", 0, time.Now(), time.Now().Add(time.Minute), nil))
+	mock.ExpectExec("UPDATE mfa_recovery_codes SET used_at .+").WithArgs(hashRecoveryCode("abcde-fghij"), "test@test.com").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE mfa_challenges SET consumed_at .+").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	_, _, err := service.VerifyChallenge("challenge", MethodRecoveryCode, "ABCDE FGHIJ")
+	if err != nil {
+		t.Fatalf("Error executing VerifyChallenge_RecoveryCode test: %s\n", err.Error())
+	}
+}
+
+var emailColumns = []string{"user_email", "failed_attempts", "locked_until", "created_at"}
+
+type mailerStub struct {
+	sent []*mail.Message
+}
+
+func (m *mailerStub) Send(message *mail.Message) error {
+	m.sent = append(m.sent, message)
+	return nil
+}
+
+func challengeRow(amr string) *sqlmock.Rows {
+	return sqlmock.NewRows(challengeColumns).AddRow(utils.HashToken("challenge"), "test@test.com", amr, 0, time.Now(), time.Now().Add(time.Minute), nil)
+}
+
+func Test_SendEmailCode(t *testing.T) {
+	service, mock := newTestService(t)
+	mailer := &mailerStub{}
+	service.mailer = mailer
+	service.emailCodeTTL = 5 * time.Minute
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM mfa_challenges .+").WillReturnRows(challengeRow("pwd"))
+	mock.ExpectQuery("SELECT (.+) FROM mfa_email WHERE .+").WithArgs("test@test.com").WillReturnRows(sqlmock.NewRows(emailColumns).AddRow("test@test.com", 0, nil, time.Now()))
+	mock.ExpectQuery("SELECT created_at FROM mfa_email_codes .+").WillReturnRows(sqlmock.NewRows([]string{"created_at"}))
+	mock.ExpectExec("INSERT INTO mfa_email_codes .+").WithArgs(utils.HashToken("challenge"), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT first_name FROM users .+").WillReturnRows(sqlmock.NewRows([]string{"first_name"}).AddRow("Test"))
+	mock.ExpectCommit()
+
+	err := service.SendEmailCode("challenge")
+	if err != nil {
+		t.Fatalf("Error executing SendEmailCode test: %s\n", err.Error())
+	}
+	if len(mailer.sent) != 1 || mailer.sent[0].To != "test@test.com" || !strings.Contains(mailer.sent[0].Text, "5 minutes") {
+		t.Fatalf("Error executing SendEmailCode test: unexpected messages %v\n", mailer.sent)
+	}
+}
+
+func Test_SendEmailCode_MagicLink(t *testing.T) {
+	service, mock := newTestService(t)
+	service.mailer = &mailerStub{}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM mfa_challenges .+").WillReturnRows(challengeRow("email"))
+	mock.ExpectRollback()
+
+	err := service.SendEmailCode("challenge")
+	if err == nil {
+		t.Fatal("Error executing SendEmailCode_MagicLink test: no error returned")
+	}
+}
+
+func Test_SendEmailCode_Locked(t *testing.T) {
+	service, mock := newTestService(t)
+	service.mailer = &mailerStub{}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM mfa_challenges .+").WillReturnRows(challengeRow("pwd"))
+	mock.ExpectQuery("SELECT (.+) FROM mfa_email WHERE .+").WillReturnRows(sqlmock.NewRows(emailColumns).AddRow("test@test.com", 0, time.Now().Add(time.Minute), time.Now()))
+	mock.ExpectRollback()
+
+	err := service.SendEmailCode("challenge")
+	if err == nil {
+		t.Fatal("Error executing SendEmailCode_Locked test: no error returned")
+	}
+}
+
+func Test_VerifyChallenge_Email(t *testing.T) {
+	service, mock := newTestService(t)
+	codeHash := hashEmailCode(utils.HashToken("challenge"), "123456")
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM mfa_challenges .+").WillReturnRows(challengeRow("pwd"))
+	mock.ExpectQuery("SELECT (.+) FROM mfa_email WHERE .+").WillReturnRows(sqlmock.NewRows(emailColumns).AddRow("test@test.com", 3, nil, time.Now()))
+	mock.ExpectQuery("SELECT code_hash FROM mfa_email_codes .+").WillReturnRows(sqlmock.NewRows([]string{"code_hash"}).AddRow(codeHash))
+	mock.ExpectExec("UPDATE mfa_email SET failed_attempts = 0.+").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM mfa_email_codes .+").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE mfa_challenges SET consumed_at .+").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	_, amr, err := service.VerifyChallenge("challenge", MethodEmail, "123456")
+	if err != nil {
+		t.Fatalf("Error executing VerifyChallenge_Email test: %s\n", err.Error())
+	}
+	if strings.Join(amr, ",") != "pwd,otp,email,mfa" {
+		t.Fatalf("Error executing VerifyChallenge_Email test: unexpected amr %v\n", amr)
+	}
+}
+
+func Test_VerifyChallenge_EmailWrongCode(t *testing.T) {
+	service, mock := newTestService(t)
+	codeHash := hashEmailCode(utils.HashToken("challenge"), "123456")
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM mfa_challenges .+").WillReturnRows(challengeRow("pwd"))
+	mock.ExpectQuery("SELECT (.+) FROM mfa_email WHERE .+").WillReturnRows(sqlmock.NewRows(emailColumns).AddRow("test@test.com", 3, nil, time.Now()))
+	mock.ExpectQuery("SELECT code_hash FROM mfa_email_codes .+").WillReturnRows(sqlmock.NewRows([]string{"code_hash"}).AddRow(codeHash))
+	mock.ExpectExec("UPDATE mfa_email SET failed_attempts = .+").WithArgs(4, sql.NullTime{}, "test@test.com").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE mfa_challenges SET attempts .+").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	_, _, err := service.VerifyChallenge("challenge", MethodEmail, "654321")
+	if err == nil {
+		t.Fatal("Error executing VerifyChallenge_EmailWrongCode test: no error returned")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("Error executing VerifyChallenge_EmailWrongCode test: %s\n", err.Error())
+	}
+}
+
+func Test_VerifyChallenge_EmailLockout(t *testing.T) {
+	service, mock := newTestService(t)
+	service.emailLockout = 15 * time.Minute
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM mfa_challenges .+").WillReturnRows(challengeRow("pwd"))
+	mock.ExpectQuery("SELECT (.+) FROM mfa_email WHERE .+").WillReturnRows(sqlmock.NewRows(emailColumns).AddRow("test@test.com", maxEmailCodeFailures-1, nil, time.Now()))
+	mock.ExpectQuery("SELECT code_hash FROM mfa_email_codes .+").WillReturnRows(sqlmock.NewRows([]string{"code_hash"}))
+	mock.ExpectExec("UPDATE mfa_email SET failed_attempts = .+").WithArgs(0, sqlmock.AnyArg(), "test@test.com").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE mfa_challenges SET attempts .+").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	_, _, err := service.VerifyChallenge("challenge", MethodEmail, "123456")
+	if err == nil {
+		t.Fatal("Error executing VerifyChallenge_EmailLockout test: no error returned")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("Error executing VerifyChallenge_EmailLockout test: %s\n", err.Error())
+	}
+}
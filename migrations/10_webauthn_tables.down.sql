@@ -0,0 +1,11 @@
+DELETE FROM webauthn_challenges;
+
+DROP TABLE webauthn_challenges;
+
+DELETE FROM webauthn_credentials;
+
+DROP TABLE webauthn_credentials;
+
+DELETE FROM webauthn_users;
+
+DROP TABLE webauthn_users;
@@ -0,0 +1,27 @@
+CREATE TABLE "webauthn_users" (
+    user_email VARCHAR(255) PRIMARY KEY NOT NULL REFERENCES users(email) ON UPDATE CASCADE ON DELETE CASCADE,
+    handle BYTEA UNIQUE NOT NULL
+);
+
+CREATE TABLE "webauthn_credentials" (
+    id BYTEA PRIMARY KEY NOT NULL,
+    user_email VARCHAR(255) NOT NULL REFERENCES users(email) ON UPDATE CASCADE ON DELETE CASCADE,
+    name VARCHAR(255) NOT NULL,
+    public_key BYTEA NOT NULL,
+    algorithm INTEGER NOT NULL,
+    sign_count BIGINT NOT NULL DEFAULT 0,
+    transports VARCHAR(255) NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    last_used_at TIMESTAMP
+);
+
+CREATE INDEX webauthn_credentials_user_email_idx ON webauthn_credentials (user_email);
+
+CREATE TABLE "webauthn_challenges" (
+    challenge_hash VARCHAR(64) PRIMARY KEY NOT NULL,
+    user_email VARCHAR(255) REFERENCES users(email) ON UPDATE CASCADE ON DELETE CASCADE,
+    ceremony VARCHAR(16) NOT NULL,
+    user_verification BOOLEAN NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    consumed_at TIMESTAMP
+);
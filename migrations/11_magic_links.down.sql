@@ -0,0 +1,5 @@
+ALTER TABLE mfa_challenges DROP COLUMN amr;
+
+DELETE FROM user_tokens WHERE binding_hash IS NOT NULL;
+
+ALTER TABLE user_tokens DROP COLUMN binding_hash;
@@ -0,0 +1,3 @@
+ALTER TABLE user_tokens ADD COLUMN binding_hash VARCHAR(64);
+
+ALTER TABLE mfa_challenges ADD COLUMN amr VARCHAR(255) NOT NULL DEFAULT 'pwd';
@@ -0,0 +1,7 @@
+DELETE FROM mfa_email_codes;
+
+DROP TABLE mfa_email_codes;
+
+DELETE FROM mfa_email;
+
+DROP TABLE mfa_email;
@@ -0,0 +1,13 @@
+CREATE TABLE "mfa_email" (
+    user_email VARCHAR(255) PRIMARY KEY NOT NULL REFERENCES users(email) ON UPDATE CASCADE ON DELETE CASCADE,
+    failed_attempts INTEGER NOT NULL DEFAULT 0,
+    locked_until TIMESTAMP,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE "mfa_email_codes" (
+    challenge_hash VARCHAR(64) PRIMARY KEY NOT NULL REFERENCES mfa_challenges(token_hash) ON DELETE CASCADE,
+    code_hash VARCHAR(64) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMP NOT NULL
+);
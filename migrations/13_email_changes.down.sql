@@ -0,0 +1,7 @@
+DELETE FROM email_changes;
+
+DROP TABLE email_changes;
+
+DELETE FROM user_tokens WHERE purpose = 'email_change';
+
+ALTER TABLE users DROP COLUMN id;
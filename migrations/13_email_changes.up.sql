@@ -0,0 +1,6 @@
+ALTER TABLE users ADD COLUMN id UUID NOT NULL UNIQUE DEFAULT gen_random_uuid();
+
+CREATE TABLE "email_changes" (
+    token_hash VARCHAR(64) PRIMARY KEY NOT NULL REFERENCES user_tokens(token_hash) ON DELETE CASCADE,
+    new_email VARCHAR(255) NOT NULL
+);
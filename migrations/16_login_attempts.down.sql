@@ -0,0 +1,3 @@
+DELETE FROM login_attempts;
+
+DROP TABLE login_attempts;
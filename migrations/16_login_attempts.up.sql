@@ -0,0 +1,8 @@
+CREATE TABLE "login_attempts" (
+    kind VARCHAR(16) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    failures INTEGER NOT NULL DEFAULT 0,
+    last_failure_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    blocked_until TIMESTAMP,
+    PRIMARY KEY (kind, subject)
+);
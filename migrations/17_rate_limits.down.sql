@@ -0,0 +1,3 @@
+DELETE FROM rate_limits;
+
+DROP TABLE rate_limits;
@@ -0,0 +1,3 @@
+DELETE FROM clients;
+
+DROP TABLE clients;
@@ -0,0 +1,12 @@
+CREATE TABLE "clients" (
+    id VARCHAR(64) PRIMARY KEY NOT NULL,
+    secret_hash VARCHAR(64) NOT NULL DEFAULT '',
+    name VARCHAR(255) NOT NULL,
+    type VARCHAR(16) NOT NULL,
+    redirect_uris TEXT NOT NULL DEFAULT '',
+    grant_types VARCHAR(255) NOT NULL DEFAULT '',
+    scopes TEXT NOT NULL DEFAULT '',
+    access_token_ttl INTEGER NOT NULL DEFAULT 0,
+    refresh_token_ttl INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
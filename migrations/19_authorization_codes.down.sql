@@ -0,0 +1,6 @@
+DELETE FROM authorization_codes;
+
+DROP TABLE authorization_codes;
+
+ALTER TABLE refresh_tokens DROP COLUMN scope;
+ALTER TABLE refresh_tokens DROP COLUMN client_id;
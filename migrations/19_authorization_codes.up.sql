@@ -0,0 +1,16 @@
+ALTER TABLE refresh_tokens ADD COLUMN client_id VARCHAR(64) REFERENCES clients(id) ON DELETE CASCADE;
+ALTER TABLE refresh_tokens ADD COLUMN scope TEXT NOT NULL DEFAULT '';
+
+CREATE TABLE "authorization_codes" (
+    code_hash VARCHAR(64) PRIMARY KEY NOT NULL,
+    client_id VARCHAR(64) NOT NULL REFERENCES clients(id) ON DELETE CASCADE,
+    user_email VARCHAR(255) NOT NULL REFERENCES users(email) ON UPDATE CASCADE ON DELETE CASCADE,
+    redirect_uri TEXT NOT NULL,
+    scope TEXT NOT NULL DEFAULT '',
+    code_challenge VARCHAR(128) NOT NULL,
+    amr VARCHAR(255) NOT NULL DEFAULT '',
+    family_id VARCHAR(64) NOT NULL DEFAULT '',
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMP NOT NULL,
+    consumed_at TIMESTAMP
+);
@@ -0,0 +1,3 @@
+DELETE FROM client_roles;
+
+DROP TABLE client_roles;
@@ -0,0 +1,5 @@
+CREATE TABLE "client_roles" (
+    client_id VARCHAR(64) NOT NULL REFERENCES clients(id) ON DELETE CASCADE,
+    role_name VARCHAR(255) NOT NULL REFERENCES roles(name) ON UPDATE CASCADE ON DELETE CASCADE,
+    PRIMARY KEY (client_id, role_name)
+);
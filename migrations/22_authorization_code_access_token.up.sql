@@ -0,0 +1,2 @@
+ALTER TABLE authorization_codes ADD COLUMN access_token_id VARCHAR(64) NOT NULL DEFAULT '';
+ALTER TABLE authorization_codes ADD COLUMN access_token_expires_at TIMESTAMP;
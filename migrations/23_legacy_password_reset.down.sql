@@ -0,0 +1 @@
+-- The passwords blanked by the up migration cannot be restored.
@@ -0,0 +1,3 @@
+-- Accounts made before the pepper stored a hash of SECRET_KEY rather than of
+-- their password, so those hashes must never verify again.
+UPDATE users SET password = '', password_reset_required = true WHERE pepper_version = 0;
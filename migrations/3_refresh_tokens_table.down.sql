@@ -0,0 +1,3 @@
+DELETE FROM refresh_tokens;
+
+DROP TABLE refresh_tokens;
\ No newline at end of file
@@ -0,0 +1,11 @@
+CREATE TABLE "refresh_tokens" (
+    token_hash VARCHAR(64) PRIMARY KEY NOT NULL,
+    family_id VARCHAR(64) NOT NULL,
+    user_email VARCHAR(255) NOT NULL REFERENCES users(email) ON UPDATE CASCADE ON DELETE CASCADE,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMP NOT NULL,
+    rotated_at TIMESTAMP,
+    revoked_at TIMESTAMP
+);
+
+CREATE INDEX refresh_tokens_family_id_idx ON refresh_tokens (family_id);
@@ -0,0 +1,3 @@
+DELETE FROM sessions;
+
+DROP TABLE sessions;
\ No newline at end of file
@@ -0,0 +1,8 @@
+CREATE TABLE "sessions" (
+    id_hash VARCHAR(64) PRIMARY KEY NOT NULL,
+    user_email VARCHAR(255) NOT NULL REFERENCES users(email) ON UPDATE CASCADE ON DELETE CASCADE,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX sessions_user_email_idx ON sessions (user_email);
@@ -0,0 +1,3 @@
+DELETE FROM user_roles;
+
+DROP TABLE user_roles;
\ No newline at end of file
@@ -0,0 +1,7 @@
+CREATE TABLE "user_roles" (
+    user_email VARCHAR(255) NOT NULL REFERENCES users(email) ON UPDATE CASCADE ON DELETE CASCADE,
+    role_name VARCHAR(255) NOT NULL REFERENCES roles(name) ON UPDATE CASCADE ON DELETE CASCADE,
+    PRIMARY KEY (user_email, role_name)
+);
+
+INSERT INTO roles (name, visible_name) VALUES ('ADMIN', 'Administrator') ON CONFLICT (name) DO NOTHING;
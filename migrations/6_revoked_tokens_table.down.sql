@@ -0,0 +1,7 @@
+DELETE FROM revoked_subjects;
+
+DROP TABLE revoked_subjects;
+
+DELETE FROM revoked_tokens;
+
+DROP TABLE revoked_tokens;
\ No newline at end of file
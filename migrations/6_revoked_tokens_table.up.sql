@@ -0,0 +1,10 @@
+CREATE TABLE "revoked_tokens" (
+    jti VARCHAR(255) PRIMARY KEY NOT NULL,
+    expires_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE "revoked_subjects" (
+    subject VARCHAR(255) PRIMARY KEY NOT NULL,
+    issued_before TIMESTAMP NOT NULL,
+    expires_at TIMESTAMP NOT NULL
+);
@@ -0,0 +1,3 @@
+DELETE FROM signing_keys;
+
+DROP TABLE signing_keys;
\ No newline at end of file
@@ -0,0 +1,8 @@
+CREATE TABLE "signing_keys" (
+    kid VARCHAR(64) PRIMARY KEY NOT NULL,
+    algorithm VARCHAR(16) NOT NULL,
+    private_key BYTEA NOT NULL,
+    public_key BYTEA NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    retired_at TIMESTAMP
+);
@@ -0,0 +1,3 @@
+DELETE FROM user_tokens;
+
+DROP TABLE user_tokens;
\ No newline at end of file
@@ -0,0 +1,10 @@
+CREATE TABLE "user_tokens" (
+    token_hash VARCHAR(64) PRIMARY KEY NOT NULL,
+    user_email VARCHAR(255) NOT NULL REFERENCES users(email) ON UPDATE CASCADE ON DELETE CASCADE,
+    purpose VARCHAR(32) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMP NOT NULL,
+    consumed_at TIMESTAMP
+);
+
+CREATE INDEX user_tokens_user_email_purpose_idx ON user_tokens (user_email, purpose);
@@ -0,0 +1,15 @@
+ALTER TABLE sessions DROP COLUMN amr;
+
+ALTER TABLE refresh_tokens DROP COLUMN amr;
+
+DELETE FROM mfa_challenges;
+
+DROP TABLE mfa_challenges;
+
+DELETE FROM mfa_recovery_codes;
+
+DROP TABLE mfa_recovery_codes;
+
+DELETE FROM mfa_totp;
+
+DROP TABLE mfa_totp;
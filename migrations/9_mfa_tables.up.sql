@@ -0,0 +1,28 @@
+CREATE TABLE "mfa_totp" (
+    user_email VARCHAR(255) PRIMARY KEY NOT NULL REFERENCES users(email) ON UPDATE CASCADE ON DELETE CASCADE,
+    secret BYTEA NOT NULL,
+    last_used_step BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    confirmed_at TIMESTAMP
+);
+
+CREATE TABLE "mfa_recovery_codes" (
+    code_hash VARCHAR(64) PRIMARY KEY NOT NULL,
+    user_email VARCHAR(255) NOT NULL REFERENCES users(email) ON UPDATE CASCADE ON DELETE CASCADE,
+    used_at TIMESTAMP
+);
+
+CREATE INDEX mfa_recovery_codes_user_email_idx ON mfa_recovery_codes (user_email);
+
+CREATE TABLE "mfa_challenges" (
+    token_hash VARCHAR(64) PRIMARY KEY NOT NULL,
+    user_email VARCHAR(255) NOT NULL REFERENCES users(email) ON UPDATE CASCADE ON DELETE CASCADE,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMP NOT NULL,
+    consumed_at TIMESTAMP
+);
+
+ALTER TABLE refresh_tokens ADD COLUMN amr VARCHAR(255) NOT NULL DEFAULT 'pwd';
+
+ALTER TABLE sessions ADD COLUMN amr VARCHAR(255) NOT NULL DEFAULT 'pwd';
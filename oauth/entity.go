@@ -0,0 +1,161 @@
+package oauth
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/Kavuti/goauth/tokens"
+)
+
+// Error codes of RFC 6749 sections 4.1.2.1 and 5.2, and of OpenID Connect
+// for login_required.
+const (
+	ErrInvalidRequest          = "invalid_request"
+	ErrInvalidClient           = "invalid_client"
+	ErrInvalidGrant            = "invalid_grant"
+	ErrInvalidScope            = "invalid_scope"
+	ErrUnauthorizedClient      = "unauthorized_client"
+	ErrUnsupportedGrantType    = "unsupported_grant_type"
+	ErrUnsupportedResponseType = "unsupported_response_type"
+	ErrLoginRequired           = "login_required"
+	ErrServerError             = "server_error"
+	ErrInvalidToken            = "invalid_token"
+	ErrInsufficientScope       = "insufficient_scope"
+	ErrTemporarilyUnavailable  = "temporarily_unavailable"
+)
+
+// Scopes of OpenID Connect: openid asks for an ID token, and the others for
+// the claims they stand for.
+const (
+	ScopeOpenID  = "openid"
+	ScopeProfile = "profile"
+	ScopeEmail   = "email"
+)
+
+// Error is an error reported to OAuth clients, either in the query of the
+// redirect URI or in the body of a token response.
+type Error struct {
+	Code        string
+	Description string
+	Status      int
+
+	// RetryAfter is set when the client is rate limited.
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	return e.Description
+}
+
+func oauthError(code string, description string) error {
+	status := http.StatusBadRequest
+	if code == ErrInvalidClient {
+		status = http.StatusUnauthorized
+	}
+	return &Error{Code: code, Description: description, Status: status}
+}
+
+// AuthorizationCode is the credential handed to a client through the user
+// agent, which it exchanges for tokens. RedirectURI is empty when the client
+// did not send one. FamilyID and the access token fields are set once the
+// code has been exchanged, to revoke the tokens issued if it is replayed.
+type AuthorizationCode struct {
+	CodeHash      string       `db:"code_hash"`
+	ClientID      string       `db:"client_id"`
+	UserEmail     string       `db:"user_email"`
+	RedirectURI   string       `db:"redirect_uri"`
+	Scope         string       `db:"scope"`
+	CodeChallenge string       `db:"code_challenge"`
+	AMR           string       `db:"amr"`
+	FamilyID      string       `db:"family_id"`
+	CreatedAt     time.Time    `db:"created_at"`
+	ExpiresAt     time.Time    `db:"expires_at"`
+	ConsumedAt    sql.NullTime `db:"consumed_at"`
+	Nonce         string       `db:"nonce"`
+
+	AccessTokenID        string       `db:"access_token_id"`
+	AccessTokenExpiresAt sql.NullTime `db:"access_token_expires_at"`
+}
+
+// AuthorizeRequest holds the query parameters of the authorization endpoint.
+type AuthorizeRequest struct {
+	ResponseType        string
+	ClientID            string
+	RedirectURI         string
+	Scope               string
+	State               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+	Nonce               string
+}
+
+// TokenRequest holds the form parameters of the token endpoint, along with
+// the client credentials from the Authorization header or the form.
+type TokenRequest struct {
+	GrantType    string
+	Code         string
+	RedirectURI  string
+	CodeVerifier string
+	RefreshToken string
+	Scope        string
+	ClientID     string
+	ClientSecret string
+
+	// Issuer is the identifier goauth signs ID tokens with.
+	Issuer string
+}
+
+type TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+	IDToken      string `json:"id_token,omitempty"`
+}
+
+// UserInfoResponse describes the user an access token was issued for.
+type UserInfoResponse struct {
+	Subject string `json:"sub"`
+	tokens.UserInfo
+}
+
+// ProviderMetadata is the OpenID Connect discovery document.
+type ProviderMetadata struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	UserInfoEndpoint                  string   `json:"userinfo_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	ResponseModesSupported            []string `json:"response_modes_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+}
+
+type errorResponse struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+func (resp *TokenResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func (resp *UserInfoResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func (resp *ProviderMetadata) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func (resp *errorResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
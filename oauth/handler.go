@@ -0,0 +1,332 @@
+package oauth
+
+import (
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Kavuti/goauth/auth"
+	"github.com/Kavuti/goauth/clients"
+	"github.com/Kavuti/goauth/keys"
+	"github.com/Kavuti/goauth/ratelimit"
+	"github.com/Kavuti/goauth/tokens"
+	"github.com/Kavuti/goauth/utils"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/jmoiron/sqlx"
+)
+
+type OAuthHandler interface {
+	Routes() chi.Router
+	UserInfoRoutes() chi.Router
+
+	Authorize(w http.ResponseWriter, r *http.Request)
+	Token(w http.ResponseWriter, r *http.Request)
+	Introspect(w http.ResponseWriter, r *http.Request)
+	Revoke(w http.ResponseWriter, r *http.Request)
+	UserInfo(w http.ResponseWriter, r *http.Request)
+	Discovery(w http.ResponseWriter, r *http.Request)
+}
+
+type oauthHandler struct {
+	chi.Router
+	service  OAuthService
+	keys     keys.KeyService
+	limits   ratelimit.Store
+	loginURL string
+	issuer   string
+}
+
+// Authorize serves the authorization endpoint (RFC 6749 section 4.1.1).
+// Users who are not signed in are sent to OAUTH_LOGIN_URL, if set, with the
+// URL to come back to once they are. Errors are redirected to the client,
+// unless the client or its redirect URI are invalid: redirecting then would
+// turn goauth into an open redirector.
+func (h *oauthHandler) Authorize(w http.ResponseWriter, r *http.Request) {
+	defer utils.RecoverIfError(w, r)
+	query := r.URL.Query()
+	request := AuthorizeRequest{
+		ResponseType:        query.Get("response_type"),
+		ClientID:            query.Get("client_id"),
+		RedirectURI:         query.Get("redirect_uri"),
+		Scope:               query.Get("scope"),
+		State:               query.Get("state"),
+		CodeChallenge:       query.Get("code_challenge"),
+		CodeChallengeMethod: query.Get("code_challenge_method"),
+		Nonce:               query.Get("nonce"),
+	}
+
+	client, redirectURI, err := h.service.ResolveClient(request.ClientID, request.RedirectURI)
+	if err != nil {
+		errorResponseFor(w, r, err)
+		return
+	}
+
+	// Access tokens issued to a client cannot be used to authorize others.
+	principal, ok := auth.FromContext(r.Context())
+	if !ok || principal.ClientID != "" {
+		if h.loginURL != "" {
+			redirect(w, r, h.loginURL, url.Values{"return_to": {r.URL.RequestURI()}}, "")
+			return
+		}
+		redirectError(w, r, redirectURI, request.State, oauthError(ErrLoginRequired, "The user is not signed in"))
+		return
+	}
+
+	code, err := h.service.Authorize(client, principal, &request)
+	if err != nil {
+		redirectError(w, r, redirectURI, request.State, err)
+		return
+	}
+	redirect(w, r, redirectURI, url.Values{"code": {code}}, request.State)
+}
+
+// Token serves the token endpoint (RFC 6749 section 3.2). Clients can
+// authenticate with HTTP Basic or with client_id and client_secret in the
+// form.
+func (h *oauthHandler) Token(w http.ResponseWriter, r *http.Request) {
+	defer utils.RecoverIfError(w, r)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+
+	request, err := tokenRequest(r)
+	if err != nil {
+		clientErrorResponse(w, r, err)
+		return
+	}
+	request.Issuer = h.issuer
+
+	response, err := h.service.Exchange(request)
+	if err != nil {
+		clientErrorResponse(w, r, err)
+		return
+	}
+	render.Render(w, r, response)
+}
+
+// Introspect serves the introspection endpoint (RFC 7662), telling resource
+// servers whether a token is active. The token_type_hint parameter is not
+// needed, as access tokens are told apart from refresh tokens by their
+// format.
+func (h *oauthHandler) Introspect(w http.ResponseWriter, r *http.Request) {
+	defer utils.RecoverIfError(w, r)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+
+	request, err := tokenRequest(r)
+	if err != nil {
+		clientErrorResponse(w, r, err)
+		return
+	}
+	response, err := h.service.Introspect(request, r.PostForm.Get("token"))
+	if err != nil {
+		clientErrorResponse(w, r, err)
+		return
+	}
+	render.Render(w, r, response)
+}
+
+// Revoke serves the revocation endpoint (RFC 7009). It succeeds whether or
+// not the token was known, so that clients cannot tell.
+func (h *oauthHandler) Revoke(w http.ResponseWriter, r *http.Request) {
+	defer utils.RecoverIfError(w, r)
+	request, err := tokenRequest(r)
+	if err != nil {
+		clientErrorResponse(w, r, err)
+		return
+	}
+	err = h.service.Revoke(request, r.PostForm.Get("token"))
+	if err != nil {
+		clientErrorResponse(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// tokenRequest reads the form of the endpoints authenticating clients.
+// Clients can send their credentials with HTTP Basic, form-encoded first
+// (RFC 6749 section 2.3.1), or as client_id and client_secret in the form.
+func tokenRequest(r *http.Request) (*TokenRequest, error) {
+	err := r.ParseForm()
+	if err != nil {
+		return nil, oauthError(ErrInvalidRequest, "Invalid form")
+	}
+	request := &TokenRequest{
+		GrantType:    r.PostForm.Get("grant_type"),
+		Code:         r.PostForm.Get("code"),
+		RedirectURI:  r.PostForm.Get("redirect_uri"),
+		CodeVerifier: r.PostForm.Get("code_verifier"),
+		RefreshToken: r.PostForm.Get("refresh_token"),
+		Scope:        r.PostForm.Get("scope"),
+		ClientID:     r.PostForm.Get("client_id"),
+		ClientSecret: r.PostForm.Get("client_secret"),
+	}
+	if username, password, ok := r.BasicAuth(); ok {
+		request.ClientID, err = url.QueryUnescape(username)
+		if err == nil {
+			request.ClientSecret, err = url.QueryUnescape(password)
+		}
+		if err != nil {
+			return nil, oauthError(ErrInvalidClient, "Invalid client credentials")
+		}
+	}
+	return request, nil
+}
+
+// clientErrorResponse renders an error of an endpoint authenticating
+// clients, challenging those which sent HTTP Basic credentials to try again.
+func clientErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	if _, _, basic := r.BasicAuth(); basic && utils.ErrorStatus(err) == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="goauth"`)
+	}
+	errorResponseFor(w, r, err)
+}
+
+// UserInfo serves the userinfo endpoint of OpenID Connect, which only
+// accepts access tokens issued to a client with the openid scope. Errors are
+// reported in the WWW-Authenticate header (RFC 6750 section 3).
+func (h *oauthHandler) UserInfo(w http.ResponseWriter, r *http.Request) {
+	defer utils.RecoverIfError(w, r)
+	principal, ok := auth.FromContext(r.Context())
+	if !ok || principal.ClientID == "" || principal.Email == "" {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		errorResponseFor(w, r, &Error{Code: ErrInvalidToken, Description: "An access token issued to a client is required", Status: http.StatusUnauthorized})
+		return
+	}
+	if !contains(principal.Scopes, ScopeOpenID) {
+		w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="openid"`)
+		errorResponseFor(w, r, &Error{Code: ErrInsufficientScope, Description: "The openid scope is required", Status: http.StatusForbidden})
+		return
+	}
+
+	response, err := h.service.UserInfo(principal.Email, principal.Scopes)
+	if err != nil {
+		errorResponseFor(w, r, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	render.Render(w, r, response)
+}
+
+// Discovery serves the OpenID Connect discovery document.
+func (h *oauthHandler) Discovery(w http.ResponseWriter, r *http.Request) {
+	defer utils.RecoverIfError(w, r)
+	key, err := h.keys.SigningKey()
+	utils.CheckError(err)
+
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	render.Render(w, r, &ProviderMetadata{
+		Issuer:                            h.issuer,
+		AuthorizationEndpoint:             h.issuer + "/oauth/authorize",
+		TokenEndpoint:                     h.issuer + "/oauth/token",
+		UserInfoEndpoint:                  h.issuer + "/userinfo",
+		JWKSURI:                           h.issuer + "/.well-known/jwks.json",
+		ScopesSupported:                   []string{ScopeOpenID, ScopeProfile, ScopeEmail, tokens.ScopeRoles},
+		ResponseTypesSupported:            []string{"code"},
+		ResponseModesSupported:            []string{"query"},
+		GrantTypesSupported:               []string{clients.GrantAuthorizationCode, clients.GrantRefreshToken, clients.GrantClientCredentials},
+		SubjectTypesSupported:             []string{"public"},
+		IDTokenSigningAlgValuesSupported:  []string{key.Algorithm},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+		ClaimsSupported:                   []string{"sub", "iss", "aud", "exp", "iat", "nonce", "amr", "email", "email_verified", "name", "given_name", "family_name"},
+		CodeChallengeMethodsSupported:     []string{MethodS256},
+	})
+}
+
+// errorResponseFor renders an error in the body of the response, as the
+// token endpoint does.
+func errorResponseFor(w http.ResponseWriter, r *http.Request, err error) {
+	oerr := asOAuthError(err)
+	if oerr.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(oerr.RetryAfter.Seconds()))))
+	}
+	render.Status(r, oerr.Status)
+	render.Render(w, r, &errorResponse{Error: oerr.Code, ErrorDescription: oerr.Description})
+}
+
+// redirectError reports an error to the client through the user agent.
+func redirectError(w http.ResponseWriter, r *http.Request, redirectURI string, state string, err error) {
+	oerr := asOAuthError(err)
+	redirect(w, r, redirectURI, url.Values{"error": {oerr.Code}, "error_description": {oerr.Description}}, state)
+}
+
+// redirect sends the user agent to the given URI, adding the parameters to
+// those it already has.
+func redirect(w http.ResponseWriter, r *http.Request, redirectURI string, params url.Values, state string) {
+	target, err := url.Parse(redirectURI)
+	utils.CheckError(err)
+	query := target.Query()
+	for name, values := range params {
+		query[name] = values
+	}
+	if state != "" {
+		query.Set("state", state)
+	}
+	target.RawQuery = query.Encode()
+	http.Redirect(w, r, target.String(), http.StatusFound)
+}
+
+// asOAuthError hides internal errors from clients behind server_error.
+func asOAuthError(err error) *Error {
+	if oerr, ok := err.(*Error); ok {
+		return oerr
+	}
+	log.Printf("Detected error: %s\n", err.Error())
+	return &Error{Code: ErrServerError, Description: "Internal server error", Status: http.StatusInternalServerError}
+}
+
+// Routes are limited by user on the authorization endpoint, and by address
+// on the others. Those also limit each client once it authenticated, which
+// the service does, as client IDs sent by anyone cannot be trusted.
+func (h *oauthHandler) Routes() chi.Router {
+	r := chi.NewRouter()
+
+	authorize := ratelimit.Middleware(h.limits, ratelimit.PolicyFromEnv("OAUTH_AUTHORIZE", 30, time.Minute, ratelimit.ByUser))
+	tokenByIP := ratelimit.Middleware(h.limits, ratelimit.PolicyFromEnv("OAUTH_TOKEN_IP", 120, time.Minute, ratelimit.ByIP))
+	introspectByIP := ratelimit.Middleware(h.limits, ratelimit.PolicyFromEnv("OAUTH_INTROSPECT_IP", 1200, time.Minute, ratelimit.ByIP))
+
+	r.With(authorize).Get("/authorize", h.Authorize)
+	r.With(tokenByIP).Post("/token", h.Token)
+	r.With(tokenByIP).Post("/revoke", h.Revoke)
+	r.With(introspectByIP).Post("/introspect", h.Introspect)
+
+	return r
+}
+
+// UserInfoRoutes serve the userinfo endpoint, which OpenID Connect clients
+// call with GET or POST.
+func (h *oauthHandler) UserInfoRoutes() chi.Router {
+	r := chi.NewRouter()
+	r.Use(ratelimit.Middleware(h.limits, ratelimit.PolicyFromEnv("USERINFO", 120, time.Minute, ratelimit.ByUser)))
+
+	r.Get("/", h.UserInfo)
+	r.Post("/", h.UserInfo)
+
+	return r
+}
+
+// NewOAuthHandler builds the OAuth and OpenID Connect endpoints. TOKEN_ISSUER,
+// the public URL of goauth, is mandatory: ID tokens and the discovery document
+// must not name an issuer taken from the Host header of a request.
+func NewOAuthHandler(r chi.Router, db *sqlx.DB, tokenService tokens.TokenService, keyService keys.KeyService, limits ratelimit.Store) OAuthHandler {
+	issuer := strings.TrimSuffix(os.Getenv("TOKEN_ISSUER"), "/")
+	if issuer == "" {
+		utils.CheckError(errors.New("TOKEN_ISSUER must be set to the public URL of goauth"))
+	}
+	handler := &oauthHandler{
+		Router:   r,
+		service:  NewOAuthService(db, tokenService, limits),
+		keys:     keyService,
+		limits:   limits,
+		loginURL: os.Getenv("OAUTH_LOGIN_URL"),
+		issuer:   issuer,
+	}
+
+	return handler
+}
@@ -0,0 +1,64 @@
+package oauth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Kavuti/goauth/auth"
+	"github.com/Kavuti/goauth/clients"
+	"github.com/Kavuti/goauth/ratelimit"
+	"github.com/Kavuti/goauth/tokens"
+	"github.com/go-chi/chi/v5"
+)
+
+func Test_Token_BasicThroughRouter(t *testing.T) {
+	service := &oauthServiceStub{}
+	r := chi.NewRouter()
+	r.Use(tokens.Middleware(&tokenServiceStub{}))
+	handler := &oauthHandler{Router: r, service: service, limits: ratelimit.NewMemoryStore()}
+	r.Mount("/oauth", handler.Routes())
+
+	request := httptest.NewRequest(http.MethodPost, "/oauth/token", strings.NewReader("grant_type="+clients.GrantClientCredentials))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.SetBasicAuth("client", "secret")
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, request)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("Error executing Token_BasicThroughRouter test: unexpected status %d, %s\n", recorder.Code, recorder.Body.String())
+	}
+	if service.exchanged == nil || service.exchanged.ClientID != "client" || service.exchanged.ClientSecret != "secret" {
+		t.Fatalf("Error executing Token_BasicThroughRouter test: unexpected request %+v\n", service.exchanged)
+	}
+}
+
+type oauthServiceStub struct {
+	exchanged *TokenRequest
+}
+
+func (s *oauthServiceStub) ResolveClient(clientID string, redirectURI string) (*clients.Client, string, error) {
+	return publicClient(), redirectURI, nil
+}
+
+func (s *oauthServiceStub) Authorize(client *clients.Client, principal *auth.Principal, req *AuthorizeRequest) (string, error) {
+	return "code", nil
+}
+
+func (s *oauthServiceStub) Exchange(req *TokenRequest) (*TokenResponse, error) {
+	s.exchanged = req
+	return &TokenResponse{AccessToken: req.ClientID, TokenType: "Bearer"}, nil
+}
+
+func (s *oauthServiceStub) UserInfo(email string, scopes []string) (*UserInfoResponse, error) {
+	return &UserInfoResponse{}, nil
+}
+
+func (s *oauthServiceStub) Introspect(req *TokenRequest, token string) (*tokens.Introspection, error) {
+	return &tokens.Introspection{}, nil
+}
+
+func (s *oauthServiceStub) Revoke(req *TokenRequest, token string) error {
+	return nil
+}
@@ -0,0 +1,44 @@
+package oauth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+)
+
+// MethodS256 is the only PKCE code challenge method accepted (RFC 7636
+// section 4.2): the plain method would hand the verifier to anyone who can
+// read the authorization request.
+const MethodS256 = "S256"
+
+// validPKCEValue tells whether a code verifier or challenge is made of 43 to
+// 128 unreserved characters (RFC 7636 section 4.1).
+func validPKCEValue(value string) bool {
+	if len(value) < 43 || len(value) > 128 {
+		return false
+	}
+	for _, c := range value {
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+		case c == '-', c == '.', c == '_', c == '~':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// S256Challenge derives the code challenge of a code verifier.
+func S256Challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// verifyPKCE checks a code verifier against the challenge the authorization
+// code was bound to.
+func verifyPKCE(verifier string, challenge string) bool {
+	if !validPKCEValue(verifier) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(S256Challenge(verifier)), []byte(challenge)) == 1
+}
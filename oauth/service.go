@@ -0,0 +1,476 @@
+package oauth
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Kavuti/goauth/auth"
+	"github.com/Kavuti/goauth/clients"
+	"github.com/Kavuti/goauth/ratelimit"
+	"github.com/Kavuti/goauth/tokens"
+	"github.com/Kavuti/goauth/users"
+	"github.com/Kavuti/goauth/utils"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/jmoiron/sqlx"
+)
+
+const defaultCodeTTL = time.Minute
+
+type OAuthService interface {
+	ResolveClient(clientID string, redirectURI string) (*clients.Client, string, error)
+	Authorize(client *clients.Client, principal *auth.Principal, req *AuthorizeRequest) (string, error)
+	Exchange(req *TokenRequest) (*TokenResponse, error)
+	UserInfo(email string, scopes []string) (*UserInfoResponse, error)
+	Introspect(req *TokenRequest, token string) (*tokens.Introspection, error)
+	Revoke(req *TokenRequest, token string) error
+}
+
+type oauthService struct {
+	db      *sqlx.DB
+	clients clients.ClientService
+	tokens  tokens.TokenService
+	codeTTL time.Duration
+
+	// limits holds the buckets of the authenticated clients. Requests are
+	// only limited by address until the client is known.
+	limits          ratelimit.Store
+	tokenLimit      ratelimit.Policy
+	introspectLimit ratelimit.Policy
+}
+
+// ResolveClient finds the client of an authorization request and the URI to
+// redirect the user agent to, which must exactly match one registered for
+// the client. It can only be omitted when the client registered a single
+// one. Until both are known errors cannot be redirected to the client.
+func (s *oauthService) ResolveClient(clientID string, redirectURI string) (*clients.Client, string, error) {
+	if clientID == "" {
+		return nil, "", oauthError(ErrInvalidRequest, "client_id is required")
+	}
+	client, err := s.clients.Get(clientID)
+	if utils.ErrorStatus(err) == http.StatusNotFound {
+		return nil, "", oauthError(ErrInvalidRequest, "Unknown client")
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if redirectURI == "" {
+		if len(client.RedirectURIs) != 1 {
+			return nil, "", oauthError(ErrInvalidRequest, "redirect_uri is required")
+		}
+		return client, client.RedirectURIs[0], nil
+	}
+	if !client.RedirectURIs.Contains(redirectURI) {
+		return nil, "", oauthError(ErrInvalidRequest, "redirect_uri is not registered for the client")
+	}
+	return client, redirectURI, nil
+}
+
+// Authorize issues an authorization code to a client the user signed in to.
+// Clients are registered by administrators, so the user is not asked for
+// consent. The code is bound to the PKCE challenge of the request and can be
+// exchanged only once, shortly after.
+func (s *oauthService) Authorize(client *clients.Client, principal *auth.Principal, req *AuthorizeRequest) (string, error) {
+	if req.ResponseType != "code" {
+		return "", oauthError(ErrUnsupportedResponseType, "Only the code response type is supported")
+	}
+	if !client.GrantTypes.Contains(clients.GrantAuthorizationCode) {
+		return "", oauthError(ErrUnauthorizedClient, "The client cannot use the authorization_code grant")
+	}
+	if req.CodeChallenge == "" {
+		return "", oauthError(ErrInvalidRequest, "code_challenge is required")
+	}
+	if req.CodeChallengeMethod != MethodS256 {
+		return "", oauthError(ErrInvalidRequest, "code_challenge_method must be S256")
+	}
+	if !validPKCEValue(req.CodeChallenge) {
+		return "", oauthError(ErrInvalidRequest, "Invalid code_challenge")
+	}
+	scopes, err := requestedScopes(client, req.Scope)
+	if err != nil {
+		return "", err
+	}
+
+	code, err := utils.RandomToken()
+	if err != nil {
+		return "", utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+
+	tx := s.db.MustBegin()
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT INTO authorization_codes (code_hash, client_id, user_email, redirect_uri, scope, code_challenge, amr, nonce, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`, utils.HashToken(code), client.ID, principal.Email, req.RedirectURI,
+		strings.Join(scopes, " "), req.CodeChallenge, strings.Join(principal.AMR, ","), req.Nonce, time.Now().Add(s.codeTTL))
+	if err != nil {
+		return "", utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return "", utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	return code, nil
+}
+
+// Exchange serves the token endpoint, authenticating the client before
+// handing its request to the grant.
+func (s *oauthService) Exchange(req *TokenRequest) (*TokenResponse, error) {
+	client, err := s.authenticateClient(req.ClientID, req.ClientSecret)
+	if err != nil {
+		return nil, err
+	}
+	err = s.throttleClient(s.tokenLimit, client)
+	if err != nil {
+		return nil, err
+	}
+
+	switch req.GrantType {
+	case clients.GrantAuthorizationCode:
+		if !client.GrantTypes.Contains(clients.GrantAuthorizationCode) {
+			return nil, oauthError(ErrUnauthorizedClient, "The client cannot use the authorization_code grant")
+		}
+		return s.exchangeCode(client, req)
+	case clients.GrantRefreshToken:
+		if !client.GrantTypes.Contains(clients.GrantRefreshToken) {
+			return nil, oauthError(ErrUnauthorizedClient, "The client cannot use the refresh_token grant")
+		}
+		return s.refresh(client, req)
+	case clients.GrantClientCredentials:
+		if !client.GrantTypes.Contains(clients.GrantClientCredentials) || client.Type != clients.TypeConfidential {
+			return nil, oauthError(ErrUnauthorizedClient, "The client cannot use the client_credentials grant")
+		}
+		return s.clientCredentials(client, req)
+	case "":
+		return nil, oauthError(ErrInvalidRequest, "grant_type is required")
+	default:
+		return nil, oauthError(ErrUnsupportedGrantType, "Unsupported grant type")
+	}
+}
+
+// exchangeCode redeems an authorization code. A code presented twice has
+// leaked, so the tokens issued for it the first time are revoked.
+func (s *oauthService) exchangeCode(client *clients.Client, req *TokenRequest) (*TokenResponse, error) {
+	if req.Code == "" {
+		return nil, oauthError(ErrInvalidRequest, "code is required")
+	}
+
+	tx := s.db.MustBegin()
+	defer tx.Rollback()
+
+	var code AuthorizationCode
+	err := tx.Get(&code, "SELECT * FROM authorization_codes WHERE code_hash=$1 FOR UPDATE", utils.HashToken(req.Code))
+	if err == sql.ErrNoRows {
+		return nil, oauthError(ErrInvalidGrant, "Invalid authorization code")
+	}
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	if code.ConsumedAt.Valid {
+		tx.Rollback()
+		log.Printf("Authorization code reuse detected for user %s: issued tokens revoked\n", code.UserEmail)
+		err = s.revokeIssued(code.FamilyID, code.AccessTokenID, code.AccessTokenExpiresAt.Time)
+		if err != nil {
+			return nil, err
+		}
+		return nil, oauthError(ErrInvalidGrant, "Invalid authorization code")
+	}
+	if code.ClientID != client.ID || time.Now().After(code.ExpiresAt) {
+		return nil, oauthError(ErrInvalidGrant, "Invalid authorization code")
+	}
+	if code.RedirectURI != req.RedirectURI {
+		return nil, oauthError(ErrInvalidGrant, "redirect_uri does not match the authorization request")
+	}
+	if !verifyPKCE(req.CodeVerifier, code.CodeChallenge) {
+		return nil, oauthError(ErrInvalidGrant, "Invalid code_verifier")
+	}
+
+	var verified bool
+	err = tx.Get(&verified, "SELECT verified FROM users WHERE email=$1", code.UserEmail)
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+
+	// The tokens are issued while the code is locked, and recorded in the
+	// same transaction that consumes it: a replay, even one racing with this
+	// exchange, then finds both the access token and the refresh token family
+	// to revoke.
+	scopes := strings.Fields(code.Scope)
+	amr := strings.Split(code.AMR, ",")
+	issued, err := s.tokens.IssueGrant(code.UserEmail, verified, amr, &tokens.Grant{
+		ClientID:        client.ID,
+		Scopes:          scopes,
+		AccessTokenTTL:  client.AccessTokenLifetime(0),
+		RefreshTokenTTL: client.RefreshTokenLifetime(0),
+		Refresh:         client.GrantTypes.Contains(clients.GrantRefreshToken),
+	})
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec("UPDATE authorization_codes SET consumed_at = NOW(), family_id = $1, access_token_id = $2, access_token_expires_at = $3 WHERE code_hash = $4",
+		issued.FamilyID, issued.TokenID, issued.ExpiresAt, code.CodeHash)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		// Tokens which are not tied to the code could outlive a replay.
+		revokeErr := s.revokeIssued(issued.FamilyID, issued.TokenID, issued.ExpiresAt)
+		if revokeErr != nil {
+			log.Printf("Error revoking the tokens of an unrecorded code exchange for user %s: %s\n", code.UserEmail, revokeErr.Error())
+		}
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+
+	response := tokenResponse(issued)
+	if contains(scopes, ScopeOpenID) {
+		response.IDToken, err = s.idToken(req.Issuer, client.ID, code.UserEmail, code.Nonce, amr, scopes)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return response, nil
+}
+
+// revokeIssued revokes the access token and the refresh token family issued
+// in exchange for an authorization code.
+func (s *oauthService) revokeIssued(familyID string, tokenID string, expiresAt time.Time) error {
+	err := s.tokens.RevokeFamily(familyID)
+	if err != nil {
+		return err
+	}
+	if tokenID == "" {
+		return nil
+	}
+	return s.tokens.RevokeAccessToken(tokenID, expiresAt)
+}
+
+func (s *oauthService) refresh(client *clients.Client, req *TokenRequest) (*TokenResponse, error) {
+	if req.RefreshToken == "" {
+		return nil, oauthError(ErrInvalidRequest, "refresh_token is required")
+	}
+	issued, err := s.tokens.Refresh(req.RefreshToken, client.ID)
+	if utils.ErrorStatus(err) == http.StatusUnauthorized {
+		return nil, oauthError(ErrInvalidGrant, "Invalid refresh token")
+	}
+	if err != nil {
+		return nil, err
+	}
+	response := tokenResponse(issued)
+	scopes := strings.Fields(issued.Scope)
+	if contains(scopes, ScopeOpenID) {
+		claims, err := s.tokens.ParseAccessToken(issued.AccessToken)
+		if err != nil {
+			return nil, err
+		}
+		response.IDToken, err = s.idToken(req.Issuer, client.ID, claims.Email, "", claims.AMR, scopes)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return response, nil
+}
+
+// clientCredentials issues an access token to a client calling goauth on
+// its own behalf, limited to the scopes it requested among its own.
+func (s *oauthService) clientCredentials(client *clients.Client, req *TokenRequest) (*TokenResponse, error) {
+	scopes, err := requestedScopes(client, req.Scope)
+	if err != nil {
+		return nil, err
+	}
+	issued, err := s.tokens.IssueClientToken(&tokens.Grant{
+		ClientID:       client.ID,
+		Scopes:         scopes,
+		AccessTokenTTL: client.AccessTokenLifetime(0),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tokenResponse(issued), nil
+}
+
+// Introspect describes a token to a resource server, which must
+// authenticate as a confidential client.
+func (s *oauthService) Introspect(req *TokenRequest, token string) (*tokens.Introspection, error) {
+	client, err := s.authenticateClient(req.ClientID, req.ClientSecret)
+	if err != nil {
+		return nil, err
+	}
+	if client.Type != clients.TypeConfidential {
+		return nil, oauthError(ErrInvalidClient, "Client authentication required")
+	}
+	err = s.throttleClient(s.introspectLimit, client)
+	if err != nil {
+		return nil, err
+	}
+	if token == "" {
+		return nil, oauthError(ErrInvalidRequest, "token is required")
+	}
+	return s.tokens.Introspect(token)
+}
+
+// Revoke revokes a token issued to the client asking for it.
+func (s *oauthService) Revoke(req *TokenRequest, token string) error {
+	client, err := s.authenticateClient(req.ClientID, req.ClientSecret)
+	if err != nil {
+		return err
+	}
+	err = s.throttleClient(s.tokenLimit, client)
+	if err != nil {
+		return err
+	}
+	if token == "" {
+		return oauthError(ErrInvalidRequest, "token is required")
+	}
+	return s.tokens.RevokeToken(token, client.ID)
+}
+
+// UserInfo returns the claims about a user a client was granted the scopes
+// of.
+func (s *oauthService) UserInfo(email string, scopes []string) (*UserInfoResponse, error) {
+	user, err := s.user(email)
+	if err != nil {
+		return nil, err
+	}
+	return &UserInfoResponse{Subject: user.ID, UserInfo: userInfo(user, scopes)}, nil
+}
+
+// idToken signs an ID token telling the client who the user is. Its subject
+// is the stable ID of the user, and nonce the value the client sent in the
+// authorization request, if any.
+func (s *oauthService) idToken(issuer string, clientID string, email string, nonce string, amr []string, scopes []string) (string, error) {
+	user, err := s.user(email)
+	if err != nil {
+		return "", err
+	}
+	return s.tokens.SignIDToken(&tokens.IDClaims{
+		Nonce:    nonce,
+		AMR:      amr,
+		UserInfo: userInfo(user, scopes),
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:   issuer,
+			Subject:  user.ID,
+			Audience: jwt.ClaimStrings{clientID},
+		},
+	})
+}
+
+func (s *oauthService) user(email string) (*users.User, error) {
+	tx := s.db.MustBegin()
+	defer tx.Rollback()
+
+	var user users.User
+	err := tx.Get(&user, "SELECT * FROM users WHERE email=$1", email)
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	return &user, nil
+}
+
+// userInfo picks the standard claims of the user matching the scopes.
+func userInfo(user *users.User, scopes []string) tokens.UserInfo {
+	info := tokens.UserInfo{}
+	if contains(scopes, ScopeEmail) {
+		verified := user.Verified
+		info.Email = user.Email
+		info.EmailVerified = &verified
+	}
+	if contains(scopes, ScopeProfile) {
+		info.GivenName = user.FirstName
+		info.FamilyName = user.LastName
+		info.Name = strings.TrimSpace(user.FirstName + " " + user.LastName)
+	}
+	return info
+}
+
+func contains(values []string, value string) bool {
+	for _, item := range values {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticateClient identifies the client calling the token endpoint.
+// Confidential clients authenticate with their secret, while public ones
+// only send their ID.
+func (s *oauthService) authenticateClient(clientID string, secret string) (*clients.Client, error) {
+	if clientID == "" {
+		return nil, oauthError(ErrInvalidClient, "Client authentication required")
+	}
+	if secret != "" {
+		client, err := s.clients.Authenticate(clientID, secret)
+		if utils.ErrorStatus(err) == http.StatusUnauthorized {
+			return nil, oauthError(ErrInvalidClient, "Invalid client credentials")
+		}
+		return client, err
+	}
+	client, err := s.clients.Get(clientID)
+	if err != nil && utils.ErrorStatus(err) != http.StatusNotFound {
+		return nil, err
+	}
+	if client == nil || client.Type != clients.TypePublic {
+		return nil, oauthError(ErrInvalidClient, "Invalid client credentials")
+	}
+	return client, nil
+}
+
+// throttleClient takes a request of an authenticated client from its bucket,
+// so that nobody can use up the allowance of a client by sending its ID. Like
+// the rate limits, it fails open when the store is unavailable.
+func (s *oauthService) throttleClient(policy ratelimit.Policy, client *clients.Client) error {
+	result, err := policy.Take(s.limits, "client:"+client.ID)
+	if err != nil {
+		log.Printf("Error applying rate limit %s: %s\n", policy.Name, err.Error())
+		return nil
+	}
+	if !result.Allowed {
+		return &Error{Code: ErrTemporarilyUnavailable, Description: "Too many requests, retry later", Status: http.StatusTooManyRequests, RetryAfter: result.RetryAfter}
+	}
+	return nil
+}
+
+// requestedScopes checks the space separated scopes of a request against
+// those of the client, which are all granted when none is requested.
+func requestedScopes(client *clients.Client, scope string) ([]string, error) {
+	scopes := strings.Fields(scope)
+	if len(scopes) == 0 {
+		return append([]string{}, client.Scopes...), nil
+	}
+	for _, requested := range scopes {
+		if !client.Scopes.Contains(requested) {
+			return nil, oauthError(ErrInvalidScope, "Scope "+requested+" is not allowed for the client")
+		}
+	}
+	return scopes, nil
+}
+
+func tokenResponse(issued *tokens.TokenResponse) *TokenResponse {
+	return &TokenResponse{
+		AccessToken:  issued.AccessToken,
+		TokenType:    issued.TokenType,
+		ExpiresIn:    issued.ExpiresIn,
+		RefreshToken: issued.RefreshToken,
+		Scope:        issued.Scope,
+	}
+}
+
+// NewOAuthService builds the OAuth service. Resource servers call the
+// introspection endpoint for many requests of their own, so its limit is
+// higher than the one of the token and revocation endpoints.
+func NewOAuthService(db *sqlx.DB, tokenService tokens.TokenService, limits ratelimit.Store) OAuthService {
+	return &oauthService{
+		db:              db,
+		clients:         clients.NewClientService(db),
+		tokens:          tokenService,
+		codeTTL:         utils.DurationFromEnv("OAUTH_CODE_TTL", defaultCodeTTL),
+		limits:          limits,
+		tokenLimit:      ratelimit.PolicyFromEnv("OAUTH_TOKEN", 60, time.Minute, nil),
+		introspectLimit: ratelimit.PolicyFromEnv("OAUTH_INTROSPECT", 600, time.Minute, nil),
+	}
+}
@@ -0,0 +1,487 @@
+package oauth
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/Kavuti/goauth/auth"
+	"github.com/Kavuti/goauth/clients"
+	"github.com/Kavuti/goauth/ratelimit"
+	"github.com/Kavuti/goauth/tokens"
+	"github.com/Kavuti/goauth/utils"
+	"github.com/jmoiron/sqlx"
+)
+
+const testVerifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+
+var clientColumns = []string{"id", "secret_hash", "name", "type", "redirect_uris", "grant_types", "scopes", "access_token_ttl", "refresh_token_ttl", "created_at"}
+
+var codeColumns = []string{"code_hash", "client_id", "user_email", "redirect_uri", "scope", "code_challenge", "amr", "family_id", "created_at", "expires_at", "consumed_at", "nonce", "access_token_id", "access_token_expires_at"}
+
+func publicClient() *clients.Client {
+	return &clients.Client{
+		ID:           "client",
+		Type:         clients.TypePublic,
+		RedirectURIs: clients.List{"https://app.test/callback"},
+		GrantTypes:   clients.List{clients.GrantAuthorizationCode, clients.GrantRefreshToken},
+		Scopes:       clients.List{"read", "write"},
+	}
+}
+
+func expectClient(mock sqlmock.Sqlmock) {
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM clients WHERE (.+)").WithArgs("client").WillReturnRows(sqlmock.NewRows(clientColumns).
+		AddRow("client", "", "Test", clients.TypePublic, "https://app.test/callback", "authorization_code,refresh_token", "read,write", 0, 0, time.Now()))
+	mock.ExpectCommit()
+}
+
+const testUserID = "1b4e28ba-2fa1-11d2-883f-0016d3cca427"
+
+func expectUser(mock sqlmock.Sqlmock) {
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE (.+)").WithArgs("test@test.com").WillReturnRows(sqlmock.NewRows([]string{"id", "first_name", "last_name", "email", "password", "verified"}).
+		AddRow(testUserID, "Test", "User", "test@test.com", "hash", true))
+	mock.ExpectCommit()
+}
+
+func newTestService(db *sqlx.DB, tokenService tokens.TokenService) *oauthService {
+	return &oauthService{db: db, clients: clients.NewClientService(db), tokens: tokenService, codeTTL: time.Minute}
+}
+
+func errorCode(err error) string {
+	oerr, ok := err.(*Error)
+	if !ok {
+		return ""
+	}
+	return oerr.Code
+}
+
+func Test_S256Challenge(t *testing.T) {
+	// Example of RFC 7636 appendix B.
+	if challenge := S256Challenge(testVerifier); challenge != "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM" {
+		t.Fatalf("Error executing S256Challenge test: unexpected challenge %s\n", challenge)
+	}
+	if verifyPKCE("short", S256Challenge("short")) {
+		t.Fatal("Error executing S256Challenge test: short verifier accepted")
+	}
+}
+
+func Test_ResolveClient(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	expectClient(mock)
+	expectClient(mock)
+
+	service := newTestService(sqlx.NewDb(db, "sqlmock"), &tokenServiceStub{})
+	_, redirectURI, err := service.ResolveClient("client", "")
+	if err != nil || redirectURI != "https://app.test/callback" {
+		t.Fatalf("Error executing ResolveClient test: unexpected redirect URI %s, %v\n", redirectURI, err)
+	}
+	_, _, err = service.ResolveClient("client", "https://app.test/callback/other")
+	if errorCode(err) != ErrInvalidRequest {
+		t.Fatalf("Error executing ResolveClient test: unregistered redirect URI accepted %v\n", err)
+	}
+}
+
+func Test_Authorize(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	challenge := S256Challenge(testVerifier)
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO authorization_codes").WithArgs(sqlmock.AnyArg(), "client", "test@test.com", "", "read", challenge, "pwd,mfa", "nonce", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	service := newTestService(sqlx.NewDb(db, "sqlmock"), &tokenServiceStub{})
+	principal := &auth.Principal{Email: "test@test.com", AMR: []string{"pwd", "mfa"}}
+	code, err := service.Authorize(publicClient(), principal, &AuthorizeRequest{ResponseType: "code", Scope: "read", CodeChallenge: challenge, CodeChallengeMethod: MethodS256, Nonce: "nonce"})
+	if err != nil || code == "" {
+		t.Fatalf("Error executing Authorize test: %v\n", err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("Error executing Authorize test: %s\n", err.Error())
+	}
+}
+
+func Test_Authorize_Invalid(t *testing.T) {
+	service := newTestService(nil, &tokenServiceStub{})
+	principal := &auth.Principal{Email: "test@test.com"}
+	challenge := S256Challenge(testVerifier)
+	cases := map[string]AuthorizeRequest{
+		ErrUnsupportedResponseType: {ResponseType: "token", CodeChallenge: challenge, CodeChallengeMethod: MethodS256},
+		ErrInvalidRequest:          {ResponseType: "code", CodeChallenge: testVerifier, CodeChallengeMethod: "plain"},
+		ErrInvalidScope:            {ResponseType: "code", Scope: "read admin", CodeChallenge: challenge, CodeChallengeMethod: MethodS256},
+	}
+	for expected, request := range cases {
+		_, err := service.Authorize(publicClient(), principal, &request)
+		if errorCode(err) != expected {
+			t.Fatalf("Error executing Authorize_Invalid test: expected %s, got %v\n", expected, err)
+		}
+	}
+}
+
+func Test_Exchange(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	expectClient(mock)
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM authorization_codes WHERE (.+) FOR UPDATE").WithArgs(utils.HashToken("code")).WillReturnRows(sqlmock.NewRows(codeColumns).
+		AddRow(utils.HashToken("code"), "client", "test@test.com", "https://app.test/callback", "read", S256Challenge(testVerifier), "pwd", "", time.Now(), time.Now().Add(time.Minute), nil, "", "", nil))
+	mock.ExpectQuery("SELECT verified FROM users WHERE (.+)").WillReturnRows(sqlmock.NewRows([]string{"verified"}).AddRow(true))
+	mock.ExpectExec("UPDATE authorization_codes SET consumed_at (.+) family_id (.+) access_token_id").WithArgs("family", "jti", sqlmock.AnyArg(), utils.HashToken("code")).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	tokenStub := &tokenServiceStub{}
+	service := newTestService(sqlx.NewDb(db, "sqlmock"), tokenStub)
+	response, err := service.Exchange(&TokenRequest{GrantType: clients.GrantAuthorizationCode, Code: "code", RedirectURI: "https://app.test/callback", CodeVerifier: testVerifier, ClientID: "client"})
+	if err != nil {
+		t.Fatalf("Error executing Exchange test: %s\n", err.Error())
+	}
+	if response.Scope != "read" || response.RefreshToken == "" {
+		t.Fatalf("Error executing Exchange test: unexpected response %+v\n", response)
+	}
+	if tokenStub.grant == nil || tokenStub.grant.ClientID != "client" || !tokenStub.grant.Refresh {
+		t.Fatalf("Error executing Exchange test: unexpected grant %+v\n", tokenStub.grant)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("Error executing Exchange test: %s\n", err.Error())
+	}
+}
+
+func Test_Exchange_OpenID(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	expectClient(mock)
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM authorization_codes WHERE (.+)").WillReturnRows(sqlmock.NewRows(codeColumns).
+		AddRow(utils.HashToken("code"), "client", "test@test.com", "", "openid email", S256Challenge(testVerifier), "pwd", "", time.Now(), time.Now().Add(time.Minute), nil, "nonce", "", nil))
+	mock.ExpectQuery("SELECT verified FROM users WHERE (.+)").WillReturnRows(sqlmock.NewRows([]string{"verified"}).AddRow(true))
+	mock.ExpectExec("UPDATE authorization_codes SET consumed_at").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	expectUser(mock)
+
+	tokenStub := &tokenServiceStub{}
+	service := newTestService(sqlx.NewDb(db, "sqlmock"), tokenStub)
+	response, err := service.Exchange(&TokenRequest{GrantType: clients.GrantAuthorizationCode, Code: "code", CodeVerifier: testVerifier, ClientID: "client", Issuer: "https://auth.test"})
+	if err != nil {
+		t.Fatalf("Error executing Exchange_OpenID test: %s\n", err.Error())
+	}
+	claims := tokenStub.idClaims
+	if response.IDToken == "" || claims == nil {
+		t.Fatal("Error executing Exchange_OpenID test: no ID token issued")
+	}
+	if claims.Subject != testUserID || claims.Nonce != "nonce" || claims.Issuer != "https://auth.test" || len(claims.Audience) != 1 || claims.Audience[0] != "client" {
+		t.Fatalf("Error executing Exchange_OpenID test: unexpected claims %+v\n", claims)
+	}
+	if claims.Email != "test@test.com" || claims.EmailVerified == nil || !*claims.EmailVerified || claims.GivenName != "" {
+		t.Fatalf("Error executing Exchange_OpenID test: unexpected user claims %+v\n", claims.UserInfo)
+	}
+}
+
+func Test_UserInfo(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	expectUser(mock)
+
+	service := newTestService(sqlx.NewDb(db, "sqlmock"), &tokenServiceStub{})
+	info, err := service.UserInfo("test@test.com", []string{ScopeOpenID, ScopeProfile})
+	if err != nil {
+		t.Fatalf("Error executing UserInfo test: %s\n", err.Error())
+	}
+	if info.Subject != testUserID || info.GivenName != "Test" || info.FamilyName != "User" || info.Name != "Test User" || info.Email != "" {
+		t.Fatalf("Error executing UserInfo test: unexpected claims %+v\n", info)
+	}
+}
+
+func Test_Exchange_WrongVerifier(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	expectClient(mock)
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM authorization_codes WHERE (.+)").WillReturnRows(sqlmock.NewRows(codeColumns).
+		AddRow(utils.HashToken("code"), "client", "test@test.com", "", "read", S256Challenge(testVerifier), "pwd", "", time.Now(), time.Now().Add(time.Minute), nil, "", "", nil))
+	mock.ExpectRollback()
+
+	service := newTestService(sqlx.NewDb(db, "sqlmock"), &tokenServiceStub{})
+	_, err = service.Exchange(&TokenRequest{GrantType: clients.GrantAuthorizationCode, Code: "code", CodeVerifier: S256Challenge(testVerifier), ClientID: "client"})
+	if errorCode(err) != ErrInvalidGrant {
+		t.Fatalf("Error executing Exchange_WrongVerifier test: unexpected error %v\n", err)
+	}
+}
+
+func Test_Exchange_Replay(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	expectClient(mock)
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM authorization_codes WHERE (.+)").WillReturnRows(sqlmock.NewRows(codeColumns).
+		AddRow(utils.HashToken("code"), "client", "test@test.com", "", "read", S256Challenge(testVerifier), "pwd", "family", time.Now(), time.Now().Add(time.Minute), time.Now(), "", "jti", time.Now().Add(time.Minute)))
+	mock.ExpectRollback()
+
+	tokenStub := &tokenServiceStub{}
+	service := newTestService(sqlx.NewDb(db, "sqlmock"), tokenStub)
+	_, err = service.Exchange(&TokenRequest{GrantType: clients.GrantAuthorizationCode, Code: "code", CodeVerifier: testVerifier, ClientID: "client"})
+	if errorCode(err) != ErrInvalidGrant {
+		t.Fatalf("Error executing Exchange_Replay test: unexpected error %v\n", err)
+	}
+	if len(tokenStub.revoked) != 2 || tokenStub.revoked[0] != "family" || tokenStub.revoked[1] != "jti" {
+		t.Fatalf("Error executing Exchange_Replay test: issued tokens not revoked, got %v\n", tokenStub.revoked)
+	}
+}
+
+func Test_Exchange_ConfidentialWithoutSecret(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM clients WHERE (.+)").WithArgs("client").WillReturnRows(sqlmock.NewRows(clientColumns).
+		AddRow("client", "hash", "Test", clients.TypeConfidential, "https://app.test/callback", "authorization_code", "read", 0, 0, time.Now()))
+	mock.ExpectCommit()
+
+	service := newTestService(sqlx.NewDb(db, "sqlmock"), &tokenServiceStub{})
+	_, err = service.Exchange(&TokenRequest{GrantType: clients.GrantAuthorizationCode, Code: "code", ClientID: "client"})
+	if errorCode(err) != ErrInvalidClient || err.(*Error).Status != http.StatusUnauthorized {
+		t.Fatalf("Error executing Exchange_ConfidentialWithoutSecret test: unexpected error %v\n", err)
+	}
+}
+
+func Test_Exchange_Refresh(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	expectClient(mock)
+
+	tokenStub := &tokenServiceStub{refreshErr: utils.ServiceError("Invalid refresh token", http.StatusUnauthorized)}
+	service := newTestService(sqlx.NewDb(db, "sqlmock"), tokenStub)
+	_, err = service.Exchange(&TokenRequest{GrantType: clients.GrantRefreshToken, RefreshToken: "token", ClientID: "client"})
+	if errorCode(err) != ErrInvalidGrant || tokenStub.refreshedFor != "client" {
+		t.Fatalf("Error executing Exchange_Refresh test: unexpected error %v\n", err)
+	}
+}
+
+func Test_Exchange_ClientCredentials(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM clients WHERE (.+)").WithArgs("client").WillReturnRows(sqlmock.NewRows(clientColumns).
+		AddRow("client", utils.HashToken("secret"), "Test", clients.TypeConfidential, "", "client_credentials", "read,write", 300, 0, time.Now()))
+	mock.ExpectCommit()
+
+	tokenStub := &tokenServiceStub{}
+	service := newTestService(sqlx.NewDb(db, "sqlmock"), tokenStub)
+	response, err := service.Exchange(&TokenRequest{GrantType: clients.GrantClientCredentials, Scope: "write", ClientID: "client", ClientSecret: "secret"})
+	if err != nil {
+		t.Fatalf("Error executing Exchange_ClientCredentials test: %s\n", err.Error())
+	}
+	if response.Scope != "write" || response.RefreshToken != "" {
+		t.Fatalf("Error executing Exchange_ClientCredentials test: unexpected response %+v\n", response)
+	}
+	if tokenStub.grant.AccessTokenTTL != 5*time.Minute {
+		t.Fatalf("Error executing Exchange_ClientCredentials test: unexpected grant %+v\n", tokenStub.grant)
+	}
+}
+
+func Test_Exchange_ClientLimit(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	for i := 0; i < 3; i++ {
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT (.+) FROM clients WHERE (.+)").WithArgs("client").WillReturnRows(sqlmock.NewRows(clientColumns).
+			AddRow("client", utils.HashToken("secret"), "Test", clients.TypeConfidential, "", "client_credentials", "read,write", 300, 0, time.Now()))
+		mock.ExpectCommit()
+	}
+
+	service := newTestService(sqlx.NewDb(db, "sqlmock"), &tokenServiceStub{})
+	service.limits = ratelimit.NewMemoryStore()
+	service.tokenLimit = ratelimit.Policy{Name: "test", Limit: ratelimit.Limit{Count: 1, Period: time.Minute}}
+	_, err = service.Exchange(&TokenRequest{GrantType: clients.GrantClientCredentials, ClientID: "client", ClientSecret: "wrong"})
+	if errorCode(err) != ErrInvalidClient {
+		t.Fatalf("Error executing Exchange_ClientLimit test: unexpected error %v\n", err)
+	}
+	_, err = service.Exchange(&TokenRequest{GrantType: clients.GrantClientCredentials, ClientID: "client", ClientSecret: "secret"})
+	if err != nil {
+		t.Fatalf("Error executing Exchange_ClientLimit test: client limited by a failed authentication: %s\n", err.Error())
+	}
+	_, err = service.Exchange(&TokenRequest{GrantType: clients.GrantClientCredentials, ClientID: "client", ClientSecret: "secret"})
+	if oerr, ok := err.(*Error); !ok || oerr.Code != ErrTemporarilyUnavailable || oerr.Status != http.StatusTooManyRequests || oerr.RetryAfter <= 0 {
+		t.Fatalf("Error executing Exchange_ClientLimit test: unexpected error %v\n", err)
+	}
+}
+
+func Test_Exchange_ClientCredentials_Public(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	expectClient(mock)
+
+	service := newTestService(sqlx.NewDb(db, "sqlmock"), &tokenServiceStub{})
+	_, err = service.Exchange(&TokenRequest{GrantType: clients.GrantClientCredentials, ClientID: "client"})
+	if errorCode(err) != ErrUnauthorizedClient {
+		t.Fatalf("Error executing Exchange_ClientCredentials_Public test: unexpected error %v\n", err)
+	}
+}
+
+func Test_Introspect_PublicClient(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	expectClient(mock)
+
+	service := newTestService(sqlx.NewDb(db, "sqlmock"), &tokenServiceStub{})
+	_, err = service.Introspect(&TokenRequest{ClientID: "client"}, "active")
+	if errorCode(err) != ErrInvalidClient {
+		t.Fatalf("Error executing Introspect_PublicClient test: unexpected error %v\n", err)
+	}
+}
+
+func Test_Introspect(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM clients WHERE (.+)").WithArgs("client").WillReturnRows(sqlmock.NewRows(clientColumns).
+		AddRow("client", utils.HashToken("secret"), "Test", clients.TypeConfidential, "", "client_credentials", "", 0, 0, time.Now()))
+	mock.ExpectCommit()
+
+	service := newTestService(sqlx.NewDb(db, "sqlmock"), &tokenServiceStub{})
+	info, err := service.Introspect(&TokenRequest{ClientID: "client", ClientSecret: "secret"}, "active")
+	if err != nil || !info.Active {
+		t.Fatalf("Error executing Introspect test: unexpected result %+v, %v\n", info, err)
+	}
+}
+
+func Test_Revoke(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	expectClient(mock)
+
+	tokenStub := &tokenServiceStub{}
+	service := newTestService(sqlx.NewDb(db, "sqlmock"), tokenStub)
+	err = service.Revoke(&TokenRequest{ClientID: "client"}, "token")
+	if err != nil || len(tokenStub.revoked) != 1 || tokenStub.revoked[0] != "client:token" {
+		t.Fatalf("Error executing Revoke test: unexpected result %v, %v\n", tokenStub.revoked, err)
+	}
+}
+
+type tokenServiceStub struct {
+	grant        *tokens.Grant
+	idClaims     *tokens.IDClaims
+	revoked      []string
+	refreshedFor string
+	refreshErr   error
+}
+
+func (s *tokenServiceStub) IssueTokens(email string, verified bool, amr []string) (*tokens.TokenResponse, error) {
+	return s.IssueGrant(email, verified, amr, nil)
+}
+
+func (s *tokenServiceStub) IssueGrant(email string, verified bool, amr []string, grant *tokens.Grant) (*tokens.TokenResponse, error) {
+	s.grant = grant
+	response := &tokens.TokenResponse{AccessToken: email, RefreshToken: email, TokenType: "Bearer", FamilyID: "family", TokenID: "jti", ExpiresAt: time.Now().Add(time.Minute)}
+	if grant != nil {
+		response.Scope = strings.Join(grant.Scopes, " ")
+	}
+	return response, nil
+}
+
+func (s *tokenServiceStub) IssueClientToken(grant *tokens.Grant) (*tokens.TokenResponse, error) {
+	s.grant = grant
+	return &tokens.TokenResponse{AccessToken: grant.ClientID, TokenType: "Bearer", Scope: strings.Join(grant.Scopes, " ")}, nil
+}
+
+func (s *tokenServiceStub) SignIDToken(claims *tokens.IDClaims) (string, error) {
+	s.idClaims = claims
+	return "id_token", nil
+}
+
+func (s *tokenServiceStub) ParseAccessToken(token string) (*tokens.Claims, error) {
+	return &tokens.Claims{Email: token}, nil
+}
+
+func (s *tokenServiceStub) Refresh(refreshToken string, clientID string) (*tokens.TokenResponse, error) {
+	s.refreshedFor = clientID
+	if s.refreshErr != nil {
+		return nil, s.refreshErr
+	}
+	return &tokens.TokenResponse{AccessToken: refreshToken, RefreshToken: refreshToken, TokenType: "Bearer"}, nil
+}
+
+func (s *tokenServiceStub) Introspect(token string) (*tokens.Introspection, error) {
+	return &tokens.Introspection{Active: token == "active"}, nil
+}
+
+func (s *tokenServiceStub) RevokeAccessToken(jti string, expiresAt time.Time) error {
+	s.revoked = append(s.revoked, jti)
+	return nil
+}
+
+func (s *tokenServiceStub) RevokeFamily(familyID string) error {
+	s.revoked = append(s.revoked, familyID)
+	return nil
+}
+
+func (s *tokenServiceStub) RevokeAllForUser(email string) error {
+	return nil
+}
+
+func (s *tokenServiceStub) RevokeToken(token string, clientID string) error {
+	s.revoked = append(s.revoked, clientID+":"+token)
+	return nil
+}
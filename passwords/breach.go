@@ -0,0 +1,164 @@
+package passwords
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	hashLength   = 40
+	prefixLength = 5
+	// maxLineLength bounds the lines of a corpus: a hash, a colon and a count.
+	maxLineLength = 128
+)
+
+// BreachCorpus tells how many times a password appears in known data breaches,
+// reading a local copy of the Have I Been Pwned password hashes.
+type BreachCorpus interface {
+	Count(password string) (int, error)
+}
+
+// NewBreachCorpus opens the corpus at the given path, which is either a file
+// of "HASH:COUNT" lines sorted by SHA-1 hash, as produced by the Pwned
+// Passwords downloader, or a directory of range files named after the first
+// five characters of the hashes and holding "SUFFIX:COUNT" lines, as returned
+// by the range API. Neither is loaded in memory.
+func NewBreachCorpus(path string) (BreachCorpus, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return &rangeDirectory{dir: path}, nil
+	}
+	return &sortedFile{path: path, size: info.Size()}, nil
+}
+
+func sha1Hex(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// parseEntry splits a corpus line into its hash, or hash suffix, and count.
+func parseEntry(line []byte) (string, int, bool) {
+	line = bytes.TrimRight(line, "\r")
+	separator := bytes.IndexByte(line, ':')
+	if separator < 0 {
+		return "", 0, false
+	}
+	count, err := strconv.Atoi(string(line[separator+1:]))
+	if err != nil {
+		return "", 0, false
+	}
+	return strings.ToUpper(string(line[:separator])), count, true
+}
+
+type rangeDirectory struct {
+	dir string
+}
+
+func (c *rangeDirectory) Count(password string) (int, error) {
+	hash := sha1Hex(password)
+	prefix, suffix := hash[:prefixLength], hash[prefixLength:]
+
+	file, err := os.Open(filepath.Join(c.dir, prefix))
+	if errors.Is(err, os.ErrNotExist) {
+		file, err = os.Open(filepath.Join(c.dir, prefix+".txt"))
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		entry, count, ok := parseEntry(scanner.Bytes())
+		if ok && entry == suffix {
+			return count, nil
+		}
+	}
+	return 0, scanner.Err()
+}
+
+type sortedFile struct {
+	path string
+	size int64
+}
+
+// Count binary searches the file on disk, so that only a few blocks are read
+// whatever the size of the corpus.
+func (c *sortedFile) Count(password string) (int, error) {
+	hash := sha1Hex(password)
+	file, err := os.Open(c.path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	low, high := int64(0), c.size
+	for low < high {
+		middle := low + (high-low)/2
+		start, line, err := lineAfter(file, middle)
+		if err != nil {
+			return 0, err
+		}
+		if line == nil || start >= high {
+			high = middle
+			continue
+		}
+		entry, count, ok := parseEntry(line)
+		if !ok || len(entry) != hashLength {
+			return 0, errors.New("malformed breached passwords file")
+		}
+		switch strings.Compare(entry, hash) {
+		case 0:
+			return count, nil
+		case -1:
+			low = start + int64(len(line)) + 1
+		default:
+			high = middle
+		}
+	}
+	return 0, nil
+}
+
+// lineAfter returns the first line starting at or after the given offset, with
+// its position, or a nil line when there is none.
+func lineAfter(file io.ReaderAt, offset int64) (int64, []byte, error) {
+	start := offset
+	if offset > 0 {
+		start = offset - 1
+	}
+	buffer := make([]byte, 2*maxLineLength)
+	n, err := file.ReadAt(buffer, start)
+	if err != nil && err != io.EOF {
+		return 0, nil, err
+	}
+	buffer = buffer[:n]
+	if offset > 0 {
+		newline := bytes.IndexByte(buffer, '\n')
+		if newline < 0 {
+			return 0, nil, nil
+		}
+		start += int64(newline) + 1
+		buffer = buffer[newline+1:]
+	}
+	if len(buffer) == 0 {
+		return 0, nil, nil
+	}
+	if end := bytes.IndexByte(buffer, '\n'); end >= 0 {
+		buffer = buffer[:end]
+	}
+	return start, buffer, nil
+}
@@ -0,0 +1,87 @@
+package passwords
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+var breached = map[string]int{"password": 9545824, "123456": 37359195, "letmein": 630, "hunter2": 17}
+
+func writeSortedCorpus(t *testing.T) string {
+	lines := []string{}
+	for password, count := range breached {
+		lines = append(lines, fmt.Sprintf("%s:%d", sha1Hex(password), count))
+	}
+	// Filler hashes around the breached ones exercise the binary search.
+	for i := 0; i < 500; i++ {
+		lines = append(lines, fmt.Sprintf("%s:%d", sha1Hex(fmt.Sprintf("filler-%d", i)), i+1))
+	}
+	sort.Strings(lines)
+	path := filepath.Join(t.TempDir(), "pwned-passwords.txt")
+	err := os.WriteFile(path, []byte(strings.Join(lines, "\r\n")+"\r\n"), 0600)
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	return path
+}
+
+func Test_SortedFile_Count(t *testing.T) {
+	corpus, err := NewBreachCorpus(writeSortedCorpus(t))
+	if err != nil {
+		t.Fatalf("Error executing SortedFile_Count test: %s\n", err.Error())
+	}
+	for password, expected := range breached {
+		count, err := corpus.Count(password)
+		if err != nil || count != expected {
+			t.Fatalf("Error executing SortedFile_Count test: got %d for %s, expected %d (%v)\n", count, password, expected, err)
+		}
+	}
+	for _, password := range []string{"correct horse battery staple", "filler-500", ""} {
+		count, err := corpus.Count(password)
+		if err != nil || count != 0 {
+			t.Fatalf("Error executing SortedFile_Count test: got %d for %s (%v)\n", count, password, err)
+		}
+	}
+}
+
+func Test_RangeDirectory_Count(t *testing.T) {
+	dir := t.TempDir()
+	for password, count := range breached {
+		hash := sha1Hex(password)
+		err := os.WriteFile(filepath.Join(dir, hash[:prefixLength]+".txt"), []byte(fmt.Sprintf("%s:%d\n", hash[prefixLength:], count)), 0600)
+		if err != nil {
+			t.Fatalf("Error: %s\n", err.Error())
+		}
+	}
+
+	corpus, err := NewBreachCorpus(dir)
+	if err != nil {
+		t.Fatalf("Error executing RangeDirectory_Count test: %s\n", err.Error())
+	}
+	count, err := corpus.Count("hunter2")
+	if err != nil || count != 17 {
+		t.Fatalf("Error executing RangeDirectory_Count test: got %d (%v)\n", count, err)
+	}
+	count, err = corpus.Count("correct horse battery staple")
+	if err != nil || count != 0 {
+		t.Fatalf("Error executing RangeDirectory_Count test: got %d for a missing range (%v)\n", count, err)
+	}
+}
+
+func Test_Check_Breached(t *testing.T) {
+	corpus, err := NewBreachCorpus(writeSortedCorpus(t))
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	policy := &Policy{Breaches: corpus}
+	if !rejectedCodes(policy.Check("password", "hunter2"))[CodeBreached] {
+		t.Fatal("Error executing Check_Breached test: breached password accepted")
+	}
+	if policy.Check("password", "correct horse battery staple") != nil {
+		t.Fatal("Error executing Check_Breached test: safe password rejected")
+	}
+}
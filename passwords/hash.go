@@ -0,0 +1,308 @@
+package passwords
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Kavuti/goauth/utils"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Algorithms new hashes can be produced with. Hashes made with scrypt and
+// PBKDF2, typically imported from other systems, can only be verified.
+const (
+	AlgorithmArgon2id = "argon2id"
+	AlgorithmBcrypt   = "bcrypt"
+)
+
+const (
+	defaultArgon2Memory      = 64 * 1024
+	defaultArgon2Iterations  = 3
+	defaultArgon2Parallelism = 2
+	argon2SaltLength         = 16
+	argon2KeyLength          = 32
+)
+
+var errMalformedHash = errors.New("malformed password hash")
+
+// Argon2Params are the cost parameters of Argon2id, memory being in KiB.
+type Argon2Params struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+}
+
+// Hasher hashes passwords with the preferred algorithm and verifies hashes of
+// any supported one. Hashes are stored as PHC strings, such as
+// "$argon2id$v=19$m=65536,t=3,p=2$salt$hash", which describe the algorithm
+// and parameters they were made with; bcrypt keeps its own "$2a$" format.
+// Passwords are peppered with the current version of the pepper, which is
+// returned along with the hash and has to be stored next to it. The zero
+// Hasher uses Argon2id with the default parameters and no pepper.
+type Hasher struct {
+	Algorithm  string
+	Argon2     Argon2Params
+	BcryptCost int
+	Pepper     Pepper
+}
+
+// Hash returns the encoded hash of a password and the version of the pepper
+// mixed into it.
+func (h *Hasher) Hash(password string) (string, int, error) {
+	version := h.Pepper.Current
+	password, err := h.Pepper.apply(password, version)
+	if err != nil {
+		return "", 0, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+
+	var encoded string
+	switch h.algorithm() {
+	case AlgorithmBcrypt:
+		var hashed []byte
+		hashed, err = bcrypt.GenerateFromPassword([]byte(password), h.bcryptCost())
+		encoded = string(hashed)
+	default:
+		encoded, err = hashArgon2id(password, h.argon2())
+	}
+	if err != nil {
+		return "", 0, utils.ServiceError("Error generating a secure password", http.StatusInternalServerError)
+	}
+	return encoded, version, nil
+}
+
+// Verify tells whether the password matches the encoded hash, made with the
+// given pepper version, and if so whether the hash should be replaced because
+// it was not made with the preferred algorithm, parameters and pepper.
+func (h *Hasher) Verify(password string, encoded string, pepperVersion int) (bool, bool, error) {
+	password, err := h.Pepper.apply(password, pepperVersion)
+	if err != nil {
+		return false, false, err
+	}
+	match, rehash, err := h.verify(password, encoded)
+	return match, match && (rehash || pepperVersion != h.Pepper.Current), err
+}
+
+func (h *Hasher) verify(password string, encoded string) (bool, bool, error) {
+	switch {
+	case strings.HasPrefix(encoded, "$2a$"), strings.HasPrefix(encoded, "$2b$"), strings.HasPrefix(encoded, "$2y$"):
+		err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, false, nil
+		}
+		if err != nil {
+			return false, false, err
+		}
+		cost, err := bcrypt.Cost([]byte(encoded))
+		return true, h.algorithm() != AlgorithmBcrypt || cost != h.bcryptCost(), err
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		match, params, err := verifyArgon2id(password, encoded)
+		return match, match && (h.algorithm() != AlgorithmArgon2id || params != h.argon2()), err
+	case strings.HasPrefix(encoded, "$scrypt$"):
+		match, err := verifyScrypt(password, encoded)
+		return match, match, err
+	case strings.HasPrefix(encoded, "$pbkdf2-"):
+		match, err := verifyPBKDF2(password, encoded)
+		return match, match, err
+	}
+	return false, false, errMalformedHash
+}
+
+func (h *Hasher) algorithm() string {
+	if h.Algorithm == "" {
+		return AlgorithmArgon2id
+	}
+	return h.Algorithm
+}
+
+func (h *Hasher) argon2() Argon2Params {
+	params := h.Argon2
+	if params.Memory == 0 {
+		params.Memory = defaultArgon2Memory
+	}
+	if params.Iterations == 0 {
+		params.Iterations = defaultArgon2Iterations
+	}
+	if params.Parallelism == 0 {
+		params.Parallelism = defaultArgon2Parallelism
+	}
+	return params
+}
+
+func (h *Hasher) bcryptCost() int {
+	if h.BcryptCost == 0 {
+		return bcrypt.DefaultCost
+	}
+	return h.BcryptCost
+}
+
+func hashArgon2id(password string, params Argon2Params) (string, error) {
+	salt := make([]byte, argon2SaltLength)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, argon2KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, params.Memory, params.Iterations, params.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func verifyArgon2id(password string, encoded string) (bool, Argon2Params, error) {
+	var params Argon2Params
+	fields := strings.Split(encoded, "$")
+	if len(fields) != 6 || fields[2] != fmt.Sprintf("v=%d", argon2.Version) {
+		return false, params, errMalformedHash
+	}
+	values, err := phcParams(fields[3])
+	if err != nil {
+		return false, params, err
+	}
+	params = Argon2Params{Memory: uint32(values["m"]), Iterations: uint32(values["t"]), Parallelism: uint8(values["p"])}
+	if params.Memory == 0 || params.Iterations == 0 || params.Parallelism == 0 {
+		return false, params, errMalformedHash
+	}
+	salt, key, err := phcSaltAndKey(fields[4], fields[5])
+	if err != nil {
+		return false, params, err
+	}
+	computed := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, uint32(len(key)))
+	return subtle.ConstantTimeCompare(computed, key) == 1, params, nil
+}
+
+// verifyScrypt checks "$scrypt$ln=15,r=8,p=1$salt$hash" strings.
+func verifyScrypt(password string, encoded string) (bool, error) {
+	fields := strings.Split(encoded, "$")
+	if len(fields) != 5 {
+		return false, errMalformedHash
+	}
+	values, err := phcParams(fields[2])
+	if err != nil {
+		return false, err
+	}
+	if values["ln"] <= 0 || values["ln"] >= 32 {
+		return false, errMalformedHash
+	}
+	salt, key, err := phcSaltAndKey(fields[3], fields[4])
+	if err != nil {
+		return false, err
+	}
+	computed, err := scrypt.Key([]byte(password), salt, 1<<values["ln"], values["r"], values["p"], len(key))
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(computed, key) == 1, nil
+}
+
+// verifyPBKDF2 checks "$pbkdf2-sha256$i=600000$salt$hash" strings, as well as
+// the "$pbkdf2-sha256$600000$salt$hash" variant written by passlib.
+func verifyPBKDF2(password string, encoded string) (bool, error) {
+	fields := strings.Split(encoded, "$")
+	if len(fields) != 5 {
+		return false, errMalformedHash
+	}
+	var digest func() hash.Hash
+	switch strings.TrimPrefix(fields[1], "pbkdf2-") {
+	case "sha1":
+		digest = sha1.New
+	case "sha256":
+		digest = sha256.New
+	case "sha512":
+		digest = sha512.New
+	default:
+		return false, errMalformedHash
+	}
+	iterations, err := strconv.Atoi(fields[2])
+	if err != nil {
+		values, err := phcParams(fields[2])
+		if err != nil {
+			return false, err
+		}
+		iterations = values["i"]
+	}
+	if iterations <= 0 {
+		return false, errMalformedHash
+	}
+	salt, key, err := phcSaltAndKey(fields[3], fields[4])
+	if err != nil {
+		return false, err
+	}
+	computed := pbkdf2.Key([]byte(password), salt, iterations, len(key), digest)
+	return subtle.ConstantTimeCompare(computed, key) == 1, nil
+}
+
+// phcParams parses the comma separated "name=value" parameters of a PHC string.
+func phcParams(field string) (map[string]int, error) {
+	values := map[string]int{}
+	for _, param := range strings.Split(field, ",") {
+		name, value, ok := strings.Cut(param, "=")
+		if !ok {
+			return nil, errMalformedHash
+		}
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, errMalformedHash
+		}
+		values[name] = parsed
+	}
+	return values, nil
+}
+
+func phcSaltAndKey(salt string, key string) ([]byte, []byte, error) {
+	decodedSalt, err := phcDecode(salt)
+	if err != nil {
+		return nil, nil, err
+	}
+	decodedKey, err := phcDecode(key)
+	if err != nil || len(decodedKey) == 0 {
+		return nil, nil, errMalformedHash
+	}
+	return decodedSalt, decodedKey, nil
+}
+
+// phcDecode decodes the unpadded base64 of PHC strings, accepting the "."
+// passlib uses in place of "+".
+func phcDecode(value string) ([]byte, error) {
+	value = strings.TrimRight(strings.ReplaceAll(value, ".", "+"), "=")
+	decoded, err := base64.RawStdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, errMalformedHash
+	}
+	return decoded, nil
+}
+
+// HasherFromEnv configures the preferred hashing from PASSWORD_HASH_ALGORITHM,
+// argon2id or bcrypt, ARGON2_MEMORY (KiB), ARGON2_ITERATIONS,
+// ARGON2_PARALLELISM and BCRYPT_COST, and the pepper as described by
+// PepperFromEnv. Raising the costs or rotating the pepper makes stored hashes
+// be replaced at the next login of their users.
+func HasherFromEnv() *Hasher {
+	hasher := &Hasher{
+		Algorithm: os.Getenv("PASSWORD_HASH_ALGORITHM"),
+		Argon2: Argon2Params{
+			Memory:      uint32(utils.IntFromEnv("ARGON2_MEMORY", defaultArgon2Memory)),
+			Iterations:  uint32(utils.IntFromEnv("ARGON2_ITERATIONS", defaultArgon2Iterations)),
+			Parallelism: uint8(utils.IntFromEnv("ARGON2_PARALLELISM", defaultArgon2Parallelism)),
+		},
+		BcryptCost: utils.IntFromEnv("BCRYPT_COST", bcrypt.DefaultCost),
+		Pepper:     *PepperFromEnv(),
+	}
+	switch hasher.Algorithm {
+	case "", AlgorithmArgon2id, AlgorithmBcrypt:
+	default:
+		utils.CheckError(fmt.Errorf("unknown password hash algorithm %q", hasher.Algorithm))
+	}
+	return hasher
+}
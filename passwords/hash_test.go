@@ -0,0 +1,114 @@
+package passwords
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var fastArgon2 = Argon2Params{Memory: 1024, Iterations: 1, Parallelism: 1}
+
+func Test_Hash_Argon2id(t *testing.T) {
+	hasher := &Hasher{Argon2: fastArgon2}
+	encoded, _, err := hasher.Hash("hunter2")
+	if err != nil {
+		t.Fatalf("Error executing Hash_Argon2id test: %s\n", err.Error())
+	}
+	if !strings.HasPrefix(encoded, "$argon2id$v=19$m=1024,t=1,p=1$") {
+		t.Fatalf("Error executing Hash_Argon2id test: unexpected encoding %s\n", encoded)
+	}
+
+	match, rehash, err := hasher.Verify("hunter2", encoded, 0)
+	if err != nil || !match || rehash {
+		t.Fatalf("Error executing Hash_Argon2id test: got match %t, rehash %t (%v)\n", match, rehash, err)
+	}
+	match, _, err = hasher.Verify("hunter3", encoded, 0)
+	if err != nil || match {
+		t.Fatal("Error executing Hash_Argon2id test: wrong password accepted")
+	}
+}
+
+func Test_Verify_Rehash(t *testing.T) {
+	weak := &Hasher{Argon2: fastArgon2}
+	encoded, _, _ := weak.Hash("hunter2")
+	stronger := &Hasher{Argon2: Argon2Params{Memory: 2048, Iterations: 1, Parallelism: 1}}
+	match, rehash, err := stronger.Verify("hunter2", encoded, 0)
+	if err != nil || !match || !rehash {
+		t.Fatal("Error executing Verify_Rehash test: raised argon2 cost not detected")
+	}
+
+	bcryptHash, _ := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	match, rehash, err = weak.Verify("hunter2", string(bcryptHash), 0)
+	if err != nil || !match || !rehash {
+		t.Fatal("Error executing Verify_Rehash test: bcrypt hash not upgraded")
+	}
+	bcryptHasher := &Hasher{Algorithm: AlgorithmBcrypt, BcryptCost: bcrypt.MinCost}
+	_, rehash, _ = bcryptHasher.Verify("hunter2", string(bcryptHash), 0)
+	if rehash {
+		t.Fatal("Error executing Verify_Rehash test: current bcrypt hash rehashed")
+	}
+}
+
+func Test_Verify_Imported(t *testing.T) {
+	hashes := []string{
+		"$scrypt$ln=10,r=8,p=1$c2FsdHNhbHRzYWx0c2FsdA$v/uBvjpkrv4+RPlRbT7o/v0/ucpdIQIN3+rMqzxpxj4",
+		"$pbkdf2-sha256$i=1000$c2FsdHNhbHRzYWx0c2FsdA$RilxBxnvGa3JIyaXwlUUKmvuPzxjHerJeqIuhiIvKNU",
+		"$pbkdf2-sha256$1000$c2FsdHNhbHRzYWx0c2FsdA$RilxBxnvGa3JIyaXwlUUKmvuPzxjHerJeqIuhiIvKNU",
+	}
+	hasher := &Hasher{}
+	for _, encoded := range hashes {
+		match, rehash, err := hasher.Verify("hunter2", encoded, 0)
+		if err != nil || !match || !rehash {
+			t.Fatalf("Error executing Verify_Imported test: %s not verified (%v)\n", encoded, err)
+		}
+		match, _, _ = hasher.Verify("hunter3", encoded, 0)
+		if match {
+			t.Fatalf("Error executing Verify_Imported test: wrong password accepted for %s\n", encoded)
+		}
+	}
+}
+
+func Test_Verify_Malformed(t *testing.T) {
+	hasher := &Hasher{}
+	for _, encoded := range []string{"", "plaintext", "$argon2id$v=19$m=0,t=1,p=1$c2FsdA$a2V5", "$pbkdf2-md5$i=1$c2FsdA$a2V5"} {
+		match, _, err := hasher.Verify("hunter2", encoded, 0)
+		if err == nil || match {
+			t.Fatalf("Error executing Verify_Malformed test: %q accepted\n", encoded)
+		}
+	}
+}
+
+func Test_Verify_Pepper(t *testing.T) {
+	hasher := &Hasher{Argon2: fastArgon2}
+	unpeppered, version, _ := hasher.Hash("hunter2")
+	if version != 0 {
+		t.Fatalf("Error executing Verify_Pepper test: got pepper version %d without keys\n", version)
+	}
+
+	hasher.Pepper.AddKey(1, []byte("0123456789abcdef"))
+	hasher.Pepper.Current = 1
+	match, rehash, err := hasher.Verify("hunter2", unpeppered, 0)
+	if err != nil || !match || !rehash {
+		t.Fatal("Error executing Verify_Pepper test: unpeppered hash not upgraded")
+	}
+	peppered, version, _ := hasher.Hash("hunter2")
+	if version != 1 {
+		t.Fatalf("Error executing Verify_Pepper test: got pepper version %d\n", version)
+	}
+	match, _, _ = (&Hasher{Argon2: fastArgon2}).Verify("hunter2", peppered, 0)
+	if match {
+		t.Fatal("Error executing Verify_Pepper test: peppered hash verified without the pepper")
+	}
+
+	hasher.Pepper.AddKey(2, []byte("fedcba9876543210"))
+	hasher.Pepper.Current = 2
+	match, rehash, err = hasher.Verify("hunter2", peppered, 1)
+	if err != nil || !match || !rehash {
+		t.Fatal("Error executing Verify_Pepper test: hash of the retired pepper not upgraded")
+	}
+	_, _, err = hasher.Verify("hunter2", peppered, 3)
+	if err == nil {
+		t.Fatal("Error executing Verify_Pepper test: unknown pepper version accepted")
+	}
+}
@@ -0,0 +1,95 @@
+package passwords
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Kavuti/goauth/utils"
+)
+
+// Pepper holds the secret keys mixed into passwords before hashing them. The
+// keys never reach the database, which only records the version each hash was
+// made with, so that a dump of it is not enough to crack the passwords.
+// Version 0 stands for no pepper. The zero Pepper has no keys.
+type Pepper struct {
+	Current int
+	keys    map[int][]byte
+}
+
+// AddKey registers the key of a pepper version.
+func (p *Pepper) AddKey(version int, key []byte) {
+	if p.keys == nil {
+		p.keys = map[int][]byte{}
+	}
+	p.keys[version] = key
+}
+
+// apply returns the password peppered with the key of the given version.
+func (p *Pepper) apply(password string, version int) (string, error) {
+	if version == 0 {
+		return password, nil
+	}
+	key, ok := p.keys[version]
+	if !ok {
+		return "", fmt.Errorf("unknown pepper version %d", version)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(password))
+	return base64.RawStdEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// PepperFromEnv loads the pepper keys. SECRET_KEY is the key of the current
+// version, PASSWORD_PEPPER_VERSION, 1 by default. PASSWORD_PEPPER_FILE can list
+// further keys as "version:base64 key" lines: after a rotation it keeps the
+// retired keys, needed until every hash made with them is upgraded. Without
+// SECRET_KEY the highest version of the file is the current one, and without
+// either passwords are not peppered.
+func PepperFromEnv() *Pepper {
+	pepper := &Pepper{}
+	if path := os.Getenv("PASSWORD_PEPPER_FILE"); path != "" {
+		file, err := os.Open(path)
+		utils.CheckError(err)
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			version, key, ok := strings.Cut(line, ":")
+			if !ok {
+				utils.CheckError(fmt.Errorf("malformed line in PASSWORD_PEPPER_FILE"))
+			}
+			parsedVersion, err := strconv.Atoi(version)
+			utils.CheckError(err)
+			decodedKey, err := base64.StdEncoding.DecodeString(key)
+			utils.CheckError(err)
+			pepper.addVersion(parsedVersion, decodedKey)
+			if parsedVersion > pepper.Current {
+				pepper.Current = parsedVersion
+			}
+		}
+		utils.CheckError(scanner.Err())
+	}
+	if secret := os.Getenv("SECRET_KEY"); secret != "" {
+		pepper.Current = utils.IntFromEnv("PASSWORD_PEPPER_VERSION", 1)
+		pepper.addVersion(pepper.Current, []byte(secret))
+	}
+	return pepper
+}
+
+func (p *Pepper) addVersion(version int, key []byte) {
+	if version < 1 {
+		utils.CheckError(fmt.Errorf("pepper versions start from 1, got %d", version))
+	}
+	if len(key) < 16 {
+		utils.CheckError(fmt.Errorf("the key of pepper version %d is too short", version))
+	}
+	p.AddKey(version, key)
+}
@@ -0,0 +1,244 @@
+package passwords
+
+import (
+	"bufio"
+	_ "embed"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/Kavuti/goauth/utils"
+)
+
+// Character classes a policy can require.
+const (
+	ClassLower  = "lower"
+	ClassUpper  = "upper"
+	ClassDigit  = "digit"
+	ClassSymbol = "symbol"
+)
+
+// Codes of the field errors reported for rejected passwords.
+const (
+	CodeTooShort     = "too_short"
+	CodeTooLong      = "too_long"
+	CodeMissingClass = "missing_class"
+	CodeCommon       = "common"
+	CodePersonalInfo = "personal_info"
+	CodeTooWeak      = "too_weak"
+	CodeBreached     = "breached"
+)
+
+const (
+	defaultMinLength  = 10
+	defaultMaxLength  = 64
+	defaultMinEntropy = 35
+	minPersonalLength = 3
+)
+
+//go:embed common.txt
+var commonPasswords string
+
+// Policy decides which passwords users can choose. The zero Policy accepts any
+// password.
+type Policy struct {
+	MinLength       int
+	MaxLength       int
+	RequiredClasses []string
+	MinEntropy      float64
+	RejectPersonal  bool
+	Breaches        BreachCorpus
+	denylist        map[string]struct{}
+}
+
+// Check returns the field errors of the given password, or nil when the policy
+// accepts it. Personal is the information about the user, such as their name
+// or email, the password must not contain.
+func (p *Policy) Check(field string, password string, personal ...string) error {
+	var fields []utils.FieldError
+	reject := func(code string, message string) {
+		fields = append(fields, utils.FieldError{Field: field, Code: code, Message: message})
+	}
+
+	length := utf8.RuneCountInString(password)
+	if length < p.MinLength {
+		reject(CodeTooShort, fmt.Sprintf("Must be at least %d characters long", p.MinLength))
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		reject(CodeTooLong, fmt.Sprintf("Must be at most %d characters long", p.MaxLength))
+	}
+	classes := characterClasses(password)
+	for _, class := range p.RequiredClasses {
+		if !classes[class] {
+			reject(CodeMissingClass, fmt.Sprintf("Must contain a %s character", class))
+		}
+	}
+	lowered := strings.ToLower(password)
+	if _, ok := p.denylist[lowered]; ok {
+		reject(CodeCommon, "Is too common")
+	}
+	if p.RejectPersonal && containsPersonalInfo(lowered, personal) {
+		reject(CodePersonalInfo, "Must not contain your name or email")
+	}
+	if p.MinEntropy > 0 && Entropy(password) < p.MinEntropy {
+		reject(CodeTooWeak, "Is too easy to guess")
+	}
+	breached, err := p.IsBreached(password)
+	if err != nil {
+		return err
+	}
+	if breached {
+		reject(CodeBreached, "Appears in a known data breach")
+	}
+
+	if len(fields) > 0 {
+		return utils.ValidationError(fields...)
+	}
+	return nil
+}
+
+// IsBreached tells whether the password appears in the breach corpus of the
+// policy, if it has one.
+func (p *Policy) IsBreached(password string) (bool, error) {
+	if p.Breaches == nil {
+		return false, nil
+	}
+	count, err := p.Breaches.Count(password)
+	if err != nil {
+		return false, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	return count > 0, nil
+}
+
+// Deny adds the given passwords to the denylist of the policy.
+func (p *Policy) Deny(passwords ...string) {
+	if p.denylist == nil {
+		p.denylist = map[string]struct{}{}
+	}
+	for _, password := range passwords {
+		password = strings.ToLower(strings.TrimSpace(password))
+		if password != "" {
+			p.denylist[password] = struct{}{}
+		}
+	}
+}
+
+// Entropy estimates in bits how hard a password is to guess by brute force: the
+// size of the alphabet its characters are taken from, raised to its length.
+// Repeated characters and runs such as "abc" or "321" add little, and count
+// as a fraction of a character.
+func Entropy(password string) float64 {
+	classes := characterClasses(password)
+	pool := 0
+	for class, size := range map[string]int{ClassLower: 26, ClassUpper: 26, ClassDigit: 10, ClassSymbol: 33, classOther: 100} {
+		if classes[class] {
+			pool += size
+		}
+	}
+	if pool == 0 {
+		return 0
+	}
+
+	length := 0.0
+	previous := rune(-1)
+	for _, r := range password {
+		delta := r - previous
+		if delta == 0 || delta == 1 || delta == -1 {
+			length += 0.25
+		} else {
+			length++
+		}
+		previous = r
+	}
+	return length * math.Log2(float64(pool))
+}
+
+const classOther = "other"
+
+func characterClasses(password string) map[string]bool {
+	classes := map[string]bool{}
+	for _, r := range password {
+		switch {
+		case r >= 'a' && r <= 'z':
+			classes[ClassLower] = true
+		case r >= 'A' && r <= 'Z':
+			classes[ClassUpper] = true
+		case r >= '0' && r <= '9':
+			classes[ClassDigit] = true
+		case r < unicode.MaxASCII && unicode.IsPrint(r):
+			classes[ClassSymbol] = true
+		default:
+			classes[classOther] = true
+		}
+	}
+	return classes
+}
+
+// containsPersonalInfo tells whether the lowercase password contains one of the
+// given values. Emails are checked both whole and by their local part.
+func containsPersonalInfo(password string, personal []string) bool {
+	for _, value := range personal {
+		value = strings.ToLower(value)
+		candidates := []string{value}
+		if at := strings.LastIndex(value, "@"); at > 0 {
+			candidates = append(candidates, value[:at])
+		}
+		for _, candidate := range candidates {
+			if utf8.RuneCountInString(candidate) >= minPersonalLength && strings.Contains(password, candidate) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// PolicyFromEnv builds the password policy from the environment:
+// PASSWORD_MIN_LENGTH, PASSWORD_MAX_LENGTH, PASSWORD_MIN_ENTROPY (in bits, 0
+// disables the estimate), PASSWORD_REQUIRED_CLASSES, a comma separated list of
+// lower, upper, digit and symbol, and PASSWORD_ALLOW_PERSONAL_INFO, which lets
+// passwords contain the name or email of the user.
+//
+// The built-in denylist of common passwords can be extended with
+// PASSWORD_DENYLIST_FILE, one password per line, and BREACHED_PASSWORDS_PATH
+// points to a local copy of the Have I Been Pwned corpus, as described by
+// NewBreachCorpus.
+func PolicyFromEnv() *Policy {
+	policy := &Policy{
+		MinLength:      utils.IntFromEnv("PASSWORD_MIN_LENGTH", defaultMinLength),
+		MaxLength:      utils.IntFromEnv("PASSWORD_MAX_LENGTH", defaultMaxLength),
+		MinEntropy:     float64(utils.IntFromEnv("PASSWORD_MIN_ENTROPY", defaultMinEntropy)),
+		RejectPersonal: os.Getenv("PASSWORD_ALLOW_PERSONAL_INFO") != "true",
+	}
+	for _, class := range strings.Split(os.Getenv("PASSWORD_REQUIRED_CLASSES"), ",") {
+		class = strings.TrimSpace(class)
+		switch class {
+		case "":
+		case ClassLower, ClassUpper, ClassDigit, ClassSymbol:
+			policy.RequiredClasses = append(policy.RequiredClasses, class)
+		default:
+			utils.CheckError(fmt.Errorf("unknown password character class %q", class))
+		}
+	}
+
+	policy.Deny(strings.Split(commonPasswords, "\n")...)
+	if path := os.Getenv("PASSWORD_DENYLIST_FILE"); path != "" {
+		file, err := os.Open(path)
+		utils.CheckError(err)
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			policy.Deny(scanner.Text())
+		}
+		utils.CheckError(scanner.Err())
+	}
+	if path := os.Getenv("BREACHED_PASSWORDS_PATH"); path != "" {
+		corpus, err := NewBreachCorpus(path)
+		utils.CheckError(err)
+		policy.Breaches = corpus
+	}
+	return policy
+}
@@ -0,0 +1,61 @@
+package passwords
+
+import (
+	"testing"
+
+	"github.com/Kavuti/goauth/utils"
+)
+
+func rejectedCodes(err error) map[string]bool {
+	codes := map[string]bool{}
+	for _, field := range utils.FieldErrors(err) {
+		codes[field.Code] = true
+	}
+	return codes
+}
+
+func Test_Check_Accepted(t *testing.T) {
+	policy := PolicyFromEnv()
+	err := policy.Check("password", "correct horse battery staple", "Mario", "Rossi", "mario@test.com")
+	if err != nil {
+		t.Fatalf("Error executing Check_Accepted test: %s\n", err.Error())
+	}
+}
+
+func Test_Check_Rules(t *testing.T) {
+	policy := &Policy{MinLength: 10, MaxLength: 20, RequiredClasses: []string{ClassDigit}, RejectPersonal: true}
+	policy.Deny("letmein123")
+	cases := map[string]string{
+		"short":                      CodeTooShort,
+		"averyveryverylongpassword1": CodeTooLong,
+		"nodigitshere":               CodeMissingClass,
+		"LetMeIn123":                 CodeCommon,
+		"xmario.rossi9":              CodePersonalInfo,
+	}
+	for password, code := range cases {
+		codes := rejectedCodes(policy.Check("password", password, "Mario", "Rossi", "mario.rossi@test.com"))
+		if !codes[code] {
+			t.Fatalf("Error executing Check_Rules test: %s not rejected as %s, got %v\n", password, code, codes)
+		}
+	}
+}
+
+func Test_Check_ZeroPolicy(t *testing.T) {
+	policy := &Policy{}
+	err := policy.Check("password", "a", "a")
+	if err != nil {
+		t.Fatalf("Error executing Check_ZeroPolicy test: %s\n", err.Error())
+	}
+}
+
+func Test_Entropy(t *testing.T) {
+	if Entropy("aaaaaaaaaaaa") >= Entropy("qzmwxnebrvct") {
+		t.Fatal("Error executing Entropy test: repeated characters not penalized")
+	}
+	if Entropy("abcdefghijkl") >= Entropy("qzmwxnebrvct") {
+		t.Fatal("Error executing Entropy test: runs not penalized")
+	}
+	if Entropy("Tr0ub4dor&3x") <= Entropy("troubadorxyz") {
+		t.Fatal("Error executing Entropy test: larger alphabet not rewarded")
+	}
+}
@@ -0,0 +1,120 @@
+package ratelimit
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Kavuti/goauth/auth"
+	"github.com/Kavuti/goauth/utils"
+)
+
+// KeyFunc tells which client a request counts against.
+type KeyFunc func(r *http.Request) string
+
+// ByIP limits each client address, as told by utils.ClientIP: forwarded
+// headers only count when a trusted proxy sent them.
+func ByIP(r *http.Request) string {
+	return "ip:" + utils.ClientIP(r)
+}
+
+// ByUser limits each authenticated user, and anonymous requests by address.
+// Clients authenticated with an access token of their own count as users.
+func ByUser(r *http.Request) string {
+	principal, ok := auth.FromContext(r.Context())
+	if !ok {
+		return ByIP(r)
+	}
+	if principal.Email == "" && principal.ClientID != "" {
+		return "client:" + principal.ClientID
+	}
+	return "user:" + principal.Email
+}
+
+// Policy limits the requests to a group of routes. Policies keep separate
+// buckets, named after them. The zero Limit lets every request through. Key is
+// only needed by Middleware.
+type Policy struct {
+	Name string
+	Limit
+	Key KeyFunc
+}
+
+// Take takes a token from the bucket of the given key. Services limiting by
+// something only known once a request is handled, such as the client it
+// authenticated, call it rather than going through Middleware.
+func (p Policy) Take(store Store, key string) (*Result, error) {
+	if p.Count <= 0 {
+		return &Result{Allowed: true}, nil
+	}
+	return store.Take(p.Name+"|"+key, p.Limit)
+}
+
+// PolicyFromEnv builds a policy which RATE_LIMIT_<NAME> can override with a
+// value such as "10/1m", or disable with "off".
+func PolicyFromEnv(name string, count int, period time.Duration, key KeyFunc) Policy {
+	policy := Policy{Name: strings.ToLower(name), Limit: Limit{Count: count, Period: period}, Key: key}
+	variable := "RATE_LIMIT_" + strings.ToUpper(name)
+	value := os.Getenv(variable)
+	if value == "" {
+		return policy
+	}
+	if value == "off" {
+		policy.Limit = Limit{}
+		return policy
+	}
+	countValue, periodValue, ok := strings.Cut(value, "/")
+	if !ok {
+		utils.CheckError(fmt.Errorf("%s must look like 10/1m", variable))
+	}
+	parsedCount, err := strconv.Atoi(countValue)
+	utils.CheckError(err)
+	parsedPeriod, err := time.ParseDuration(periodValue)
+	utils.CheckError(err)
+	if parsedCount < 1 || parsedPeriod <= 0 {
+		utils.CheckError(fmt.Errorf("%s must allow at least one request per period", variable))
+	}
+	policy.Limit = Limit{Count: parsedCount, Period: parsedPeriod}
+	return policy
+}
+
+// Middleware rejects the requests exceeding the policy with 429 Too Many
+// Requests. Responses carry the RateLimit headers of the IETF draft, and
+// rejections a Retry-After header. Requests pass when the store fails, so
+// that an outage of the store does not take goauth down with it.
+func Middleware(store Store, policy Policy) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if policy.Count <= 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			result, err := policy.Take(store, policy.Key(r))
+			if err != nil {
+				log.Printf("Error applying rate limit %s: %s\n", policy.Name, err.Error())
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			header := w.Header()
+			header.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", policy.Count, ceilSeconds(policy.Period)))
+			header.Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+			header.Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+			header.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.ResetAfter)))
+			if !result.Allowed {
+				header.Set("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+				utils.ServiceErrorResponse(w, r, utils.ServiceError("Too many requests, retry later", http.StatusTooManyRequests))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,92 @@
+package ratelimit
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Kavuti/goauth/auth"
+)
+
+type failingStore struct{}
+
+func (s *failingStore) Take(key string, limit Limit) (*Result, error) {
+	return nil, errors.New("Random error")
+}
+
+func Test_Middleware(t *testing.T) {
+	policy := Policy{Name: "test", Limit: Limit{Count: 1, Period: time.Minute}, Key: ByIP}
+	handler := Middleware(NewMemoryStore(), policy)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	request := httptest.NewRequest(http.MethodPost, "/", nil)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK || recorder.Header().Get("RateLimit-Remaining") != "0" || recorder.Header().Get("RateLimit-Policy") != "1;w=60" {
+		t.Fatalf("Error executing Middleware test: unexpected first response %d %v\n", recorder.Code, recorder.Header())
+	}
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusTooManyRequests || recorder.Header().Get("Retry-After") != "60" {
+		t.Fatalf("Error executing Middleware test: unexpected second response %d %v\n", recorder.Code, recorder.Header())
+	}
+
+	other := httptest.NewRequest(http.MethodPost, "/", nil)
+	other.RemoteAddr = "192.0.2.2:1234"
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, other)
+	if recorder.Code != http.StatusOK {
+		t.Fatal("Error executing Middleware test: other address limited")
+	}
+}
+
+func Test_Middleware_StoreError(t *testing.T) {
+	policy := Policy{Name: "test", Limit: Limit{Count: 1, Period: time.Minute}, Key: ByIP}
+	handler := Middleware(&failingStore{}, policy)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/", nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatal("Error executing Middleware_StoreError test: request rejected")
+	}
+}
+
+func Test_Policy_Take_Unlimited(t *testing.T) {
+	result, err := Policy{Name: "test"}.Take(&failingStore{}, "key")
+	if err != nil || !result.Allowed {
+		t.Fatal("Error executing Policy_Take_Unlimited test: request rejected")
+	}
+}
+
+func Test_Keys(t *testing.T) {
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	if ByUser(request) != "ip:192.0.2.1" {
+		t.Fatal("Error executing Keys test: anonymous request not keyed by address")
+	}
+	request.Header.Set("X-Forwarded-For", "198.51.100.1")
+	if ByIP(request) != "ip:192.0.2.1" {
+		t.Fatal("Error executing Keys test: address forwarded by an untrusted peer believed")
+	}
+	request = request.WithContext(auth.NewContext(request.Context(), &auth.Principal{Email: "test@test.com"}))
+	if ByUser(request) != "user:test@test.com" {
+		t.Fatal("Error executing Keys test: user not recognized")
+	}
+	request = request.WithContext(auth.NewContext(request.Context(), &auth.Principal{ClientID: "client"}))
+	if ByUser(request) != "client:client" {
+		t.Fatal("Error executing Keys test: client token not recognized")
+	}
+}
+
+func Test_PolicyFromEnv(t *testing.T) {
+	t.Setenv("RATE_LIMIT_TEST", "5/1h")
+	policy := PolicyFromEnv("TEST", 1, time.Minute, ByIP)
+	if policy.Name != "test" || policy.Count != 5 || policy.Period != time.Hour {
+		t.Fatalf("Error executing PolicyFromEnv test: unexpected policy %+v\n", policy)
+	}
+	t.Setenv("RATE_LIMIT_TEST", "off")
+	if PolicyFromEnv("TEST", 1, time.Minute, ByIP).Count != 0 {
+		t.Fatal("Error executing PolicyFromEnv test: policy not disabled")
+	}
+}
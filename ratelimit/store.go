@@ -0,0 +1,189 @@
+package ratelimit
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// sweepInterval is how often stores drop the buckets that refilled, which
+// are equivalent to missing ones.
+const sweepInterval = time.Minute
+
+// Limit allows Count requests per Period. Unused allowance accumulates up to
+// Count, so that bursts of Count requests are accepted after a quiet period.
+type Limit struct {
+	Count  int
+	Period time.Duration
+}
+
+// Result describes the state of a bucket after a request took from it.
+type Result struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+
+	// RetryAfter is set for rejected requests, telling when a new one will
+	// be allowed. ResetAfter tells when the bucket is full again.
+	RetryAfter time.Duration
+	ResetAfter time.Duration
+}
+
+// Store keeps the token buckets of the limited clients. Take atomically takes
+// a token from the bucket of the given key, refilling it first for the time
+// elapsed since the last request.
+type Store interface {
+	Take(key string, limit Limit) (*Result, error)
+}
+
+type bucket struct {
+	Tokens    float64   `db:"tokens"`
+	UpdatedAt time.Time `db:"updated_at"`
+	FullAt    time.Time `db:"full_at"`
+}
+
+// take updates the bucket for a request made at the given time. The zero
+// bucket is a full one.
+func (b *bucket) take(limit Limit, now time.Time) *Result {
+	capacity := float64(limit.Count)
+	rate := capacity / limit.Period.Seconds()
+	if b.UpdatedAt.IsZero() {
+		b.Tokens = capacity
+	} else if now.After(b.UpdatedAt) {
+		b.Tokens = math.Min(capacity, b.Tokens+now.Sub(b.UpdatedAt).Seconds()*rate)
+	}
+	b.UpdatedAt = now
+
+	result := &Result{Limit: limit.Count}
+	if b.Tokens >= 1 {
+		b.Tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = seconds((1 - b.Tokens) / rate)
+	}
+	result.Remaining = int(b.Tokens)
+	result.ResetAfter = seconds((capacity - b.Tokens) / rate)
+	b.FullAt = now.Add(result.ResetAfter)
+	return result
+}
+
+func seconds(value float64) time.Duration {
+	return time.Duration(value * float64(time.Second))
+}
+
+type memoryStore struct {
+	mutex     sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// NewMemoryStore keeps the buckets in the memory of the process, which suits
+// deployments running a single instance.
+func NewMemoryStore() Store {
+	return &memoryStore{buckets: map[string]*bucket{}}
+}
+
+func (s *memoryStore) Take(key string, limit Limit) (*Result, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.lastSweep) > sweepInterval {
+		for key, bucket := range s.buckets {
+			if bucket.FullAt.Before(now) {
+				delete(s.buckets, key)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{}
+		s.buckets[key] = b
+	}
+	return b.take(limit, now), nil
+}
+
+type postgresStore struct {
+	db        *sqlx.DB
+	mutex     sync.Mutex
+	lastSweep time.Time
+}
+
+// NewPostgresStore keeps the buckets in the database, sharing the limits
+// between every instance of goauth using it.
+func NewPostgresStore(db *sqlx.DB) Store {
+	return &postgresStore{db: db}
+}
+
+func (s *postgresStore) Take(key string, limit Limit) (*Result, error) {
+	now := time.Now()
+	err := s.sweep(now)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// A full bucket is inserted first for new keys, so that there always is
+	// a row to lock: concurrent first requests would otherwise all read no
+	// bucket and each take from a full one.
+	_, err = tx.Exec(`INSERT INTO rate_limits (key, tokens, updated_at, full_at) VALUES ($1, $2, $3, $3)
+		ON CONFLICT (key) DO NOTHING`, key, float64(limit.Count), now)
+	if err != nil {
+		return nil, err
+	}
+	var b bucket
+	err = tx.Get(&b, "SELECT tokens, updated_at, full_at FROM rate_limits WHERE key=$1 FOR UPDATE", key)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	result := b.take(limit, now)
+	_, err = tx.Exec(`INSERT INTO rate_limits (key, tokens, updated_at, full_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (key) DO UPDATE SET tokens = $2, updated_at = $3, full_at = $4`, key, b.Tokens, b.UpdatedAt, b.FullAt)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (s *postgresStore) sweep(now time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if now.Sub(s.lastSweep) <= sweepInterval {
+		return nil
+	}
+	_, err := s.db.Exec("DELETE FROM rate_limits WHERE full_at < $1", now)
+	if err != nil {
+		return err
+	}
+	s.lastSweep = now
+	return nil
+}
+
+// StoreFromEnv reads RATE_LIMIT_STORE, accepting "memory" (the default) and
+// "postgres", needed when several instances of goauth serve the same clients.
+func StoreFromEnv(db *sqlx.DB) Store {
+	switch store := os.Getenv("RATE_LIMIT_STORE"); store {
+	case "", "memory":
+		return NewMemoryStore()
+	case "postgres":
+		return NewPostgresStore(db)
+	default:
+		panic(fmt.Errorf("unknown RATE_LIMIT_STORE %q", store))
+	}
+}
@@ -0,0 +1,72 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+)
+
+var testLimit = Limit{Count: 2, Period: 10 * time.Second}
+
+func Test_Bucket_Take(t *testing.T) {
+	now := time.Now()
+	b := &bucket{}
+	for i := 0; i < 2; i++ {
+		if result := b.take(testLimit, now); !result.Allowed || result.Remaining != 1-i {
+			t.Fatalf("Error executing Bucket_Take test: request %d rejected\n", i)
+		}
+	}
+	result := b.take(testLimit, now)
+	if result.Allowed || result.RetryAfter != 5*time.Second || result.ResetAfter != 10*time.Second {
+		t.Fatalf("Error executing Bucket_Take test: unexpected result %+v\n", result)
+	}
+	if !b.take(testLimit, now.Add(5*time.Second)).Allowed {
+		t.Fatal("Error executing Bucket_Take test: bucket not refilled")
+	}
+	if result := b.take(testLimit, now.Add(time.Hour)); result.Remaining != 1 {
+		t.Fatalf("Error executing Bucket_Take test: bucket filled beyond its capacity, %d remaining\n", result.Remaining)
+	}
+}
+
+func Test_MemoryStore_Take(t *testing.T) {
+	store := NewMemoryStore()
+	store.Take("a", testLimit)
+	store.Take("a", testLimit)
+	result, err := store.Take("a", testLimit)
+	if err != nil || result.Allowed {
+		t.Fatal("Error executing MemoryStore_Take test: limit not enforced")
+	}
+	result, _ = store.Take("b", testLimit)
+	if !result.Allowed {
+		t.Fatal("Error executing MemoryStore_Take test: keys share a bucket")
+	}
+}
+
+func Test_PostgresStore_Take(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	mock.ExpectExec("DELETE FROM rate_limits").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO rate_limits (.+) ON CONFLICT \\(key\\) DO NOTHING").WithArgs("a", 2.0, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT tokens, updated_at, full_at FROM rate_limits (.+) FOR UPDATE").WithArgs("a").WillReturnRows(sqlmock.NewRows([]string{"tokens", "updated_at", "full_at"}).AddRow(0.5, time.Now(), time.Now().Add(time.Minute)))
+	mock.ExpectExec("INSERT INTO rate_limits (.+) ON CONFLICT").WithArgs("a", sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	store := NewPostgresStore(sqlx.NewDb(db, "sqlmock"))
+	result, err := store.Take("a", testLimit)
+	if err != nil {
+		t.Fatalf("Error executing PostgresStore_Take test: %s\n", err.Error())
+	}
+	if result.Allowed {
+		t.Fatal("Error executing PostgresStore_Take test: request allowed from an empty bucket")
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("Error executing PostgresStore_Take test: %s\n", err.Error())
+	}
+}
@@ -24,6 +24,14 @@ type RoleUpdateRequest struct {
 	VisibleName string `json:"visibleName" db:"visible_name" validate:"required,max=255"`
 }
 
+type RoleAssignmentRequest struct {
+	Email string `json:"email" validate:"required,email,max=255"`
+}
+
+type RoleClientAssignmentRequest struct {
+	ClientID string `json:"clientId" validate:"required,max=64"`
+}
+
 func (resp *MultipleRoleResponse) Render(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
@@ -3,7 +3,10 @@ package roles
 import (
 	"encoding/json"
 	"net/http"
+	"time"
 
+	"github.com/Kavuti/goauth/auth"
+	"github.com/Kavuti/goauth/ratelimit"
 	"github.com/Kavuti/goauth/utils"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/render"
@@ -18,11 +21,16 @@ type RoleHandler interface {
 	Create(w http.ResponseWriter, r *http.Request)
 	Update(w http.ResponseWriter, r *http.Request)
 	Delete(w http.ResponseWriter, r *http.Request)
+	AssignUser(w http.ResponseWriter, r *http.Request)
+	UnassignUser(w http.ResponseWriter, r *http.Request)
+	AssignClient(w http.ResponseWriter, r *http.Request)
+	UnassignClient(w http.ResponseWriter, r *http.Request)
 }
 
 type rolesHandler struct {
 	chi.Router
 	service RoleService
+	limits  ratelimit.Store
 }
 
 func (h *rolesHandler) SearchByVisibleName(w http.ResponseWriter, r *http.Request) {
@@ -78,25 +86,78 @@ func (h *rolesHandler) Delete(w http.ResponseWriter, r *http.Request) {
 	utils.CheckError(err)
 }
 
+func (h *rolesHandler) AssignUser(w http.ResponseWriter, r *http.Request) {
+	defer utils.RecoverIfError(w, r)
+	name := chi.URLParam(r, "name")
+	request := RoleAssignmentRequest{}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	utils.CheckError(err)
+
+	err = h.service.AssignUser(name, &request)
+	utils.CheckError(err)
+}
+
+func (h *rolesHandler) UnassignUser(w http.ResponseWriter, r *http.Request) {
+	defer utils.RecoverIfError(w, r)
+	name := chi.URLParam(r, "name")
+	email := chi.URLParam(r, "email")
+	err := h.service.UnassignUser(name, email)
+	utils.CheckError(err)
+}
+
+func (h *rolesHandler) AssignClient(w http.ResponseWriter, r *http.Request) {
+	defer utils.RecoverIfError(w, r)
+	name := chi.URLParam(r, "name")
+	request := RoleClientAssignmentRequest{}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	utils.CheckError(err)
+
+	err = h.service.AssignClient(name, &request)
+	utils.CheckError(err)
+}
+
+func (h *rolesHandler) UnassignClient(w http.ResponseWriter, r *http.Request) {
+	defer utils.RecoverIfError(w, r)
+	name := chi.URLParam(r, "name")
+	clientID := chi.URLParam(r, "clientID")
+	err := h.service.UnassignClient(name, clientID)
+	utils.CheckError(err)
+}
+
 func (h *rolesHandler) Routes() chi.Router {
 	r := chi.NewRouter()
 
-	r.Get("/", h.SearchByVisibleName)
-	r.Post("/", h.Create)
+	r.Group(func(r chi.Router) {
+		r.Use(ratelimit.Middleware(h.limits, ratelimit.PolicyFromEnv("ROLES_READ", 120, time.Minute, ratelimit.ByUser)))
+
+		r.Get("/", h.SearchByVisibleName)
+		r.Get("/{name}", h.Get)
+	})
 
-	r.Route("/{name}", func(r chi.Router) {
-		r.Get("/", h.Get)
-		r.Put("/", h.Update)
-		r.Delete("/", h.Delete)
+	// Changes to roles are restricted to administrators who logged in with a
+	// second factor.
+	r.Group(func(r chi.Router) {
+		r.Use(auth.RequireRole(auth.AdminRole))
+		r.Use(auth.RequireMFA)
+		r.Use(ratelimit.Middleware(h.limits, ratelimit.PolicyFromEnv("ROLES_WRITE", 30, time.Minute, ratelimit.ByUser)))
+
+		r.Post("/", h.Create)
+		r.Put("/{name}", h.Update)
+		r.Delete("/{name}", h.Delete)
+		r.Post("/{name}/users", h.AssignUser)
+		r.Delete("/{name}/users/{email}", h.UnassignUser)
+		r.Post("/{name}/clients", h.AssignClient)
+		r.Delete("/{name}/clients/{clientID}", h.UnassignClient)
 	})
 
 	return r
 }
 
-func NewRoleHandler(r chi.Router, db *sqlx.DB) RoleHandler {
+func NewRoleHandler(r chi.Router, db *sqlx.DB, limits ratelimit.Store) RoleHandler {
 	handler := &rolesHandler{
 		Router:  r,
 		service: NewRoleService(db),
+		limits:  limits,
 	}
 
 	return handler
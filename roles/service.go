@@ -3,6 +3,7 @@ package roles
 import (
 	"net/http"
 
+	"github.com/Kavuti/goauth/auth"
 	"github.com/Kavuti/goauth/utils"
 	"github.com/jmoiron/sqlx"
 )
@@ -13,6 +14,11 @@ type RoleService interface {
 	Create(req *RoleCreationRequest) error
 	Update(name string, req *RoleUpdateRequest) error
 	Delete(name string) error
+	AssignUser(name string, req *RoleAssignmentRequest) error
+	UnassignUser(name string, email string) error
+	AssignClient(name string, req *RoleClientAssignmentRequest) error
+	UnassignClient(name string, clientID string) error
+	BootstrapAdmin(email string) error
 }
 
 type roleService struct {
@@ -135,6 +141,160 @@ func (s *roleService) Delete(name string) error {
 	return nil
 }
 
+func (s *roleService) AssignUser(name string, req *RoleAssignmentRequest) error {
+	if name == "" {
+		return utils.ServiceError("Name parameter is mandatory", http.StatusBadRequest)
+	}
+
+	err := utils.ValidateStruct(req)
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusBadRequest)
+	}
+
+	tx := s.db.MustBegin()
+	defer tx.Rollback()
+
+	var role Role
+	err = tx.Get(&role, "SELECT * FROM roles WHERE name=$1", name)
+	if err != nil {
+		return utils.ServiceError("No role found with the given name", http.StatusNotFound)
+	}
+	var users int
+	err = tx.Get(&users, "SELECT COUNT(*) FROM users WHERE email=$1", req.Email)
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	if users == 0 {
+		return utils.ServiceError("No user found with the given email", http.StatusNotFound)
+	}
+
+	_, err = tx.Exec("INSERT INTO user_roles (user_email, role_name) VALUES ($1, $2) ON CONFLICT DO NOTHING", req.Email, name)
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	return nil
+}
+
+func (s *roleService) UnassignUser(name string, email string) error {
+	if name == "" || email == "" {
+		return utils.ServiceError("Name and email parameters are mandatory", http.StatusBadRequest)
+	}
+
+	tx := s.db.MustBegin()
+	defer tx.Rollback()
+
+	rows, err := tx.MustExec("DELETE FROM user_roles WHERE role_name=$1 AND user_email=$2", name, email).RowsAffected()
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	if rows == 0 {
+		return utils.ServiceError("The user is not assigned to the given role", http.StatusNotFound)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	return nil
+}
+
+// AssignClient gives a role to an OAuth client, carried by the access tokens
+// it obtains with the client_credentials grant.
+func (s *roleService) AssignClient(name string, req *RoleClientAssignmentRequest) error {
+	if name == "" {
+		return utils.ServiceError("Name parameter is mandatory", http.StatusBadRequest)
+	}
+
+	err := utils.ValidateStruct(req)
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusBadRequest)
+	}
+
+	tx := s.db.MustBegin()
+	defer tx.Rollback()
+
+	var role Role
+	err = tx.Get(&role, "SELECT * FROM roles WHERE name=$1", name)
+	if err != nil {
+		return utils.ServiceError("No role found with the given name", http.StatusNotFound)
+	}
+	var clients int
+	err = tx.Get(&clients, "SELECT COUNT(*) FROM clients WHERE id=$1", req.ClientID)
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	if clients == 0 {
+		return utils.ServiceError("No client found with the given ID", http.StatusNotFound)
+	}
+
+	_, err = tx.Exec("INSERT INTO client_roles (client_id, role_name) VALUES ($1, $2) ON CONFLICT DO NOTHING", req.ClientID, name)
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	return nil
+}
+
+func (s *roleService) UnassignClient(name string, clientID string) error {
+	if name == "" || clientID == "" {
+		return utils.ServiceError("Name and client ID parameters are mandatory", http.StatusBadRequest)
+	}
+
+	tx := s.db.MustBegin()
+	defer tx.Rollback()
+
+	rows, err := tx.MustExec("DELETE FROM client_roles WHERE role_name=$1 AND client_id=$2", name, clientID).RowsAffected()
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	if rows == 0 {
+		return utils.ServiceError("The client is not assigned to the given role", http.StatusNotFound)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	return nil
+}
+
+// BootstrapAdmin grants the ADMIN role to the user goauth is first set up
+// with, since only administrators can assign roles through the API. The user
+// has to exist and have verified their email, so that whoever registers the
+// address first cannot claim the role before its owner does.
+func (s *roleService) BootstrapAdmin(email string) error {
+	if email == "" {
+		return utils.ServiceError("Email parameter is mandatory", http.StatusBadRequest)
+	}
+
+	tx := s.db.MustBegin()
+	defer tx.Rollback()
+
+	var verified bool
+	err := tx.Get(&verified, "SELECT verified FROM users WHERE email=$1", email)
+	if err != nil {
+		return utils.ServiceError("No user found with the given email", http.StatusNotFound)
+	}
+	if !verified {
+		return utils.ServiceError("The user has not verified their email yet", http.StatusConflict)
+	}
+
+	_, err = tx.Exec("INSERT INTO user_roles (user_email, role_name) VALUES ($1, $2) ON CONFLICT DO NOTHING", email, auth.AdminRole)
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	return nil
+}
+
 func NewRoleService(db *sqlx.DB) RoleService {
 	return &roleService{db: db}
 }
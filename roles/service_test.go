@@ -327,3 +327,138 @@ func Test_Delete_ErrorDeleting(t *testing.T) {
 		t.Fatal("Error executing Delete_ErrorDeleting test: no error returned")
 	}
 }
+
+func Test_AssignUser(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM roles WHERE (.+)").WillReturnRows(sqlmock.NewRows([]string{"name", "visible_name"}).AddRow("ADMIN", "Administrator"))
+	mock.ExpectQuery("SELECT COUNT(.+) FROM users WHERE (.+)").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectExec("INSERT INTO user_roles").WithArgs("test@test.com", "ADMIN").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	service := &roleService{db: sqlx.NewDb(db, "sqlmock")}
+	err = service.AssignUser("ADMIN", &RoleAssignmentRequest{Email: "test@test.com"})
+	if err != nil {
+		t.Fatalf("Error executing AssignUser test: %s\n", err.Error())
+	}
+}
+
+func Test_AssignUser_MissingUser(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM roles WHERE (.+)").WillReturnRows(sqlmock.NewRows([]string{"name", "visible_name"}).AddRow("ADMIN", "Administrator"))
+	mock.ExpectQuery("SELECT COUNT(.+) FROM users WHERE (.+)").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectRollback()
+
+	service := &roleService{db: sqlx.NewDb(db, "sqlmock")}
+	err = service.AssignUser("ADMIN", &RoleAssignmentRequest{Email: "test@test.com"})
+	if err == nil {
+		t.Fatal("Error executing AssignUser_MissingUser test: no error returned")
+	}
+}
+
+func Test_UnassignUser(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM user_roles WHERE (.+)").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	service := &roleService{db: sqlx.NewDb(db, "sqlmock")}
+	err = service.UnassignUser("ADMIN", "test@test.com")
+	if err != nil {
+		t.Fatalf("Error executing UnassignUser test: %s\n", err.Error())
+	}
+}
+
+func Test_AssignClient(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM roles WHERE (.+)").WillReturnRows(sqlmock.NewRows([]string{"name", "visible_name"}).AddRow("ADMIN", "Administrator"))
+	mock.ExpectQuery("SELECT COUNT(.+) FROM clients WHERE (.+)").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectExec("INSERT INTO client_roles").WithArgs("client", "ADMIN").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	service := &roleService{db: sqlx.NewDb(db, "sqlmock")}
+	err = service.AssignClient("ADMIN", &RoleClientAssignmentRequest{ClientID: "client"})
+	if err != nil {
+		t.Fatalf("Error executing AssignClient test: %s\n", err.Error())
+	}
+}
+
+func Test_UnassignClient(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM client_roles WHERE (.+)").WithArgs("ADMIN", "client").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectRollback()
+
+	service := &roleService{db: sqlx.NewDb(db, "sqlmock")}
+	err = service.UnassignClient("ADMIN", "client")
+	if err == nil {
+		t.Fatal("Error executing UnassignClient test: missing assignment removed")
+	}
+}
+
+func Test_BootstrapAdmin(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT verified FROM users WHERE (.+)").WithArgs("test@test.com").WillReturnRows(sqlmock.NewRows([]string{"verified"}).AddRow(true))
+	mock.ExpectExec("INSERT INTO user_roles").WithArgs("test@test.com", "ADMIN").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	service := &roleService{db: sqlx.NewDb(db, "sqlmock")}
+	err = service.BootstrapAdmin("test@test.com")
+	if err != nil {
+		t.Fatalf("Error executing BootstrapAdmin test: %s\n", err.Error())
+	}
+}
+
+func Test_BootstrapAdmin_Unverified(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT verified FROM users WHERE (.+)").WithArgs("test@test.com").WillReturnRows(sqlmock.NewRows([]string{"verified"}).AddRow(false))
+	mock.ExpectRollback()
+
+	service := &roleService{db: sqlx.NewDb(db, "sqlmock")}
+	err = service.BootstrapAdmin("test@test.com")
+	if err == nil {
+		t.Fatal("Error executing BootstrapAdmin_Unverified test: no error returned")
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("Error executing BootstrapAdmin_Unverified test: %s\n", err.Error())
+	}
+}
@@ -0,0 +1,13 @@
+package sessions
+
+import "time"
+
+type Session struct {
+	IDHash    string    `db:"id_hash"`
+	UserEmail string    `db:"user_email"`
+	Verified  bool      `db:"verified"`
+	CreatedAt time.Time `db:"created_at"`
+	ExpiresAt time.Time `db:"expires_at"`
+	AMR       string    `db:"amr"`
+	Roles     []string  `db:"-"`
+}
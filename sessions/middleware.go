@@ -0,0 +1,39 @@
+package sessions
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/Kavuti/goauth/auth"
+)
+
+// Middleware resolves the session cookie, if any, and exposes its user to
+// downstream handlers through auth.FromContext. Requests without a valid
+// session pass through unauthenticated.
+func Middleware(service SessionService) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token := service.Token(r)
+			if token == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			session, err := service.Get(token)
+			if err != nil {
+				service.ClearCookie(w)
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			ctx := auth.NewContext(r.Context(), &auth.Principal{
+				Email:     session.UserEmail,
+				Verified:  session.Verified,
+				Roles:     session.Roles,
+				AMR:       strings.Split(session.AMR, ","),
+				SessionID: session.IDHash,
+			})
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package sessions
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Kavuti/goauth/utils"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	defaultCookieName = "goauth_session"
+	defaultSessionTTL = 24 * time.Hour
+)
+
+type SessionService interface {
+	Create(email string, amr []string) (string, error)
+	Get(token string) (*Session, error)
+	Delete(token string) error
+	DeleteAllForUser(email string) error
+	DeleteOthersForUser(email string, idHash string) error
+
+	Token(r *http.Request) string
+	SetCookie(w http.ResponseWriter, token string)
+	ClearCookie(w http.ResponseWriter)
+}
+
+type sessionService struct {
+	db       *sqlx.DB
+	ttl      time.Duration
+	name     string
+	secure   bool
+	sameSite http.SameSite
+}
+
+func (s *sessionService) Create(email string, amr []string) (string, error) {
+	token, err := utils.RandomToken()
+	if err != nil {
+		return "", utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+
+	tx := s.db.MustBegin()
+	defer tx.Rollback()
+
+	_, err = tx.Exec("INSERT INTO sessions (id_hash, user_email, expires_at, amr) VALUES ($1, $2, $3, $4)",
+		utils.HashToken(token), email, time.Now().Add(s.ttl), strings.Join(amr, ","))
+	if err != nil {
+		return "", utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return "", utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	return token, nil
+}
+
+func (s *sessionService) Get(token string) (*Session, error) {
+	if token == "" {
+		return nil, utils.ServiceError("Session token is mandatory", http.StatusUnauthorized)
+	}
+
+	tx := s.db.MustBegin()
+	defer tx.Rollback()
+
+	var session Session
+	err := tx.Get(&session, `SELECT s.id_hash, s.user_email, u.verified, s.created_at, s.expires_at, s.amr
+		FROM sessions s JOIN users u ON u.email = s.user_email
+		WHERE s.id_hash=$1 AND s.expires_at > NOW()`, utils.HashToken(token))
+	if err != nil {
+		return nil, utils.ServiceError("Invalid session", http.StatusUnauthorized)
+	}
+	err = tx.Select(&session.Roles, "SELECT role_name FROM user_roles WHERE user_email=$1 ORDER BY role_name", session.UserEmail)
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	return &session, nil
+}
+
+func (s *sessionService) Delete(token string) error {
+	tx := s.db.MustBegin()
+	defer tx.Rollback()
+
+	_, err := tx.Exec("DELETE FROM sessions WHERE id_hash=$1", utils.HashToken(token))
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	return nil
+}
+
+func (s *sessionService) DeleteAllForUser(email string) error {
+	tx := s.db.MustBegin()
+	defer tx.Rollback()
+
+	_, err := tx.Exec("DELETE FROM sessions WHERE user_email=$1", email)
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	return nil
+}
+
+// DeleteOthersForUser deletes the sessions of the user except the one with the
+// given hashed ID.
+func (s *sessionService) DeleteOthersForUser(email string, idHash string) error {
+	tx := s.db.MustBegin()
+	defer tx.Rollback()
+
+	_, err := tx.Exec("DELETE FROM sessions WHERE user_email=$1 AND id_hash<>$2", email, idHash)
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	return nil
+}
+
+func (s *sessionService) Token(r *http.Request) string {
+	cookie, err := r.Cookie(s.name)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+func (s *sessionService) SetCookie(w http.ResponseWriter, token string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     s.name,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(s.ttl.Seconds()),
+		HttpOnly: true,
+		Secure:   s.secure,
+		SameSite: s.sameSite,
+	})
+}
+
+func (s *sessionService) ClearCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     s.name,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   s.secure,
+		SameSite: s.sameSite,
+	})
+}
+
+func NewSessionService(db *sqlx.DB) SessionService {
+	name := os.Getenv("SESSION_COOKIE_NAME")
+	if name == "" {
+		name = defaultCookieName
+	}
+	sameSite := http.SameSiteLaxMode
+	if os.Getenv("SESSION_COOKIE_SAMESITE") == "strict" {
+		sameSite = http.SameSiteStrictMode
+	}
+	return &sessionService{
+		db:       db,
+		ttl:      utils.DurationFromEnv("SESSION_TTL", defaultSessionTTL),
+		name:     name,
+		secure:   os.Getenv("SESSION_COOKIE_INSECURE") != "true",
+		sameSite: sameSite,
+	}
+}
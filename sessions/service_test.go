@@ -0,0 +1,121 @@
+package sessions
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/Kavuti/goauth/auth"
+	"github.com/Kavuti/goauth/utils"
+	"github.com/jmoiron/sqlx"
+)
+
+func Test_Create(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO sessions").WithArgs(sqlmock.AnyArg(), "test@test.com", sqlmock.AnyArg(), "pwd").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	service := &sessionService{db: sqlx.NewDb(db, "sqlmock"), ttl: time.Hour}
+	token, err := service.Create("test@test.com", []string{"pwd"})
+	if err != nil {
+		t.Fatalf("Error executing Create test: %s\n", err.Error())
+	}
+	if token == "" {
+		t.Fatal("Error executing Create test: empty session token")
+	}
+}
+
+func Test_Get(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	now := time.Now()
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM sessions (.+) WHERE (.+)").WithArgs(utils.HashToken("token")).WillReturnRows(sqlmock.NewRows([]string{"id_hash", "user_email", "verified", "created_at", "expires_at", "amr"}).AddRow(utils.HashToken("token"), "test@test.com", true, now, now.Add(time.Hour), "pwd,otp,mfa"))
+	mock.ExpectQuery("SELECT role_name FROM user_roles WHERE (.+)").WillReturnRows(sqlmock.NewRows([]string{"role_name"}).AddRow("ADMIN"))
+	mock.ExpectCommit()
+
+	service := &sessionService{db: sqlx.NewDb(db, "sqlmock"), ttl: time.Hour}
+	session, err := service.Get("token")
+	if err != nil {
+		t.Fatalf("Error executing Get test: %s\n", err.Error())
+	}
+	if session.UserEmail != "test@test.com" {
+		t.Fatalf("Error executing Get test: unexpected user %s\n", session.UserEmail)
+	}
+}
+
+func Test_Get_Invalid(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM sessions (.+) WHERE (.+)").WillReturnError(errors.New("Not found"))
+	mock.ExpectRollback()
+
+	service := &sessionService{db: sqlx.NewDb(db, "sqlmock"), ttl: time.Hour}
+	_, err = service.Get("token")
+	if err == nil {
+		t.Fatal("Error executing Get_Invalid test: no error returned")
+	}
+}
+
+func Test_Delete(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM sessions WHERE (.+)").WithArgs(utils.HashToken("token")).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	service := &sessionService{db: sqlx.NewDb(db, "sqlmock"), ttl: time.Hour}
+	err = service.Delete("token")
+	if err != nil {
+		t.Fatalf("Error executing Delete test: %s\n", err.Error())
+	}
+}
+
+func Test_Middleware(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	now := time.Now()
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM sessions (.+) WHERE (.+)").WillReturnRows(sqlmock.NewRows([]string{"id_hash", "user_email", "verified", "created_at", "expires_at", "amr"}).AddRow(utils.HashToken("token"), "test@test.com", true, now, now.Add(time.Hour), "pwd,otp,mfa"))
+	mock.ExpectQuery("SELECT role_name FROM user_roles WHERE (.+)").WillReturnRows(sqlmock.NewRows([]string{"role_name"}).AddRow("ADMIN"))
+	mock.ExpectCommit()
+
+	service := &sessionService{db: sqlx.NewDb(db, "sqlmock"), ttl: time.Hour, name: defaultCookieName}
+	var principal *auth.Principal
+	handler := Middleware(service)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, _ = auth.FromContext(r.Context())
+	}))
+
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.AddCookie(&http.Cookie{Name: defaultCookieName, Value: "token"})
+	handler.ServeHTTP(httptest.NewRecorder(), request)
+	if principal == nil || principal.Email != "test@test.com" || !principal.HasRole("ADMIN") || !principal.HasMFA() {
+		t.Fatal("Error executing Middleware test: session user not exposed in context")
+	}
+}
@@ -0,0 +1,78 @@
+package tokens
+
+import (
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Denylist keeps track of access tokens revoked before their natural expiry.
+// Entries only need to outlive the tokens they deny, after which they are
+// purged.
+type Denylist interface {
+	Revoke(jti string, expiresAt time.Time) error
+	RevokeSubject(subject string, issuedBefore time.Time, expiresAt time.Time) error
+	IsRevoked(claims *Claims) (bool, error)
+}
+
+type denylist struct {
+	db *sqlx.DB
+}
+
+func (d *denylist) Revoke(jti string, expiresAt time.Time) error {
+	tx := d.db.MustBegin()
+	defer tx.Rollback()
+
+	_, err := tx.Exec("DELETE FROM revoked_tokens WHERE expires_at < NOW()")
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO revoked_tokens (jti, expires_at) VALUES ($1, $2)
+		ON CONFLICT (jti) DO NOTHING`, jti, expiresAt)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (d *denylist) RevokeSubject(subject string, issuedBefore time.Time, expiresAt time.Time) error {
+	tx := d.db.MustBegin()
+	defer tx.Rollback()
+
+	_, err := tx.Exec("DELETE FROM revoked_subjects WHERE expires_at < NOW()")
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO revoked_subjects (subject, issued_before, expires_at) VALUES ($1, $2, $3)
+		ON CONFLICT (subject) DO UPDATE SET issued_before = EXCLUDED.issued_before, expires_at = EXCLUDED.expires_at`,
+		subject, issuedBefore, expiresAt)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (d *denylist) IsRevoked(claims *Claims) (bool, error) {
+	var count int
+	err := d.db.Get(&count, "SELECT COUNT(*) FROM revoked_tokens WHERE jti=$1", claims.ID)
+	if err != nil {
+		return false, err
+	}
+	if count > 0 {
+		return true, nil
+	}
+
+	if claims.IssuedAt == nil {
+		return false, nil
+	}
+	err = d.db.Get(&count, "SELECT COUNT(*) FROM revoked_subjects WHERE subject=$1 AND issued_before >= $2",
+		claims.Subject, claims.IssuedAt.Time)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func NewDenylist(db *sqlx.DB) Denylist {
+	return &denylist{db: db}
+}
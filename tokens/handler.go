@@ -0,0 +1,52 @@
+package tokens
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/Kavuti/goauth/utils"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+)
+
+type TokenHandler interface {
+	Routes() chi.Router
+	Refresh(w http.ResponseWriter, r *http.Request)
+}
+
+type tokenHandler struct {
+	chi.Router
+	service TokenService
+}
+
+func (h *tokenHandler) Refresh(w http.ResponseWriter, r *http.Request) {
+	defer utils.RecoverIfError(w, r)
+	request := RefreshRequest{}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	utils.CheckError(err)
+
+	err = utils.ValidateStruct(request)
+	utils.CheckError(err)
+
+	response, err := h.service.Refresh(request.RefreshToken, "")
+	utils.CheckError(err)
+
+	render.Render(w, r, response)
+}
+
+func (h *tokenHandler) Routes() chi.Router {
+	r := chi.NewRouter()
+
+	r.Post("/refresh", h.Refresh)
+
+	return r
+}
+
+func NewTokenHandler(r chi.Router, service TokenService) TokenHandler {
+	handler := &tokenHandler{
+		Router:  r,
+		service: service,
+	}
+
+	return handler
+}
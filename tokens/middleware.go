@@ -0,0 +1,46 @@
+package tokens
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/Kavuti/goauth/auth"
+	"github.com/Kavuti/goauth/utils"
+)
+
+// Middleware authenticates requests carrying a bearer access token and
+// exposes its user to downstream handlers through auth.FromContext. Requests
+// without a bearer token pass through unauthenticated, since other schemes
+// are handled downstream, such as the Basic credentials of OAuth clients.
+// Invalid or revoked tokens are rejected.
+func Middleware(service TokenService) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			header := r.Header.Get("Authorization")
+			if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			claims, err := service.ParseAccessToken(header[7:])
+			if err != nil {
+				utils.ServiceErrorResponse(w, r, err)
+				return
+			}
+
+			ctx := auth.NewContext(r.Context(), &auth.Principal{
+				Email:    claims.Email,
+				Verified: claims.Verified,
+				Roles:    claims.Roles,
+				AMR:      claims.AMR,
+
+				TokenID:        claims.ID,
+				TokenFamily:    claims.FamilyID,
+				TokenExpiresAt: claims.ExpiresAt.Time,
+				ClientID:       claims.ClientID,
+				Scopes:         strings.Fields(claims.Scope),
+			})
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
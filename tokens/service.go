@@ -0,0 +1,569 @@
+package tokens
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Kavuti/goauth/keys"
+	"github.com/Kavuti/goauth/utils"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	defaultAccessTokenTTL  = 15 * time.Minute
+	defaultRefreshTokenTTL = 30 * 24 * time.Hour
+)
+
+type TokenService interface {
+	IssueTokens(email string, verified bool, amr []string) (*TokenResponse, error)
+	IssueGrant(email string, verified bool, amr []string, grant *Grant) (*TokenResponse, error)
+	IssueClientToken(grant *Grant) (*TokenResponse, error)
+	SignIDToken(claims *IDClaims) (string, error)
+	ParseAccessToken(token string) (*Claims, error)
+	Refresh(refreshToken string, clientID string) (*TokenResponse, error)
+	Introspect(token string) (*Introspection, error)
+
+	RevokeAccessToken(jti string, expiresAt time.Time) error
+	RevokeFamily(familyID string) error
+	RevokeAllForUser(email string) error
+	RevokeToken(token string, clientID string) error
+}
+
+type tokenService struct {
+	db         *sqlx.DB
+	denylist   Denylist
+	keys       keys.KeyService
+	issuer     string
+	ttl        time.Duration
+	refreshTTL time.Duration
+}
+
+// IssueTokens starts a new refresh token family for a user who just logged in
+// with the given authentication methods.
+func (s *tokenService) IssueTokens(email string, verified bool, amr []string) (*TokenResponse, error) {
+	return s.IssueGrant(email, verified, amr, nil)
+}
+
+// IssueGrant is the counterpart of IssueTokens for an OAuth client acting on
+// behalf of the user. A nil grant issues the tokens of goauth itself.
+func (s *tokenService) IssueGrant(email string, verified bool, amr []string, grant *Grant) (*TokenResponse, error) {
+	familyID, err := utils.RandomToken()
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+
+	tx := s.db.MustBegin()
+	defer tx.Rollback()
+
+	userID, err := userID(tx, email)
+	if err != nil {
+		return nil, err
+	}
+	roles, err := userRoles(tx, email)
+	if err != nil {
+		return nil, err
+	}
+	roles = grantedRoles(roles, grant)
+	refreshToken := ""
+	if grant == nil || grant.Refresh {
+		refreshToken, err = s.insertRefreshToken(tx, email, familyID, amr, grant)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+
+	response, err := s.signAccessToken(userID, email, verified, roles, amr, familyID, grant)
+	if err != nil {
+		return nil, err
+	}
+	response.RefreshToken = refreshToken
+	return response, nil
+}
+
+// IssueClientToken issues an access token to an OAuth client acting on its
+// own behalf, whose subject is the client and whose roles are those assigned
+// to it. No refresh token is issued, as the client can simply ask again.
+func (s *tokenService) IssueClientToken(grant *Grant) (*TokenResponse, error) {
+	tx := s.db.MustBegin()
+	defer tx.Rollback()
+
+	var roles []string
+	err := tx.Select(&roles, "SELECT role_name FROM client_roles WHERE client_id=$1 ORDER BY role_name", grant.ClientID)
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	return s.signAccessToken(grant.ClientID, "", false, roles, nil, "", grant)
+}
+
+// signAccessToken signs an access token whose subject is the stable ID of the
+// user, which unlike the email never changes.
+func (s *tokenService) signAccessToken(userID string, email string, verified bool, roles []string, amr []string, familyID string, grant *Grant) (*TokenResponse, error) {
+	jti, err := utils.RandomToken()
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+
+	now := time.Now()
+	ttl := s.ttl
+	claims := &Claims{
+		Email:    email,
+		Verified: verified,
+		Roles:    roles,
+		AMR:      amr,
+		FamilyID: familyID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        jti,
+			Issuer:    s.issuer,
+			Subject:   userID,
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+		},
+	}
+	if grant != nil {
+		claims.ClientID = grant.ClientID
+		claims.Scope = strings.Join(grant.Scopes, " ")
+		if grant.AccessTokenTTL > 0 {
+			ttl = grant.AccessTokenTTL
+		}
+	}
+	claims.ExpiresAt = jwt.NewNumericDate(now.Add(ttl))
+
+	signed, err := s.sign(claims)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenResponse{
+		AccessToken: signed,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(ttl.Seconds()),
+		FamilyID:    familyID,
+		Scope:       claims.Scope,
+		TokenID:     jti,
+		ExpiresAt:   claims.ExpiresAt.Time,
+	}, nil
+}
+
+// SignIDToken signs an ID token, valid as long as access tokens are by
+// default. Its issuer defaults to the one of access tokens.
+func (s *tokenService) SignIDToken(claims *IDClaims) (string, error) {
+	now := time.Now()
+	if claims.Issuer == "" {
+		claims.Issuer = s.issuer
+	}
+	claims.IssuedAt = jwt.NewNumericDate(now)
+	claims.ExpiresAt = jwt.NewNumericDate(now.Add(s.ttl))
+
+	return s.sign(claims)
+}
+
+// sign signs claims with the active signing key, naming it in the header.
+func (s *tokenService) sign(claims jwt.Claims) (string, error) {
+	key, err := s.keys.SigningKey()
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(key.Algorithm), claims)
+	token.Header["kid"] = key.Kid
+	signed, err := token.SignedString(key.Private)
+	if err != nil {
+		return "", utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	return signed, nil
+}
+
+func (s *tokenService) ParseAccessToken(token string) (*Claims, error) {
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(token, claims, s.verificationKey,
+		jwt.WithValidMethods([]string{keys.RS256, keys.ES256, keys.EdDSA}))
+	if err != nil {
+		return nil, utils.ServiceError("Invalid access token", http.StatusUnauthorized)
+	}
+	if s.issuer != "" && !claims.VerifyIssuer(s.issuer, true) {
+		return nil, utils.ServiceError("Invalid access token", http.StatusUnauthorized)
+	}
+	if claims.ID == "" || claims.ExpiresAt == nil {
+		return nil, utils.ServiceError("Invalid access token", http.StatusUnauthorized)
+	}
+
+	revoked, err := s.denylist.IsRevoked(claims)
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	if revoked {
+		return nil, utils.ServiceError("Access token has been revoked", http.StatusUnauthorized)
+	}
+	return claims, nil
+}
+
+// verificationKey resolves the public key a token was signed with from its
+// kid header, refusing keys whose algorithm differs from the token's.
+func (s *tokenService) verificationKey(t *jwt.Token) (interface{}, error) {
+	kid, _ := t.Header["kid"].(string)
+	key, err := s.keys.VerificationKey(kid)
+	if err != nil {
+		return nil, err
+	}
+	if key.Algorithm != t.Method.Alg() {
+		return nil, utils.ServiceError("Invalid access token", http.StatusUnauthorized)
+	}
+	return key.Public, nil
+}
+
+// Refresh exchanges a refresh token for a new access and refresh token pair.
+// Every refresh token can be used only once: presenting an already rotated
+// token is treated as theft and revokes its whole family. Tokens issued to an
+// OAuth client are only accepted from it, and the others only with an empty
+// clientID.
+func (s *tokenService) Refresh(refreshToken string, clientID string) (*TokenResponse, error) {
+	tx := s.db.MustBegin()
+	defer tx.Rollback()
+
+	var stored RefreshToken
+	err := tx.Get(&stored, "SELECT * FROM refresh_tokens WHERE token_hash=$1", utils.HashToken(refreshToken))
+	if err != nil {
+		return nil, utils.ServiceError("Invalid refresh token", http.StatusUnauthorized)
+	}
+	if stored.RevokedAt.Valid || time.Now().After(stored.ExpiresAt) || stored.ClientID.String != clientID {
+		return nil, utils.ServiceError("Invalid refresh token", http.StatusUnauthorized)
+	}
+
+	rows := int64(0)
+	if !stored.RotatedAt.Valid {
+		rows, err = tx.MustExec("UPDATE refresh_tokens SET rotated_at = NOW() WHERE token_hash = $1 AND rotated_at IS NULL", stored.TokenHash).RowsAffected()
+		if err != nil {
+			return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+		}
+	}
+	if rows == 0 {
+		tx.MustExec("UPDATE refresh_tokens SET revoked_at = NOW() WHERE family_id = $1 AND revoked_at IS NULL", stored.FamilyID)
+		err = tx.Commit()
+		if err != nil {
+			return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+		}
+		log.Printf("Refresh token reuse detected for user %s: token family revoked\n", stored.UserEmail)
+		return nil, utils.ServiceError("Invalid refresh token", http.StatusUnauthorized)
+	}
+
+	var user struct {
+		ID       string `db:"id"`
+		Verified bool   `db:"verified"`
+	}
+	err = tx.Get(&user, "SELECT id, verified FROM users WHERE email=$1", stored.UserEmail)
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	roles, err := userRoles(tx, stored.UserEmail)
+	if err != nil {
+		return nil, err
+	}
+
+	grant, err := storedGrant(tx, &stored)
+	if err != nil {
+		return nil, err
+	}
+	roles = grantedRoles(roles, grant)
+
+	amr := strings.Split(stored.AMR, ",")
+	newRefreshToken, err := s.insertRefreshToken(tx, stored.UserEmail, stored.FamilyID, amr, grant)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+
+	response, err := s.signAccessToken(user.ID, stored.UserEmail, user.Verified, roles, amr, stored.FamilyID, grant)
+	if err != nil {
+		return nil, err
+	}
+	response.RefreshToken = newRefreshToken
+	return response, nil
+}
+
+// Introspect tells whether an access or refresh token can still be used,
+// and if so who it was issued to. Refresh tokens which have been rotated are
+// no longer active.
+func (s *tokenService) Introspect(token string) (*Introspection, error) {
+	claims, err := s.ParseAccessToken(token)
+	if err == nil {
+		return &Introspection{
+			Active:    true,
+			TokenType: "access_token",
+			Scope:     claims.Scope,
+			ClientID:  claims.ClientID,
+			Username:  claims.Email,
+			Subject:   claims.Subject,
+			Issuer:    claims.Issuer,
+			ID:        claims.ID,
+			IssuedAt:  claims.IssuedAt.Unix(),
+			ExpiresAt: claims.ExpiresAt.Unix(),
+			Roles:     claims.Roles,
+			AMR:       claims.AMR,
+		}, nil
+	}
+	if utils.ErrorStatus(err) != http.StatusUnauthorized {
+		return nil, err
+	}
+
+	tx := s.db.MustBegin()
+	defer tx.Rollback()
+
+	stored, err := activeRefreshToken(tx, token)
+	if err != nil || stored == nil {
+		return &Introspection{Active: false}, err
+	}
+	userID, err := userID(tx, stored.UserEmail)
+	if err != nil {
+		return nil, err
+	}
+	roles, err := userRoles(tx, stored.UserEmail)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	return &Introspection{
+		Active:    true,
+		TokenType: "refresh_token",
+		Scope:     stored.Scope,
+		ClientID:  stored.ClientID.String,
+		Username:  stored.UserEmail,
+		Subject:   userID,
+		Issuer:    s.issuer,
+		IssuedAt:  stored.CreatedAt.Unix(),
+		ExpiresAt: stored.ExpiresAt.Unix(),
+		Roles:     roles,
+		AMR:       strings.Split(stored.AMR, ","),
+	}, nil
+}
+
+// RevokeToken revokes an access or refresh token on behalf of the OAuth
+// client it was issued to, along with the refresh token family of the
+// latter. Unknown tokens and those of other clients are ignored, so that
+// clients cannot probe them (RFC 7009 section 2.2).
+func (s *tokenService) RevokeToken(token string, clientID string) error {
+	claims, err := s.ParseAccessToken(token)
+	if err == nil {
+		if claims.ClientID != clientID {
+			return nil
+		}
+		return s.RevokeAccessToken(claims.ID, claims.ExpiresAt.Time)
+	}
+	if utils.ErrorStatus(err) != http.StatusUnauthorized {
+		return err
+	}
+
+	tx := s.db.MustBegin()
+	defer tx.Rollback()
+
+	stored, err := activeRefreshToken(tx, token)
+	if err != nil || stored == nil || stored.ClientID.String != clientID {
+		return err
+	}
+	tx.Rollback()
+	return s.RevokeFamily(stored.FamilyID)
+}
+
+func (s *tokenService) RevokeAccessToken(jti string, expiresAt time.Time) error {
+	if jti == "" {
+		return utils.ServiceError("Access token cannot be revoked", http.StatusBadRequest)
+	}
+	err := s.denylist.Revoke(jti, expiresAt)
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	return nil
+}
+
+func (s *tokenService) RevokeFamily(familyID string) error {
+	if familyID == "" {
+		return nil
+	}
+
+	tx := s.db.MustBegin()
+	defer tx.Rollback()
+
+	_, err := tx.Exec("UPDATE refresh_tokens SET revoked_at = NOW() WHERE family_id = $1 AND revoked_at IS NULL", familyID)
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	return nil
+}
+
+// RevokeAllForUser revokes every refresh token of the user and denies all the
+// access tokens issued to them so far. Access tokens carry their issue time in
+// whole seconds, so those issued during the current second stay valid: tokens
+// issued right after the revocation, to replace those of the caller, are not
+// denied along with the others.
+func (s *tokenService) RevokeAllForUser(email string) error {
+	if email == "" {
+		return utils.ServiceError("Email parameter is mandatory", http.StatusBadRequest)
+	}
+
+	tx := s.db.MustBegin()
+	defer tx.Rollback()
+
+	userID, err := userID(tx, email)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE refresh_tokens SET revoked_at = NOW() WHERE user_email = $1 AND revoked_at IS NULL", email)
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	ttl, err := s.longestAccessTTL(tx)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+
+	now := time.Now()
+	err = s.denylist.RevokeSubject(userID, now.Truncate(time.Second).Add(-time.Nanosecond), now.Add(ttl))
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	return nil
+}
+
+func (s *tokenService) insertRefreshToken(tx *sqlx.Tx, email string, familyID string, amr []string, grant *Grant) (string, error) {
+	token, err := utils.RandomToken()
+	if err != nil {
+		return "", utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	ttl := s.refreshTTL
+	clientID := sql.NullString{}
+	scope := ""
+	if grant != nil {
+		clientID = sql.NullString{String: grant.ClientID, Valid: true}
+		scope = strings.Join(grant.Scopes, " ")
+		if grant.RefreshTokenTTL > 0 {
+			ttl = grant.RefreshTokenTTL
+		}
+	}
+	_, err = tx.Exec(`INSERT INTO refresh_tokens (token_hash, family_id, user_email, expires_at, amr, client_id, scope)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`, utils.HashToken(token), familyID, email, time.Now().Add(ttl), strings.Join(amr, ","), clientID, scope)
+	if err != nil {
+		return "", utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	return token, nil
+}
+
+// storedGrant rebuilds the grant a refresh token was issued with, reading the
+// current token lifetimes of its client.
+func storedGrant(tx *sqlx.Tx, stored *RefreshToken) (*Grant, error) {
+	if !stored.ClientID.Valid {
+		return nil, nil
+	}
+	var lifetimes struct {
+		Access  int `db:"access_token_ttl"`
+		Refresh int `db:"refresh_token_ttl"`
+	}
+	err := tx.Get(&lifetimes, "SELECT access_token_ttl, refresh_token_ttl FROM clients WHERE id=$1", stored.ClientID.String)
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	return &Grant{
+		ClientID:        stored.ClientID.String,
+		Scopes:          strings.Fields(stored.Scope),
+		AccessTokenTTL:  time.Duration(lifetimes.Access) * time.Second,
+		RefreshTokenTTL: time.Duration(lifetimes.Refresh) * time.Second,
+		Refresh:         true,
+	}, nil
+}
+
+// longestAccessTTL returns how long the access tokens issued so far can stay
+// valid, as clients can be given lifetimes longer than the default.
+func (s *tokenService) longestAccessTTL(tx *sqlx.Tx) (time.Duration, error) {
+	var seconds int
+	err := tx.Get(&seconds, "SELECT COALESCE(MAX(access_token_ttl), 0) FROM clients")
+	if err != nil {
+		return 0, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	if ttl := time.Duration(seconds) * time.Second; ttl > s.ttl {
+		return ttl, nil
+	}
+	return s.ttl, nil
+}
+
+// activeRefreshToken looks up a refresh token which has been neither
+// rotated nor revoked and has not expired yet, returning nil otherwise.
+func activeRefreshToken(tx *sqlx.Tx, token string) (*RefreshToken, error) {
+	var stored RefreshToken
+	err := tx.Get(&stored, "SELECT * FROM refresh_tokens WHERE token_hash=$1", utils.HashToken(token))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	if stored.RotatedAt.Valid || stored.RevokedAt.Valid || time.Now().After(stored.ExpiresAt) {
+		return nil, nil
+	}
+	return &stored, nil
+}
+
+func userID(tx *sqlx.Tx, email string) (string, error) {
+	var id string
+	err := tx.Get(&id, "SELECT id FROM users WHERE email=$1", email)
+	if err != nil {
+		return "", utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	return id, nil
+}
+
+func userRoles(tx *sqlx.Tx, email string) ([]string, error) {
+	var roles []string
+	err := tx.Select(&roles, "SELECT role_name FROM user_roles WHERE user_email=$1 ORDER BY role_name", email)
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	return roles, nil
+}
+
+// grantedRoles keeps the roles of a user out of the access tokens of OAuth
+// clients which were not granted the roles scope.
+func grantedRoles(roles []string, grant *Grant) []string {
+	if grant == nil {
+		return roles
+	}
+	for _, scope := range grant.Scopes {
+		if scope == ScopeRoles {
+			return roles
+		}
+	}
+	return nil
+}
+
+func NewTokenService(db *sqlx.DB, keyService keys.KeyService) TokenService {
+	return &tokenService{
+		db:         db,
+		denylist:   NewDenylist(db),
+		keys:       keyService,
+		issuer:     os.Getenv("TOKEN_ISSUER"),
+		ttl:        utils.DurationFromEnv("ACCESS_TOKEN_TTL", defaultAccessTokenTTL),
+		refreshTTL: utils.DurationFromEnv("REFRESH_TOKEN_TTL", defaultRefreshTokenTTL),
+	}
+}
@@ -0,0 +1,547 @@
+package tokens
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/Kavuti/goauth/keys"
+	"github.com/Kavuti/goauth/utils"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/jmoiron/sqlx"
+)
+
+var testKeys = newKeyServiceStub()
+
+const testUserID = "6f1c1f0e-5d3b-4f7a-9d0e-1f2a3b4c5d6e"
+
+var refreshTokenColumns = []string{"token_hash", "family_id", "user_email", "created_at", "expires_at", "rotated_at", "revoked_at", "amr"}
+
+func Test_SignAccessToken(t *testing.T) {
+	service := &tokenService{denylist: &denylistStub{}, keys: testKeys, issuer: "goauth", ttl: time.Minute}
+	response, err := service.signAccessToken(testUserID, "test@test.com", true, []string{"ADMIN"}, []string{"pwd"}, "family", nil)
+	if err != nil {
+		t.Fatalf("Error executing SignAccessToken test: %s\n", err.Error())
+	}
+
+	claims, err := service.ParseAccessToken(response.AccessToken)
+	if err != nil {
+		t.Fatalf("Error executing SignAccessToken test: %s\n", err.Error())
+	}
+	if claims.Subject != testUserID || claims.Email != "test@test.com" || !claims.Verified || claims.FamilyID != "family" || claims.ID == "" {
+		t.Fatalf("Error executing SignAccessToken test: unexpected claims %#v\n", claims)
+	}
+}
+
+func Test_ParseAccessToken_WrongSecret(t *testing.T) {
+	service := &tokenService{denylist: &denylistStub{}, keys: testKeys, issuer: "goauth", ttl: time.Minute}
+	response, err := service.signAccessToken(testUserID, "test@test.com", true, []string{"ADMIN"}, []string{"pwd"}, "family", nil)
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+
+	other := &tokenService{denylist: &denylistStub{}, keys: newKeyServiceStub(), issuer: "goauth", ttl: time.Minute}
+	_, err = other.ParseAccessToken(response.AccessToken)
+	if err == nil {
+		t.Fatal("Error executing ParseAccessToken_WrongSecret test: no error returned")
+	}
+}
+
+func Test_ParseAccessToken_Expired(t *testing.T) {
+	service := &tokenService{denylist: &denylistStub{}, keys: testKeys, issuer: "goauth", ttl: -time.Minute}
+	response, err := service.signAccessToken(testUserID, "test@test.com", true, []string{"ADMIN"}, []string{"pwd"}, "family", nil)
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+
+	_, err = service.ParseAccessToken(response.AccessToken)
+	if err == nil {
+		t.Fatal("Error executing ParseAccessToken_Expired test: no error returned")
+	}
+}
+
+func Test_IssueTokens(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id FROM users WHERE (.+)").WithArgs("test@test.com").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testUserID))
+	mock.ExpectQuery("SELECT role_name FROM user_roles WHERE (.+)").WillReturnRows(sqlmock.NewRows([]string{"role_name"}))
+	mock.ExpectExec("INSERT INTO refresh_tokens").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	service := &tokenService{db: sqlx.NewDb(db, "sqlmock"), keys: testKeys, ttl: time.Minute, refreshTTL: time.Hour}
+	response, err := service.IssueTokens("test@test.com", true, []string{"pwd"})
+	if err != nil {
+		t.Fatalf("Error executing IssueTokens test: %s\n", err.Error())
+	}
+	if response.RefreshToken == "" {
+		t.Fatal("Error executing IssueTokens test: no refresh token returned")
+	}
+}
+
+func Test_Refresh(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	now := time.Now()
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM refresh_tokens WHERE (.+)").WithArgs(utils.HashToken("token")).WillReturnRows(sqlmock.NewRows(refreshTokenColumns).AddRow(utils.HashToken("token"), "family", "test@test.com", now, now.Add(time.Hour), nil, nil, "pwd,otp,mfa"))
+	mock.ExpectExec("UPDATE refresh_tokens SET rotated_at").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery("SELECT id, verified FROM users WHERE (.+)").WillReturnRows(sqlmock.NewRows([]string{"id", "verified"}).AddRow(testUserID, true))
+	mock.ExpectQuery("SELECT role_name FROM user_roles WHERE (.+)").WillReturnRows(sqlmock.NewRows([]string{"role_name"}).AddRow("ADMIN"))
+	mock.ExpectExec("INSERT INTO refresh_tokens").WithArgs(sqlmock.AnyArg(), "family", "test@test.com", sqlmock.AnyArg(), "pwd,otp,mfa", sql.NullString{}, "").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	service := &tokenService{db: sqlx.NewDb(db, "sqlmock"), keys: testKeys, ttl: time.Minute, refreshTTL: time.Hour}
+	response, err := service.Refresh("token", "")
+	if err != nil {
+		t.Fatalf("Error executing Refresh test: %s\n", err.Error())
+	}
+	if response.RefreshToken == "" || response.RefreshToken == "token" {
+		t.Fatal("Error executing Refresh test: refresh token not rotated")
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("Error executing Refresh test: %s\n", err.Error())
+	}
+}
+
+func Test_Refresh_Reused(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	now := time.Now()
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM refresh_tokens WHERE (.+)").WillReturnRows(sqlmock.NewRows(refreshTokenColumns).AddRow(utils.HashToken("token"), "family", "test@test.com", now, now.Add(time.Hour), now, nil, "pwd"))
+	mock.ExpectExec("UPDATE refresh_tokens SET revoked_at (.+) WHERE family_id").WithArgs("family").WillReturnResult(sqlmock.NewResult(1, 3))
+	mock.ExpectCommit()
+
+	service := &tokenService{db: sqlx.NewDb(db, "sqlmock"), keys: testKeys, ttl: time.Minute, refreshTTL: time.Hour}
+	_, err = service.Refresh("token", "")
+	if err == nil {
+		t.Fatal("Error executing Refresh_Reused test: no error returned")
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("Error executing Refresh_Reused test: %s\n", err.Error())
+	}
+}
+
+func Test_Refresh_Expired(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	now := time.Now()
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM refresh_tokens WHERE (.+)").WillReturnRows(sqlmock.NewRows(refreshTokenColumns).AddRow(utils.HashToken("token"), "family", "test@test.com", now.Add(-2*time.Hour), now.Add(-time.Hour), nil, nil, "pwd"))
+	mock.ExpectRollback()
+
+	service := &tokenService{db: sqlx.NewDb(db, "sqlmock"), keys: testKeys, ttl: time.Minute, refreshTTL: time.Hour}
+	_, err = service.Refresh("token", "")
+	if err == nil {
+		t.Fatal("Error executing Refresh_Expired test: no error returned")
+	}
+}
+
+func Test_ParseAccessToken_Revoked(t *testing.T) {
+	service := &tokenService{denylist: &denylistStub{revoked: true}, keys: testKeys, issuer: "goauth", ttl: time.Minute}
+	response, err := service.signAccessToken(testUserID, "test@test.com", true, nil, []string{"pwd"}, "family", nil)
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+
+	_, err = service.ParseAccessToken(response.AccessToken)
+	if err == nil {
+		t.Fatal("Error executing ParseAccessToken_Revoked test: no error returned")
+	}
+}
+
+func Test_RevokeAllForUser(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id FROM users WHERE (.+)").WithArgs("test@test.com").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testUserID))
+	mock.ExpectExec("UPDATE refresh_tokens SET revoked_at (.+) WHERE user_email").WithArgs("test@test.com").WillReturnResult(sqlmock.NewResult(1, 2))
+	mock.ExpectQuery("SELECT COALESCE\\(MAX\\(access_token_ttl\\), 0\\) FROM clients").WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(3600))
+	mock.ExpectCommit()
+
+	denylist := &denylistStub{}
+	service := &tokenService{db: sqlx.NewDb(db, "sqlmock"), denylist: denylist, keys: testKeys, ttl: time.Minute}
+	err = service.RevokeAllForUser("test@test.com")
+	if err != nil {
+		t.Fatalf("Error executing RevokeAllForUser test: %s\n", err.Error())
+	}
+	if denylist.subject != testUserID {
+		t.Fatal("Error executing RevokeAllForUser test: access tokens not denied")
+	}
+	if !denylist.issuedBefore.Before(time.Now().Truncate(time.Second)) {
+		t.Fatal("Error executing RevokeAllForUser test: tokens issued from now on denied")
+	}
+	if denylist.expiresAt.Before(time.Now().Add(59 * time.Minute)) {
+		t.Fatal("Error executing RevokeAllForUser test: denial shorter than the longest client access token lifetime")
+	}
+}
+
+func Test_IssueGrant(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id FROM users WHERE (.+)").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testUserID))
+	mock.ExpectQuery("SELECT role_name FROM user_roles WHERE (.+)").WillReturnRows(sqlmock.NewRows([]string{"role_name"}).AddRow("ADMIN"))
+	mock.ExpectCommit()
+
+	service := &tokenService{db: sqlx.NewDb(db, "sqlmock"), denylist: &denylistStub{}, keys: testKeys, ttl: time.Minute, refreshTTL: time.Hour}
+	grant := &Grant{ClientID: "client", Scopes: []string{"read", "write"}, AccessTokenTTL: time.Hour}
+	response, err := service.IssueGrant("test@test.com", true, []string{"pwd"}, grant)
+	if err != nil {
+		t.Fatalf("Error executing IssueGrant test: %s\n", err.Error())
+	}
+	if response.RefreshToken != "" || response.ExpiresIn != 3600 {
+		t.Fatalf("Error executing IssueGrant test: unexpected response %+v\n", response)
+	}
+	claims, err := service.ParseAccessToken(response.AccessToken)
+	if err != nil {
+		t.Fatalf("Error executing IssueGrant test: %s\n", err.Error())
+	}
+	if claims.ClientID != "client" || claims.Scope != "read write" || len(claims.Roles) != 0 {
+		t.Fatalf("Error executing IssueGrant test: unexpected claims %+v\n", claims)
+	}
+}
+
+func Test_IssueGrant_RolesScope(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT id FROM users WHERE (.+)").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testUserID))
+	mock.ExpectQuery("SELECT role_name FROM user_roles WHERE (.+)").WillReturnRows(sqlmock.NewRows([]string{"role_name"}).AddRow("ADMIN"))
+	mock.ExpectCommit()
+
+	service := &tokenService{db: sqlx.NewDb(db, "sqlmock"), denylist: &denylistStub{}, keys: testKeys, ttl: time.Minute, refreshTTL: time.Hour}
+	response, err := service.IssueGrant("test@test.com", true, []string{"pwd"}, &Grant{ClientID: "client", Scopes: []string{ScopeRoles}})
+	if err != nil {
+		t.Fatalf("Error executing IssueGrant_RolesScope test: %s\n", err.Error())
+	}
+	claims, err := service.ParseAccessToken(response.AccessToken)
+	if err != nil {
+		t.Fatalf("Error executing IssueGrant_RolesScope test: %s\n", err.Error())
+	}
+	if len(claims.Roles) != 1 || claims.Roles[0] != "ADMIN" {
+		t.Fatalf("Error executing IssueGrant_RolesScope test: unexpected roles %v\n", claims.Roles)
+	}
+}
+
+func Test_IssueClientToken(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT role_name FROM client_roles WHERE (.+)").WithArgs("client").WillReturnRows(sqlmock.NewRows([]string{"role_name"}).AddRow("SERVICE"))
+	mock.ExpectCommit()
+
+	service := &tokenService{db: sqlx.NewDb(db, "sqlmock"), denylist: &denylistStub{}, keys: testKeys, ttl: time.Minute, refreshTTL: time.Hour}
+	response, err := service.IssueClientToken(&Grant{ClientID: "client", Scopes: []string{"read"}})
+	if err != nil {
+		t.Fatalf("Error executing IssueClientToken test: %s\n", err.Error())
+	}
+	if response.RefreshToken != "" {
+		t.Fatal("Error executing IssueClientToken test: refresh token issued")
+	}
+	claims, err := service.ParseAccessToken(response.AccessToken)
+	if err != nil {
+		t.Fatalf("Error executing IssueClientToken test: %s\n", err.Error())
+	}
+	if claims.Subject != "client" || claims.Email != "" || len(claims.Roles) != 1 || claims.Roles[0] != "SERVICE" || claims.Scope != "read" {
+		t.Fatalf("Error executing IssueClientToken test: unexpected claims %+v\n", claims)
+	}
+}
+
+func Test_SignIDToken(t *testing.T) {
+	service := &tokenService{keys: testKeys, issuer: "https://auth.test", ttl: time.Minute}
+	verified := true
+	signed, err := service.SignIDToken(&IDClaims{
+		Nonce:            "nonce",
+		UserInfo:         UserInfo{Email: "test@test.com", EmailVerified: &verified},
+		RegisteredClaims: jwt.RegisteredClaims{Subject: testUserID, Audience: jwt.ClaimStrings{"client"}},
+	})
+	if err != nil {
+		t.Fatalf("Error executing SignIDToken test: %s\n", err.Error())
+	}
+
+	claims := &IDClaims{}
+	_, err = jwt.ParseWithClaims(signed, claims, service.verificationKey)
+	if err != nil {
+		t.Fatalf("Error executing SignIDToken test: %s\n", err.Error())
+	}
+	if claims.Issuer != "https://auth.test" || claims.Nonce != "nonce" || claims.Email != "test@test.com" || !claims.VerifyAudience("client", true) || claims.ExpiresAt == nil {
+		t.Fatalf("Error executing SignIDToken test: unexpected claims %+v\n", claims)
+	}
+}
+
+func Test_Refresh_ClientMismatch(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	now := time.Now()
+	columns := append(refreshTokenColumns, "client_id", "scope")
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM refresh_tokens WHERE (.+)").WillReturnRows(sqlmock.NewRows(columns).AddRow(utils.HashToken("token"), "family", "test@test.com", now, now.Add(time.Hour), nil, nil, "pwd", "client", "read"))
+	mock.ExpectRollback()
+
+	service := &tokenService{db: sqlx.NewDb(db, "sqlmock"), denylist: &denylistStub{}, keys: testKeys, ttl: time.Minute, refreshTTL: time.Hour}
+	_, err = service.Refresh("token", "")
+	if err == nil {
+		t.Fatal("Error executing Refresh_ClientMismatch test: client token refreshed without its client")
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("Error executing Refresh_ClientMismatch test: %s\n", err.Error())
+	}
+}
+
+func Test_Refresh_Client(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	now := time.Now()
+	columns := append(refreshTokenColumns, "client_id", "scope")
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM refresh_tokens WHERE (.+)").WillReturnRows(sqlmock.NewRows(columns).AddRow(utils.HashToken("token"), "family", "test@test.com", now, now.Add(time.Hour), nil, nil, "pwd", "client", "read"))
+	mock.ExpectExec("UPDATE refresh_tokens SET rotated_at").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery("SELECT id, verified FROM users WHERE (.+)").WillReturnRows(sqlmock.NewRows([]string{"id", "verified"}).AddRow(testUserID, true))
+	mock.ExpectQuery("SELECT role_name FROM user_roles WHERE (.+)").WillReturnRows(sqlmock.NewRows([]string{"role_name"}))
+	mock.ExpectQuery("SELECT access_token_ttl, refresh_token_ttl FROM clients WHERE (.+)").WithArgs("client").WillReturnRows(sqlmock.NewRows([]string{"access_token_ttl", "refresh_token_ttl"}).AddRow(300, 0))
+	mock.ExpectExec("INSERT INTO refresh_tokens").WithArgs(sqlmock.AnyArg(), "family", "test@test.com", sqlmock.AnyArg(), "pwd", sql.NullString{String: "client", Valid: true}, "read").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	service := &tokenService{db: sqlx.NewDb(db, "sqlmock"), denylist: &denylistStub{}, keys: testKeys, ttl: time.Minute, refreshTTL: time.Hour}
+	response, err := service.Refresh("token", "client")
+	if err != nil {
+		t.Fatalf("Error executing Refresh_Client test: %s\n", err.Error())
+	}
+	if response.ExpiresIn != 300 || response.RefreshToken == "" {
+		t.Fatalf("Error executing Refresh_Client test: unexpected response %+v\n", response)
+	}
+}
+
+func Test_Denylist_IsRevoked(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT COUNT(.+) FROM revoked_tokens WHERE (.+)").WithArgs("jti").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectQuery("SELECT COUNT(.+) FROM revoked_subjects WHERE (.+)").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+
+	denylist := NewDenylist(sqlx.NewDb(db, "sqlmock"))
+	claims := &Claims{RegisteredClaims: jwt.RegisteredClaims{ID: "jti", Subject: testUserID, IssuedAt: jwt.NewNumericDate(time.Now())}}
+	revoked, err := denylist.IsRevoked(claims)
+	if err != nil {
+		t.Fatalf("Error executing Denylist_IsRevoked test: %s\n", err.Error())
+	}
+	if !revoked {
+		t.Fatal("Error executing Denylist_IsRevoked test: token issued before subject revocation accepted")
+	}
+}
+
+func Test_Introspect_AccessToken(t *testing.T) {
+	service := &tokenService{denylist: &denylistStub{}, keys: testKeys, issuer: "goauth", ttl: time.Minute}
+	response, err := service.signAccessToken(testUserID, "test@test.com", true, []string{"ADMIN"}, []string{"pwd"}, "family", &Grant{ClientID: "client", Scopes: []string{"read"}})
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+
+	info, err := service.Introspect(response.AccessToken)
+	if err != nil {
+		t.Fatalf("Error executing Introspect_AccessToken test: %s\n", err.Error())
+	}
+	if !info.Active || info.TokenType != "access_token" || info.Subject != testUserID || info.Username != "test@test.com" ||
+		info.ClientID != "client" || info.Scope != "read" || len(info.Roles) != 1 || info.ExpiresAt == 0 {
+		t.Fatalf("Error executing Introspect_AccessToken test: unexpected introspection %+v\n", info)
+	}
+}
+
+func Test_Introspect_RefreshToken(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	now := time.Now()
+	columns := append(refreshTokenColumns, "client_id", "scope")
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM refresh_tokens WHERE (.+)").WithArgs(utils.HashToken("token")).WillReturnRows(sqlmock.NewRows(columns).AddRow(utils.HashToken("token"), "family", "test@test.com", now, now.Add(time.Hour), nil, nil, "pwd", "client", "read"))
+	mock.ExpectQuery("SELECT id FROM users WHERE (.+)").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(testUserID))
+	mock.ExpectQuery("SELECT role_name FROM user_roles WHERE (.+)").WillReturnRows(sqlmock.NewRows([]string{"role_name"}).AddRow("ADMIN"))
+	mock.ExpectCommit()
+
+	service := &tokenService{db: sqlx.NewDb(db, "sqlmock"), denylist: &denylistStub{}, keys: testKeys, ttl: time.Minute}
+	info, err := service.Introspect("token")
+	if err != nil {
+		t.Fatalf("Error executing Introspect_RefreshToken test: %s\n", err.Error())
+	}
+	if !info.Active || info.TokenType != "refresh_token" || info.Subject != testUserID || info.ClientID != "client" || info.Scope != "read" {
+		t.Fatalf("Error executing Introspect_RefreshToken test: unexpected introspection %+v\n", info)
+	}
+}
+
+func Test_Introspect_Rotated(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	now := time.Now()
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM refresh_tokens WHERE (.+)").WillReturnRows(sqlmock.NewRows(refreshTokenColumns).AddRow(utils.HashToken("token"), "family", "test@test.com", now, now.Add(time.Hour), now, nil, "pwd"))
+	mock.ExpectRollback()
+
+	service := &tokenService{db: sqlx.NewDb(db, "sqlmock"), denylist: &denylistStub{}, keys: testKeys, ttl: time.Minute}
+	info, err := service.Introspect("token")
+	if err != nil {
+		t.Fatalf("Error executing Introspect_Rotated test: %s\n", err.Error())
+	}
+	if info.Active || info.Username != "" {
+		t.Fatalf("Error executing Introspect_Rotated test: unexpected introspection %+v\n", info)
+	}
+}
+
+func Test_RevokeToken_AccessToken(t *testing.T) {
+	denylist := &denylistStub{}
+	service := &tokenService{denylist: denylist, keys: testKeys, ttl: time.Minute}
+	response, err := service.signAccessToken(testUserID, "test@test.com", true, nil, []string{"pwd"}, "family", &Grant{ClientID: "client"})
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+
+	err = service.RevokeToken(response.AccessToken, "other")
+	if err != nil || denylist.jti != "" {
+		t.Fatal("Error executing RevokeToken_AccessToken test: token of another client revoked")
+	}
+	err = service.RevokeToken(response.AccessToken, "client")
+	if err != nil || denylist.jti == "" {
+		t.Fatal("Error executing RevokeToken_AccessToken test: token not revoked")
+	}
+}
+
+func Test_RevokeToken_RefreshToken(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	now := time.Now()
+	columns := append(refreshTokenColumns, "client_id", "scope")
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM refresh_tokens WHERE (.+)").WillReturnRows(sqlmock.NewRows(columns).AddRow(utils.HashToken("token"), "family", "test@test.com", now, now.Add(time.Hour), nil, nil, "pwd", "client", ""))
+	mock.ExpectRollback()
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE refresh_tokens SET revoked_at (.+) WHERE family_id (.+)").WithArgs("family").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	service := &tokenService{db: sqlx.NewDb(db, "sqlmock"), denylist: &denylistStub{}, keys: testKeys, ttl: time.Minute}
+	err = service.RevokeToken("token", "client")
+	if err != nil {
+		t.Fatalf("Error executing RevokeToken_RefreshToken test: %s\n", err.Error())
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("Error executing RevokeToken_RefreshToken test: %s\n", err.Error())
+	}
+}
+
+type denylistStub struct {
+	revoked      bool
+	jti          string
+	subject      string
+	issuedBefore time.Time
+	expiresAt    time.Time
+}
+
+func (d *denylistStub) Revoke(jti string, expiresAt time.Time) error {
+	d.jti = jti
+	return nil
+}
+
+func (d *denylistStub) RevokeSubject(subject string, issuedBefore time.Time, expiresAt time.Time) error {
+	d.subject = subject
+	d.issuedBefore = issuedBefore
+	d.expiresAt = expiresAt
+	return nil
+}
+
+func (d *denylistStub) IsRevoked(claims *Claims) (bool, error) {
+	return d.revoked, nil
+}
+
+type keyServiceStub struct {
+	key *keys.Key
+}
+
+func newKeyServiceStub() *keyServiceStub {
+	private, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	return &keyServiceStub{key: &keys.Key{Kid: "kid", Algorithm: keys.ES256, Private: private, Public: private.Public()}}
+}
+
+func (s *keyServiceStub) SigningKey() (*keys.Key, error) {
+	return s.key, nil
+}
+
+func (s *keyServiceStub) VerificationKey(kid string) (*keys.Key, error) {
+	return s.key, nil
+}
+
+func (s *keyServiceStub) Rotate() (*keys.Key, error) {
+	return s.key, nil
+}
+
+func (s *keyServiceStub) RotateIfOlderThan(maxAge time.Duration) error {
+	return nil
+}
+
+func (s *keyServiceStub) List() ([]keys.SigningKeyInfo, error) {
+	return nil, nil
+}
+
+func (s *keyServiceStub) JWKS() (*keys.JWKSet, error) {
+	return nil, nil
+}
+
+func (s *keyServiceStub) StartRotation(interval time.Duration) {}
@@ -1,38 +1,117 @@
 package users
 
 import (
+	"encoding/json"
 	"net/http"
-	"os"
 
-	"github.com/Kavuti/goauth/utils"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/Kavuti/goauth/mfa"
+	"github.com/Kavuti/goauth/webauthn"
 )
 
+// User is identified by its ID, which unlike the email never changes.
 type User struct {
+	ID        string `json:"id"`
 	FirstName string `json:"firstName" db:"first_name"`
 	LastName  string `json:"lastName" db:"last_name"`
 	Email     string `json:"email"`
-	Password  string `json:"password"`
+	Password  string `json:"-"`
 	Verified  bool   `json:"verified"`
+
+	PasswordResetRequired bool `json:"-" db:"password_reset_required"`
+	PepperVersion         int  `json:"-" db:"pepper_version"`
 }
 
 type RegistrationRequest struct {
-	FirstName string `json:"first_name" validate:"required,len=50"`
-	LastName  string `json:"last_name" validate:"required,len=50"`
-	Email     string `json:"email" validate:"required,emaillen=255"`
+	FirstName string `json:"first_name" validate:"required,max=50"`
+	LastName  string `json:"last_name" validate:"required,max=50"`
+	Email     string `json:"email" validate:"required,email,max=255"`
 	Password  string `json:"password" validate:"required"`
 }
 
-func NewUserForRegistration(firstName string, lastName string, email string, password string) *User {
-	bytes, err := bcrypt.GenerateFromPassword([]byte(os.Getenv("SECRET_KEY")), bcrypt.DefaultCost)
-	if err != nil {
-		utils.ServiceError("Error generating a secure password", http.StatusInternalServerError)
+type ResendVerificationRequest struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"currentPassword" validate:"required"`
+	NewPassword     string `json:"newPassword" validate:"required"`
+}
+
+type ChangeEmailRequest struct {
+	NewEmail string `json:"newEmail" validate:"required,email,max=255"`
+	Password string `json:"password" validate:"required"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token" validate:"required"`
+	Password string `json:"password" validate:"required"`
+}
+
+type MagicLinkRequest struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+type LoginRequest struct {
+	Email    string `json:"email" validate:"required,email"`
+	Password string `json:"password" validate:"required"`
+}
+
+// MFALoginRequest answers a login challenge. Passkeys send the credential
+// returned by the browser in place of a code.
+type MFALoginRequest struct {
+	MFAToken   string          `json:"mfaToken" validate:"required"`
+	Method     string          `json:"method" validate:"required"`
+	Code       string          `json:"code" validate:"required_without=Credential"`
+	Credential json.RawMessage `json:"credential"`
+}
+
+// Answer returns the proof of the second factor in the form expected by the
+// MFA service.
+func (req *MFALoginRequest) Answer() string {
+	if req.Method == mfa.MethodWebAuthn {
+		return string(req.Credential)
 	}
+	return req.Code
+}
+
+type MFAEmailCodeRequest struct {
+	MFAToken string `json:"mfaToken" validate:"required"`
+}
+
+// MFAChallengeResponse is returned by the login endpoints in place of the
+// credentials when the user has to provide a second factor.
+type MFAChallengeResponse struct {
+	MFARequired bool     `json:"mfaRequired"`
+	MFAToken    string   `json:"mfaToken"`
+	Methods     []string `json:"methods"`
+
+	// Options of the passkey login, when a passkey is among the methods.
+	WebAuthn *webauthn.RequestOptions `json:"webauthn,omitempty"`
+}
+
+func (resp *MFAChallengeResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+type SingleUserResponse struct {
+	User User `json:"user"`
+}
+
+func (resp *SingleUserResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func NewUserForRegistration(firstName string, lastName string, email string, passwordHash string, pepperVersion int) *User {
 	return &User{
-		FirstName: firstName,
-		LastName:  lastName,
-		Email:     email,
-		Password:  string(bytes),
-		Verified:  false,
+		FirstName:     firstName,
+		LastName:      lastName,
+		Email:         email,
+		Password:      passwordHash,
+		PepperVersion: pepperVersion,
+		Verified:      false,
 	}
 }
@@ -3,9 +3,19 @@ package users
 import (
 	"encoding/json"
 	"net/http"
+	"os"
+	"time"
 
+	"github.com/Kavuti/goauth/auth"
+	"github.com/Kavuti/goauth/mail"
+	"github.com/Kavuti/goauth/mfa"
+	"github.com/Kavuti/goauth/ratelimit"
+	"github.com/Kavuti/goauth/sessions"
+	"github.com/Kavuti/goauth/tokens"
 	"github.com/Kavuti/goauth/utils"
+	"github.com/Kavuti/goauth/webauthn"
 	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
 	"github.com/jmoiron/sqlx"
 )
 
@@ -13,28 +23,100 @@ type UserHandler interface {
 	Routes() chi.Router
 	Registration(w http.ResponseWriter, r *http.Request)
 	Verify(w http.ResponseWriter, r *http.Request)
+	ResendVerification(w http.ResponseWriter, r *http.Request)
+	ForgotPassword(w http.ResponseWriter, r *http.Request)
+	ResetPassword(w http.ResponseWriter, r *http.Request)
+	ChangePassword(w http.ResponseWriter, r *http.Request)
+	RequestEmailChange(w http.ResponseWriter, r *http.Request)
+	ConfirmEmailChange(w http.ResponseWriter, r *http.Request)
+	Login(w http.ResponseWriter, r *http.Request)
+	CompleteLogin(w http.ResponseWriter, r *http.Request)
+	SessionLogin(w http.ResponseWriter, r *http.Request)
+	CompleteSessionLogin(w http.ResponseWriter, r *http.Request)
+	SendMFAEmailCode(w http.ResponseWriter, r *http.Request)
+	RequestMagicLink(w http.ResponseWriter, r *http.Request)
+	MagicLinkLogin(w http.ResponseWriter, r *http.Request)
+	RequestSessionMagicLink(w http.ResponseWriter, r *http.Request)
+	SessionMagicLinkLogin(w http.ResponseWriter, r *http.Request)
+	PasskeyOptions(w http.ResponseWriter, r *http.Request)
+	PasskeyLogin(w http.ResponseWriter, r *http.Request)
+	SessionPasskeyLogin(w http.ResponseWriter, r *http.Request)
+	SessionLogout(w http.ResponseWriter, r *http.Request)
+	Logout(w http.ResponseWriter, r *http.Request)
+	RevokeAll(w http.ResponseWriter, r *http.Request)
+	Unlock(w http.ResponseWriter, r *http.Request)
+	Me(w http.ResponseWriter, r *http.Request)
 }
 
 type userHandler struct {
 	chi.Router
-	service UserService
+	service  UserService
+	sessions sessions.SessionService
+	limits   ratelimit.Store
+	mode     auth.Mode
+
+	secureCookies bool
 }
 
 func (h *userHandler) Routes() chi.Router {
 	r := chi.NewRouter()
 
-	r.Post("/registration", h.Registration)
-	r.Route("/{name}", func(r chi.Router) {
-		r.Post("/verify", h.Verify)
+	// Anonymous endpoints are limited by client address: strictly those
+	// creating accounts or sending emails, less so those checking
+	// credentials. Account changes are limited by user.
+	registration := ratelimit.Middleware(h.limits, ratelimit.PolicyFromEnv("REGISTRATION", 5, time.Hour, ratelimit.ByIP))
+	emails := ratelimit.Middleware(h.limits, ratelimit.PolicyFromEnv("EMAIL", 10, time.Hour, ratelimit.ByIP))
+	login := ratelimit.Middleware(h.limits, ratelimit.PolicyFromEnv("LOGIN", 20, time.Minute, ratelimit.ByIP))
+	account := ratelimit.Middleware(h.limits, ratelimit.PolicyFromEnv("ACCOUNT", 10, time.Hour, ratelimit.ByUser))
+
+	r.With(registration).Post("/registration", h.Registration)
+	r.Get("/verify", h.Verify)
+	r.With(emails).Post("/verify/resend", h.ResendVerification)
+	r.With(emails).Post("/password/forgot", h.ForgotPassword)
+	r.With(login).Post("/password/reset", h.ResetPassword)
+	r.With(login).Post("/login/passkey/options", h.PasskeyOptions)
+	r.With(emails).Post("/login/mfa/email", h.SendMFAEmailCode)
+	if h.mode.Tokens {
+		r.With(login).Post("/login", h.Login)
+		r.With(login).Post("/login/mfa", h.CompleteLogin)
+		r.With(emails).Post("/login/magic-link", h.RequestMagicLink)
+		r.With(login).Get("/login/magic-link", h.MagicLinkLogin)
+		r.With(login).Post("/login/passkey", h.PasskeyLogin)
+		r.With(auth.RequireAuthentication).Post("/logout", h.Logout)
+	}
+	if h.mode.Sessions {
+		r.With(login).Post("/session/login", h.SessionLogin)
+		r.With(login).Post("/session/login/mfa", h.CompleteSessionLogin)
+		r.With(emails).Post("/session/login/magic-link", h.RequestSessionMagicLink)
+		r.With(login).Get("/session/login/magic-link", h.SessionMagicLinkLogin)
+		r.With(login).Post("/session/login/passkey", h.SessionPasskeyLogin)
+		r.Post("/session/logout", h.SessionLogout)
+	}
+	r.With(auth.RequireAuthentication).Get("/me", h.Me)
+	r.With(auth.RequireAuthentication, account).Put("/me/password", h.ChangePassword)
+	r.With(auth.RequireAuthentication, account).Post("/me/email", h.RequestEmailChange)
+	r.Get("/email/confirm", h.ConfirmEmailChange)
+	// Acting on other users' accounts is restricted to administrators who
+	// logged in with a second factor.
+	r.Route("/{email}", func(r chi.Router) {
+		r.Use(auth.RequireRole(auth.AdminRole))
+		r.Use(auth.RequireMFA)
+		r.Post("/revoke", h.RevokeAll)
+		r.Post("/unlock", h.Unlock)
 	})
 
 	return r
 }
 
-func NewUserHandler(r chi.Router, db *sqlx.DB) UserHandler {
+func NewUserHandler(r chi.Router, db *sqlx.DB, tokenService tokens.TokenService, sessionService sessions.SessionService, mfaService mfa.MFAService, webAuthnService webauthn.WebAuthnService, mailer mail.Mailer, limits ratelimit.Store, mode auth.Mode) UserHandler {
 	handler := &userHandler{
-		Router:  r,
-		service: NewUserService(db),
+		Router:   r,
+		service:  NewUserService(db, tokenService, sessionService, mfaService, webAuthnService, NewMailNotifier(mailer), limits),
+		sessions: sessionService,
+		limits:   limits,
+		mode:     mode,
+
+		secureCookies: os.Getenv("SESSION_COOKIE_INSECURE") != "true",
 	}
 
 	return handler
@@ -54,8 +136,326 @@ func (h *userHandler) Registration(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *userHandler) Verify(w http.ResponseWriter, r *http.Request) {
+	defer utils.RecoverIfError(w, r)
+	token := r.URL.Query().Get("token")
+	err := h.service.Verify(token)
+	utils.CheckError(err)
+}
+
+func (h *userHandler) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	defer utils.RecoverIfError(w, r)
+	request := ResendVerificationRequest{}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	utils.CheckError(err)
+
+	err = utils.ValidateStruct(request)
+	utils.CheckError(err)
+
+	err = h.service.ResendVerification(request.Email)
+	utils.CheckError(err)
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (h *userHandler) Login(w http.ResponseWriter, r *http.Request) {
+	defer utils.RecoverIfError(w, r)
+	request := LoginRequest{}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	utils.CheckError(err)
+
+	err = utils.ValidateStruct(request)
+	utils.CheckError(err)
+
+	response, challenge, err := h.service.Login(request.Email, request.Password, utils.ClientIP(r))
+	utils.CheckError(err)
+
+	if challenge != nil {
+		render.Render(w, r, challenge)
+		return
+	}
+	render.Render(w, r, response)
+}
+
+func (h *userHandler) CompleteLogin(w http.ResponseWriter, r *http.Request) {
+	defer utils.RecoverIfError(w, r)
+	request := MFALoginRequest{}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	utils.CheckError(err)
+
+	err = utils.ValidateStruct(request)
+	utils.CheckError(err)
+
+	response, err := h.service.CompleteLogin(request.MFAToken, request.Method, request.Answer())
+	utils.CheckError(err)
+
+	render.Render(w, r, response)
+}
+
+func (h *userHandler) SendMFAEmailCode(w http.ResponseWriter, r *http.Request) {
+	defer utils.RecoverIfError(w, r)
+	request := MFAEmailCodeRequest{}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	utils.CheckError(err)
+
+	err = utils.ValidateStruct(request)
+	utils.CheckError(err)
+
+	err = h.service.SendMFAEmailCode(request.MFAToken)
+	utils.CheckError(err)
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (h *userHandler) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	defer utils.RecoverIfError(w, r)
+	request := ForgotPasswordRequest{}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	utils.CheckError(err)
+
+	err = utils.ValidateStruct(request)
+	utils.CheckError(err)
+
+	err = h.service.ForgotPassword(request.Email)
+	utils.CheckError(err)
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (h *userHandler) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	defer utils.RecoverIfError(w, r)
+	request := ResetPasswordRequest{}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	utils.CheckError(err)
+
+	err = utils.ValidateStruct(request)
+	utils.CheckError(err)
+
+	err = h.service.ResetPassword(request.Token, request.Password)
+	utils.CheckError(err)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *userHandler) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	defer utils.RecoverIfError(w, r)
+	principal, _ := auth.FromContext(r.Context())
+	request := ChangePasswordRequest{}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	utils.CheckError(err)
+
+	err = utils.ValidateStruct(request)
+	utils.CheckError(err)
+
+	response, err := h.service.ChangePassword(principal, request.CurrentPassword, request.NewPassword)
+	utils.CheckError(err)
+
+	if response != nil {
+		render.Render(w, r, response)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *userHandler) RequestEmailChange(w http.ResponseWriter, r *http.Request) {
+	defer utils.RecoverIfError(w, r)
+	principal, _ := auth.FromContext(r.Context())
+	request := ChangeEmailRequest{}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	utils.CheckError(err)
+
+	err = utils.ValidateStruct(request)
+	utils.CheckError(err)
+
+	err = h.service.RequestEmailChange(principal.Email, request.Password, request.NewEmail)
+	utils.CheckError(err)
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (h *userHandler) ConfirmEmailChange(w http.ResponseWriter, r *http.Request) {
+	defer utils.RecoverIfError(w, r)
+	token := r.URL.Query().Get("token")
+	err := h.service.ConfirmEmailChange(token)
+	utils.CheckError(err)
+}
+
+func (h *userHandler) SessionLogin(w http.ResponseWriter, r *http.Request) {
+	defer utils.RecoverIfError(w, r)
+	request := LoginRequest{}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	utils.CheckError(err)
+
+	err = utils.ValidateStruct(request)
+	utils.CheckError(err)
+
+	token, challenge, err := h.service.SessionLogin(request.Email, request.Password, utils.ClientIP(r))
+	utils.CheckError(err)
+
+	if challenge != nil {
+		render.Render(w, r, challenge)
+		return
+	}
+	h.sessions.SetCookie(w, token)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *userHandler) CompleteSessionLogin(w http.ResponseWriter, r *http.Request) {
+	defer utils.RecoverIfError(w, r)
+	request := MFALoginRequest{}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	utils.CheckError(err)
+
+	err = utils.ValidateStruct(request)
+	utils.CheckError(err)
+
+	token, err := h.service.CompleteSessionLogin(request.MFAToken, request.Method, request.Answer())
+	utils.CheckError(err)
+
+	h.sessions.SetCookie(w, token)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *userHandler) RequestMagicLink(w http.ResponseWriter, r *http.Request) {
+	defer utils.RecoverIfError(w, r)
+	request := MagicLinkRequest{}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	utils.CheckError(err)
+
+	err = utils.ValidateStruct(request)
+	utils.CheckError(err)
+
+	nonce, err := h.service.RequestMagicLink(request.Email)
+	utils.CheckError(err)
+
+	setMagicLinkCookie(w, nonce, h.secureCookies)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (h *userHandler) MagicLinkLogin(w http.ResponseWriter, r *http.Request) {
+	defer utils.RecoverIfError(w, r)
+	token := r.URL.Query().Get("token")
+	response, challenge, err := h.service.MagicLinkLogin(token, magicLinkNonce(r))
+	utils.CheckError(err)
+
+	clearMagicLinkCookie(w, h.secureCookies)
+	if challenge != nil {
+		render.Render(w, r, challenge)
+		return
+	}
+	render.Render(w, r, response)
+}
+
+func (h *userHandler) RequestSessionMagicLink(w http.ResponseWriter, r *http.Request) {
+	defer utils.RecoverIfError(w, r)
+	request := MagicLinkRequest{}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	utils.CheckError(err)
+
+	err = utils.ValidateStruct(request)
+	utils.CheckError(err)
+
+	nonce, err := h.service.RequestSessionMagicLink(request.Email)
+	utils.CheckError(err)
+
+	setMagicLinkCookie(w, nonce, h.secureCookies)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (h *userHandler) SessionMagicLinkLogin(w http.ResponseWriter, r *http.Request) {
+	defer utils.RecoverIfError(w, r)
+	token := r.URL.Query().Get("token")
+	sessionToken, challenge, err := h.service.SessionMagicLinkLogin(token, magicLinkNonce(r))
+	utils.CheckError(err)
+
+	clearMagicLinkCookie(w, h.secureCookies)
+	if challenge != nil {
+		render.Render(w, r, challenge)
+		return
+	}
+	h.sessions.SetCookie(w, sessionToken)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *userHandler) PasskeyOptions(w http.ResponseWriter, r *http.Request) {
+	defer utils.RecoverIfError(w, r)
+	options, err := h.service.PasskeyOptions()
+	utils.CheckError(err)
+
+	render.Render(w, r, options)
+}
+
+func (h *userHandler) PasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	defer utils.RecoverIfError(w, r)
+	request := webauthn.AssertionRequest{}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	utils.CheckError(err)
+
+	err = utils.ValidateStruct(request)
+	utils.CheckError(err)
+
+	response, err := h.service.PasskeyLogin(&request)
+	utils.CheckError(err)
+
+	render.Render(w, r, response)
+}
+
+func (h *userHandler) SessionPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	defer utils.RecoverIfError(w, r)
+	request := webauthn.AssertionRequest{}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	utils.CheckError(err)
+
+	err = utils.ValidateStruct(request)
+	utils.CheckError(err)
+
+	token, err := h.service.SessionPasskeyLogin(&request)
+	utils.CheckError(err)
+
+	h.sessions.SetCookie(w, token)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *userHandler) SessionLogout(w http.ResponseWriter, r *http.Request) {
+	defer utils.RecoverIfError(w, r)
+	err := h.service.SessionLogout(h.sessions.Token(r))
+	utils.CheckError(err)
+
+	h.sessions.ClearCookie(w)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *userHandler) Logout(w http.ResponseWriter, r *http.Request) {
+	defer utils.RecoverIfError(w, r)
+	principal, _ := auth.FromContext(r.Context())
+	err := h.service.Logout(principal)
+	utils.CheckError(err)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *userHandler) RevokeAll(w http.ResponseWriter, r *http.Request) {
+	defer utils.RecoverIfError(w, r)
+	email := chi.URLParam(r, "email")
+	err := h.service.RevokeAll(email)
+	utils.CheckError(err)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *userHandler) Unlock(w http.ResponseWriter, r *http.Request) {
 	defer utils.RecoverIfError(w, r)
 	email := chi.URLParam(r, "email")
-	err := h.service.Verify(email)
+	err := h.service.Unlock(email)
 	utils.CheckError(err)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *userHandler) Me(w http.ResponseWriter, r *http.Request) {
+	defer utils.RecoverIfError(w, r)
+	principal, _ := auth.FromContext(r.Context())
+	user, err := h.service.Get(principal.Email)
+	utils.CheckError(err)
+
+	render.Render(w, r, &SingleUserResponse{User: *user})
 }
@@ -0,0 +1,221 @@
+package users
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Kavuti/goauth/utils"
+	"github.com/jmoiron/sqlx"
+)
+
+// Failed password logins are counted per account, slowing down the guessing
+// of one user's password, and per client address, slowing down the guessing
+// of many users' passwords at once. Wrong second factors are counted per
+// account apart from passwords, across login challenges, since whoever knows
+// the password can open as many challenges as they like.
+const (
+	attemptsAccount      = "account"
+	attemptsIP           = "ip"
+	attemptsSecondFactor = "mfa"
+)
+
+const (
+	defaultLoginDelayAfter       = 3
+	defaultLoginLockoutThreshold = 10
+	defaultIPDelayAfter          = 20
+	defaultIPLockoutThreshold    = 100
+	defaultMFADelayAfter         = 3
+	defaultMFALockoutThreshold   = 10
+	defaultLoginDelayBase        = time.Second
+	defaultLoginDelayMax         = 15 * time.Minute
+	defaultLoginLockout          = 15 * time.Minute
+	defaultLoginFailureWindow    = 24 * time.Hour
+)
+
+// throttle describes how failed logins hold back the next attempts. Past
+// delayAfter failures, each one blocks attempts for twice as long as the
+// previous did, from baseDelay up to maxDelay. From lockAfter failures on,
+// each one locks attempts for lockFor. Failures are forgotten after a window
+// without any. The zero throttle never blocks.
+type throttle struct {
+	delayAfter int
+	baseDelay  time.Duration
+	maxDelay   time.Duration
+	lockAfter  int
+	lockFor    time.Duration
+	window     time.Duration
+}
+
+// throttleFromEnv reads the throttle whose variables start with the given
+// prefix, such as LOGIN_LOCKOUT_THRESHOLD for the prefix LOGIN.
+func throttleFromEnv(prefix string, delayAfter int, lockAfter int) throttle {
+	return throttle{
+		delayAfter: utils.IntFromEnv(prefix+"_DELAY_AFTER", delayAfter),
+		baseDelay:  utils.DurationFromEnv(prefix+"_DELAY_BASE", defaultLoginDelayBase),
+		maxDelay:   utils.DurationFromEnv(prefix+"_DELAY_MAX", defaultLoginDelayMax),
+		lockAfter:  utils.IntFromEnv(prefix+"_LOCKOUT_THRESHOLD", lockAfter),
+		lockFor:    utils.DurationFromEnv(prefix+"_LOCKOUT_DURATION", defaultLoginLockout),
+		window:     utils.DurationFromEnv(prefix+"_FAILURE_WINDOW", defaultLoginFailureWindow),
+	}
+}
+
+func (t throttle) enabled() bool {
+	return t.baseDelay > 0 || t.lockAfter > 0
+}
+
+// delay returns how long attempts are blocked after the given number of
+// consecutive failures.
+func (t throttle) delay(failures int) time.Duration {
+	if t.lockAfter > 0 && failures >= t.lockAfter {
+		return t.lockFor
+	}
+	if t.baseDelay <= 0 || failures <= t.delayAfter {
+		return 0
+	}
+	delay := t.baseDelay
+	for i := t.delayAfter + 1; i < failures && delay < t.maxDelay; i++ {
+		delay *= 2
+	}
+	if t.maxDelay > 0 && delay > t.maxDelay {
+		delay = t.maxDelay
+	}
+	return delay
+}
+
+type loginCounter struct {
+	kind     string
+	subject  string
+	throttle throttle
+}
+
+// fail counts a failure, blocking the next attempts as its throttle demands.
+// It returns the consecutive failures and the end of the block.
+func (c *loginCounter) fail(db *sqlx.DB) (int, time.Time, error) {
+	tx := db.MustBegin()
+	defer tx.Rollback()
+
+	now := time.Now()
+	var failures int
+	err := tx.Get(&failures, `INSERT INTO login_attempts (kind, subject, failures, last_failure_at) VALUES ($1, $2, 1, $3)
+		ON CONFLICT (kind, subject) DO UPDATE SET last_failure_at = $3,
+		failures = CASE WHEN login_attempts.last_failure_at < $4 THEN 1 ELSE login_attempts.failures + 1 END
+		RETURNING failures`, c.kind, c.subject, now, now.Add(-c.throttle.window))
+	if err != nil {
+		return 0, now, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	blockedUntil := now.Add(c.throttle.delay(failures))
+	if blockedUntil.After(now) {
+		_, err = tx.Exec("UPDATE login_attempts SET blocked_until = $1 WHERE kind = $2 AND subject = $3", blockedUntil, c.kind, c.subject)
+		if err != nil {
+			return 0, now, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, now, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	return failures, blockedUntil, nil
+}
+
+// loginCounters returns the counters a password login from the given address
+// is subject to. Accounts are counted by the email as typed, known or not, so
+// that being blocked does not tell whether an account exists.
+func (s *userService) loginCounters(email string, ip string) []loginCounter {
+	counters := []loginCounter{}
+	if s.accountThrottle.enabled() {
+		counters = append(counters, loginCounter{kind: attemptsAccount, subject: strings.ToLower(email), throttle: s.accountThrottle})
+	}
+	if s.ipThrottle.enabled() && ip != "" {
+		counters = append(counters, loginCounter{kind: attemptsIP, subject: ip, throttle: s.ipThrottle})
+	}
+	return counters
+}
+
+// secondFactorCounters returns the counters the second step of a login to
+// the given account is subject to.
+func (s *userService) secondFactorCounters(email string) []loginCounter {
+	if !s.mfaThrottle.enabled() {
+		return []loginCounter{}
+	}
+	return []loginCounter{{kind: attemptsSecondFactor, subject: strings.ToLower(email), throttle: s.mfaThrottle}}
+}
+
+// checkLoginAttempts fails while previous failures block password logins to
+// the account or from the address. Blocked attempts are rejected before the
+// password is checked, so they give no hint about it.
+func (s *userService) checkLoginAttempts(email string, ip string) error {
+	return s.checkBlocked(s.loginCounters(email, ip))
+}
+
+// checkBlocked fails while one of the counters blocks attempts.
+func (s *userService) checkBlocked(counters []loginCounter) error {
+	for _, counter := range counters {
+		var blockedUntil sql.NullTime
+		err := s.db.Get(&blockedUntil, "SELECT blocked_until FROM login_attempts WHERE kind=$1 AND subject=$2", counter.kind, counter.subject)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+		}
+		if blockedUntil.Valid && blockedUntil.Time.After(time.Now()) {
+			return utils.ServiceError("Too many failed login attempts, retry later", http.StatusTooManyRequests)
+		}
+	}
+	return nil
+}
+
+// failLogin counts a wrong password and returns the error answering it. The
+// user, nil when no account matches the email, is warned once their account
+// gets locked.
+func (s *userService) failLogin(email string, ip string, user *User) error {
+	err := s.countFailure(s.loginCounters(email, ip), user)
+	if err != nil {
+		return err
+	}
+	return utils.ServiceError("Invalid email or password", http.StatusUnauthorized)
+}
+
+// countFailure counts a failure on each counter, warning the user, if known,
+// when one of the counters of their account locks it.
+func (s *userService) countFailure(counters []loginCounter, user *User) error {
+	for _, counter := range counters {
+		failures, blockedUntil, err := counter.fail(s.db)
+		if err != nil {
+			return err
+		}
+		if user == nil || counter.kind == attemptsIP || failures != counter.throttle.lockAfter {
+			continue
+		}
+		err = s.notifier.SendAccountLocked(user, blockedUntil)
+		if err != nil {
+			log.Printf("Error sending lockout notice to %s: %s\n", user.Email, err.Error())
+		}
+	}
+	return nil
+}
+
+// clearLoginFailures forgets the wrong passwords counted against an account.
+// Those of the addresses involved are kept, or an attacker could clear them
+// by logging in to an account of their own.
+func clearLoginFailures(db sqlx.Execer, email string) error {
+	return clearFailures(db, attemptsAccount, email)
+}
+
+// clearSecondFactorFailures forgets the wrong second factors counted against
+// an account. A correct password does not clear them, or knowing it would be
+// enough to keep guessing codes.
+func clearSecondFactorFailures(db sqlx.Execer, email string) error {
+	return clearFailures(db, attemptsSecondFactor, email)
+}
+
+func clearFailures(db sqlx.Execer, kind string, email string) error {
+	_, err := db.Exec("DELETE FROM login_attempts WHERE kind = $1 AND subject = $2", kind, strings.ToLower(email))
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package users
+
+import (
+	"net/http"
+)
+
+// magicLinkCookie holds the nonce binding a magic link to the browser that
+// requested it. It has to be Lax rather than Strict, so that it is sent when
+// the link is opened from an email client or a webmail.
+const magicLinkCookie = "goauth_magic_link"
+
+func setMagicLinkCookie(w http.ResponseWriter, nonce string, secure bool) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     magicLinkCookie,
+		Value:    nonce,
+		Path:     "/users",
+		HttpOnly: true,
+		Secure:   secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func clearMagicLinkCookie(w http.ResponseWriter, secure bool) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     magicLinkCookie,
+		Value:    "",
+		Path:     "/users",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func magicLinkNonce(r *http.Request) string {
+	cookie, err := r.Cookie(magicLinkCookie)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
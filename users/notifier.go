@@ -0,0 +1,159 @@
+package users
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/Kavuti/goauth/mail"
+	"github.com/Kavuti/goauth/utils"
+)
+
+// Notifier delivers to users the messages they need to act upon.
+type Notifier interface {
+	SendVerification(user *User, token string, expiresIn time.Duration) error
+	SendPasswordReset(user *User, token string, expiresIn time.Duration) error
+	SendMagicLink(user *User, token string, session bool, expiresIn time.Duration) error
+	SendPasswordChanged(user *User, changedAt time.Time) error
+	SendEmailChange(user *User, newEmail string, token string, expiresIn time.Duration) error
+	SendEmailChangeNotice(user *User, newEmail string) error
+	SendAccountLocked(user *User, lockedUntil time.Time) error
+}
+
+type messageData struct {
+	Name      string
+	Link      string
+	ExpiresIn string
+}
+
+type securityNoticeData struct {
+	Name     string
+	Time     string
+	NewEmail string
+}
+
+type mailNotifier struct {
+	mailer              mail.Mailer
+	verificationURL     string
+	passwordResetURL    string
+	magicLinkURL        string
+	sessionMagicLinkURL string
+	emailChangeURL      string
+}
+
+func (n *mailNotifier) SendVerification(user *User, token string, expiresIn time.Duration) error {
+	return n.send(mail.KindVerification, user, n.verificationURL, token, expiresIn)
+}
+
+func (n *mailNotifier) SendPasswordReset(user *User, token string, expiresIn time.Duration) error {
+	return n.send(mail.KindPasswordReset, user, n.passwordResetURL, token, expiresIn)
+}
+
+// SendMagicLink sends a sign-in link, which logs in with tokens or with a
+// session depending on the endpoint the user requested it from.
+func (n *mailNotifier) SendMagicLink(user *User, token string, session bool, expiresIn time.Duration) error {
+	link := n.magicLinkURL
+	if session {
+		link = n.sessionMagicLinkURL
+	}
+	return n.send(mail.KindMagicLink, user, link, token, expiresIn)
+}
+
+// SendPasswordChanged warns the user that their password changed, so that
+// they can react if they did not change it themselves.
+func (n *mailNotifier) SendPasswordChanged(user *User, changedAt time.Time) error {
+	message, err := mail.Compose(mail.KindPasswordChanged, user.Email, &securityNoticeData{
+		Name: user.FirstName,
+		Time: changedAt.UTC().Format("2 January 2006 at 15:04 UTC"),
+	})
+	if err != nil {
+		return err
+	}
+	return n.mailer.Send(message)
+}
+
+// SendEmailChange sends the link confirming a new address to the address
+// itself, proving the user owns it.
+func (n *mailNotifier) SendEmailChange(user *User, newEmail string, token string, expiresIn time.Duration) error {
+	message, err := mail.Compose(mail.KindEmailChange, newEmail, &messageData{
+		Name:      user.FirstName,
+		Link:      withToken(n.emailChangeURL, token),
+		ExpiresIn: mail.HumanDuration(expiresIn),
+	})
+	if err != nil {
+		return err
+	}
+	return n.mailer.Send(message)
+}
+
+// SendEmailChangeNotice warns the current address of the user that a change
+// to another one was requested.
+func (n *mailNotifier) SendEmailChangeNotice(user *User, newEmail string) error {
+	message, err := mail.Compose(mail.KindEmailChangeNotice, user.Email, &securityNoticeData{
+		Name:     user.FirstName,
+		NewEmail: newEmail,
+	})
+	if err != nil {
+		return err
+	}
+	return n.mailer.Send(message)
+}
+
+// SendAccountLocked warns the user that too many wrong passwords locked their
+// account, which may mean someone is trying to guess it.
+func (n *mailNotifier) SendAccountLocked(user *User, lockedUntil time.Time) error {
+	message, err := mail.Compose(mail.KindAccountLocked, user.Email, &securityNoticeData{
+		Name: user.FirstName,
+		Time: lockedUntil.UTC().Format("2 January 2006 at 15:04 UTC"),
+	})
+	if err != nil {
+		return err
+	}
+	return n.mailer.Send(message)
+}
+
+func (n *mailNotifier) send(kind string, user *User, link string, token string, expiresIn time.Duration) error {
+	message, err := mail.Compose(kind, user.Email, &messageData{
+		Name:      user.FirstName,
+		Link:      withToken(link, token),
+		ExpiresIn: mail.HumanDuration(expiresIn),
+	})
+	if err != nil {
+		return err
+	}
+	return n.mailer.Send(message)
+}
+
+// NewMailNotifier builds the links sent to users from PUBLIC_URL, the address
+// goauth is reachable at. PASSWORD_RESET_URL is mandatory and points reset
+// links to the page of a client application serving the reset form, since
+// goauth only exposes the JSON endpoint that form posts to. Magic links always
+// point to goauth, since they only work along with the cookie it set when
+// they were requested.
+func NewMailNotifier(mailer mail.Mailer) Notifier {
+	publicURL := os.Getenv("PUBLIC_URL")
+	resetURL := os.Getenv("PASSWORD_RESET_URL")
+	if resetURL == "" {
+		utils.CheckError(errors.New("PASSWORD_RESET_URL must point to the page serving the password reset form"))
+	}
+	return &mailNotifier{
+		mailer:              mailer,
+		verificationURL:     publicURL + "/users/verify",
+		passwordResetURL:    resetURL,
+		magicLinkURL:        publicURL + "/users/login/magic-link",
+		sessionMagicLinkURL: publicURL + "/users/session/login/magic-link",
+		emailChangeURL:      publicURL + "/users/email/confirm",
+	}
+}
+
+func withToken(link string, token string) string {
+	parsed, err := url.Parse(link)
+	if err != nil {
+		return link + "?token=" + url.QueryEscape(token)
+	}
+	query := parsed.Query()
+	query.Set("token", token)
+	parsed.RawQuery = query.Encode()
+	return parsed.String()
+}
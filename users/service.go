@@ -1,65 +1,919 @@
 package users
 
 import (
+	"database/sql"
+	"log"
 	"net/http"
+	"os"
+	"strings"
+	"time"
 
+	"github.com/Kavuti/goauth/auth"
+	"github.com/Kavuti/goauth/mfa"
+	"github.com/Kavuti/goauth/passwords"
+	"github.com/Kavuti/goauth/ratelimit"
+	"github.com/Kavuti/goauth/sessions"
+	"github.com/Kavuti/goauth/tokens"
 	"github.com/Kavuti/goauth/utils"
+	"github.com/Kavuti/goauth/webauthn"
 	"github.com/jmoiron/sqlx"
 )
 
+var passwordAMR = []string{auth.AMRPassword}
+
+var magicLinkAMR = []string{auth.AMREmail}
+
+// passkeyAMR describes a passwordless login, whose passkey required user
+// verification.
+var passkeyAMR = []string{auth.AMRHardwareKey, auth.AMRMFA}
+
+const (
+	defaultVerificationTTL  = 24 * time.Hour
+	defaultPasswordResetTTL = time.Hour
+	defaultResendInterval   = time.Minute
+	defaultMagicLinkTTL     = 15 * time.Minute
+	defaultEmailChangeTTL   = 24 * time.Hour
+)
+
 type UserService interface {
 	Registration(firstName string, lastName string, email string, password string) error
-	Verify(email string) error
+	Verify(token string) error
+	ResendVerification(email string) error
+	ForgotPassword(email string) error
+	ResetPassword(token string, password string) error
+	ChangePassword(principal *auth.Principal, currentPassword string, newPassword string) (*tokens.TokenResponse, error)
+	RequestEmailChange(email string, password string, newEmail string) error
+	ConfirmEmailChange(token string) error
+	Authenticate(email string, password string, ip string) (*User, error)
+	Login(email string, password string, ip string) (*tokens.TokenResponse, *MFAChallengeResponse, error)
+	CompleteLogin(mfaToken string, method string, code string) (*tokens.TokenResponse, error)
+	SessionLogin(email string, password string, ip string) (string, *MFAChallengeResponse, error)
+	CompleteSessionLogin(mfaToken string, method string, code string) (string, error)
+	SendMFAEmailCode(mfaToken string) error
+	RequestMagicLink(email string) (string, error)
+	MagicLinkLogin(token string, nonce string) (*tokens.TokenResponse, *MFAChallengeResponse, error)
+	RequestSessionMagicLink(email string) (string, error)
+	SessionMagicLinkLogin(token string, nonce string) (string, *MFAChallengeResponse, error)
+	PasskeyOptions() (*webauthn.RequestOptions, error)
+	PasskeyLogin(req *webauthn.AssertionRequest) (*tokens.TokenResponse, error)
+	SessionPasskeyLogin(req *webauthn.AssertionRequest) (string, error)
+	SessionLogout(token string) error
+	Logout(principal *auth.Principal) error
+	RevokeAll(email string) error
+	Unlock(email string) error
+	Get(email string) (*User, error)
 }
 
 type userService struct {
-	db *sqlx.DB
+	db       *sqlx.DB
+	tokens   tokens.TokenService
+	sessions sessions.SessionService
+	mfa      mfa.MFAService
+	webauthn webauthn.WebAuthnService
+	notifier Notifier
+	policy   passwords.Policy
+	hasher   passwords.Hasher
+
+	// dummyHash is verified when no user matches a login attempt, so that
+	// unknown emails take as long to reject as wrong passwords.
+	dummyHash string
+
+	// accountThrottle and ipThrottle hold back password logins after
+	// failures on the same account or from the same address.
+	accountThrottle throttle
+	ipThrottle      throttle
+
+	// mfaThrottle holds back the second step of logins after wrong codes on
+	// the same account, whatever the challenge they answered.
+	mfaThrottle throttle
+
+	breachCheckAtLogin bool
+	verificationTTL    time.Duration
+	passwordResetTTL   time.Duration
+	magicLinkTTL       time.Duration
+	emailChangeTTL     time.Duration
+	resendInterval     time.Duration
+
+	// limits holds the cooldowns between messages sent to the same address,
+	// shared between instances along with the other rate limits.
+	limits ratelimit.Store
 }
 
-func NewUserService(db *sqlx.DB) UserService {
-	return &userService{db: db}
+func NewUserService(db *sqlx.DB, tokenService tokens.TokenService, sessionService sessions.SessionService, mfaService mfa.MFAService, webAuthnService webauthn.WebAuthnService, notifier Notifier, limits ratelimit.Store) UserService {
+	hasher := passwords.HasherFromEnv()
+	dummyHash, _, err := hasher.Hash("goauth-dummy-password")
+	utils.CheckError(err)
+	return &userService{
+		db:                 db,
+		tokens:             tokenService,
+		sessions:           sessionService,
+		mfa:                mfaService,
+		webauthn:           webAuthnService,
+		notifier:           notifier,
+		policy:             *passwords.PolicyFromEnv(),
+		hasher:             *hasher,
+		dummyHash:          dummyHash,
+		accountThrottle:    throttleFromEnv("LOGIN", defaultLoginDelayAfter, defaultLoginLockoutThreshold),
+		ipThrottle:         throttleFromEnv("LOGIN_IP", defaultIPDelayAfter, defaultIPLockoutThreshold),
+		mfaThrottle:        throttleFromEnv("LOGIN_MFA", defaultMFADelayAfter, defaultMFALockoutThreshold),
+		breachCheckAtLogin: os.Getenv("BREACHED_PASSWORDS_CHECK_AT_LOGIN") == "true",
+		verificationTTL:    utils.DurationFromEnv("VERIFICATION_TOKEN_TTL", defaultVerificationTTL),
+		passwordResetTTL:   utils.DurationFromEnv("PASSWORD_RESET_TOKEN_TTL", defaultPasswordResetTTL),
+		magicLinkTTL:       utils.DurationFromEnv("MAGIC_LINK_TTL", defaultMagicLinkTTL),
+		emailChangeTTL:     utils.DurationFromEnv("EMAIL_CHANGE_TOKEN_TTL", defaultEmailChangeTTL),
+		resendInterval:     utils.DurationFromEnv("VERIFICATION_RESEND_INTERVAL", defaultResendInterval),
+		limits:             limits,
+	}
 }
 
 func (s *userService) Registration(firstName string, lastName string, email string, password string) error {
+	err := s.policy.Check("password", password, firstName, lastName, email)
+	if err != nil {
+		return err
+	}
+
 	tx := s.db.MustBegin()
 	defer tx.Rollback()
 
 	var existingUsers []User
-	err := tx.Select(&existingUsers, "SELECT * FROM users WHERE email=$1", email)
+	err = tx.Select(&existingUsers, "SELECT * FROM users WHERE email=$1", email)
 	if err != nil {
 		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
 	}
 	if len(existingUsers) > 0 {
 		return utils.ServiceError("User already exists", http.StatusBadRequest)
 	}
-	user := NewUserForRegistration(firstName, lastName, email, password)
+	hash, pepperVersion, err := s.hasher.Hash(password)
+	if err != nil {
+		return err
+	}
+	user := NewUserForRegistration(firstName, lastName, email, hash, pepperVersion)
+
+	_, err = tx.NamedExec(`INSERT INTO users (first_name, last_name, email, password, pepper_version, verified) 
+		VALUES (:first_name, :last_name, :email, :password, :pepper_version, :verified)`, user)
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	token, err := createUserToken(tx, user.Email, purposeVerification, s.verificationTTL)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+
+	err = s.notifier.SendVerification(user, token, s.verificationTTL)
+	if err != nil {
+		log.Printf("Error sending verification to %s: %s\n", user.Email, err.Error())
+	}
+	return nil
+}
+
+// Verify consumes a verification token, marking its user as verified.
+func (s *userService) Verify(token string) error {
+	if token == "" {
+		return utils.ServiceError("Token parameter is mandatory", http.StatusBadRequest)
+	}
+
+	tx := s.db.MustBegin()
+	defer tx.Rollback()
+
+	email, err := consumeUserToken(tx, token, purposeVerification)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE users SET verified = true WHERE email=$1", email)
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	return nil
+}
+
+// ResendVerification issues a new verification token to an unverified user.
+// Unknown and already verified emails are silently ignored, so the response
+// does not reveal whether an account exists.
+func (s *userService) ResendVerification(email string) error {
+	if !s.allowResend(purposeVerification, email) {
+		return utils.ServiceError("Verification already sent recently, retry later", http.StatusTooManyRequests)
+	}
+
+	tx := s.db.MustBegin()
+	defer tx.Rollback()
+
+	var users []User
+	err := tx.Select(&users, "SELECT * FROM users WHERE email=$1 AND verified = false", email)
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	if len(users) == 0 {
+		return nil
+	}
+	token, err := createUserToken(tx, email, purposeVerification, s.verificationTTL)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+
+	err = s.notifier.SendVerification(&users[0], token, s.verificationTTL)
+	if err != nil {
+		log.Printf("Error sending verification to %s: %s\n", email, err.Error())
+	}
+	return nil
+}
 
-	_, err = tx.NamedExec(`INSERT INTO users (first_name, last_name, email, password, verified) 
-		VALUES (:first_name, :last_name, :email, :password, :verified)`, user)
+// allowResend throttles the messages sent to the same address for the same
+// purpose, regardless of whether an account exists for it. Like the rate
+// limits, it fails open when the store is unavailable.
+func (s *userService) allowResend(purpose string, email string) bool {
+	key := "resend:" + purpose + ":" + strings.ToLower(email)
+	result, err := s.limits.Take(key, ratelimit.Limit{Count: 1, Period: s.resendInterval})
+	if err != nil {
+		log.Printf("Error checking the resend interval of %s: %s\n", email, err.Error())
+		return true
+	}
+	return result.Allowed
+}
+
+// ForgotPassword sends a password reset token to the user. The outcome is the
+// same whether or not the email belongs to an account.
+func (s *userService) ForgotPassword(email string) error {
+	if !s.allowResend(purposePasswordReset, email) {
+		return utils.ServiceError("Password reset already requested recently, retry later", http.StatusTooManyRequests)
+	}
+
+	tx := s.db.MustBegin()
+	defer tx.Rollback()
+
+	var users []User
+	err := tx.Select(&users, "SELECT * FROM users WHERE email=$1", email)
 	if err != nil {
 		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
 	}
+	if len(users) == 0 {
+		return nil
+	}
+	token, err := createUserToken(tx, email, purposePasswordReset, s.passwordResetTTL)
+	if err != nil {
+		return err
+	}
 	err = tx.Commit()
 	if err != nil {
 		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
 	}
+
+	err = s.notifier.SendPasswordReset(&users[0], token, s.passwordResetTTL)
+	if err != nil {
+		log.Printf("Error sending password reset to %s: %s\n", email, err.Error())
+	}
 	return nil
 }
 
-func (s *userService) Verify(email string) error {
+// ResetPassword consumes a password reset token and replaces the password of
+// its user, signing them out everywhere.
+func (s *userService) ResetPassword(token string, password string) error {
+	tx := s.db.MustBegin()
+	defer tx.Rollback()
+
+	email, err := consumeUserToken(tx, token, purposePasswordReset)
+	if err != nil {
+		return err
+	}
+	var user User
+	err = tx.Get(&user, "SELECT * FROM users WHERE email=$1", email)
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	err = s.policy.Check("password", password, user.FirstName, user.LastName, user.Email)
+	if err != nil {
+		return err
+	}
+	hash, pepperVersion, err := s.hasher.Hash(password)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE users SET password = $1, pepper_version = $2, password_reset_required = false WHERE email = $3", hash, pepperVersion, email)
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	err = clearLoginFailures(tx, email)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+
+	err = s.tokens.RevokeAllForUser(email)
+	if err != nil {
+		return err
+	}
+	return s.sessions.DeleteAllForUser(email)
+}
+
+// ChangePassword replaces the password of an authenticated user who proved to
+// know the current one. Every other session of the user is deleted, and all
+// their tokens are revoked, access tokens included, so that whoever stole the
+// password is signed out at once. A caller authenticated with an access token
+// gets new tokens in return, while a session keeps working.
+func (s *userService) ChangePassword(principal *auth.Principal, currentPassword string, newPassword string) (*tokens.TokenResponse, error) {
+	tx := s.db.MustBegin()
+	defer tx.Rollback()
+
+	var user User
+	err := tx.Get(&user, "SELECT * FROM users WHERE email=$1 FOR UPDATE", principal.Email)
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	if !s.checkPassword(&user, currentPassword) {
+		return nil, utils.ServiceError("Current password is incorrect", http.StatusForbidden)
+	}
+	err = s.policy.Check("newPassword", newPassword, user.FirstName, user.LastName, user.Email)
+	if err != nil {
+		return nil, err
+	}
+	hash, pepperVersion, err := s.hasher.Hash(newPassword)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec("UPDATE users SET password = $1, pepper_version = $2, password_reset_required = false WHERE email = $3", hash, pepperVersion, user.Email)
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+
+	err = s.tokens.RevokeAllForUser(user.Email)
+	if err != nil {
+		return nil, err
+	}
+	err = s.sessions.DeleteOthersForUser(user.Email, principal.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	var response *tokens.TokenResponse
+	if principal.TokenID != "" {
+		response, err = s.tokens.IssueTokens(user.Email, user.Verified, principal.AMR)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = s.notifier.SendPasswordChanged(&user, time.Now())
+	if err != nil {
+		log.Printf("Error sending password change notice to %s: %s\n", user.Email, err.Error())
+	}
+	return response, nil
+}
+
+// RequestEmailChange sends a confirmation link to the new address of a user who
+// proved to know their password, and warns the current address about it. The
+// address changes only once the link is opened.
+func (s *userService) RequestEmailChange(email string, password string, newEmail string) error {
 	tx := s.db.MustBegin()
 	defer tx.Rollback()
 
 	var user User
 	err := tx.Get(&user, "SELECT * FROM users WHERE email=$1", email)
 	if err != nil {
-		return utils.ServiceError(err.Error(), http.StatusBadRequest)
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	if !s.checkPassword(&user, password) {
+		return utils.ServiceError("Password is incorrect", http.StatusForbidden)
+	}
+	if strings.EqualFold(newEmail, user.Email) {
+		return utils.ServiceError("The new email is the current one", http.StatusBadRequest)
+	}
+	err = ensureEmailAvailable(tx, newEmail)
+	if err != nil {
+		return err
+	}
+	token, err := createUserToken(tx, user.Email, purposeEmailChange, s.emailChangeTTL)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO email_changes (token_hash, new_email) VALUES ($1, $2)", utils.HashToken(token), newEmail)
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+
+	err = s.notifier.SendEmailChange(&user, newEmail, token, s.emailChangeTTL)
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	err = s.notifier.SendEmailChangeNotice(&user, newEmail)
+	if err != nil {
+		log.Printf("Error sending email change notice to %s: %s\n", user.Email, err.Error())
+	}
+	return nil
+}
+
+// ConfirmEmailChange consumes an email change token and moves the user to the
+// new address, which is verified by the token itself. The rows referencing
+// the user follow the address through their foreign keys, while the user ID
+// stays the same. Every credential issued to the user is revoked, since they
+// all carry the old address.
+func (s *userService) ConfirmEmailChange(token string) error {
+	if token == "" {
+		return utils.ServiceError("Token parameter is mandatory", http.StatusBadRequest)
+	}
+
+	tx := s.db.MustBegin()
+	defer tx.Rollback()
+
+	email, err := consumeUserToken(tx, token, purposeEmailChange)
+	if err != nil {
+		return err
+	}
+	var newEmail string
+	err = tx.Get(&newEmail, "SELECT new_email FROM email_changes WHERE token_hash=$1", utils.HashToken(token))
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	err = ensureEmailAvailable(tx, newEmail)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE users SET email = $1, verified = true WHERE email = $2", newEmail, email)
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+
+	return s.RevokeAll(newEmail)
+}
+
+func ensureEmailAvailable(tx *sqlx.Tx, email string) error {
+	var users int
+	err := tx.Get(&users, "SELECT COUNT(*) FROM users WHERE email=$1", email)
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	if users > 0 {
+		return utils.ServiceError("User already exists", http.StatusConflict)
+	}
+	return nil
+}
+
+// Authenticate checks the given credentials against the stored password hash.
+// Unknown emails and wrong passwords produce the same error. Repeated failures
+// block further attempts on the account or from the client address ip for a
+// while; logins not involving the password keep working meanwhile.
+func (s *userService) Authenticate(email string, password string, ip string) (*User, error) {
+	err := s.checkLoginAttempts(email, ip)
+	if err != nil {
+		return nil, err
 	}
 
-	tx.MustExec("UPDATE users SET verified = true WHERE email=$1", email)
+	tx := s.db.MustBegin()
+	defer tx.Rollback()
+
+	var user User
+	err = tx.Get(&user, "SELECT * FROM users WHERE email=$1", email)
+	if err == sql.ErrNoRows {
+		s.hasher.Verify(password, s.dummyHash, s.hasher.Pepper.Current)
+		return nil, s.failLogin(email, ip, nil)
+	}
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
 	err = tx.Commit()
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+
+	match, rehash, err := s.hasher.Verify(password, user.Password, user.PepperVersion)
+	if err != nil {
+		log.Printf("Error verifying the password of %s: %s\n", user.Email, err.Error())
+	}
+	if !match {
+		return nil, s.failLogin(email, ip, &user)
+	}
+	if !user.PasswordResetRequired && s.breachCheckAtLogin {
+		breached, err := s.policy.IsBreached(password)
+		if err != nil {
+			log.Printf("Error checking the password of %s against breaches: %s\n", user.Email, err.Error())
+		}
+		user.PasswordResetRequired = breached
+	}
+	if user.PasswordResetRequired {
+		err = s.requirePasswordReset(&user)
+		if err != nil {
+			return nil, err
+		}
+		return nil, s.failLogin(email, ip, &user)
+	}
+	if s.accountThrottle.enabled() {
+		err = clearLoginFailures(s.db, email)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if rehash {
+		s.rehashPassword(&user, password)
+	}
+	return &user, nil
+}
+
+// checkPassword tells whether the password matches the stored hash of the user.
+func (s *userService) checkPassword(user *User, password string) bool {
+	match, _, err := s.hasher.Verify(password, user.Password, user.PepperVersion)
+	if err != nil {
+		log.Printf("Error verifying the password of %s: %s\n", user.Email, err.Error())
+	}
+	return match
+}
+
+// rehashPassword replaces the stored hash of a user who just proved their
+// password with one made with the preferred algorithm, parameters and
+// pepper. The update is skipped if the password changed in the meantime, and
+// failures only delay the upgrade to the next login.
+func (s *userService) rehashPassword(user *User, password string) {
+	hash, pepperVersion, err := s.hasher.Hash(password)
+	if err == nil {
+		_, err = s.db.Exec("UPDATE users SET password = $1, pepper_version = $2 WHERE email = $3 AND password = $4",
+			hash, pepperVersion, user.Email, user.Password)
+	}
+	if err != nil {
+		log.Printf("Error rehashing the password of %s: %s\n", user.Email, err.Error())
+		return
+	}
+	user.Password = hash
+	user.PepperVersion = pepperVersion
+}
+
+// requirePasswordReset flags a user whose password must not be used anymore,
+// typically because it appeared in a data breach, and sends them a reset link.
+// The login is then rejected like one with a wrong password, so that trying
+// breached credentials does not tell which of them are valid: the user learns
+// what happened from the email.
+func (s *userService) requirePasswordReset(user *User) error {
+	_, err := s.db.Exec("UPDATE users SET password_reset_required = true WHERE email = $1", user.Email)
 	if err != nil {
 		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
 	}
+	err = s.ForgotPassword(user.Email)
+	if err != nil && utils.ErrorStatus(err) != http.StatusTooManyRequests {
+		return err
+	}
 	return nil
 }
+
+// Login checks the user's password and issues their tokens, unless the user
+// enrolled a second factor: a challenge to complete with CompleteLogin is
+// returned instead.
+func (s *userService) Login(email string, password string, ip string) (*tokens.TokenResponse, *MFAChallengeResponse, error) {
+	user, err := s.Authenticate(email, password, ip)
+	if err != nil {
+		return nil, nil, err
+	}
+	return s.issueTokens(user, passwordAMR)
+}
+
+// issueTokens issues the tokens of a user who proved a first factor, or
+// returns the MFA challenge they have to answer before.
+func (s *userService) issueTokens(user *User, amr []string) (*tokens.TokenResponse, *MFAChallengeResponse, error) {
+	challenge, err := s.challenge(user, amr)
+	if err != nil || challenge != nil {
+		return nil, challenge, err
+	}
+	response, err := s.tokens.IssueTokens(user.Email, user.Verified, amr)
+	return response, nil, err
+}
+
+func (s *userService) CompleteLogin(mfaToken string, method string, code string) (*tokens.TokenResponse, error) {
+	user, amr, err := s.verifyChallenge(mfaToken, method, code)
+	if err != nil {
+		return nil, err
+	}
+	return s.tokens.IssueTokens(user.Email, user.Verified, amr)
+}
+
+func (s *userService) SessionLogin(email string, password string, ip string) (string, *MFAChallengeResponse, error) {
+	user, err := s.Authenticate(email, password, ip)
+	if err != nil {
+		return "", nil, err
+	}
+	return s.createSession(user, passwordAMR)
+}
+
+// createSession is the counterpart of issueTokens for session logins.
+func (s *userService) createSession(user *User, amr []string) (string, *MFAChallengeResponse, error) {
+	challenge, err := s.challenge(user, amr)
+	if err != nil || challenge != nil {
+		return "", challenge, err
+	}
+	token, err := s.sessions.Create(user.Email, amr)
+	return token, nil, err
+}
+
+func (s *userService) CompleteSessionLogin(mfaToken string, method string, code string) (string, error) {
+	user, amr, err := s.verifyChallenge(mfaToken, method, code)
+	if err != nil {
+		return "", err
+	}
+	return s.sessions.Create(user.Email, amr)
+}
+
+// challenge starts the second step of the login of users who enrolled a
+// second factor, returning nil for the others.
+func (s *userService) challenge(user *User, amr []string) (*MFAChallengeResponse, error) {
+	methods, err := s.mfa.Methods(user.Email)
+	if err != nil || len(methods) == 0 {
+		return nil, err
+	}
+	methods = secondFactors(methods, amr)
+	if len(methods) == 0 {
+		return nil, utils.ServiceError("No second factor available for this login method", http.StatusForbidden)
+	}
+	token, err := s.mfa.CreateChallenge(user.Email, amr)
+	if err != nil {
+		return nil, err
+	}
+	response := &MFAChallengeResponse{MFARequired: true, MFAToken: token, Methods: methods}
+	for _, method := range methods {
+		if method == mfa.MethodWebAuthn {
+			response.WebAuthn, err = s.webauthn.BeginLogin(user.Email)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return response, nil
+}
+
+// secondFactors drops the methods which would prove again the first factor:
+// a code sent by email adds nothing to a magic link.
+func secondFactors(methods []string, amr []string) []string {
+	for _, ref := range amr {
+		if ref != auth.AMREmail {
+			continue
+		}
+		factors := []string{}
+		for _, method := range methods {
+			if method != mfa.MethodEmail {
+				factors = append(factors, method)
+			}
+		}
+		return factors
+	}
+	return methods
+}
+
+// SendMFAEmailCode emails a code answering the given login challenge.
+func (s *userService) SendMFAEmailCode(mfaToken string) error {
+	return s.mfa.SendEmailCode(mfaToken)
+}
+
+// verifyChallenge checks the second factor answering a login challenge.
+// Wrong codes are counted against the account, and too many of them block
+// the second step of its logins for a while.
+func (s *userService) verifyChallenge(mfaToken string, method string, code string) (*User, []string, error) {
+	email, err := s.mfa.ChallengeEmail(mfaToken)
+	if err != nil {
+		return nil, nil, err
+	}
+	counters := s.secondFactorCounters(email)
+	err = s.checkBlocked(counters)
+	if err != nil {
+		return nil, nil, err
+	}
+	user, err := s.Get(email)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	_, amr, err := s.mfa.VerifyChallenge(mfaToken, method, code)
+	if utils.ErrorStatus(err) == http.StatusUnauthorized {
+		countErr := s.countFailure(counters, user)
+		if countErr != nil {
+			return nil, nil, countErr
+		}
+		return nil, nil, err
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(counters) > 0 {
+		err = clearSecondFactorFailures(s.db, email)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return user, amr, nil
+}
+
+// RequestMagicLink emails the user a single-use sign-in link. The returned
+// nonce has to be kept by the requesting browser: the link only works along
+// with it, so that a forwarded link is useless. The outcome is the same
+// whether or not the email belongs to an account.
+func (s *userService) RequestMagicLink(email string) (string, error) {
+	return s.requestMagicLink(email, purposeMagicLink)
+}
+
+func (s *userService) MagicLinkLogin(token string, nonce string) (*tokens.TokenResponse, *MFAChallengeResponse, error) {
+	user, err := s.consumeMagicLink(token, nonce, purposeMagicLink)
+	if err != nil {
+		return nil, nil, err
+	}
+	return s.issueTokens(user, magicLinkAMR)
+}
+
+func (s *userService) RequestSessionMagicLink(email string) (string, error) {
+	return s.requestMagicLink(email, purposeSessionMagicLink)
+}
+
+func (s *userService) SessionMagicLinkLogin(token string, nonce string) (string, *MFAChallengeResponse, error) {
+	user, err := s.consumeMagicLink(token, nonce, purposeSessionMagicLink)
+	if err != nil {
+		return "", nil, err
+	}
+	return s.createSession(user, magicLinkAMR)
+}
+
+func (s *userService) requestMagicLink(email string, purpose string) (string, error) {
+	if !s.allowResend(purpose, email) {
+		return "", utils.ServiceError("Sign-in link already requested recently, retry later", http.StatusTooManyRequests)
+	}
+	nonce, err := utils.RandomToken()
+	if err != nil {
+		return "", utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+
+	tx := s.db.MustBegin()
+	defer tx.Rollback()
+
+	var users []User
+	err = tx.Select(&users, "SELECT * FROM users WHERE email=$1", email)
+	if err != nil {
+		return "", utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	if len(users) == 0 {
+		return nonce, nil
+	}
+	token, err := createBoundUserToken(tx, email, purpose, s.magicLinkTTL, nonce)
+	if err != nil {
+		return "", err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return "", utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+
+	err = s.notifier.SendMagicLink(&users[0], token, purpose == purposeSessionMagicLink, s.magicLinkTTL)
+	if err != nil {
+		log.Printf("Error sending magic link to %s: %s\n", email, err.Error())
+	}
+	return nonce, nil
+}
+
+// consumeMagicLink checks a sign-in link against the nonce of the browser it
+// is opened in. Opening the link proves the user owns the email, which gets
+// verified as well.
+func (s *userService) consumeMagicLink(token string, nonce string, purpose string) (*User, error) {
+	if nonce == "" {
+		return nil, utils.ServiceError("Sign-in links must be opened in the browser they were requested from", http.StatusBadRequest)
+	}
+
+	tx := s.db.MustBegin()
+	defer tx.Rollback()
+
+	email, err := consumeBoundUserToken(tx, token, purpose, nonce)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec("UPDATE users SET verified = true WHERE email = $1", email)
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	var user User
+	err = tx.Get(&user, "SELECT * FROM users WHERE email=$1", email)
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	return &user, nil
+}
+
+// PasskeyOptions starts a passwordless login, answered with any discoverable
+// passkey registered on the site.
+func (s *userService) PasskeyOptions() (*webauthn.RequestOptions, error) {
+	return s.webauthn.BeginLogin("")
+}
+
+// PasskeyLogin completes a passwordless login. The passkey verified the user,
+// so it counts as multi-factor on its own.
+func (s *userService) PasskeyLogin(req *webauthn.AssertionRequest) (*tokens.TokenResponse, error) {
+	user, err := s.authenticatePasskey(req)
+	if err != nil {
+		return nil, err
+	}
+	return s.tokens.IssueTokens(user.Email, user.Verified, passkeyAMR)
+}
+
+func (s *userService) SessionPasskeyLogin(req *webauthn.AssertionRequest) (string, error) {
+	user, err := s.authenticatePasskey(req)
+	if err != nil {
+		return "", err
+	}
+	return s.sessions.Create(user.Email, passkeyAMR)
+}
+
+func (s *userService) authenticatePasskey(req *webauthn.AssertionRequest) (*User, error) {
+	assertion, err := s.webauthn.FinishLogin(req)
+	if err != nil {
+		return nil, err
+	}
+	return s.Get(assertion.Email)
+}
+
+func (s *userService) SessionLogout(token string) error {
+	if token == "" {
+		return nil
+	}
+	return s.sessions.Delete(token)
+}
+
+// Logout revokes the access token the principal authenticated with, together
+// with the refresh token family it was issued from.
+func (s *userService) Logout(principal *auth.Principal) error {
+	if principal.TokenID == "" {
+		return utils.ServiceError("Logout requires a bearer access token", http.StatusBadRequest)
+	}
+	err := s.tokens.RevokeAccessToken(principal.TokenID, principal.TokenExpiresAt)
+	if err != nil {
+		return err
+	}
+	return s.tokens.RevokeFamily(principal.TokenFamily)
+}
+
+// RevokeAll invalidates every credential issued to the user: access and
+// refresh tokens as well as server-side sessions.
+func (s *userService) RevokeAll(email string) error {
+	user, err := s.Get(email)
+	if err != nil {
+		return err
+	}
+	err = s.tokens.RevokeAllForUser(user.Email)
+	if err != nil {
+		return err
+	}
+	return s.sessions.DeleteAllForUser(user.Email)
+}
+
+// Unlock lifts the block that failed logins, at either step, put on the
+// account of the user.
+func (s *userService) Unlock(email string) error {
+	user, err := s.Get(email)
+	if err != nil {
+		return err
+	}
+	err = clearLoginFailures(s.db, user.Email)
+	if err != nil {
+		return err
+	}
+	return clearSecondFactorFailures(s.db, user.Email)
+}
+
+func (s *userService) Get(email string) (*User, error) {
+	if email == "" {
+		return nil, utils.ServiceError("Email parameter is mandatory", http.StatusBadRequest)
+	}
+
+	tx := s.db.MustBegin()
+	defer tx.Rollback()
+
+	var user User
+	err := tx.Get(&user, "SELECT * FROM users WHERE email=$1", email)
+	if err == sql.ErrNoRows {
+		return nil, utils.ServiceError("No user found with the given email", http.StatusNotFound)
+	}
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	return &user, nil
+}
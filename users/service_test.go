@@ -1,13 +1,30 @@
 package users
 
 import (
+	"database/sql"
 	"errors"
+	"net/http"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/Kavuti/goauth/auth"
+	"github.com/Kavuti/goauth/mfa"
+	"github.com/Kavuti/goauth/passwords"
+	"github.com/Kavuti/goauth/ratelimit"
+	"github.com/Kavuti/goauth/sessions"
+	"github.com/Kavuti/goauth/tokens"
+	"github.com/Kavuti/goauth/utils"
+	"github.com/Kavuti/goauth/webauthn"
 	"github.com/jmoiron/sqlx"
+	"golang.org/x/crypto/bcrypt"
 )
 
+// testHasher keeps the tests fast, producing hashes the default hasher still
+// verifies.
+var testHasher = passwords.Hasher{Algorithm: passwords.AlgorithmBcrypt, BcryptCost: bcrypt.MinCost}
+
 func Test_Registration(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
@@ -18,13 +35,19 @@ func Test_Registration(t *testing.T) {
 	mock.ExpectBegin()
 	mock.ExpectQuery("SELECT (.+) FROM users WHERE (.+)").WillReturnRows(sqlmock.NewRows([]string{"first_name", "last_name", "email", "password", "verified"}))
 	mock.ExpectExec("INSERT INTO users").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("UPDATE user_tokens SET consumed_at").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO user_tokens").WithArgs(sqlmock.AnyArg(), "Test", purposeVerification, sqlmock.AnyArg(), nil).WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectCommit()
 
-	service := &userService{db: sqlx.NewDb(db, "sqlmock")}
+	notifier := &notifierStub{}
+	service := &userService{db: sqlx.NewDb(db, "sqlmock"), notifier: notifier, verificationTTL: time.Hour}
 	err = service.Registration("Test", "Test", "Test", "Test")
 	if err != nil {
 		t.Fatalf("Error executing Registration test: %s\n", err.Error())
 	}
+	if notifier.verifications["Test"] == "" {
+		t.Fatal("Error executing Registration test: verification not sent")
+	}
 }
 
 func Test_Registration_UserAlreadyExisting(t *testing.T) {
@@ -71,18 +94,18 @@ func Test_Verify(t *testing.T) {
 	defer db.Close()
 
 	mock.ExpectBegin()
-	mock.ExpectQuery("SELECT (.+) FROM users WHERE .+").WillReturnRows(sqlmock.NewRows([]string{"first_name", "last_name", "email", "password", "verified"}).AddRow("test", "test", "test", "test", false))
-	mock.ExpectExec("UPDATE users").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery("UPDATE user_tokens SET consumed_at (.+) RETURNING user_email").WithArgs(utils.HashToken("token"), purposeVerification).WillReturnRows(sqlmock.NewRows([]string{"user_email"}).AddRow("test"))
+	mock.ExpectExec("UPDATE users").WithArgs("test").WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectCommit()
 
 	service := &userService{db: sqlx.NewDb(db, "sqlmock")}
-	err = service.Verify("test")
+	err = service.Verify("token")
 	if err != nil {
 		t.Fatalf("Error executing Verify test: %s\n", err.Error())
 	}
 }
 
-func Test_Verify_MissingUser(t *testing.T) {
+func Test_Verify_InvalidToken(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
 		t.Fatalf("Error: %s\n", err.Error())
@@ -90,13 +113,1104 @@ func Test_Verify_MissingUser(t *testing.T) {
 	defer db.Close()
 
 	mock.ExpectBegin()
-	mock.ExpectQuery("SELECT (.+) FROM users WHERE .+").WillReturnError(errors.New("Not found"))
+	mock.ExpectQuery("UPDATE user_tokens SET consumed_at (.+) RETURNING user_email").WillReturnError(sql.ErrNoRows)
 	mock.ExpectRollback()
 
 	service := &userService{db: sqlx.NewDb(db, "sqlmock")}
-	err = service.Verify("test")
+	err = service.Verify("token")
+	if err == nil {
+		t.Fatal("Error executing Verify_InvalidToken test: no error returned")
+	}
+
+}
+
+func Test_ResendVerification(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE .+").WillReturnRows(sqlmock.NewRows([]string{"first_name", "last_name", "email", "password", "verified"}).AddRow("test", "test", "test@test.com", "hash", false))
+	mock.ExpectExec("UPDATE user_tokens SET consumed_at").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("INSERT INTO user_tokens").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	notifier := &notifierStub{}
+	service := &userService{db: sqlx.NewDb(db, "sqlmock"), notifier: notifier, verificationTTL: time.Hour, resendInterval: time.Minute, limits: ratelimit.NewMemoryStore()}
+	err = service.ResendVerification("test@test.com")
+	if err != nil {
+		t.Fatalf("Error executing ResendVerification test: %s\n", err.Error())
+	}
+	if notifier.verifications["test@test.com"] == "" {
+		t.Fatal("Error executing ResendVerification test: verification not sent")
+	}
+
+	err = service.ResendVerification("TEST@test.com")
+	if err == nil {
+		t.Fatal("Error executing ResendVerification test: second request not rate limited")
+	}
+}
+
+func Test_ResendVerification_UnknownUser(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE .+").WillReturnRows(sqlmock.NewRows([]string{"first_name", "last_name", "email", "password", "verified"}))
+	mock.ExpectRollback()
+
+	notifier := &notifierStub{}
+	service := &userService{db: sqlx.NewDb(db, "sqlmock"), notifier: notifier, verificationTTL: time.Hour, resendInterval: time.Minute, limits: ratelimit.NewMemoryStore()}
+	err = service.ResendVerification("test@test.com")
+	if err != nil {
+		t.Fatalf("Error executing ResendVerification_UnknownUser test: %s\n", err.Error())
+	}
+	if len(notifier.verifications) != 0 {
+		t.Fatal("Error executing ResendVerification_UnknownUser test: verification sent to unknown user")
+	}
+}
+
+func Test_Login(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE .+").WillReturnRows(sqlmock.NewRows([]string{"first_name", "last_name", "email", "password", "verified"}).AddRow("test", "test", "test@test.com", string(hash), true))
+	mock.ExpectCommit()
+
+	service := &userService{db: sqlx.NewDb(db, "sqlmock"), tokens: &tokenServiceStub{}, mfa: &mfaServiceStub{}}
+	response, challenge, err := service.Login("test@test.com", "password", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("Error executing Login test: %s\n", err.Error())
+	}
+	if challenge != nil || response.AccessToken != "test@test.com" {
+		t.Fatalf("Error executing Login test: unexpected response %v\n", response)
+	}
+}
+
+func Test_Login_Rehash(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	hash, _, _ := testHasher.Hash("password")
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE .+").WillReturnRows(sqlmock.NewRows([]string{"first_name", "last_name", "email", "password", "verified"}).AddRow("test", "test", "test@test.com", hash, true))
+	mock.ExpectCommit()
+	mock.ExpectExec("UPDATE users SET password (.+) AND password").WithArgs(sqlmock.AnyArg(), 0, "test@test.com", hash).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	hasher := passwords.Hasher{Argon2: passwords.Argon2Params{Memory: 1024, Iterations: 1, Parallelism: 1}}
+	service := &userService{db: sqlx.NewDb(db, "sqlmock"), tokens: &tokenServiceStub{}, mfa: &mfaServiceStub{}, hasher: hasher}
+	user, err := service.Authenticate("test@test.com", "password", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("Error executing Login_Rehash test: %s\n", err.Error())
+	}
+	if !strings.HasPrefix(user.Password, "$argon2id$") {
+		t.Fatalf("Error executing Login_Rehash test: password not rehashed %s\n", user.Password)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("Error executing Login_Rehash test: %s\n", err.Error())
+	}
+}
+
+func Test_Login_BreachedPassword(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE .+").WillReturnRows(sqlmock.NewRows([]string{"first_name", "last_name", "email", "password", "verified"}).AddRow("test", "test", "test@test.com", string(hash), true))
+	mock.ExpectCommit()
+	mock.ExpectExec("UPDATE users SET password_reset_required = true").WithArgs("test@test.com").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE .+").WillReturnRows(sqlmock.NewRows([]string{"first_name", "last_name", "email", "password", "verified", "password_reset_required"}).AddRow("test", "test", "test@test.com", string(hash), true, true))
+	mock.ExpectExec("UPDATE user_tokens SET consumed_at").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO user_tokens").WithArgs(sqlmock.AnyArg(), "test@test.com", purposePasswordReset, sqlmock.AnyArg(), nil).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	tokenStub := &tokenServiceStub{}
+	notifier := &notifierStub{}
+	service := &userService{db: sqlx.NewDb(db, "sqlmock"), tokens: tokenStub, mfa: &mfaServiceStub{}, notifier: notifier,
+		policy: passwords.Policy{Breaches: breachCorpusStub{"password": 42}}, breachCheckAtLogin: true, limits: ratelimit.NewMemoryStore(), resendInterval: time.Minute}
+	_, _, err = service.Login("test@test.com", "password", "127.0.0.1")
+	if utils.ErrorStatus(err) != http.StatusUnauthorized {
+		t.Fatalf("Error executing Login_BreachedPassword test: unexpected error %v\n", err)
+	}
+	if len(tokenStub.issued) != 0 || notifier.resets["test@test.com"] == "" {
+		t.Fatal("Error executing Login_BreachedPassword test: login not blocked until reset")
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("Error executing Login_BreachedPassword test: %s\n", err.Error())
+	}
+}
+
+type breachCorpusStub map[string]int
+
+func (c breachCorpusStub) Count(password string) (int, error) {
+	return c[password], nil
+}
+
+func Test_Login_MFARequired(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE .+").WillReturnRows(sqlmock.NewRows([]string{"first_name", "last_name", "email", "password", "verified"}).AddRow("test", "test", "test@test.com", string(hash), true))
+	mock.ExpectCommit()
+
+	tokenStub := &tokenServiceStub{}
+	service := &userService{db: sqlx.NewDb(db, "sqlmock"), tokens: tokenStub, mfa: &mfaServiceStub{methods: []string{"totp"}}}
+	response, challenge, err := service.Login("test@test.com", "password", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("Error executing Login_MFARequired test: %s\n", err.Error())
+	}
+	if response != nil || challenge == nil || !challenge.MFARequired || challenge.MFAToken != "challenge" {
+		t.Fatalf("Error executing Login_MFARequired test: unexpected challenge %v\n", challenge)
+	}
+	if len(tokenStub.issued) != 0 {
+		t.Fatal("Error executing Login_MFARequired test: tokens issued before the second factor")
+	}
+}
+
+func Test_CompleteLogin(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE .+").WillReturnRows(sqlmock.NewRows([]string{"first_name", "last_name", "email", "password", "verified"}).AddRow("test", "test", "test@test.com", "hash", true))
+	mock.ExpectCommit()
+
+	tokenStub := &tokenServiceStub{}
+	service := &userService{db: sqlx.NewDb(db, "sqlmock"), tokens: tokenStub, mfa: &mfaServiceStub{methods: []string{"totp"}}}
+	_, err = service.CompleteLogin("challenge", "totp", "123456")
+	if err != nil {
+		t.Fatalf("Error executing CompleteLogin test: %s\n", err.Error())
+	}
+	if len(tokenStub.issued) != 1 || tokenStub.issued[0] != "pwd,otp,mfa" {
+		t.Fatalf("Error executing CompleteLogin test: unexpected amr %v\n", tokenStub.issued)
+	}
+}
+
+func Test_CompleteLogin_Lockout(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT blocked_until FROM login_attempts").WithArgs(attemptsSecondFactor, "test@test.com").WillReturnError(sql.ErrNoRows)
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE .+").WillReturnRows(sqlmock.NewRows([]string{"first_name", "last_name", "email", "password", "verified"}).AddRow("test", "test", "test@test.com", "hash", true))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO login_attempts (.+) RETURNING failures").WithArgs(attemptsSecondFactor, "test@test.com", sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(10))
+	mock.ExpectExec("UPDATE login_attempts SET blocked_until").WithArgs(sqlmock.AnyArg(), attemptsSecondFactor, "test@test.com").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectQuery("SELECT blocked_until FROM login_attempts").WithArgs(attemptsSecondFactor, "test@test.com").WillReturnRows(sqlmock.NewRows([]string{"blocked_until"}).AddRow(time.Now().Add(time.Hour)))
+
+	notifier := &notifierStub{}
+	service := &userService{db: sqlx.NewDb(db, "sqlmock"), tokens: &tokenServiceStub{}, mfa: &mfaServiceStub{methods: []string{"totp"}}, notifier: notifier, mfaThrottle: testThrottle}
+	_, err = service.CompleteLogin("challenge", "totp", "000000")
+	if utils.ErrorStatus(err) != http.StatusUnauthorized {
+		t.Fatalf("Error executing CompleteLogin_Lockout test: unexpected error %v\n", err)
+	}
+	if len(notifier.lockouts) != 1 {
+		t.Fatal("Error executing CompleteLogin_Lockout test: lockout notice not sent")
+	}
+	_, err = service.CompleteLogin("new-challenge", "totp", "123456")
+	if utils.ErrorStatus(err) != http.StatusTooManyRequests {
+		t.Fatalf("Error executing CompleteLogin_Lockout test: new challenge not blocked, got %v\n", err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("Error executing CompleteLogin_Lockout test: %s\n", err.Error())
+	}
+}
+
+func Test_RequestMagicLink(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE .+").WillReturnRows(sqlmock.NewRows([]string{"first_name", "last_name", "email", "password", "verified"}).AddRow("test", "test", "test@test.com", "hash", true))
+	mock.ExpectExec("UPDATE user_tokens SET consumed_at").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO user_tokens").WithArgs(sqlmock.AnyArg(), "test@test.com", purposeMagicLink, sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	notifier := &notifierStub{}
+	service := &userService{db: sqlx.NewDb(db, "sqlmock"), notifier: notifier, magicLinkTTL: time.Minute, resendInterval: time.Minute, limits: ratelimit.NewMemoryStore()}
+	nonce, err := service.RequestMagicLink("test@test.com")
+	if err != nil {
+		t.Fatalf("Error executing RequestMagicLink test: %s\n", err.Error())
+	}
+	if nonce == "" || notifier.magicLinks["test@test.com"] == "" {
+		t.Fatal("Error executing RequestMagicLink test: magic link not sent")
+	}
+}
+
+func Test_RequestMagicLink_UnknownUser(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE .+").WillReturnRows(sqlmock.NewRows([]string{"first_name", "last_name", "email", "password", "verified"}))
+	mock.ExpectRollback()
+
+	notifier := &notifierStub{}
+	service := &userService{db: sqlx.NewDb(db, "sqlmock"), notifier: notifier, magicLinkTTL: time.Minute, resendInterval: time.Minute, limits: ratelimit.NewMemoryStore()}
+	nonce, err := service.RequestMagicLink("test@test.com")
+	if err != nil {
+		t.Fatalf("Error executing RequestMagicLink_UnknownUser test: %s\n", err.Error())
+	}
+	if nonce == "" || len(notifier.magicLinks) != 0 {
+		t.Fatal("Error executing RequestMagicLink_UnknownUser test: unexpected outcome")
+	}
+}
+
+func Test_MagicLinkLogin(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE user_tokens SET consumed_at (.+) RETURNING user_email").WithArgs(utils.HashToken("token"), purposeMagicLink, utils.HashToken("nonce")).WillReturnRows(sqlmock.NewRows([]string{"user_email"}).AddRow("test@test.com"))
+	mock.ExpectExec("UPDATE users SET verified").WithArgs("test@test.com").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE .+").WillReturnRows(sqlmock.NewRows([]string{"first_name", "last_name", "email", "password", "verified"}).AddRow("test", "test", "test@test.com", "hash", true))
+	mock.ExpectCommit()
+
+	tokenStub := &tokenServiceStub{}
+	service := &userService{db: sqlx.NewDb(db, "sqlmock"), tokens: tokenStub, mfa: &mfaServiceStub{}}
+	response, challenge, err := service.MagicLinkLogin("token", "nonce")
+	if err != nil {
+		t.Fatalf("Error executing MagicLinkLogin test: %s\n", err.Error())
+	}
+	if challenge != nil || response == nil || tokenStub.issued[0] != "email" {
+		t.Fatalf("Error executing MagicLinkLogin test: unexpected amr %v\n", tokenStub.issued)
+	}
+}
+
+func Test_MagicLinkLogin_EmailSecondFactor(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE user_tokens SET consumed_at (.+) RETURNING user_email").WillReturnRows(sqlmock.NewRows([]string{"user_email"}).AddRow("test@test.com"))
+	mock.ExpectExec("UPDATE users SET verified").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE .+").WillReturnRows(sqlmock.NewRows([]string{"first_name", "last_name", "email", "password", "verified"}).AddRow("test", "test", "test@test.com", "hash", true))
+	mock.ExpectCommit()
+
+	service := &userService{db: sqlx.NewDb(db, "sqlmock"), tokens: &tokenServiceStub{}, mfa: &mfaServiceStub{methods: []string{"email", "recovery_code"}}}
+	_, challenge, err := service.MagicLinkLogin("token", "nonce")
+	if err != nil {
+		t.Fatalf("Error executing MagicLinkLogin_EmailSecondFactor test: %s\n", err.Error())
+	}
+	if challenge == nil || strings.Join(challenge.Methods, ",") != "recovery_code" {
+		t.Fatalf("Error executing MagicLinkLogin_EmailSecondFactor test: unexpected challenge %v\n", challenge)
+	}
+}
+
+func Test_MagicLinkLogin_WrongBrowser(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE user_tokens SET consumed_at (.+) RETURNING user_email").WithArgs(utils.HashToken("token"), purposeMagicLink, utils.HashToken("other")).WillReturnError(sql.ErrNoRows)
+	mock.ExpectRollback()
+
+	service := &userService{db: sqlx.NewDb(db, "sqlmock"), tokens: &tokenServiceStub{}, mfa: &mfaServiceStub{}}
+	_, _, err = service.MagicLinkLogin("token", "other")
+	if err == nil {
+		t.Fatal("Error executing MagicLinkLogin_WrongBrowser test: no error returned")
+	}
+	_, _, err = service.MagicLinkLogin("token", "")
+	if err == nil {
+		t.Fatal("Error executing MagicLinkLogin_WrongBrowser test: no error returned without nonce")
+	}
+}
+
+func Test_PasskeyLogin(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE .+").WillReturnRows(sqlmock.NewRows([]string{"first_name", "last_name", "email", "password", "verified"}).AddRow("test", "test", "test@test.com", "hash", true))
+	mock.ExpectCommit()
+
+	tokenStub := &tokenServiceStub{}
+	service := &userService{db: sqlx.NewDb(db, "sqlmock"), tokens: tokenStub, webauthn: &webAuthnServiceStub{}}
+	_, err = service.PasskeyLogin(&webauthn.AssertionRequest{ID: "credential"})
+	if err != nil {
+		t.Fatalf("Error executing PasskeyLogin test: %s\n", err.Error())
+	}
+	if len(tokenStub.issued) != 1 || tokenStub.issued[0] != "hwk,mfa" {
+		t.Fatalf("Error executing PasskeyLogin test: unexpected amr %v\n", tokenStub.issued)
+	}
+}
+
+func Test_PasskeyLogin_InvalidAssertion(t *testing.T) {
+	tokenStub := &tokenServiceStub{}
+	service := &userService{tokens: tokenStub, webauthn: &webAuthnServiceStub{}}
+	_, err := service.PasskeyLogin(&webauthn.AssertionRequest{ID: "unknown"})
+	if err == nil {
+		t.Fatal("Error executing PasskeyLogin_InvalidAssertion test: no error returned")
+	}
+	if len(tokenStub.issued) != 0 {
+		t.Fatal("Error executing PasskeyLogin_InvalidAssertion test: tokens issued")
+	}
+}
+
+func Test_CompleteLogin_WrongCode(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE .+").WillReturnRows(sqlmock.NewRows([]string{"first_name", "last_name", "email", "password", "verified"}).AddRow("test", "test", "test@test.com", "hash", true))
+	mock.ExpectCommit()
+
+	tokenStub := &tokenServiceStub{}
+	service := &userService{db: sqlx.NewDb(db, "sqlmock"), tokens: tokenStub, mfa: &mfaServiceStub{methods: []string{"totp"}}}
+	_, err = service.CompleteLogin("challenge", "totp", "000000")
+	if err == nil {
+		t.Fatal("Error executing CompleteLogin_WrongCode test: no error returned")
+	}
+	if len(tokenStub.issued) != 0 {
+		t.Fatal("Error executing CompleteLogin_WrongCode test: tokens issued")
+	}
+}
+
+func Test_Login_WrongPassword(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE .+").WillReturnRows(sqlmock.NewRows([]string{"first_name", "last_name", "email", "password", "verified"}).AddRow("test", "test", "test@test.com", string(hash), true))
+	mock.ExpectCommit()
+
+	service := &userService{db: sqlx.NewDb(db, "sqlmock"), tokens: &tokenServiceStub{}, mfa: &mfaServiceStub{}}
+	_, _, err = service.Login("test@test.com", "wrong", "127.0.0.1")
 	if err == nil {
-		t.Fatal("Error executing Verify_MissingUser test: no error returned")
+		t.Fatal("Error executing Login_WrongPassword test: no error returned")
+	}
+}
+
+func Test_Login_MissingUser(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
 	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE .+").WillReturnError(sql.ErrNoRows)
+	mock.ExpectRollback()
+
+	service := &userService{db: sqlx.NewDb(db, "sqlmock"), tokens: &tokenServiceStub{}, mfa: &mfaServiceStub{}}
+	_, _, err = service.Login("test@test.com", "password", "127.0.0.1")
+	if err == nil {
+		t.Fatal("Error executing Login_MissingUser test: no error returned")
+	}
+}
+
+var testThrottle = throttle{delayAfter: 3, baseDelay: time.Second, maxDelay: 30 * time.Second, lockAfter: 10, lockFor: time.Hour, window: time.Hour}
+
+func Test_Throttle_Delay(t *testing.T) {
+	expected := map[int]time.Duration{1: 0, 3: 0, 4: time.Second, 5: 2 * time.Second, 7: 8 * time.Second, 9: 30 * time.Second, 10: time.Hour, 25: time.Hour}
+	for failures, delay := range expected {
+		if testThrottle.delay(failures) != delay {
+			t.Fatalf("Error executing Throttle_Delay test: got %s after %d failures\n", testThrottle.delay(failures), failures)
+		}
+	}
+	if (throttle{}).enabled() || (throttle{}).delay(100) != 0 {
+		t.Fatal("Error executing Throttle_Delay test: zero throttle blocks")
+	}
+}
+
+func Test_Login_Lockout(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	mock.ExpectQuery("SELECT blocked_until FROM login_attempts").WithArgs(attemptsAccount, "test@test.com").WillReturnRows(sqlmock.NewRows([]string{"blocked_until"}).AddRow(time.Now().Add(-time.Minute)))
+	mock.ExpectQuery("SELECT blocked_until FROM login_attempts").WithArgs(attemptsIP, "127.0.0.1").WillReturnError(sql.ErrNoRows)
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE .+").WillReturnRows(sqlmock.NewRows([]string{"first_name", "last_name", "email", "password", "verified"}).AddRow("test", "test", "test@test.com", string(hash), true))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO login_attempts (.+) RETURNING failures").WithArgs(attemptsAccount, "test@test.com", sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(10))
+	mock.ExpectExec("UPDATE login_attempts SET blocked_until").WithArgs(sqlmock.AnyArg(), attemptsAccount, "test@test.com").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectQuery("INSERT INTO login_attempts (.+) RETURNING failures").WithArgs(attemptsIP, "127.0.0.1", sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnRows(sqlmock.NewRows([]string{"failures"}).AddRow(1))
+	mock.ExpectCommit()
+
+	notifier := &notifierStub{}
+	service := &userService{db: sqlx.NewDb(db, "sqlmock"), tokens: &tokenServiceStub{}, mfa: &mfaServiceStub{}, notifier: notifier, accountThrottle: testThrottle, ipThrottle: testThrottle}
+	_, _, err = service.Login("TEST@test.com", "wrong", "127.0.0.1")
+	if utils.ErrorStatus(err) != http.StatusUnauthorized {
+		t.Fatalf("Error executing Login_Lockout test: unexpected error %v\n", err)
+	}
+	if len(notifier.lockouts) != 1 {
+		t.Fatal("Error executing Login_Lockout test: lockout notice not sent")
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("Error executing Login_Lockout test: %s\n", err.Error())
+	}
+}
+
+func Test_Login_Blocked(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	mock.ExpectQuery("SELECT blocked_until FROM login_attempts").WithArgs(attemptsAccount, "unknown@test.com").WillReturnRows(sqlmock.NewRows([]string{"blocked_until"}).AddRow(time.Now().Add(time.Minute)))
+
+	service := &userService{db: sqlx.NewDb(db, "sqlmock"), tokens: &tokenServiceStub{}, mfa: &mfaServiceStub{}, accountThrottle: testThrottle}
+	_, _, err = service.Login("unknown@test.com", "password", "127.0.0.1")
+	if utils.ErrorStatus(err) != http.StatusTooManyRequests {
+		t.Fatalf("Error executing Login_Blocked test: unexpected error %v\n", err)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("Error executing Login_Blocked test: %s\n", err.Error())
+	}
+}
+
+func Test_Login_ClearsFailures(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	mock.ExpectQuery("SELECT blocked_until FROM login_attempts").WithArgs(attemptsAccount, "test@test.com").WillReturnRows(sqlmock.NewRows([]string{"blocked_until"}).AddRow(nil))
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE .+").WillReturnRows(sqlmock.NewRows([]string{"first_name", "last_name", "email", "password", "verified"}).AddRow("test", "test", "test@test.com", string(hash), true))
+	mock.ExpectCommit()
+	mock.ExpectExec("DELETE FROM login_attempts").WithArgs(attemptsAccount, "test@test.com").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	service := &userService{db: sqlx.NewDb(db, "sqlmock"), tokens: &tokenServiceStub{}, mfa: &mfaServiceStub{}, accountThrottle: testThrottle}
+	_, _, err = service.Login("test@test.com", "password", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("Error executing Login_ClearsFailures test: %s\n", err.Error())
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("Error executing Login_ClearsFailures test: %s\n", err.Error())
+	}
+}
+
+func Test_Unlock(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE .+").WillReturnRows(sqlmock.NewRows([]string{"first_name", "last_name", "email", "password", "verified"}).AddRow("test", "test", "Test@test.com", "hash", true))
+	mock.ExpectCommit()
+	mock.ExpectExec("DELETE FROM login_attempts").WithArgs(attemptsAccount, "test@test.com").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM login_attempts").WithArgs(attemptsSecondFactor, "test@test.com").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	service := &userService{db: sqlx.NewDb(db, "sqlmock")}
+	err = service.Unlock("Test@test.com")
+	if err != nil {
+		t.Fatalf("Error executing Unlock test: %s\n", err.Error())
+	}
+}
+
+func Test_SessionLogin(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE .+").WillReturnRows(sqlmock.NewRows([]string{"first_name", "last_name", "email", "password", "verified"}).AddRow("test", "test", "test@test.com", string(hash), true))
+	mock.ExpectCommit()
+
+	service := &userService{db: sqlx.NewDb(db, "sqlmock"), sessions: &sessionServiceStub{}, mfa: &mfaServiceStub{}}
+	token, _, err := service.SessionLogin("test@test.com", "password", "127.0.0.1")
+	if err != nil {
+		t.Fatalf("Error executing SessionLogin test: %s\n", err.Error())
+	}
+	if token != "test@test.com" {
+		t.Fatalf("Error executing SessionLogin test: unexpected session %s\n", token)
+	}
+}
+
+func Test_Get(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE .+").WillReturnRows(sqlmock.NewRows([]string{"first_name", "last_name", "email", "password", "verified"}).AddRow("test", "test", "test@test.com", "hash", true))
+	mock.ExpectCommit()
+
+	service := &userService{db: sqlx.NewDb(db, "sqlmock")}
+	user, err := service.Get("test@test.com")
+	if err != nil {
+		t.Fatalf("Error executing Get test: %s\n", err.Error())
+	}
+	if user.Email != "test@test.com" {
+		t.Fatalf("Error executing Get test: unexpected user %s\n", user.Email)
+	}
+}
+
+func Test_Logout(t *testing.T) {
+	stub := &tokenServiceStub{}
+	service := &userService{tokens: stub}
+	err := service.Logout(&auth.Principal{Email: "test@test.com", TokenID: "jti", TokenFamily: "family"})
+	if err != nil {
+		t.Fatalf("Error executing Logout test: %s\n", err.Error())
+	}
+	if len(stub.revoked) != 2 || stub.revoked[0] != "jti" || stub.revoked[1] != "family" {
+		t.Fatalf("Error executing Logout test: unexpected revocations %v\n", stub.revoked)
+	}
+}
+
+func Test_Logout_WithoutToken(t *testing.T) {
+	service := &userService{tokens: &tokenServiceStub{}}
+	err := service.Logout(&auth.Principal{Email: "test@test.com", SessionID: "session"})
+	if err == nil {
+		t.Fatal("Error executing Logout_WithoutToken test: no error returned")
+	}
+}
+
+func Test_RevokeAll(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE .+").WillReturnRows(sqlmock.NewRows([]string{"first_name", "last_name", "email", "password", "verified"}).AddRow("test", "test", "test@test.com", "hash", true))
+	mock.ExpectCommit()
+
+	stub := &tokenServiceStub{}
+	service := &userService{db: sqlx.NewDb(db, "sqlmock"), tokens: stub, sessions: &sessionServiceStub{}}
+	err = service.RevokeAll("test@test.com")
+	if err != nil {
+		t.Fatalf("Error executing RevokeAll test: %s\n", err.Error())
+	}
+	if len(stub.revoked) != 1 || stub.revoked[0] != "test@test.com" {
+		t.Fatalf("Error executing RevokeAll test: unexpected revocations %v\n", stub.revoked)
+	}
+}
+
+func Test_ForgotPassword(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE .+").WillReturnRows(sqlmock.NewRows([]string{"first_name", "last_name", "email", "password", "verified"}).AddRow("test", "test", "test@test.com", "hash", true))
+	mock.ExpectExec("UPDATE user_tokens SET consumed_at").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO user_tokens").WithArgs(sqlmock.AnyArg(), "test@test.com", purposePasswordReset, sqlmock.AnyArg(), nil).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	notifier := &notifierStub{}
+	service := &userService{db: sqlx.NewDb(db, "sqlmock"), notifier: notifier, passwordResetTTL: time.Hour, resendInterval: time.Minute, limits: ratelimit.NewMemoryStore()}
+	err = service.ForgotPassword("test@test.com")
+	if err != nil {
+		t.Fatalf("Error executing ForgotPassword test: %s\n", err.Error())
+	}
+	if notifier.resets["test@test.com"] == "" {
+		t.Fatal("Error executing ForgotPassword test: reset not sent")
+	}
+}
+
+func Test_ForgotPassword_UnknownEmail(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE .+").WillReturnRows(sqlmock.NewRows([]string{"first_name", "last_name", "email", "password", "verified"}))
+	mock.ExpectRollback()
+
+	notifier := &notifierStub{}
+	service := &userService{db: sqlx.NewDb(db, "sqlmock"), notifier: notifier, passwordResetTTL: time.Hour, resendInterval: time.Minute, limits: ratelimit.NewMemoryStore()}
+	err = service.ForgotPassword("test@test.com")
+	if err != nil {
+		t.Fatalf("Error executing ForgotPassword_UnknownEmail test: %s\n", err.Error())
+	}
+	if len(notifier.resets) != 0 {
+		t.Fatal("Error executing ForgotPassword_UnknownEmail test: reset sent to unknown email")
+	}
+}
+
+func Test_ResetPassword(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE user_tokens SET consumed_at (.+) RETURNING user_email").WithArgs(utils.HashToken("token"), purposePasswordReset).WillReturnRows(sqlmock.NewRows([]string{"user_email"}).AddRow("test@test.com"))
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE .+").WithArgs("test@test.com").WillReturnRows(sqlmock.NewRows([]string{"id", "first_name", "last_name", "email", "password", "verified"}).AddRow("id", "test", "test", "test@test.com", "hash", true))
+	mock.ExpectExec("UPDATE users SET password").WithArgs(sqlmock.AnyArg(), 0, "test@test.com").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("DELETE FROM login_attempts").WithArgs(attemptsAccount, "test@test.com").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	tokenStub := &tokenServiceStub{}
+	sessionStub := &sessionServiceStub{}
+	service := &userService{db: sqlx.NewDb(db, "sqlmock"), tokens: tokenStub, sessions: sessionStub}
+	err = service.ResetPassword("token", "new password")
+	if err != nil {
+		t.Fatalf("Error executing ResetPassword test: %s\n", err.Error())
+	}
+	if len(tokenStub.revoked) != 1 || sessionStub.deletedFor != "test@test.com" {
+		t.Fatal("Error executing ResetPassword test: credentials not revoked")
+	}
+}
+
+func Test_ResetPassword_PolicyViolation(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE user_tokens SET consumed_at (.+) RETURNING user_email").WillReturnRows(sqlmock.NewRows([]string{"user_email"}).AddRow("test@test.com"))
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE .+").WillReturnRows(sqlmock.NewRows([]string{"id", "first_name", "last_name", "email", "password", "verified"}).AddRow("id", "Mario", "Rossi", "test@test.com", "hash", true))
+	mock.ExpectRollback()
+
+	service := &userService{db: sqlx.NewDb(db, "sqlmock"), tokens: &tokenServiceStub{}, sessions: &sessionServiceStub{}, policy: passwords.Policy{MinLength: 8, RejectPersonal: true}}
+	err = service.ResetPassword("token", "mariorossi")
+	if err == nil {
+		t.Fatal("Error executing ResetPassword_PolicyViolation test: no error returned")
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Fatalf("Error executing ResetPassword_PolicyViolation test: %s\n", err.Error())
+	}
+}
+
+func Test_ResetPassword_InvalidToken(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE user_tokens SET consumed_at (.+) RETURNING user_email").WillReturnError(sql.ErrNoRows)
+	mock.ExpectRollback()
+
+	service := &userService{db: sqlx.NewDb(db, "sqlmock"), tokens: &tokenServiceStub{}, sessions: &sessionServiceStub{}}
+	err = service.ResetPassword("token", "new password")
+	if err == nil {
+		t.Fatal("Error executing ResetPassword_InvalidToken test: no error returned")
+	}
+}
+
+func Test_ChangePassword(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+	hash, _, _ := testHasher.Hash("old password")
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE .+ FOR UPDATE").WithArgs("test@test.com").WillReturnRows(sqlmock.NewRows([]string{"first_name", "last_name", "email", "password", "verified"}).AddRow("test", "test", "test@test.com", hash, true))
+	mock.ExpectExec("UPDATE users SET password").WithArgs(sqlmock.AnyArg(), 0, "test@test.com").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	tokenStub := &tokenServiceStub{}
+	sessionStub := &sessionServiceStub{}
+	notifier := &notifierStub{}
+	service := &userService{db: sqlx.NewDb(db, "sqlmock"), tokens: tokenStub, sessions: sessionStub, notifier: notifier}
+	principal := &auth.Principal{Email: "test@test.com", AMR: []string{"pwd"}, TokenID: "jti", TokenFamily: "family"}
+	response, err := service.ChangePassword(principal, "old password", "new password")
+	if err != nil {
+		t.Fatalf("Error executing ChangePassword test: %s\n", err.Error())
+	}
+	if len(tokenStub.revoked) != 1 || tokenStub.revoked[0] != "test@test.com" || sessionStub.deletedFor != "test@test.com" {
+		t.Fatalf("Error executing ChangePassword test: other credentials not revoked %v\n", tokenStub.revoked)
+	}
+	if response == nil || len(tokenStub.issued) != 1 {
+		t.Fatal("Error executing ChangePassword test: tokens of the caller not reissued")
+	}
+	if len(notifier.passwordChanges) != 1 {
+		t.Fatal("Error executing ChangePassword test: notification not sent")
+	}
+}
+
+func Test_ChangePassword_WrongPassword(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+	hash, _, _ := testHasher.Hash("old password")
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE .+ FOR UPDATE").WillReturnRows(sqlmock.NewRows([]string{"first_name", "last_name", "email", "password", "verified"}).AddRow("test", "test", "test@test.com", hash, true))
+	mock.ExpectRollback()
+
+	tokenStub := &tokenServiceStub{}
+	service := &userService{db: sqlx.NewDb(db, "sqlmock"), tokens: tokenStub, sessions: &sessionServiceStub{}, notifier: &notifierStub{}}
+	_, err = service.ChangePassword(&auth.Principal{Email: "test@test.com"}, "wrong password", "new password")
+	if err == nil {
+		t.Fatal("Error executing ChangePassword_WrongPassword test: no error returned")
+	}
+	if len(tokenStub.revoked) != 0 {
+		t.Fatal("Error executing ChangePassword_WrongPassword test: credentials revoked")
+	}
+}
+
+func Test_RequestEmailChange(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+	hash, _, _ := testHasher.Hash("password")
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE .+").WithArgs("test@test.com").WillReturnRows(sqlmock.NewRows([]string{"id", "first_name", "last_name", "email", "password", "verified"}).AddRow("id", "test", "test", "test@test.com", hash, true))
+	mock.ExpectQuery("SELECT COUNT(.+) FROM users WHERE .+").WithArgs("new@test.com").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectExec("UPDATE user_tokens SET consumed_at").WithArgs("test@test.com", purposeEmailChange).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO user_tokens").WithArgs(sqlmock.AnyArg(), "test@test.com", purposeEmailChange, sqlmock.AnyArg(), nil).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO email_changes").WithArgs(sqlmock.AnyArg(), "new@test.com").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	notifier := &notifierStub{}
+	service := &userService{db: sqlx.NewDb(db, "sqlmock"), notifier: notifier, emailChangeTTL: time.Hour}
+	err = service.RequestEmailChange("test@test.com", "password", "new@test.com")
+	if err != nil {
+		t.Fatalf("Error executing RequestEmailChange test: %s\n", err.Error())
+	}
+	if notifier.emailChanges["new@test.com"] == "" || len(notifier.emailNotices) != 1 || notifier.emailNotices[0] != "test@test.com" {
+		t.Fatal("Error executing RequestEmailChange test: notifications not sent")
+	}
+}
+
+func Test_RequestEmailChange_Taken(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+	hash, _, _ := testHasher.Hash("password")
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE .+").WillReturnRows(sqlmock.NewRows([]string{"id", "first_name", "last_name", "email", "password", "verified"}).AddRow("id", "test", "test", "test@test.com", hash, true))
+	mock.ExpectQuery("SELECT COUNT(.+) FROM users WHERE .+").WithArgs("other@test.com").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectRollback()
+
+	notifier := &notifierStub{}
+	service := &userService{db: sqlx.NewDb(db, "sqlmock"), notifier: notifier}
+	err = service.RequestEmailChange("test@test.com", "password", "other@test.com")
+	if err == nil {
+		t.Fatal("Error executing RequestEmailChange_Taken test: no error returned")
+	}
+	if len(notifier.emailChanges) != 0 {
+		t.Fatal("Error executing RequestEmailChange_Taken test: confirmation sent")
+	}
+}
+
+func Test_ConfirmEmailChange(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE user_tokens SET consumed_at (.+) RETURNING user_email").WithArgs(utils.HashToken("token"), purposeEmailChange).WillReturnRows(sqlmock.NewRows([]string{"user_email"}).AddRow("test@test.com"))
+	mock.ExpectQuery("SELECT new_email FROM email_changes .+").WithArgs(utils.HashToken("token")).WillReturnRows(sqlmock.NewRows([]string{"new_email"}).AddRow("new@test.com"))
+	mock.ExpectQuery("SELECT COUNT(.+) FROM users WHERE .+").WithArgs("new@test.com").WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	mock.ExpectExec("UPDATE users SET email").WithArgs("new@test.com", "test@test.com").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM users WHERE .+").WithArgs("new@test.com").WillReturnRows(sqlmock.NewRows([]string{"id", "first_name", "last_name", "email", "password", "verified"}).AddRow("id", "test", "test", "new@test.com", "hash", true))
+	mock.ExpectCommit()
+
+	tokenStub := &tokenServiceStub{}
+	sessionStub := &sessionServiceStub{}
+	service := &userService{db: sqlx.NewDb(db, "sqlmock"), tokens: tokenStub, sessions: sessionStub}
+	err = service.ConfirmEmailChange("token")
+	if err != nil {
+		t.Fatalf("Error executing ConfirmEmailChange test: %s\n", err.Error())
+	}
+	if len(tokenStub.revoked) != 1 || tokenStub.revoked[0] != "new@test.com" || sessionStub.deletedFor != "new@test.com" {
+		t.Fatal("Error executing ConfirmEmailChange test: credentials not revoked")
+	}
+}
+
+type tokenServiceStub struct {
+	revoked []string
+	issued  []string
+}
+
+func (s *tokenServiceStub) IssueTokens(email string, verified bool, amr []string) (*tokens.TokenResponse, error) {
+	s.issued = append(s.issued, strings.Join(amr, ","))
+	return &tokens.TokenResponse{AccessToken: email, RefreshToken: email, TokenType: "Bearer"}, nil
+}
+
+func (s *tokenServiceStub) IssueGrant(email string, verified bool, amr []string, grant *tokens.Grant) (*tokens.TokenResponse, error) {
+	return s.IssueTokens(email, verified, amr)
+}
+
+func (s *tokenServiceStub) IssueClientToken(grant *tokens.Grant) (*tokens.TokenResponse, error) {
+	return &tokens.TokenResponse{AccessToken: grant.ClientID, TokenType: "Bearer"}, nil
+}
+
+func (s *tokenServiceStub) SignIDToken(claims *tokens.IDClaims) (string, error) {
+	return claims.Subject, nil
+}
+
+func (s *tokenServiceStub) ParseAccessToken(token string) (*tokens.Claims, error) {
+	return &tokens.Claims{Email: token}, nil
+}
+
+func (s *tokenServiceStub) Refresh(refreshToken string, clientID string) (*tokens.TokenResponse, error) {
+	return &tokens.TokenResponse{AccessToken: refreshToken, RefreshToken: refreshToken, TokenType: "Bearer"}, nil
+}
+
+func (s *tokenServiceStub) Introspect(token string) (*tokens.Introspection, error) {
+	return &tokens.Introspection{Active: true, Username: token}, nil
+}
+
+func (s *tokenServiceStub) RevokeAccessToken(jti string, expiresAt time.Time) error {
+	s.revoked = append(s.revoked, jti)
+	return nil
+}
+
+func (s *tokenServiceStub) RevokeFamily(familyID string) error {
+	s.revoked = append(s.revoked, familyID)
+	return nil
+}
+
+func (s *tokenServiceStub) RevokeAllForUser(email string) error {
+	s.revoked = append(s.revoked, email)
+	return nil
+}
+
+func (s *tokenServiceStub) RevokeToken(token string, clientID string) error {
+	s.revoked = append(s.revoked, token)
+	return nil
+}
+
+type sessionServiceStub struct {
+	deletedFor string
+	kept       string
+}
+
+func (s *sessionServiceStub) Create(email string, amr []string) (string, error) {
+	return email, nil
+}
+
+func (s *sessionServiceStub) Get(token string) (*sessions.Session, error) {
+	return &sessions.Session{UserEmail: token}, nil
+}
+
+func (s *sessionServiceStub) Delete(token string) error {
+	return nil
+}
+
+func (s *sessionServiceStub) DeleteAllForUser(email string) error {
+	s.deletedFor = email
+	return nil
+}
+
+func (s *sessionServiceStub) DeleteOthersForUser(email string, idHash string) error {
+	s.deletedFor = email
+	s.kept = idHash
+	return nil
+}
+
+func (s *sessionServiceStub) Token(r *http.Request) string {
+	return ""
+}
+
+func (s *sessionServiceStub) SetCookie(w http.ResponseWriter, token string) {}
+
+func (s *sessionServiceStub) ClearCookie(w http.ResponseWriter) {}
+
+type notifierStub struct {
+	verifications   map[string]string
+	resets          map[string]string
+	magicLinks      map[string]string
+	passwordChanges []string
+	emailChanges    map[string]string
+	emailNotices    []string
+	lockouts        []string
+}
+
+func (n *notifierStub) SendVerification(user *User, token string, expiresIn time.Duration) error {
+	if n.verifications == nil {
+		n.verifications = map[string]string{}
+	}
+	n.verifications[user.Email] = token
+	return nil
+}
+
+func (n *notifierStub) SendPasswordReset(user *User, token string, expiresIn time.Duration) error {
+	if n.resets == nil {
+		n.resets = map[string]string{}
+	}
+	n.resets[user.Email] = token
+	return nil
+}
+
+func (n *notifierStub) SendMagicLink(user *User, token string, session bool, expiresIn time.Duration) error {
+	if n.magicLinks == nil {
+		n.magicLinks = map[string]string{}
+	}
+	n.magicLinks[user.Email] = token
+	return nil
+}
+
+func (n *notifierStub) SendPasswordChanged(user *User, changedAt time.Time) error {
+	n.passwordChanges = append(n.passwordChanges, user.Email)
+	return nil
+}
+
+func (n *notifierStub) SendEmailChange(user *User, newEmail string, token string, expiresIn time.Duration) error {
+	if n.emailChanges == nil {
+		n.emailChanges = map[string]string{}
+	}
+	n.emailChanges[newEmail] = token
+	return nil
+}
+
+func (n *notifierStub) SendEmailChangeNotice(user *User, newEmail string) error {
+	n.emailNotices = append(n.emailNotices, user.Email)
+	return nil
+}
+
+func (n *notifierStub) SendAccountLocked(user *User, lockedUntil time.Time) error {
+	n.lockouts = append(n.lockouts, user.Email)
+	return nil
+}
+
+type mfaServiceStub struct {
+	methods []string
+}
+
+func (s *mfaServiceStub) EnrollTOTP(email string) (*mfa.TOTPEnrollmentResponse, error) {
+	return &mfa.TOTPEnrollmentResponse{}, nil
+}
+
+func (s *mfaServiceStub) ConfirmTOTP(email string, code string) (*mfa.RecoveryCodesResponse, error) {
+	return &mfa.RecoveryCodesResponse{}, nil
+}
+
+func (s *mfaServiceStub) EnableEmail(email string) error {
+	return nil
+}
+
+func (s *mfaServiceStub) Methods(email string) ([]string, error) {
+	return s.methods, nil
+}
+
+func (s *mfaServiceStub) CreateChallenge(email string, amr []string) (string, error) {
+	return "challenge", nil
+}
+
+func (s *mfaServiceStub) SendEmailCode(token string) error {
+	return nil
+}
+
+func (s *mfaServiceStub) ChallengeEmail(token string) (string, error) {
+	return "test@test.com", nil
+}
+
+func (s *mfaServiceStub) VerifyChallenge(token string, method string, code string) (string, []string, error) {
+	if code != "123456" {
+		return "", nil, utils.ServiceError("Invalid code", http.StatusUnauthorized)
+	}
+	return "test@test.com", append([]string{"pwd"}, mfa.AMR(method)...), nil
+}
+
+type webAuthnServiceStub struct{}
+
+func (s *webAuthnServiceStub) BeginRegistration(email string) (*webauthn.CreationOptions, error) {
+	return &webauthn.CreationOptions{}, nil
+}
+
+func (s *webAuthnServiceStub) FinishRegistration(email string, req *webauthn.RegistrationRequest) (*webauthn.CredentialInfo, error) {
+	return &webauthn.CredentialInfo{}, nil
+}
+
+func (s *webAuthnServiceStub) BeginLogin(email string) (*webauthn.RequestOptions, error) {
+	return &webauthn.RequestOptions{Challenge: "challenge"}, nil
+}
+
+func (s *webAuthnServiceStub) FinishLogin(req *webauthn.AssertionRequest) (*webauthn.Assertion, error) {
+	if req.ID != "credential" {
+		return nil, utils.ServiceError("Invalid passkey assertion", http.StatusUnauthorized)
+	}
+	return &webauthn.Assertion{Email: "test@test.com", UserVerified: true}, nil
+}
+
+func (s *webAuthnServiceStub) Credentials(email string) ([]webauthn.CredentialInfo, error) {
+	return nil, nil
+}
 
+func (s *webAuthnServiceStub) DeleteCredential(email string, id []byte) error {
+	return nil
 }
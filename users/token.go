@@ -0,0 +1,74 @@
+package users
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/Kavuti/goauth/utils"
+	"github.com/jmoiron/sqlx"
+)
+
+// Purposes of the single-use tokens stored in the user_tokens table.
+const (
+	purposeVerification     = "verification"
+	purposePasswordReset    = "password_reset"
+	purposeMagicLink        = "magic_link"
+	purposeSessionMagicLink = "session_magic_link"
+	purposeEmailChange      = "email_change"
+)
+
+// createUserToken stores the hash of a new single-use token for the user,
+// invalidating the ones previously issued for the same purpose.
+func createUserToken(tx *sqlx.Tx, email string, purpose string, ttl time.Duration) (string, error) {
+	return createBoundUserToken(tx, email, purpose, ttl, "")
+}
+
+// createBoundUserToken is like createUserToken, but the token can only be
+// consumed along with the given binding, when not empty.
+func createBoundUserToken(tx *sqlx.Tx, email string, purpose string, ttl time.Duration, binding string) (string, error) {
+	token, err := utils.RandomToken()
+	if err != nil {
+		return "", utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+
+	_, err = tx.Exec("UPDATE user_tokens SET consumed_at = NOW() WHERE user_email = $1 AND purpose = $2 AND consumed_at IS NULL",
+		email, purpose)
+	if err != nil {
+		return "", utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	bindingHash := sql.NullString{String: utils.HashToken(binding), Valid: binding != ""}
+	_, err = tx.Exec("INSERT INTO user_tokens (token_hash, user_email, purpose, expires_at, binding_hash) VALUES ($1, $2, $3, $4, $5)",
+		utils.HashToken(token), email, purpose, time.Now().Add(ttl), bindingHash)
+	if err != nil {
+		return "", utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	return token, nil
+}
+
+// consumeUserToken marks a valid token as used and returns the email of the
+// user it was issued to.
+func consumeUserToken(tx *sqlx.Tx, token string, purpose string) (string, error) {
+	var email string
+	err := tx.Get(&email, `UPDATE user_tokens SET consumed_at = NOW()
+		WHERE token_hash = $1 AND purpose = $2 AND consumed_at IS NULL AND expires_at > NOW() AND binding_hash IS NULL
+		RETURNING user_email`, utils.HashToken(token), purpose)
+	if err != nil {
+		return "", utils.ServiceError("Invalid or expired token", http.StatusBadRequest)
+	}
+	return email, nil
+}
+
+// consumeBoundUserToken is the counterpart of consumeUserToken for tokens
+// created with a binding. A token presented without its binding is left
+// untouched, so that it can still be used by its legitimate holder.
+func consumeBoundUserToken(tx *sqlx.Tx, token string, purpose string, binding string) (string, error) {
+	var email string
+	err := tx.Get(&email, `UPDATE user_tokens SET consumed_at = NOW()
+		WHERE token_hash = $1 AND purpose = $2 AND consumed_at IS NULL AND expires_at > NOW() AND binding_hash = $3
+		RETURNING user_email`, utils.HashToken(token), purpose, utils.HashToken(binding))
+	if err != nil {
+		return "", utils.ServiceError("Invalid or expired token", http.StatusBadRequest)
+	}
+	return email, nil
+}
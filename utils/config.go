@@ -0,0 +1,31 @@
+package utils
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+// DurationFromEnv reads a duration such as "15m" from the named environment
+// variable, falling back to the given default when it is not set.
+func DurationFromEnv(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	parsed, err := time.ParseDuration(value)
+	CheckError(err)
+	return parsed
+}
+
+// IntFromEnv reads an integer from the named environment variable, falling
+// back to the given default when it is not set.
+func IntFromEnv(name string, fallback int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	parsed, err := strconv.Atoi(value)
+	CheckError(err)
+	return parsed
+}
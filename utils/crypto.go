@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"os"
+)
+
+// EncryptionKeyFromEnv decodes KEY_ENCRYPTION_KEY, the AES-256 key protecting
+// the secrets goauth needs to store in a recoverable form.
+func EncryptionKeyFromEnv() []byte {
+	key, err := base64.StdEncoding.DecodeString(os.Getenv("KEY_ENCRYPTION_KEY"))
+	CheckError(err)
+	if len(key) != 32 {
+		CheckError(errors.New("KEY_ENCRYPTION_KEY must be 32 base64 encoded bytes"))
+	}
+	return key
+}
+
+// Encrypt seals plaintext with AES-GCM, prefixing the random nonce.
+func Encrypt(key []byte, plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// Decrypt opens a ciphertext produced by Encrypt.
+func Decrypt(key []byte, ciphertext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext is too short")
+	}
+	nonce, sealed := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, sealed, nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -10,9 +10,10 @@ import (
 
 // ErrorResponse
 type errorResponse struct {
-	Message   string `json:"message"`
-	Code      int    `json:"code"`
-	Timestamp int64  `json:"timestamp"`
+	Message   string       `json:"message"`
+	Code      int          `json:"code"`
+	Errors    []FieldError `json:"errors,omitempty"`
+	Timestamp int64        `json:"timestamp"`
 }
 
 func (resp *errorResponse) Render(w http.ResponseWriter, r *http.Request) error {
@@ -24,10 +25,19 @@ func ErrorResponse(message string, code int) render.Renderer {
 	return &errorResponse{Message: message, Code: code}
 }
 
+// FieldError describes why the value of a request field was rejected. Code is
+// meant for programs, Message for people.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
 // ServiceError
 type serviceError struct {
 	Code    int
 	Message string
+	Fields  []FieldError
 }
 
 func (e *serviceError) Error() string {
@@ -38,16 +48,45 @@ func ServiceError(message string, code int) error {
 	return &serviceError{Message: message, Code: code}
 }
 
+// ValidationError reports the fields of a request that were rejected.
+func ValidationError(fields ...FieldError) error {
+	return &serviceError{Message: "Invalid request", Code: http.StatusBadRequest, Fields: fields}
+}
+
+// ErrorStatus returns the HTTP status an error is reported with.
+func ErrorStatus(err error) int {
+	serr, ok := err.(*serviceError)
+	if !ok {
+		return http.StatusInternalServerError
+	}
+	return serr.Code
+}
+
+// FieldErrors returns the rejected fields reported by a ValidationError.
+func FieldErrors(err error) []FieldError {
+	serr, ok := err.(*serviceError)
+	if !ok {
+		return nil
+	}
+	return serr.Fields
+}
+
+// ServiceErrorResponse reports an error to the client. The HTTP status of the
+// response is the code of the error, repeated in its body, so that clients can
+// rely on either; errors which are not service errors are reported as 500.
 func ServiceErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
 	code := http.StatusInternalServerError
 	message := err.Error()
+	var fields []FieldError
 
 	serr, ok := err.(*serviceError)
 	if ok {
 		code = serr.Code
 		message = serr.Message
+		fields = serr.Fields
 	}
-	render.Render(w, r, ErrorResponse(message, code))
+	render.Status(r, code)
+	render.Render(w, r, &errorResponse{Message: message, Code: code, Errors: fields})
 }
 
 func CheckError(err error) {
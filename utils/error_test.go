@@ -0,0 +1,29 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_ServiceErrorResponse_Status(t *testing.T) {
+	cases := map[error]int{
+		ServiceError("Not found", http.StatusNotFound):        http.StatusNotFound,
+		ServiceError("Unauthorized", http.StatusUnauthorized): http.StatusUnauthorized,
+		ValidationError(FieldError{Field: "email"}):           http.StatusBadRequest,
+		errors.New("Random error"):                            http.StatusInternalServerError,
+	}
+	for err, expected := range cases {
+		recorder := httptest.NewRecorder()
+		ServiceErrorResponse(recorder, httptest.NewRequest("GET", "/", nil), err)
+		if recorder.Code != expected {
+			t.Fatalf("Error executing ServiceErrorResponse_Status test: expected %d, got %d\n", expected, recorder.Code)
+		}
+		var body errorResponse
+		if err := json.NewDecoder(recorder.Body).Decode(&body); err != nil || body.Code != expected {
+			t.Fatalf("Error executing ServiceErrorResponse_Status test: unexpected body %+v\n", body)
+		}
+	}
+}
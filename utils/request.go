@@ -0,0 +1,97 @@
+package utils
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// trustedProxies are the networks of the proxies whose forwarded headers
+// ClientIP believes. Set once at startup by TrustProxiesFromEnv.
+var trustedProxies []*net.IPNet
+
+// TrustProxiesFromEnv reads TRUSTED_PROXIES, a comma separated list of the
+// addresses or CIDR ranges of the proxies goauth runs behind. Without it,
+// forwarded headers are ignored, as anyone could send them.
+func TrustProxiesFromEnv() {
+	trustedProxies = ParseProxies(os.Getenv("TRUSTED_PROXIES"))
+}
+
+// ParseProxies parses a comma separated list of addresses and CIDR ranges.
+func ParseProxies(value string) []*net.IPNet {
+	var proxies []*net.IPNet
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				CheckError(&net.ParseError{Type: "IP address", Text: entry})
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		CheckError(err)
+		proxies = append(proxies, network)
+	}
+	return proxies
+}
+
+// ClientIP returns the address of the client of a request. The headers set by
+// proxies are only believed when the request comes from a trusted proxy, so
+// that clients cannot pick the address they are rate limited and locked out
+// by.
+func ClientIP(r *http.Request) string {
+	return clientIP(r, trustedProxies)
+}
+
+func clientIP(r *http.Request, proxies []*net.IPNet) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !trusted(proxies, net.ParseIP(host)) {
+		return host
+	}
+
+	// Each proxy appends the address it got the request from, so the client
+	// is the rightmost hop that is not a trusted proxy. Hops on its left were
+	// sent by the client itself.
+	if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+		hops := strings.Split(strings.Join(forwarded, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := net.ParseIP(strings.TrimSpace(hops[i]))
+			if ip == nil {
+				return host
+			}
+			if !trusted(proxies, ip) || i == 0 {
+				return ip.String()
+			}
+		}
+	}
+	if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+		return ip.String()
+	}
+	return host
+}
+
+func trusted(proxies []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, proxy := range proxies {
+		if proxy.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,42 @@
+package utils
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_ClientIP_Untrusted(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "203.0.113.7:4321"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1")
+	r.Header.Set("X-Real-IP", "198.51.100.2")
+
+	if ip := clientIP(r, nil); ip != "203.0.113.7" {
+		t.Fatalf("Error executing ClientIP_Untrusted test: got %s\n", ip)
+	}
+	if ip := clientIP(r, ParseProxies("10.0.0.0/8")); ip != "203.0.113.7" {
+		t.Fatalf("Error executing ClientIP_Untrusted test: got %s\n", ip)
+	}
+}
+
+func Test_ClientIP_TrustedProxy(t *testing.T) {
+	proxies := ParseProxies("10.0.0.0/8, 192.0.2.1")
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "10.0.0.2:4321"
+	r.Header.Set("X-Forwarded-For", "198.51.100.9, 203.0.113.7, 192.0.2.1")
+
+	if ip := clientIP(r, proxies); ip != "203.0.113.7" {
+		t.Fatalf("Error executing ClientIP_TrustedProxy test: got %s\n", ip)
+	}
+
+	r.Header.Del("X-Forwarded-For")
+	r.Header.Set("X-Real-IP", "203.0.113.8")
+	if ip := clientIP(r, proxies); ip != "203.0.113.8" {
+		t.Fatalf("Error executing ClientIP_TrustedProxy test: got %s\n", ip)
+	}
+
+	r.Header.Del("X-Real-IP")
+	if ip := clientIP(r, proxies); ip != "10.0.0.2" {
+		t.Fatalf("Error executing ClientIP_TrustedProxy test: got %s\n", ip)
+	}
+}
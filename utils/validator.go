@@ -1,6 +1,10 @@
 package utils
 
 import (
+	"fmt"
+	"reflect"
+	"strings"
+
 	"github.com/go-playground/validator/v10"
 )
 
@@ -8,8 +12,30 @@ var validate *validator.Validate
 
 func init() {
 	validate = validator.New()
+	validate.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name := strings.SplitN(field.Tag.Get("json"), ",", 2)[0]
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
 }
 
+// ValidateStruct checks the validate tags of a request, reporting the rejected
+// fields by their JSON names.
 func ValidateStruct(s interface{}) error {
-	return validate.Struct(s)
+	err := validate.Struct(s)
+	validationErrors, ok := err.(validator.ValidationErrors)
+	if !ok {
+		return err
+	}
+	fields := make([]FieldError, 0, len(validationErrors))
+	for _, fieldError := range validationErrors {
+		fields = append(fields, FieldError{
+			Field:   fieldError.Field(),
+			Code:    fieldError.Tag(),
+			Message: fmt.Sprintf("Failed the %s validation", fieldError.Tag()),
+		})
+	}
+	return ValidationError(fields...)
 }
@@ -0,0 +1,177 @@
+package webauthn
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Flags of the authenticator data.
+const (
+	flagUserPresent       = 0x01
+	flagUserVerified      = 0x04
+	flagAttestedData      = 0x40
+	flagExtensionData     = 0x80
+	authenticatorDataSize = 37
+)
+
+type clientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin"`
+}
+
+type authenticatorData struct {
+	RPIDHash  []byte
+	Flags     byte
+	SignCount uint32
+
+	// Only present in the authenticator data of a registration.
+	CredentialID []byte
+	PublicKey    []byte
+}
+
+func (d *authenticatorData) userPresent() bool {
+	return d.Flags&flagUserPresent != 0
+}
+
+func (d *authenticatorData) userVerified() bool {
+	return d.Flags&flagUserVerified != 0
+}
+
+type attestationObject struct {
+	Format    string          `cbor:"fmt"`
+	Statement cbor.RawMessage `cbor:"attStmt"`
+	AuthData  []byte          `cbor:"authData"`
+}
+
+type packedStatement struct {
+	Algorithm    int      `cbor:"alg"`
+	Signature    []byte   `cbor:"sig"`
+	Certificates [][]byte `cbor:"x5c"`
+}
+
+// parseClientData decodes the client data of a ceremony and checks the
+// fields that do not depend on stored state.
+func (c *config) parseClientData(data []byte, ceremonyType string) (*clientData, error) {
+	var client clientData
+	err := json.Unmarshal(data, &client)
+	if err != nil {
+		return nil, err
+	}
+	if client.Type != ceremonyType {
+		return nil, errors.New("unexpected client data type")
+	}
+	if client.CrossOrigin || !c.allowedOrigin(client.Origin) {
+		return nil, errors.New("unexpected origin")
+	}
+	return &client, nil
+}
+
+func (c *config) allowedOrigin(origin string) bool {
+	for _, allowed := range c.origins {
+		if origin == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAuthenticatorData decodes the authenticator data and checks that it was
+// produced for the relying party by a present, and if required verified, user.
+func (c *config) parseAuthenticatorData(data []byte, userVerification bool) (*authenticatorData, error) {
+	if len(data) < authenticatorDataSize {
+		return nil, errors.New("authenticator data too short")
+	}
+	authData := &authenticatorData{
+		RPIDHash:  data[:32],
+		Flags:     data[32],
+		SignCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	rpIDHash := sha256.Sum256([]byte(c.rpID))
+	if !bytes.Equal(authData.RPIDHash, rpIDHash[:]) {
+		return nil, errors.New("unexpected relying party")
+	}
+	if !authData.userPresent() {
+		return nil, errors.New("user presence required")
+	}
+	if userVerification && !authData.userVerified() {
+		return nil, errors.New("user verification required")
+	}
+
+	rest := data[authenticatorDataSize:]
+	if authData.Flags&flagAttestedData != 0 {
+		// AAGUID (16 bytes), credential ID length (2 bytes), credential ID and
+		// the CBOR encoded public key.
+		if len(rest) < 18 {
+			return nil, errors.New("attested credential data too short")
+		}
+		length := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if len(rest) < length {
+			return nil, errors.New("attested credential data too short")
+		}
+		authData.CredentialID = rest[:length]
+		var key cbor.RawMessage
+		rest, err := cbor.UnmarshalFirst(rest[length:], &key)
+		if err != nil {
+			return nil, err
+		}
+		authData.PublicKey = key
+		if authData.Flags&flagExtensionData == 0 && len(rest) > 0 {
+			return nil, errors.New("unexpected trailing authenticator data")
+		}
+	} else if authData.Flags&flagExtensionData == 0 && len(rest) > 0 {
+		return nil, errors.New("unexpected trailing authenticator data")
+	}
+	return authData, nil
+}
+
+// verifyAttestation checks the attestation statement of a new credential.
+// goauth asks for no attestation, so only the "none" format and the packed
+// format are accepted, and attestation certificates are not chained to a
+// trusted root.
+func verifyAttestation(object *attestationObject, authData *authenticatorData, clientDataHash []byte) error {
+	switch object.Format {
+	case "none":
+		var statement map[string]interface{}
+		err := cbor.Unmarshal(object.Statement, &statement)
+		if err != nil || len(statement) > 0 {
+			return errors.New("unexpected attestation statement")
+		}
+		return nil
+	case "packed":
+		var statement packedStatement
+		err := cbor.Unmarshal(object.Statement, &statement)
+		if err != nil {
+			return err
+		}
+		signed := append(append([]byte{}, object.AuthData...), clientDataHash...)
+		if len(statement.Certificates) == 0 {
+			key, algorithm, err := parseCOSEKey(authData.PublicKey)
+			if err != nil {
+				return err
+			}
+			if statement.Algorithm != algorithm || !verifySignature(key, algorithm, signed, statement.Signature) {
+				return errors.New("invalid self attestation")
+			}
+			return nil
+		}
+		certificate, err := x509.ParseCertificate(statement.Certificates[0])
+		if err != nil {
+			return err
+		}
+		if !verifySignature(certificate.PublicKey, statement.Algorithm, signed, statement.Signature) {
+			return errors.New("invalid attestation signature")
+		}
+		return nil
+	default:
+		return errors.New("unsupported attestation format")
+	}
+}
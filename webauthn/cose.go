@@ -0,0 +1,114 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"math/big"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// COSE algorithm identifiers of the signatures goauth verifies.
+const (
+	AlgES256 = -7
+	AlgEdDSA = -8
+	AlgRS256 = -257
+)
+
+// supportedAlgorithms is advertised to authenticators in order of preference.
+var supportedAlgorithms = []int{AlgES256, AlgEdDSA, AlgRS256}
+
+// COSE key parameters (RFC 9053).
+const (
+	coseKeyType   = 1
+	coseAlgorithm = 3
+	coseCurve     = -1
+	coseX         = -2
+	coseY         = -3
+	coseRSAN      = -1
+	coseRSAE      = -2
+
+	coseKeyTypeOKP = 1
+	coseKeyTypeEC2 = 2
+	coseKeyTypeRSA = 3
+
+	coseCurveP256    = 1
+	coseCurveEd25519 = 6
+)
+
+// parseCOSEKey decodes a COSE_Key as found in the attested credential data,
+// returning the public key together with its algorithm.
+func parseCOSEKey(data []byte) (crypto.PublicKey, int, error) {
+	var params map[int]cbor.RawMessage
+	err := cbor.Unmarshal(data, &params)
+	if err != nil {
+		return nil, 0, err
+	}
+	var keyType, algorithm int
+	if cbor.Unmarshal(params[coseKeyType], &keyType) != nil || cbor.Unmarshal(params[coseAlgorithm], &algorithm) != nil {
+		return nil, 0, errors.New("malformed COSE key")
+	}
+
+	switch {
+	case keyType == coseKeyTypeEC2 && algorithm == AlgES256:
+		var curve int
+		var x, y []byte
+		if cbor.Unmarshal(params[coseCurve], &curve) != nil || cbor.Unmarshal(params[coseX], &x) != nil || cbor.Unmarshal(params[coseY], &y) != nil {
+			return nil, 0, errors.New("malformed EC2 key")
+		}
+		if curve != coseCurveP256 || len(x) != 32 || len(y) != 32 {
+			return nil, 0, errors.New("unsupported EC2 key")
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, 0, errors.New("invalid EC2 key")
+		}
+		return key, algorithm, nil
+	case keyType == coseKeyTypeOKP && algorithm == AlgEdDSA:
+		var curve int
+		var x []byte
+		if cbor.Unmarshal(params[coseCurve], &curve) != nil || cbor.Unmarshal(params[coseX], &x) != nil {
+			return nil, 0, errors.New("malformed OKP key")
+		}
+		if curve != coseCurveEd25519 || len(x) != ed25519.PublicKeySize {
+			return nil, 0, errors.New("unsupported OKP key")
+		}
+		return ed25519.PublicKey(x), algorithm, nil
+	case keyType == coseKeyTypeRSA && algorithm == AlgRS256:
+		var n, e []byte
+		if cbor.Unmarshal(params[coseRSAN], &n) != nil || cbor.Unmarshal(params[coseRSAE], &e) != nil {
+			return nil, 0, errors.New("malformed RSA key")
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 || len(n) < 256 {
+			return nil, 0, errors.New("unsupported RSA key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, algorithm, nil
+	default:
+		return nil, 0, errors.New("unsupported COSE algorithm")
+	}
+}
+
+// verifySignature checks a signature made with algorithm over data.
+func verifySignature(key crypto.PublicKey, algorithm int, data []byte, signature []byte) bool {
+	switch algorithm {
+	case AlgES256:
+		publicKey, ok := key.(*ecdsa.PublicKey)
+		digest := sha256.Sum256(data)
+		return ok && ecdsa.VerifyASN1(publicKey, digest[:], signature)
+	case AlgEdDSA:
+		publicKey, ok := key.(ed25519.PublicKey)
+		return ok && ed25519.Verify(publicKey, data, signature)
+	case AlgRS256:
+		publicKey, ok := key.(*rsa.PublicKey)
+		digest := sha256.Sum256(data)
+		return ok && rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], signature) == nil
+	default:
+		return false
+	}
+}
@@ -0,0 +1,182 @@
+package webauthn
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Ceremonies a challenge can be answered in.
+const (
+	CeremonyRegistration = "registration"
+	CeremonyLogin        = "login"
+)
+
+const publicKeyType = "public-key"
+
+// Base64URL is binary data exchanged with browsers as unpadded base64url, the
+// encoding of the JSON serialization of WebAuthn credentials.
+type Base64URL []byte
+
+func (b Base64URL) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.RawURLEncoding.EncodeToString(b))
+}
+
+func (b *Base64URL) UnmarshalJSON(data []byte) error {
+	var encoded string
+	err := json.Unmarshal(data, &encoded)
+	if err != nil {
+		return err
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+	if err != nil {
+		return err
+	}
+	*b = decoded
+	return nil
+}
+
+type Credential struct {
+	ID         []byte       `db:"id"`
+	UserEmail  string       `db:"user_email"`
+	Name       string       `db:"name"`
+	PublicKey  []byte       `db:"public_key"`
+	Algorithm  int          `db:"algorithm"`
+	SignCount  int64        `db:"sign_count"`
+	Transports string       `db:"transports"`
+	CreatedAt  time.Time    `db:"created_at"`
+	LastUsedAt sql.NullTime `db:"last_used_at"`
+
+	UserHandle []byte `db:"user_handle"`
+}
+
+// Assertion is the outcome of a successful login ceremony.
+type Assertion struct {
+	Email        string
+	UserVerified bool
+}
+
+type RelyingParty struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type UserEntity struct {
+	ID          Base64URL `json:"id"`
+	Name        string    `json:"name"`
+	DisplayName string    `json:"displayName"`
+}
+
+type CredentialParameter struct {
+	Type      string `json:"type"`
+	Algorithm int    `json:"alg"`
+}
+
+type CredentialDescriptor struct {
+	Type       string    `json:"type"`
+	ID         Base64URL `json:"id"`
+	Transports []string  `json:"transports,omitempty"`
+}
+
+type AuthenticatorSelection struct {
+	ResidentKey      string `json:"residentKey"`
+	UserVerification string `json:"userVerification"`
+}
+
+// CreationOptions are the options of navigator.credentials.create(), in the
+// JSON form accepted by PublicKeyCredential.parseCreationOptionsFromJSON().
+type CreationOptions struct {
+	RelyingParty           RelyingParty           `json:"rp"`
+	User                   UserEntity             `json:"user"`
+	Challenge              string                 `json:"challenge"`
+	Parameters             []CredentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout"`
+	ExcludeCredentials     []CredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection AuthenticatorSelection `json:"authenticatorSelection"`
+	Attestation            string                 `json:"attestation"`
+}
+
+// RequestOptions are the options of navigator.credentials.get(), in the JSON
+// form accepted by PublicKeyCredential.parseRequestOptionsFromJSON().
+type RequestOptions struct {
+	Challenge        string                 `json:"challenge"`
+	Timeout          int64                  `json:"timeout"`
+	RelyingPartyID   string                 `json:"rpId"`
+	AllowCredentials []CredentialDescriptor `json:"allowCredentials"`
+	UserVerification string                 `json:"userVerification"`
+}
+
+type AttestationResponse struct {
+	ClientDataJSON    Base64URL `json:"clientDataJSON" validate:"required"`
+	AttestationObject Base64URL `json:"attestationObject" validate:"required"`
+	Transports        []string  `json:"transports"`
+}
+
+// RegistrationRequest carries the credential returned by
+// navigator.credentials.create(), serialized with toJSON(), along with the
+// name the user gives to it.
+type RegistrationRequest struct {
+	ID       string              `json:"id" validate:"required"`
+	RawID    Base64URL           `json:"rawId" validate:"required"`
+	Type     string              `json:"type" validate:"required,eq=public-key"`
+	Response AttestationResponse `json:"response" validate:"required"`
+	Name     string              `json:"name" validate:"max=255"`
+}
+
+type AssertionResponse struct {
+	ClientDataJSON    Base64URL `json:"clientDataJSON" validate:"required"`
+	AuthenticatorData Base64URL `json:"authenticatorData" validate:"required"`
+	Signature         Base64URL `json:"signature" validate:"required"`
+	UserHandle        Base64URL `json:"userHandle"`
+}
+
+// AssertionRequest carries the credential returned by
+// navigator.credentials.get(), serialized with toJSON().
+type AssertionRequest struct {
+	ID       string            `json:"id" validate:"required"`
+	RawID    Base64URL         `json:"rawId" validate:"required"`
+	Type     string            `json:"type" validate:"required,eq=public-key"`
+	Response AssertionResponse `json:"response" validate:"required"`
+}
+
+type CredentialInfo struct {
+	ID         Base64URL  `json:"id"`
+	Name       string     `json:"name"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+}
+
+type MultipleCredentialResponse struct {
+	Credentials []CredentialInfo `json:"credentials"`
+}
+
+func (opts *CreationOptions) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func (opts *RequestOptions) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func (resp *CredentialInfo) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func (resp *MultipleCredentialResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	return nil
+}
+
+func NewCredentialInfo(credential *Credential) CredentialInfo {
+	info := CredentialInfo{
+		ID:        credential.ID,
+		Name:      credential.Name,
+		CreatedAt: credential.CreatedAt,
+	}
+	if credential.LastUsedAt.Valid {
+		info.LastUsedAt = &credential.LastUsedAt.Time
+	}
+	return info
+}
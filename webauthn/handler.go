@@ -0,0 +1,94 @@
+package webauthn
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+
+	"github.com/Kavuti/goauth/auth"
+	"github.com/Kavuti/goauth/utils"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+)
+
+type WebAuthnHandler interface {
+	Routes() chi.Router
+
+	Credentials(w http.ResponseWriter, r *http.Request)
+	BeginRegistration(w http.ResponseWriter, r *http.Request)
+	FinishRegistration(w http.ResponseWriter, r *http.Request)
+	DeleteCredential(w http.ResponseWriter, r *http.Request)
+}
+
+type webAuthnHandler struct {
+	chi.Router
+	service WebAuthnService
+}
+
+func (h *webAuthnHandler) Credentials(w http.ResponseWriter, r *http.Request) {
+	defer utils.RecoverIfError(w, r)
+	principal, _ := auth.FromContext(r.Context())
+	credentials, err := h.service.Credentials(principal.Email)
+	utils.CheckError(err)
+
+	render.Render(w, r, &MultipleCredentialResponse{Credentials: credentials})
+}
+
+func (h *webAuthnHandler) BeginRegistration(w http.ResponseWriter, r *http.Request) {
+	defer utils.RecoverIfError(w, r)
+	principal, _ := auth.FromContext(r.Context())
+	options, err := h.service.BeginRegistration(principal.Email)
+	utils.CheckError(err)
+
+	render.Render(w, r, options)
+}
+
+func (h *webAuthnHandler) FinishRegistration(w http.ResponseWriter, r *http.Request) {
+	defer utils.RecoverIfError(w, r)
+	principal, _ := auth.FromContext(r.Context())
+	request := RegistrationRequest{}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	utils.CheckError(err)
+
+	err = utils.ValidateStruct(request)
+	utils.CheckError(err)
+
+	credential, err := h.service.FinishRegistration(principal.Email, &request)
+	utils.CheckError(err)
+
+	render.Render(w, r, credential)
+}
+
+func (h *webAuthnHandler) DeleteCredential(w http.ResponseWriter, r *http.Request) {
+	defer utils.RecoverIfError(w, r)
+	principal, _ := auth.FromContext(r.Context())
+	id, err := base64.RawURLEncoding.DecodeString(chi.URLParam(r, "id"))
+	if err != nil {
+		utils.CheckError(utils.ServiceError("Invalid passkey id", http.StatusBadRequest))
+	}
+	err = h.service.DeleteCredential(principal.Email, id)
+	utils.CheckError(err)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *webAuthnHandler) Routes() chi.Router {
+	r := chi.NewRouter()
+	r.Use(auth.RequireAuthentication)
+
+	r.Get("/", h.Credentials)
+	r.Post("/registration/options", h.BeginRegistration)
+	r.Post("/registration", h.FinishRegistration)
+	r.Delete("/{id}", h.DeleteCredential)
+
+	return r
+}
+
+func NewWebAuthnHandler(r chi.Router, service WebAuthnService) WebAuthnHandler {
+	handler := &webAuthnHandler{
+		Router:  r,
+		service: service,
+	}
+
+	return handler
+}
@@ -0,0 +1,387 @@
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Kavuti/goauth/utils"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	defaultRPName         = "goauth"
+	defaultTimeout        = 5 * time.Minute
+	defaultCredentialName = "Passkey"
+)
+
+type WebAuthnService interface {
+	BeginRegistration(email string) (*CreationOptions, error)
+	FinishRegistration(email string, req *RegistrationRequest) (*CredentialInfo, error)
+	BeginLogin(email string) (*RequestOptions, error)
+	FinishLogin(req *AssertionRequest) (*Assertion, error)
+	Credentials(email string) ([]CredentialInfo, error)
+	DeleteCredential(email string, id []byte) error
+}
+
+// config describes the relying party, that is the site passkeys are bound to.
+type config struct {
+	rpID    string
+	rpName  string
+	origins []string
+	timeout time.Duration
+}
+
+type webAuthnService struct {
+	config
+	db *sqlx.DB
+}
+
+// BeginRegistration starts the registration of a new passkey for the user.
+// Credentials the user already has are excluded so that an authenticator is
+// not registered twice.
+func (s *webAuthnService) BeginRegistration(email string) (*CreationOptions, error) {
+	challenge, err := utils.RandomToken()
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	handle := make([]byte, 32)
+	_, err = rand.Read(handle)
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+
+	tx := s.db.MustBegin()
+	defer tx.Rollback()
+
+	// The user handle is an opaque identifier, so that the email is not
+	// stored on authenticators.
+	_, err = tx.Exec("INSERT INTO webauthn_users (user_email, handle) VALUES ($1, $2) ON CONFLICT (user_email) DO NOTHING", email, handle)
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	err = tx.Get(&handle, "SELECT handle FROM webauthn_users WHERE user_email=$1", email)
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	var credentials []Credential
+	err = tx.Select(&credentials, "SELECT * FROM webauthn_credentials WHERE user_email=$1", email)
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	err = s.insertChallenge(tx, challenge, email, CeremonyRegistration, false)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+
+	parameters := make([]CredentialParameter, 0, len(supportedAlgorithms))
+	for _, algorithm := range supportedAlgorithms {
+		parameters = append(parameters, CredentialParameter{Type: publicKeyType, Algorithm: algorithm})
+	}
+	return &CreationOptions{
+		RelyingParty:       RelyingParty{ID: s.rpID, Name: s.rpName},
+		User:               UserEntity{ID: handle, Name: email, DisplayName: email},
+		Challenge:          challenge,
+		Parameters:         parameters,
+		Timeout:            s.timeout.Milliseconds(),
+		ExcludeCredentials: descriptors(credentials),
+		AuthenticatorSelection: AuthenticatorSelection{
+			ResidentKey:      "preferred",
+			UserVerification: "preferred",
+		},
+		Attestation: "none",
+	}, nil
+}
+
+// FinishRegistration verifies the attestation of a new credential and stores
+// its public key.
+func (s *webAuthnService) FinishRegistration(email string, req *RegistrationRequest) (*CredentialInfo, error) {
+	invalid := utils.ServiceError("Invalid passkey registration", http.StatusBadRequest)
+	client, err := s.parseClientData(req.Response.ClientDataJSON, "webauthn.create")
+	if err != nil {
+		return nil, invalid
+	}
+	var object attestationObject
+	err = cbor.Unmarshal(req.Response.AttestationObject, &object)
+	if err != nil {
+		return nil, invalid
+	}
+
+	tx := s.db.MustBegin()
+	defer tx.Rollback()
+
+	challengeEmail, userVerification, err := consumeChallenge(tx, client.Challenge, CeremonyRegistration)
+	if err != nil {
+		return nil, err
+	}
+	if challengeEmail.String != email {
+		return nil, invalid
+	}
+	authData, err := s.parseAuthenticatorData(object.AuthData, userVerification)
+	if err != nil || authData.CredentialID == nil || !bytes.Equal(authData.CredentialID, req.RawID) {
+		return nil, invalid
+	}
+	_, algorithm, err := parseCOSEKey(authData.PublicKey)
+	if err != nil {
+		return nil, invalid
+	}
+	clientDataHash := sha256.Sum256(req.Response.ClientDataJSON)
+	err = verifyAttestation(&object, authData, clientDataHash[:])
+	if err != nil {
+		return nil, invalid
+	}
+
+	name := req.Name
+	if name == "" {
+		name = defaultCredentialName
+	}
+	credential := Credential{
+		ID:         authData.CredentialID,
+		UserEmail:  email,
+		Name:       name,
+		PublicKey:  authData.PublicKey,
+		Algorithm:  algorithm,
+		SignCount:  int64(authData.SignCount),
+		Transports: strings.Join(req.Response.Transports, ","),
+		CreatedAt:  time.Now(),
+	}
+	rows, err := tx.NamedExec(`INSERT INTO webauthn_credentials (id, user_email, name, public_key, algorithm, sign_count, transports)
+		VALUES (:id, :user_email, :name, :public_key, :algorithm, :sign_count, :transports) ON CONFLICT (id) DO NOTHING`, &credential)
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	if affected, err := rows.RowsAffected(); err != nil || affected == 0 {
+		return nil, utils.ServiceError("Passkey already registered", http.StatusConflict)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	info := NewCredentialInfo(&credential)
+	return &info, nil
+}
+
+// BeginLogin starts a login ceremony. With an email, only the credentials of
+// that user are allowed, as when a passkey is used as a second factor. Without
+// one, any discoverable credential is accepted and user verification is
+// required, since the passkey replaces the password altogether.
+func (s *webAuthnService) BeginLogin(email string) (*RequestOptions, error) {
+	challenge, err := utils.RandomToken()
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+
+	tx := s.db.MustBegin()
+	defer tx.Rollback()
+
+	credentials := []Credential{}
+	if email != "" {
+		err = tx.Select(&credentials, "SELECT * FROM webauthn_credentials WHERE user_email=$1", email)
+		if err != nil {
+			return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+		}
+		if len(credentials) == 0 {
+			return nil, utils.ServiceError("No passkey registered", http.StatusNotFound)
+		}
+	}
+	userVerification := email == ""
+	err = s.insertChallenge(tx, challenge, email, CeremonyLogin, userVerification)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+
+	options := &RequestOptions{
+		Challenge:        challenge,
+		Timeout:          s.timeout.Milliseconds(),
+		RelyingPartyID:   s.rpID,
+		AllowCredentials: descriptors(credentials),
+		UserVerification: "preferred",
+	}
+	if userVerification {
+		options.UserVerification = "required"
+	}
+	return options, nil
+}
+
+// FinishLogin verifies an assertion against the stored public key of the
+// credential and returns the user it belongs to. A signature counter that does
+// not increase reveals a cloned authenticator and fails the login.
+func (s *webAuthnService) FinishLogin(req *AssertionRequest) (*Assertion, error) {
+	invalid := utils.ServiceError("Invalid passkey assertion", http.StatusUnauthorized)
+	client, err := s.parseClientData(req.Response.ClientDataJSON, "webauthn.get")
+	if err != nil {
+		return nil, invalid
+	}
+
+	tx := s.db.MustBegin()
+	defer tx.Rollback()
+
+	challengeEmail, userVerification, err := consumeChallenge(tx, client.Challenge, CeremonyLogin)
+	if err != nil {
+		return nil, err
+	}
+	var credential Credential
+	err = tx.Get(&credential, `SELECT c.*, u.handle AS user_handle FROM webauthn_credentials c
+		JOIN webauthn_users u ON u.user_email = c.user_email WHERE c.id=$1 FOR UPDATE`, []byte(req.RawID))
+	if err != nil {
+		return nil, invalid
+	}
+	if challengeEmail.Valid && challengeEmail.String != credential.UserEmail {
+		return nil, invalid
+	}
+	if len(req.Response.UserHandle) > 0 && !bytes.Equal(req.Response.UserHandle, credential.UserHandle) {
+		return nil, invalid
+	}
+	authData, err := s.parseAuthenticatorData(req.Response.AuthenticatorData, userVerification)
+	if err != nil {
+		return nil, invalid
+	}
+	key, algorithm, err := parseCOSEKey(credential.PublicKey)
+	if err != nil || algorithm != credential.Algorithm {
+		return nil, invalid
+	}
+	clientDataHash := sha256.Sum256(req.Response.ClientDataJSON)
+	signed := append(append([]byte{}, req.Response.AuthenticatorData...), clientDataHash[:]...)
+	if !verifySignature(key, algorithm, signed, req.Response.Signature) {
+		return nil, invalid
+	}
+	signCount := int64(authData.SignCount)
+	if (signCount != 0 || credential.SignCount != 0) && signCount <= credential.SignCount {
+		return nil, invalid
+	}
+
+	_, err = tx.Exec("UPDATE webauthn_credentials SET sign_count = $1, last_used_at = NOW() WHERE id = $2", signCount, credential.ID)
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	return &Assertion{Email: credential.UserEmail, UserVerified: authData.userVerified()}, nil
+}
+
+func (s *webAuthnService) Credentials(email string) ([]CredentialInfo, error) {
+	tx := s.db.MustBegin()
+	defer tx.Rollback()
+
+	var credentials []Credential
+	err := tx.Select(&credentials, "SELECT * FROM webauthn_credentials WHERE user_email=$1 ORDER BY created_at", email)
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+
+	infos := make([]CredentialInfo, 0, len(credentials))
+	for i := range credentials {
+		infos = append(infos, NewCredentialInfo(&credentials[i]))
+	}
+	return infos, nil
+}
+
+func (s *webAuthnService) DeleteCredential(email string, id []byte) error {
+	tx := s.db.MustBegin()
+	defer tx.Rollback()
+
+	rows, err := tx.MustExec("DELETE FROM webauthn_credentials WHERE id = $1 AND user_email = $2", id, email).RowsAffected()
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	if rows == 0 {
+		return utils.ServiceError("Passkey not found", http.StatusNotFound)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	return nil
+}
+
+func (s *webAuthnService) insertChallenge(tx *sqlx.Tx, challenge string, email string, ceremony string, userVerification bool) error {
+	_, err := tx.Exec(`INSERT INTO webauthn_challenges (challenge_hash, user_email, ceremony, user_verification, expires_at)
+		VALUES ($1, $2, $3, $4, $5)`, utils.HashToken(challenge), sql.NullString{String: email, Valid: email != ""},
+		ceremony, userVerification, time.Now().Add(s.timeout))
+	if err != nil {
+		return utils.ServiceError(err.Error(), http.StatusInternalServerError)
+	}
+	return nil
+}
+
+// consumeChallenge marks a challenge as answered, returning the user it was
+// issued for, if any, and whether user verification is required.
+func consumeChallenge(tx *sqlx.Tx, challenge string, ceremony string) (sql.NullString, bool, error) {
+	var row struct {
+		UserEmail        sql.NullString `db:"user_email"`
+		UserVerification bool           `db:"user_verification"`
+	}
+	err := tx.Get(&row, `UPDATE webauthn_challenges SET consumed_at = NOW()
+		WHERE challenge_hash = $1 AND ceremony = $2 AND consumed_at IS NULL AND expires_at > NOW()
+		RETURNING user_email, user_verification`, utils.HashToken(challenge), ceremony)
+	if err != nil {
+		return sql.NullString{}, false, utils.ServiceError("Invalid or expired challenge", http.StatusBadRequest)
+	}
+	return row.UserEmail, row.UserVerification, nil
+}
+
+func descriptors(credentials []Credential) []CredentialDescriptor {
+	result := make([]CredentialDescriptor, 0, len(credentials))
+	for _, credential := range credentials {
+		descriptor := CredentialDescriptor{Type: publicKeyType, ID: credential.ID}
+		if credential.Transports != "" {
+			descriptor.Transports = strings.Split(credential.Transports, ",")
+		}
+		result = append(result, descriptor)
+	}
+	return result
+}
+
+// NewWebAuthnService reads the relying party from the environment.
+// WEBAUTHN_ORIGINS lists, comma separated, the origins of the pages allowed to
+// run the ceremonies and defaults to PUBLIC_URL. WEBAUTHN_RP_ID defaults to the
+// host of the first origin and WEBAUTHN_RP_NAME is shown by authenticators.
+func NewWebAuthnService(db *sqlx.DB) WebAuthnService {
+	origins := os.Getenv("WEBAUTHN_ORIGINS")
+	if origins == "" {
+		origins = os.Getenv("PUBLIC_URL")
+	}
+	if origins == "" {
+		origins = "http://localhost"
+	}
+	cfg := config{
+		rpID:    os.Getenv("WEBAUTHN_RP_ID"),
+		rpName:  os.Getenv("WEBAUTHN_RP_NAME"),
+		timeout: utils.DurationFromEnv("WEBAUTHN_TIMEOUT", defaultTimeout),
+	}
+	for _, origin := range strings.Split(origins, ",") {
+		cfg.origins = append(cfg.origins, strings.TrimRight(strings.TrimSpace(origin), "/"))
+	}
+	if cfg.rpID == "" {
+		parsed, err := url.Parse(cfg.origins[0])
+		if err != nil {
+			panic(err)
+		}
+		cfg.rpID = parsed.Hostname()
+	}
+	if cfg.rpName == "" {
+		cfg.rpName = defaultRPName
+	}
+	return &webAuthnService{config: cfg, db: db}
+}
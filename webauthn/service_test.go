@@ -0,0 +1,344 @@
+package webauthn
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/jmoiron/sqlx"
+)
+
+const testOrigin = "http://localhost:8080"
+
+var credentialColumns = []string{"id", "user_email", "name", "public_key", "algorithm", "sign_count", "transports", "created_at", "last_used_at", "user_handle"}
+
+// softAuthenticator emulates a platform authenticator holding a single P-256
+// credential.
+type softAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	userHandle   []byte
+	signCount    uint32
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	return &softAuthenticator{key: key, credentialID: []byte("credential-id"), userHandle: []byte("user-handle")}
+}
+
+func (a *softAuthenticator) publicKey() []byte {
+	encoder, _ := cbor.CoreDetEncOptions().EncMode()
+	key, _ := encoder.Marshal(map[int]interface{}{
+		coseKeyType:   coseKeyTypeEC2,
+		coseAlgorithm: AlgES256,
+		coseCurve:     coseCurveP256,
+		coseX:         a.key.X.FillBytes(make([]byte, 32)),
+		coseY:         a.key.Y.FillBytes(make([]byte, 32)),
+	})
+	return key
+}
+
+func (a *softAuthenticator) authenticatorData(flags byte, attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte("localhost"))
+	data := append([]byte{}, rpIDHash[:]...)
+	if attested {
+		flags |= flagAttestedData
+	}
+	data = append(data, flags)
+	data = binary.BigEndian.AppendUint32(data, a.signCount)
+	if attested {
+		data = append(data, make([]byte, 16)...)
+		data = binary.BigEndian.AppendUint16(data, uint16(len(a.credentialID)))
+		data = append(data, a.credentialID...)
+		data = append(data, a.publicKey()...)
+	}
+	return data
+}
+
+func clientDataJSON(ceremonyType string, challenge string, origin string) []byte {
+	data, _ := json.Marshal(&clientData{Type: ceremonyType, Challenge: challenge, Origin: origin})
+	return data
+}
+
+func (a *softAuthenticator) sign(authData []byte, clientData []byte) []byte {
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	signature, _ := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	return signature
+}
+
+func (a *softAuthenticator) create(challenge string, origin string, format string) *RegistrationRequest {
+	authData := a.authenticatorData(flagUserPresent|flagUserVerified, true)
+	client := clientDataJSON("webauthn.create", challenge, origin)
+	statement := map[string]interface{}{}
+	if format == "packed" {
+		statement["alg"] = AlgES256
+		statement["sig"] = a.sign(authData, client)
+	}
+	object, _ := cbor.Marshal(map[string]interface{}{"fmt": format, "attStmt": statement, "authData": authData})
+	return &RegistrationRequest{
+		ID:       "credential-id",
+		RawID:    a.credentialID,
+		Type:     publicKeyType,
+		Response: AttestationResponse{ClientDataJSON: client, AttestationObject: object, Transports: []string{"internal"}},
+	}
+}
+
+func (a *softAuthenticator) get(challenge string, origin string, flags byte) *AssertionRequest {
+	a.signCount++
+	authData := a.authenticatorData(flags, false)
+	client := clientDataJSON("webauthn.get", challenge, origin)
+	return &AssertionRequest{
+		ID:    "credential-id",
+		RawID: a.credentialID,
+		Type:  publicKeyType,
+		Response: AssertionResponse{
+			ClientDataJSON:    client,
+			AuthenticatorData: authData,
+			Signature:         a.sign(authData, client),
+			UserHandle:        a.userHandle,
+		},
+	}
+}
+
+func (a *softAuthenticator) storedCredential(signCount int64) *sqlmock.Rows {
+	return sqlmock.NewRows(credentialColumns).AddRow(a.credentialID, "test@test.com", "Passkey", a.publicKey(), AlgES256, signCount, "internal", time.Now(), nil, a.userHandle)
+}
+
+func newTestService(t *testing.T) (*webAuthnService, sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	t.Cleanup(func() { db.Close() })
+	cfg := config{rpID: "localhost", rpName: "goauth", origins: []string{testOrigin}, timeout: time.Minute}
+	return &webAuthnService{config: cfg, db: sqlx.NewDb(db, "sqlmock")}, mock
+}
+
+func Test_BeginRegistration(t *testing.T) {
+	service, mock := newTestService(t)
+	authenticator := newSoftAuthenticator(t)
+
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO webauthn_users .+").WithArgs("test@test.com", sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT handle FROM webauthn_users .+").WillReturnRows(sqlmock.NewRows([]string{"handle"}).AddRow(authenticator.userHandle))
+	mock.ExpectQuery("SELECT (.+) FROM webauthn_credentials .+").WillReturnRows(authenticator.storedCredential(0))
+	mock.ExpectExec("INSERT INTO webauthn_challenges .+").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	options, err := service.BeginRegistration("test@test.com")
+	if err != nil {
+		t.Fatalf("Error executing BeginRegistration test: %s\n", err.Error())
+	}
+	if options.Challenge == "" || string(options.User.ID) != "user-handle" || options.RelyingParty.ID != "localhost" {
+		t.Fatalf("Error executing BeginRegistration test: unexpected options %v\n", options)
+	}
+	if len(options.ExcludeCredentials) != 1 || len(options.Parameters) != len(supportedAlgorithms) {
+		t.Fatalf("Error executing BeginRegistration test: unexpected credentials %v\n", options)
+	}
+}
+
+func Test_FinishRegistration(t *testing.T) {
+	for _, format := range []string{"none", "packed"} {
+		service, mock := newTestService(t)
+		authenticator := newSoftAuthenticator(t)
+
+		mock.ExpectBegin()
+		mock.ExpectQuery("UPDATE webauthn_challenges .+").WithArgs(sqlmock.AnyArg(), CeremonyRegistration).WillReturnRows(sqlmock.NewRows([]string{"user_email", "user_verification"}).AddRow("test@test.com", false))
+		mock.ExpectExec("INSERT INTO webauthn_credentials .+").WithArgs(authenticator.credentialID, "test@test.com", "Laptop", authenticator.publicKey(), AlgES256, 0, "internal").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		request := authenticator.create("challenge", testOrigin, format)
+		request.Name = "Laptop"
+		credential, err := service.FinishRegistration("test@test.com", request)
+		if err != nil {
+			t.Fatalf("Error executing FinishRegistration test with %s attestation: %s\n", format, err.Error())
+		}
+		if string(credential.ID) != "credential-id" {
+			t.Fatalf("Error executing FinishRegistration test: unexpected credential %v\n", credential)
+		}
+	}
+}
+
+func Test_FinishRegistration_WrongOrigin(t *testing.T) {
+	service, _ := newTestService(t)
+	authenticator := newSoftAuthenticator(t)
+
+	_, err := service.FinishRegistration("test@test.com", authenticator.create("challenge", "https://evil.example", "none"))
+	if err == nil {
+		t.Fatal("Error executing FinishRegistration_WrongOrigin test: no error returned")
+	}
+}
+
+func Test_FinishRegistration_OtherUser(t *testing.T) {
+	service, mock := newTestService(t)
+	authenticator := newSoftAuthenticator(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE webauthn_challenges .+").WillReturnRows(sqlmock.NewRows([]string{"user_email", "user_verification"}).AddRow("other@test.com", false))
+	mock.ExpectRollback()
+
+	_, err := service.FinishRegistration("test@test.com", authenticator.create("challenge", testOrigin, "none"))
+	if err == nil {
+		t.Fatal("Error executing FinishRegistration_OtherUser test: no error returned")
+	}
+}
+
+func Test_FinishRegistration_InvalidSelfAttestation(t *testing.T) {
+	service, mock := newTestService(t)
+	authenticator := newSoftAuthenticator(t)
+	request := authenticator.create("challenge", testOrigin, "packed")
+	// Signed by another key than the one being registered.
+	request.Response.AttestationObject = newSoftAuthenticator(t).create("challenge", testOrigin, "packed").Response.AttestationObject
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE webauthn_challenges .+").WillReturnRows(sqlmock.NewRows([]string{"user_email", "user_verification"}).AddRow("test@test.com", false))
+	mock.ExpectRollback()
+
+	_, err := service.FinishRegistration("test@test.com", request)
+	if err == nil {
+		t.Fatal("Error executing FinishRegistration_InvalidSelfAttestation test: no error returned")
+	}
+}
+
+func Test_BeginLogin_Passwordless(t *testing.T) {
+	service, mock := newTestService(t)
+
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO webauthn_challenges .+").WithArgs(sqlmock.AnyArg(), nil, CeremonyLogin, true, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	options, err := service.BeginLogin("")
+	if err != nil {
+		t.Fatalf("Error executing BeginLogin_Passwordless test: %s\n", err.Error())
+	}
+	if options.UserVerification != "required" || len(options.AllowCredentials) != 0 {
+		t.Fatalf("Error executing BeginLogin_Passwordless test: unexpected options %v\n", options)
+	}
+}
+
+func Test_BeginLogin_NoCredentials(t *testing.T) {
+	service, mock := newTestService(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT (.+) FROM webauthn_credentials .+").WillReturnRows(sqlmock.NewRows(credentialColumns))
+	mock.ExpectRollback()
+
+	_, err := service.BeginLogin("test@test.com")
+	if err == nil {
+		t.Fatal("Error executing BeginLogin_NoCredentials test: no error returned")
+	}
+}
+
+func Test_FinishLogin(t *testing.T) {
+	service, mock := newTestService(t)
+	authenticator := newSoftAuthenticator(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE webauthn_challenges .+").WithArgs(sqlmock.AnyArg(), CeremonyLogin).WillReturnRows(sqlmock.NewRows([]string{"user_email", "user_verification"}).AddRow(nil, true))
+	mock.ExpectQuery("SELECT (.+) FROM webauthn_credentials .+").WithArgs(authenticator.credentialID).WillReturnRows(authenticator.storedCredential(0))
+	mock.ExpectExec("UPDATE webauthn_credentials SET sign_count .+").WithArgs(1, authenticator.credentialID).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	assertion, err := service.FinishLogin(authenticator.get("challenge", testOrigin, flagUserPresent|flagUserVerified))
+	if err != nil {
+		t.Fatalf("Error executing FinishLogin test: %s\n", err.Error())
+	}
+	if assertion.Email != "test@test.com" || !assertion.UserVerified {
+		t.Fatalf("Error executing FinishLogin test: unexpected assertion %v\n", assertion)
+	}
+}
+
+func Test_FinishLogin_UserVerificationRequired(t *testing.T) {
+	service, mock := newTestService(t)
+	authenticator := newSoftAuthenticator(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE webauthn_challenges .+").WillReturnRows(sqlmock.NewRows([]string{"user_email", "user_verification"}).AddRow(nil, true))
+	mock.ExpectQuery("SELECT (.+) FROM webauthn_credentials .+").WillReturnRows(authenticator.storedCredential(0))
+	mock.ExpectRollback()
+
+	_, err := service.FinishLogin(authenticator.get("challenge", testOrigin, flagUserPresent))
+	if err == nil {
+		t.Fatal("Error executing FinishLogin_UserVerificationRequired test: no error returned")
+	}
+}
+
+func Test_FinishLogin_OtherUser(t *testing.T) {
+	service, mock := newTestService(t)
+	authenticator := newSoftAuthenticator(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE webauthn_challenges .+").WillReturnRows(sqlmock.NewRows([]string{"user_email", "user_verification"}).AddRow("other@test.com", false))
+	mock.ExpectQuery("SELECT (.+) FROM webauthn_credentials .+").WillReturnRows(authenticator.storedCredential(0))
+	mock.ExpectRollback()
+
+	_, err := service.FinishLogin(authenticator.get("challenge", testOrigin, flagUserPresent))
+	if err == nil {
+		t.Fatal("Error executing FinishLogin_OtherUser test: no error returned")
+	}
+}
+
+func Test_FinishLogin_InvalidSignature(t *testing.T) {
+	service, mock := newTestService(t)
+	authenticator := newSoftAuthenticator(t)
+	request := authenticator.get("challenge", testOrigin, flagUserPresent)
+	request.Response.ClientDataJSON = clientDataJSON("webauthn.get", "other challenge", testOrigin)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE webauthn_challenges .+").WillReturnRows(sqlmock.NewRows([]string{"user_email", "user_verification"}).AddRow("test@test.com", false))
+	mock.ExpectQuery("SELECT (.+) FROM webauthn_credentials .+").WillReturnRows(authenticator.storedCredential(0))
+	mock.ExpectRollback()
+
+	_, err := service.FinishLogin(request)
+	if err == nil {
+		t.Fatal("Error executing FinishLogin_InvalidSignature test: no error returned")
+	}
+}
+
+func Test_FinishLogin_ClonedAuthenticator(t *testing.T) {
+	service, mock := newTestService(t)
+	authenticator := newSoftAuthenticator(t)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery("UPDATE webauthn_challenges .+").WillReturnRows(sqlmock.NewRows([]string{"user_email", "user_verification"}).AddRow("test@test.com", false))
+	mock.ExpectQuery("SELECT (.+) FROM webauthn_credentials .+").WillReturnRows(authenticator.storedCredential(10))
+	mock.ExpectRollback()
+
+	_, err := service.FinishLogin(authenticator.get("challenge", testOrigin, flagUserPresent))
+	if err == nil {
+		t.Fatal("Error executing FinishLogin_ClonedAuthenticator test: no error returned")
+	}
+}
+
+func Test_ParseCOSEKey_EdDSA(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Error: %s\n", err.Error())
+	}
+	encoded, _ := cbor.Marshal(map[int]interface{}{
+		coseKeyType:   coseKeyTypeOKP,
+		coseAlgorithm: AlgEdDSA,
+		coseCurve:     coseCurveEd25519,
+		coseX:         []byte(public),
+	})
+
+	key, algorithm, err := parseCOSEKey(encoded)
+	if err != nil {
+		t.Fatalf("Error executing ParseCOSEKey_EdDSA test: %s\n", err.Error())
+	}
+	if !verifySignature(key, algorithm, []byte("data"), ed25519.Sign(private, []byte("data"))) {
+		t.Fatal("Error executing ParseCOSEKey_EdDSA test: signature refused")
+	}
+}